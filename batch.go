@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plop-systems/shallpass/internal/sshargs"
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+	"golang.org/x/time/rate"
+)
+
+// batchLine is one session of a -batch or -hosts file: the ssh arguments
+// on line n. A -hosts line may name a password source for its host, which
+// is read into secret before any session starts.
+type batchLine struct {
+	n      int
+	args   []string
+	source string
+	secret string
+}
+
+// readBatch reads a -batch file. Each line holds the ssh arguments of one
+// session, the host and then the command, split into words as a shell
+// would for quotes and backslashes but without expanding anything. Blank
+// lines and lines starting with # are skipped.
+func readBatch(path string) ([]batchLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []batchLine
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		words, err := splitWords(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if sshargs.Destination(words) == "" {
+			return nil, fmt.Errorf("line %d: no host", n)
+		}
+		lines = append(lines, batchLine{n: n, args: words})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("no sessions in " + path)
+	}
+	return lines, nil
+}
+
+// readHosts reads a -hosts file. Each line holds one destination, and
+// may follow it with a password source (env:NAME, file:PATH and so on)
+// that is used for that host instead of the password. Blank lines and
+// lines starting with # are skipped.
+func readHosts(path string) ([]batchLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []batchLine
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		words, err := splitWords(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		switch {
+		case len(words) > 2:
+			return nil, fmt.Errorf("line %d: want a host and at most a password source, got %d words", n, len(words))
+		case strings.HasPrefix(words[0], "-"):
+			return nil, fmt.Errorf("line %d: %q is not a host", n, words[0])
+		}
+		line := batchLine{n: n, args: words[:1]}
+		if len(words) == 2 {
+			line.source = words[1]
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("no hosts in " + path)
+	}
+	return lines, nil
+}
+
+// splitWords splits a line at blanks. Single quotes keep everything up to
+// the next one as it is; in double quotes and outside quotes a backslash
+// keeps the next character.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'' && c != '\'':
+			word.WriteRune(c)
+		case c == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote, inWord = c, true
+		case quote == 0 && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// batchResult is how one session of a batch ended, as -summary-file
+// records it. Sessions that were never started have the reason "not_run".
+type batchResult struct {
+	Line     int     `json:"line"`
+	Host     string  `json:"host"`
+	ExitCode int     `json:"exit_code"`
+	Reason   string  `json:"reason"`
+	Seconds  float64 `json:"duration_seconds"`
+}
+
+// runBatch runs the sessions of a -batch or -hosts file, up to parallel of
+// them at a time, and prints the exit code of each, then how many failed.
+// limiter, if not nil, spaces out the starts of the sessions, however many
+// may run. name is the flag the lines came from. It returns the result of
+// every line, and 0 if they all succeeded and ExitFailure otherwise. Once
+// stop reports a signal no more are started, and the code of the last
+// session started is returned.
+func runBatch(w io.Writer, name string, lines []batchLine, parallel int, limiter *rate.Limiter, run func(line batchLine) (code int, reason string), stop func() bool) ([]batchResult, int) {
+	results := make([]batchResult, len(lines))
+	for i, line := range lines {
+		results[i] = batchResult{Line: line.n, Host: sshargs.Destination(line.args), Reason: "not_run"}
+	}
+	slots := make(chan struct{}, max(parallel, 1))
+	var wg sync.WaitGroup
+	started := 0
+	for i, line := range lines {
+		slots <- struct{}{}
+		if !waitTurn(limiter, stop) {
+			break
+		}
+		started++
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			start := time.Now()
+			code, reason := run(line)
+			results[i].ExitCode, results[i].Reason = code, reason
+			results[i].Seconds = time.Since(start).Seconds()
+		}()
+	}
+	wg.Wait()
+	failed := 0
+	for _, res := range results[:started] {
+		fmt.Fprintf(w, "shallpass: %s: line %d: %s: exit %d\n", name, res.Line, res.Host, res.ExitCode)
+		if res.ExitCode != 0 {
+			failed++
+		}
+	}
+	if started < len(lines) {
+		fmt.Fprintf(w, "shallpass: %s: interrupted, %d of %d not run\n", name, len(lines)-started, len(lines))
+		if started == 0 {
+			return results, shallpass.ExitInterrupted
+		}
+		return results, results[started-1].ExitCode
+	}
+	fmt.Fprintf(w, "shallpass: %s: %d of %d failed\n", name, failed, len(lines))
+	if failed > 0 {
+		return results, shallpass.ExitFailure
+	}
+	return results, 0
+}
+
+// waitTurn waits until limiter lets the next session start, which is at
+// once without a limiter, and reports false if stop says to start no more
+// first.
+func waitTurn(limiter *rate.Limiter, stop func() bool) bool {
+	if limiter == nil {
+		return !stop()
+	}
+	turn := limiter.Reserve()
+	at := time.Now().Add(turn.Delay())
+	for {
+		if stop() {
+			turn.Cancel()
+			return false
+		}
+		left := time.Until(at)
+		if left <= 0 {
+			return true
+		}
+		// A signal is only noticed between naps.
+		time.Sleep(min(left, 100*time.Millisecond))
+	}
+}
+
+// writeSummary writes the results of a batch to path as JSON, with the
+// exit code shallpass ends with, replacing the file atomically.
+func writeSummary(path string, results []batchResult, code int) error {
+	data, err := json.MarshalIndent(struct {
+		ExitCode int           `json:"exit_code"`
+		Hosts    []batchResult `json:"hosts"`
+	}{code, results}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0o600)
+}
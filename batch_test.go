@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRunBatchRate(t *testing.T) {
+	const perSecond = 20
+	lines := make([]batchLine, 5)
+	for i := range lines {
+		lines[i] = batchLine{n: i + 1, args: []string{"host"}}
+	}
+	var mu sync.Mutex
+	var starts []time.Time
+	run := func(batchLine) (int, string) {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+		return 0, "ok"
+	}
+	limiter := rate.NewLimiter(perSecond, 1)
+	_, code := runBatch(io.Discard, "-batch", lines, len(lines), limiter, run, func() bool { return false })
+	if code != 0 {
+		t.Fatalf("runBatch = %d, want 0", code)
+	}
+	if len(starts) != len(lines) {
+		t.Fatalf("%d sessions started, want %d", len(starts), len(lines))
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	// Allow for the scheduler, but not for two starts in the same turn.
+	min := time.Second / perSecond * 8 / 10
+	for i := 1; i < len(starts); i++ {
+		if gap := starts[i].Sub(starts[i-1]); gap < min {
+			t.Errorf("start %d came %v after the one before, want at least %v", i+1, gap, min)
+		}
+	}
+}
+
+func TestRunBatchUnlimited(t *testing.T) {
+	lines := make([]batchLine, 5)
+	for i := range lines {
+		lines[i] = batchLine{n: i + 1, args: []string{"host"}}
+	}
+	begin := time.Now()
+	runBatch(io.Discard, "-batch", lines, len(lines), nil, func(batchLine) (int, string) { return 0, "ok" }, func() bool { return false })
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("five sessions without a limit took %v", took)
+	}
+}
+
+func TestWaitTurnStop(t *testing.T) {
+	limiter := rate.NewLimiter(0.1, 1)
+	limiter.Allow()
+	begin := time.Now()
+	var stopped atomic.Bool
+	time.AfterFunc(50*time.Millisecond, func() { stopped.Store(true) })
+	if waitTurn(limiter, stopped.Load) {
+		t.Error("waitTurn = true after stop, want false")
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("waitTurn took %v to notice stop", took)
+	}
+}
+
+func TestBatchFile(t *testing.T) {
+	// Every line its own session with the one password; comments and
+	// blank lines are no sessions.
+	fake := fakeSSH(t, `printf 'password: ' >&2
+read pw
+[ "$pw" = secret ] || exit 5
+echo "$1 ran $2"
+[ "$2" = ok ]`)
+	batch := filepath.Join(t.TempDir(), "batch")
+	if err := os.WriteFile(batch, []byte("# fleet\nweb1 ok\n\ndb1 broken\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runMain(t, []string{"PW=secret"}, "-batch", batch, "-password", "env:PW", "-ssh-bin", fake)
+	if code != 1 || stdout != "web1 ran ok\ndb1 ran broken\n" {
+		t.Errorf("exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+	for _, want := range []string{
+		"shallpass: batch: line 2: web1: exit 0\n",
+		"shallpass: batch: line 4: db1: exit 1\n",
+		"shallpass: batch: 1 of 2 failed\n",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr %q lacks %q", stderr, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// configDump is what -dump-config prints: the settings a session would
+// run with once flags and the profile have been merged. Secrets never
+// appear in it, only where they come from.
+type configDump struct {
+	SSHPath          string         `json:"ssh_path"`
+	SSHArgs          []string       `json:"ssh_args"`
+	Dir              string         `json:"dir,omitempty"`
+	PasswordSource   string         `json:"password_source"`
+	PromptSource     string         `json:"prompt_source"`
+	Matchers         []matcherDump  `json:"matchers"`
+	NewPassword      string         `json:"new_password,omitempty"`
+	Timeouts         timeoutsDump   `json:"timeouts"`
+	Reconnect        int            `json:"reconnect_on_timeout"`
+	MaxTries         int            `json:"max_tries,omitempty"`
+	RetryWithoutPTY  bool           `json:"retry_without_pty"`
+	MaxInjections    int            `json:"max_injections"`
+	MaxPasswordBytes int            `json:"max_password_bytes"`
+	ScanLimit        int            `json:"scan_limit"`
+	ResponseEncoding string         `json:"response_encoding"`
+	StripANSI        bool           `json:"strip_ansi"`
+	Askpass          bool           `json:"askpass"`
+	ForbidPrompt     bool           `json:"forbid_prompt"`
+	EchoCheck        bool           `json:"echo_check"`
+	FailOnEcho       bool           `json:"fail_on_echo"`
+	KeepStdin        bool           `json:"keep_stdin"`
+	Output           outputDump     `json:"output"`
+	Wake             wakeDump       `json:"wake"`
+	AllowPassthrough bool           `json:"allow_passthrough"`
+	RedactPatterns   []string       `json:"redact_patterns"`
+	FailureMarker    string         `json:"failure_marker,omitempty"`
+	Extra            map[string]any `json:"extra,omitempty"`
+}
+
+type matcherDump struct {
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+	Sends   string `json:"sends"`
+}
+
+type timeoutsDump struct {
+	Prompt  string `json:"prompt"`
+	Connect string `json:"connect"`
+	Banner  string `json:"banner"`
+	Idle    string `json:"idle"`
+	Run     string `json:"run"`
+	Grace   string `json:"prompt_grace"`
+	MFA     string `json:"mfa"`
+	Type    string `json:"type_delay"`
+}
+
+type outputDump struct {
+	Prefix       string `json:"prefix"`
+	Timestamps   bool   `json:"timestamps"`
+	Binary       bool   `json:"binary"`
+	MergeStreams bool   `json:"merge_streams"`
+	TTY          bool   `json:"tty"`
+}
+
+type wakeDump struct {
+	After  string `json:"after"`
+	Repeat int    `json:"repeat"`
+}
+
+// dumpConfig prints the settings of r as indented JSON, for -dump-config.
+// source says where the password comes from, as in -audit, and extra holds
+// settings of the command line that are not the Runner's.
+func dumpConfig(w io.Writer, r *shallpass.Runner, source string, extra map[string]any) error {
+	sshPath := r.SSHPath
+	if sshPath == "" {
+		sshPath = "ssh"
+	}
+	promptSource := "both"
+	switch {
+	case r.ScanStdout && !r.ScanStderr:
+		promptSource = "stdout"
+	case r.ScanStderr && !r.ScanStdout:
+		promptSource = "stderr"
+	}
+	d := configDump{
+		SSHPath:          sshPath,
+		SSHArgs:          append([]string{}, r.Args...),
+		Dir:              r.Dir,
+		PasswordSource:   source,
+		PromptSource:     promptSource,
+		Matchers:         []matcherDump{},
+		Reconnect:        r.ReconnectOnTimeout,
+		MaxTries:         r.MaxTries,
+		RetryWithoutPTY:  r.RetryWithoutPTY,
+		MaxInjections:    r.MaxInjections,
+		MaxPasswordBytes: r.MaxPasswordBytes,
+		ScanLimit:        r.ScanLimit,
+		ResponseEncoding: r.ResponseEncoding,
+		StripANSI:        !r.KeepANSI,
+		Askpass:          r.Askpass,
+		ForbidPrompt:     r.ForbidPrompt,
+		EchoCheck:        r.EchoCheck,
+		FailOnEcho:       r.FailOnEcho,
+		KeepStdin:        r.KeepStdin,
+		AllowPassthrough: r.AllowPassthrough,
+		RedactPatterns:   []string{},
+		Timeouts: timeoutsDump{
+			Prompt:  durationString(r.PromptTimeout),
+			Connect: durationString(r.ConnectTimeout),
+			Banner:  durationString(r.BannerTimeout),
+			Idle:    durationString(r.IdleTimeout),
+			Run:     durationString(r.Timeout),
+			Grace:   durationString(r.PromptGrace),
+			MFA:     durationString(r.MFAWait),
+			Type:    durationString(r.TypeDelay),
+		},
+		Output: outputDump{
+			Prefix:       r.Prefix,
+			Timestamps:   r.Timestamps,
+			Binary:       r.Binary,
+			MergeStreams: r.MergeStreams,
+			TTY:          r.TTY,
+		},
+		Wake:  wakeDump{After: durationString(r.Wake), Repeat: r.WakeRepeat},
+		Extra: extra,
+	}
+	if d.ResponseEncoding == "" {
+		d.ResponseEncoding = "raw"
+	}
+	if r.NewPassword != "" {
+		d.NewPassword = "<redacted>"
+		// The Runner tries these first, once the password has expired.
+		for _, rule := range shallpass.PasswordChangeRules(r.NewPassword) {
+			kind, sends := rule.Describe()
+			d.Matchers = append(d.Matchers, matcherDump{kind, rule.Name, sends})
+		}
+	}
+	for _, rule := range r.Rules {
+		kind, sends := rule.Describe()
+		d.Matchers = append(d.Matchers, matcherDump{kind, rule.Name, sends})
+	}
+	for _, s := range r.Script {
+		d.Matchers = append(d.Matchers, matcherDump{"step", s.Name, s.Describe()})
+	}
+	for _, t := range r.Triggers {
+		d.Matchers = append(d.Matchers, matcherDump{"trigger", t.Name, t.Describe()})
+	}
+	for _, re := range r.RedactPatterns {
+		d.RedactPatterns = append(d.RedactPatterns, re.String())
+	}
+	if r.FailureMarker != nil {
+		d.FailureMarker = r.FailureMarker.String()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(d)
+}
+
+// durationString writes a zero duration as "0", which is "off" for every
+// timeout here.
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return "0"
+	}
+	return d.String()
+}
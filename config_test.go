@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDumpConfig(t *testing.T) {
+	writeProfiles(t, `[db]
+prompt-timeout = "30s"
+connect-timeout = 10
+ssh-args = ["-o", "User=deploy"]
+`)
+	ran := filepath.Join(t.TempDir(), "ran")
+	fake := fakeSSH(t, `touch '`+ran+`'`)
+	stdout, stderr, code := runMain(t, []string{"PW=hunter2", "SUDO_PW=sudo-hunter2"}, "-dump-config", "-profile", "db", "-host-config", "none",
+		"-prompt-timeout", "5s", "-password", "env:PW", "-sudo-password", "env:SUDO_PW", "-ssh-bin", fake, "--", "db1")
+	if code != 0 {
+		t.Fatalf("exit %d; stderr: %s", code, stderr)
+	}
+	var dump configDump
+	if err := json.Unmarshal([]byte(stdout), &dump); err != nil {
+		t.Fatalf("%v in %s", err, stdout)
+	}
+	// The command line over the profile, the profile over the defaults.
+	if dump.Timeouts.Prompt != "5s" || dump.Timeouts.Connect != "10s" {
+		t.Errorf("prompt timeout %s, connect timeout %s; want 5s from the flag and 10s from the profile", dump.Timeouts.Prompt, dump.Timeouts.Connect)
+	}
+	if want := []string{"-o", "ConnectTimeout=10", "-o", "User=deploy", "db1"}; !reflect.DeepEqual(dump.SSHArgs, want) {
+		t.Errorf("ssh args %q, want %q", dump.SSHArgs, want)
+	}
+	if dump.SSHPath != fake || dump.PasswordSource != "env" {
+		t.Errorf("ssh path %q, password source %q", dump.SSHPath, dump.PasswordSource)
+	}
+	for _, m := range dump.Matchers {
+		if m.Kind == "password" && m.Sends != "<redacted>" {
+			t.Errorf("matcher %+v shows what it sends", m)
+		}
+	}
+	if strings.Contains(stdout, "hunter2") {
+		t.Errorf("a secret is in the dump: %s", stdout)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("ssh was started")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// postgresPrompt is how the PostgreSQL clients ask, with the user in the
+// middle where "password:" would be.
+var postgresPrompt = regexp.MustCompile(`^Password for user \S+:\s*$`)
+
+// execPrompts are the password prompts of programs often run with -exec
+// that the -lang prompts miss, by program name. A prompt that is not here
+// goes in a -profile for the program, as prompt = "...".
+var execPrompts = map[string][]*regexp.Regexp{
+	"psql":       {postgresPrompt},
+	"pg_dump":    {postgresPrompt},
+	"pg_dumpall": {postgresPrompt},
+	"pg_restore": {postgresPrompt},
+	"createdb":   {postgresPrompt},
+	"dropdb":     {postgresPrompt},
+}
+
+// execPromptPatterns are the execPrompts of program, which may be a path;
+// a Windows program may also carry its .exe.
+func execPromptPatterns(program string) []*regexp.Regexp {
+	name := strings.TrimSuffix(filepath.Base(program), ".exe")
+	return execPrompts[name]
+}
+
+// commandLine splits what a session runs into the program and its
+// arguments: with -exec the program is the first argument, a tool runs
+// under its own name, and ssh is sshBin.
+func commandLine(tool, sshBin string, args []string) (string, []string) {
+	switch {
+	case tool == "exec" && len(args) > 0:
+		return args[0], args[1:]
+	case tool != "ssh":
+		return tool, args
+	}
+	return sshBin, args
+}
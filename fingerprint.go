@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// recordFingerprint appends a host key ssh showed us for the first time to
+// the -fingerprint-file, one "host type fingerprint" line each, in the
+// spirit of known_hosts. A line is written in one call, so concurrent runs
+// appending to the same file don't interleave.
+func recordFingerprint(path, host, keyType, fingerprint string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s %s\n", host, keyType, fingerprint); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
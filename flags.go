@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// passwordForFlag collects repeatable -password-for 'PATTERN=source' values
+// in the order they were given, which is the order they are tried in.
+type passwordForFlag []*shallpass.Rule
+
+func (f *passwordForFlag) String() string {
+	var names []string
+	for _, r := range *f {
+		names = append(names, r.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Set parses one PATTERN=source value. The pattern ends at the first "=",
+// so the source (a literal password in particular) may itself contain "=".
+func (f *passwordForFlag) Set(value string) error {
+	pattern, source, ok := strings.Cut(value, "=")
+	if !ok || pattern == "" {
+		return fmt.Errorf("want PATTERN=source, got %q", value)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	r := &shallpass.Rule{Name: pattern, Match: re.MatchString}
+	// A one-time code is only good for a moment, so it is worked out when
+	// the prompt appears rather than now.
+	if key, ok := strings.CutPrefix(source, "totp:"); ok {
+		if r.Source, err = shallpass.NewTOTPSource(key); err != nil {
+			return err
+		}
+	} else if r.Secret, err = shallpass.ReadSecret(source); err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// passwordMapFlag collects repeatable -password-map 'VALUE=source' values:
+// the secret for a prompt whose -password-capture group captured VALUE.
+// The VALUE "*" is the fallback for any other.
+type passwordMapFlag []shallpass.CaptureSecret
+
+func (f *passwordMapFlag) String() string {
+	var values []string
+	for _, e := range *f {
+		values = append(values, e.Value)
+	}
+	return strings.Join(values, ", ")
+}
+
+// Set parses one VALUE=source value. Like -password-for, VALUE ends at the
+// first "=".
+func (f *passwordMapFlag) Set(value string) error {
+	key, source, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("want VALUE=source, got %q", value)
+	}
+	secret, err := shallpass.ReadSecret(source)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, shallpass.CaptureSecret{Value: key, Secret: secret})
+	return nil
+}
+
+// onFlag collects repeatable -on 'PATTERN:response[:N][:ending]' values.
+type onFlag []*shallpass.Trigger
+
+func (f *onFlag) String() string {
+	var names []string
+	for _, t := range *f {
+		names = append(names, t.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// lineEndings are what may end an -on value to say how its response is
+// terminated; without one it is "\n".
+var lineEndings = map[string]string{
+	"lf":   "\n",
+	"cr":   "\r",
+	"crlf": "\r\n",
+	"none": "",
+}
+
+// Set parses one value. Prompts usually end in ":", so the response is
+// what follows the last colon, or the last but one or two when the value
+// ends in a count or a line ending: "Continue\?:yes", "Choice \(1-3\):2:5",
+// "Select:3:cr".
+func (f *onFlag) Set(value string) error {
+	rest, response, ok := cutLast(value, ":")
+	if !ok {
+		return fmt.Errorf("want PATTERN:response, got %q", value)
+	}
+	ending := "\n"
+	if e, known := lineEndings[response]; known && strings.Contains(rest, ":") {
+		ending = e
+		rest, response, _ = cutLast(rest, ":")
+	}
+	limit := 0
+	if n, err := strconv.Atoi(response); err == nil && n > 0 && strings.Contains(rest, ":") {
+		limit = n
+		rest, response, _ = cutLast(rest, ":")
+	}
+	if rest == "" {
+		return fmt.Errorf("want PATTERN:response, got %q", value)
+	}
+	re, err := regexp.Compile(rest)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, &shallpass.Trigger{
+		Name:     rest,
+		Match:    re.MatchString,
+		Response: response + ending,
+		Max:      limit,
+	})
+	return nil
+}
+
+// cutLast is strings.Cut at the last sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// patternsFlag collects the regular expressions of a repeatable flag,
+// -redact-pattern or -prompt.
+type patternsFlag []*regexp.Regexp
+
+func (f *patternsFlag) String() string {
+	var patterns []string
+	for _, re := range *f {
+		patterns = append(patterns, re.String())
+	}
+	return strings.Join(patterns, ", ")
+}
+
+func (f *patternsFlag) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, re)
+	return nil
+}
+
+// remapFlag collects repeatable -remap-exit FROM=TO values. A later
+// value for the same FROM replaces an earlier one.
+type remapFlag map[int]int
+
+func (f remapFlag) String() string {
+	var pairs []string
+	for from, to := range f {
+		pairs = append(pairs, fmt.Sprintf("%d=%d", from, to))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f remapFlag) Set(value string) error {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("want FROM=TO, got %q", value)
+	}
+	codes := [2]int{}
+	for i, s := range []string{from, to} {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 || n > 255 {
+			return fmt.Errorf("invalid exit code %q (want 0-255)", s)
+		}
+		codes[i] = n
+	}
+	f[codes[0]] = codes[1]
+	return nil
+}
+
+// remap applies the -remap-exit table to code. It is the last step before
+// exiting, so -audit, the metrics and the hooks all see the code unmapped.
+func (f remapFlag) remap(code int) int {
+	if to, ok := f[code]; ok {
+		return to
+	}
+	return code
+}
+
+// hostKeyFlag is the -accept-hostkey mode: yes, no, ask, or
+// fingerprint=SHA256:... to say yes only to the keys listed. As before the
+// modes were added, a bare -accept-hostkey means yes.
+type hostKeyFlag struct {
+	answer       string // "yes", "no", "ask", "fingerprint", or "" if not given
+	fingerprints []string
+}
+
+func (f *hostKeyFlag) IsBoolFlag() bool { return true }
+
+func (f *hostKeyFlag) String() string {
+	if f.answer == "fingerprint" {
+		return "fingerprint=" + strings.Join(f.fingerprints, ",")
+	}
+	return f.answer
+}
+
+// Set takes one mode. fingerprint= may list several keys, separated by
+// commas or given in more than one -accept-hostkey, and any of them is
+// accepted.
+func (f *hostKeyFlag) Set(value string) error {
+	if list, ok := strings.CutPrefix(value, "fingerprint="); ok {
+		for _, fp := range strings.Split(list, ",") {
+			fp = strings.TrimSpace(fp)
+			if hash, _, ok := strings.Cut(fp, ":"); !ok || hash == "" {
+				return fmt.Errorf("want a fingerprint as ssh prints it, such as SHA256:..., got %q", fp)
+			}
+			f.fingerprints = append(f.fingerprints, fp)
+		}
+		f.answer = "fingerprint"
+		return nil
+	}
+	switch strings.ToLower(value) {
+	case "yes", "true":
+		f.answer = "yes"
+	case "no", "false":
+		f.answer = "no"
+	case "ask":
+		f.answer = "ask"
+	default:
+		return fmt.Errorf("want yes, no, ask or fingerprint=SHA256:..., got %q", value)
+	}
+	return nil
+}
+
+// rule is the prelude rule answering ssh's host key question as f says,
+// or nil if -accept-hostkey was not given.
+func (f *hostKeyFlag) rule() *shallpass.Rule {
+	switch f.answer {
+	case "":
+		return nil
+	case "ask":
+		r := shallpass.HostKeyRule(false)
+		r.Secret, r.Source = "", &terminalAnswer{}
+		return r
+	case "fingerprint":
+		return shallpass.TrustedHostKeyRule(f.fingerprints)
+	}
+	return shallpass.HostKeyRule(f.answer == "yes")
+}
+
+// terminalAnswer is the Source of the host key rule under -accept-hostkey
+// ask: the question has been passed on with the rest of ssh's output, and
+// the answer is read from our terminal, which ssh itself could not use.
+type terminalAnswer struct {
+	tty *os.File
+}
+
+func (t *terminalAnswer) Read(b []byte) (int, error) {
+	if t.tty == nil {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return 0, fmt.Errorf("no terminal to ask on: %v", err)
+		}
+		t.tty = tty
+	}
+	n, err := t.tty.Read(b)
+	if n > 0 && b[n-1] == '\n' {
+		t.tty.Close()
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+func TestOnFlag(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		name     string
+		response string
+		max      int
+		matches  string
+	}{
+		{`Continue\?:yes`, `Continue\?`, "yes\n", 0, "Continue? [y/n]"},
+		{`Choice \(1-3\):2:5`, `Choice \(1-3\)`, "2\n", 5, "Choice (1-3)"},
+		{`Host: (a|b):`, "Host: (a|b)", "\n", 0, "Host: a"},
+		// Without a colon before it, a number is the response.
+		{`Pick:7`, "Pick", "7\n", 0, "Pick"},
+	} {
+		var f onFlag
+		if err := f.Set(tc.value); err != nil {
+			t.Errorf("Set(%q): %v", tc.value, err)
+			continue
+		}
+		tr := f[0]
+		if tr.Name != tc.name || tr.Response != tc.response || tr.Max != tc.max || !tr.Match(tc.matches) {
+			t.Errorf("Set(%q) = %q answered %q up to %d times, want %q answered %q up to %d times, matching %q",
+				tc.value, tr.Name, tr.Response, tr.Max, tc.name, tc.response, tc.max, tc.matches)
+		}
+	}
+	for _, value := range []string{"no colon", ":yes", "([:x"} {
+		var f onFlag
+		if f.Set(value) == nil {
+			t.Errorf("Set(%q) did not fail", value)
+		}
+	}
+}
+
+func TestOnFlagLineEndings(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		response string
+		max      int
+	}{
+		{`Select:3:lf`, "3\n", 0},
+		{`Select:3:cr`, "3\r", 0},
+		{`Select:3:crlf`, "3\r\n", 0},
+		{`Press any key::1:none`, "", 1},
+		// A response that only looks like an ending is still the response.
+		{`Mode:crlf`, "crlf\n", 0},
+	} {
+		var f onFlag
+		if err := f.Set(tc.value); err != nil {
+			t.Errorf("Set(%q): %v", tc.value, err)
+			continue
+		}
+		if tr := f[0]; tr.Response != tc.response || tr.Max != tc.max {
+			t.Errorf("Set(%q) answers %q up to %d times, want %q up to %d times", tc.value, tr.Response, tr.Max, tc.response, tc.max)
+		}
+	}
+}
+
+func TestRemapFlag(t *testing.T) {
+	f := remapFlag{}
+	for _, v := range []string{"5=1", " 255 = 0 ", "5=2"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if got, want := f.String(), "255=0,5=2"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	for code, want := range map[int]int{5: 2, 255: 0, 0: 0, 6: 6} {
+		if got := f.remap(code); got != want {
+			t.Errorf("remap(%d) = %d, want %d", code, got, want)
+		}
+	}
+	for _, v := range []string{"5", "a=1", "1=256", "-1=0", "1="} {
+		if f.Set(v) == nil {
+			t.Errorf("Set(%q) did not fail", v)
+		}
+	}
+}
+
+func TestOnLineEndingsInOneSession(t *testing.T) {
+	// A Unix-style question and an appliance menu in the same session,
+	// each answered with its own line ending.
+	fake := fakeSSH(t, `echo "Continue? (yes/no)"
+sleep 0.1
+echo "Select:"
+sleep 0.1
+printf 'password: ' >&2
+od -An -tx1 | tr -d ' \n'`)
+	stdout, stderr, code := runMain(t, []string{"PW=pw"}, "-on", `Continue\?:yes:1`, "-on", "Select:2:1:cr", "-password", "env:PW", "-ssh-bin", fake, "--", "host")
+	// y e s LF, 2 CR, then p w LF.
+	if want := "Continue? (yes/no)\nSelect:\n7965730a320d70770a"; code != 0 || stdout != want {
+		t.Errorf("exit %d, stdout %q, want %q; stderr: %s", code, stdout, want, stderr)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/plop-systems/shallpass/internal/sshargs"
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// forwardKeepalive is the -keepalive -wait-forward implies, so a tunnel
+// that dies quietly is noticed within a minute or so.
+const forwardKeepalive = 15
+
+// forwardBackoff bounds the wait before each of the -forward-retries: it
+// starts at the first value and doubles up to the second while the
+// forwards keep failing to come back.
+var forwardBackoff = [2]time.Duration{time.Second, 30 * time.Second}
+
+// readyNotifier tells whoever is waiting for -wait-forward that the
+// forwards are up, and that they went down again.
+type readyNotifier interface {
+	up(listeners []sshargs.Listener) error
+	down() error
+}
+
+// openNotifier makes the notifier for a -wait-forward destination:
+// file:PATH, fd:N or systemd.
+func openNotifier(dest string) (readyNotifier, error) {
+	if path, ok := strings.CutPrefix(dest, "file:"); ok && path != "" {
+		return fileNotifier(path), nil
+	}
+	if arg, ok := strings.CutPrefix(dest, "fd:"); ok {
+		fd, err := strconv.Atoi(arg)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %q", arg)
+		}
+		return fdNotifier{os.NewFile(uintptr(fd), dest)}, nil
+	}
+	if dest == "systemd" {
+		socket := os.Getenv("NOTIFY_SOCKET")
+		if socket == "" {
+			return nil, fmt.Errorf("NOTIFY_SOCKET is not set: systemd only passes it to a service of Type=notify")
+		}
+		return systemdNotifier(socket), nil
+	}
+	return nil, fmt.Errorf("unknown destination %q (want file:PATH, fd:N or systemd)", dest)
+}
+
+// fileNotifier creates its file, holding the addresses of the forwards, while
+// they are up, and removes it when they go down.
+type fileNotifier string
+
+func (path fileNotifier) up(listeners []sshargs.Listener) error {
+	var b strings.Builder
+	for _, l := range listeners {
+		fmt.Fprintf(&b, "%s %s\n", l.Network, l.Address)
+	}
+	return os.WriteFile(string(path), []byte(b.String()), 0o644)
+}
+
+func (path fileNotifier) down() error {
+	if err := os.Remove(string(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// fdNotifier writes a "ready" line to its descriptor when the forwards
+// come up and a "down" line when they go.
+type fdNotifier struct {
+	f *os.File
+}
+
+func (n fdNotifier) up([]sshargs.Listener) error {
+	_, err := fmt.Fprintln(n.f, "ready")
+	return err
+}
+
+func (n fdNotifier) down() error {
+	_, err := fmt.Fprintln(n.f, "down")
+	return err
+}
+
+// systemdNotifier speaks sd_notify to the socket systemd gave the service
+// in $NOTIFY_SOCKET; one starting with @ is in the abstract namespace.
+type systemdNotifier string
+
+func (socket systemdNotifier) up([]sshargs.Listener) error {
+	return socket.send("READY=1\nSTATUS=forwards up")
+}
+
+func (socket systemdNotifier) down() error {
+	return socket.send("STATUS=forwards down, reconnecting")
+}
+
+func (socket systemdNotifier) send(state string) error {
+	addr := string(socket)
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// waitForwards returns once every listener accepts a connection, which ssh
+// only opens once the login is over, or when ctx is done. Each connection
+// is closed straight away, so the far end of a -L forward sees one that
+// carries nothing.
+func waitForwards(ctx context.Context, listeners []sshargs.Listener) bool {
+	pending := listeners
+	for {
+		var left []sshargs.Listener
+		for _, l := range pending {
+			d := net.Dialer{Timeout: time.Second}
+			conn, err := d.DialContext(ctx, l.Network, l.Address)
+			if err != nil {
+				left = append(left, l)
+				continue
+			}
+			conn.Close()
+		}
+		if pending = left; len(pending) == 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// runForwarded runs the session of a -wait-forward tunnel: n is told once
+// its forwards are up, and again if they go down. Once they have been up,
+// a session that ends with ssh exiting 255 is started again, logging in
+// anew, up to retries times in a row without the forwards coming back
+// (for ever if retries is negative), unless ctx is done.
+func runForwarded(ctx context.Context, run *shallpass.Runner, stdin io.Reader, n readyNotifier, listeners []sshargs.Listener, retries int) (*shallpass.Result, error) {
+	delay, failed, everUp := forwardBackoff[0], 0, false
+	for {
+		watch, stop := context.WithCancel(ctx)
+		ready := make(chan bool, 1)
+		go func() {
+			ok := waitForwards(watch, listeners)
+			if ok {
+				if err := n.up(listeners); err != nil {
+					fmt.Fprintln(os.Stderr, "shallpass: warning: -wait-forward:", err)
+				}
+			}
+			ready <- ok
+		}()
+		res, err := run.RunWithStdio(stdin, os.Stdout, os.Stderr)
+		stop()
+		if <-ready {
+			if err := n.down(); err != nil {
+				fmt.Fprintln(os.Stderr, "shallpass: warning: -wait-forward:", err)
+			}
+			delay, failed, everUp = forwardBackoff[0], 0, true
+		} else {
+			failed++
+		}
+		if err != nil || !everUp || res.ExitCode != shallpass.ExitSSHError || ctx.Err() != nil || retries >= 0 && failed > retries {
+			return res, err
+		}
+		fmt.Fprintf(os.Stderr, "shallpass: the forwards went down; reconnecting in %v\n", delay)
+		select {
+		case <-ctx.Done():
+			return res, nil
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, forwardBackoff[1])
+	}
+}
@@ -0,0 +1,13 @@
+module github.com/plop-systems/shallpass
+
+go 1.23.0
+
+require (
+	github.com/creack/pty v1.1.24
+	golang.org/x/crypto v0.35.0
+	golang.org/x/sys v0.30.0
+	golang.org/x/term v0.29.0
+	golang.org/x/time v0.10.0
+)
+
+require gopkg.in/yaml.v3 v3.0.1
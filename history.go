@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// promptHistory remembers, per host, the prompt line that led to a
+// successful login, so the next run recognises it even before the -lang
+// table is consulted. It never holds a secret.
+type promptHistory struct {
+	Hosts map[string]string `json:"hosts"`
+}
+
+// historyKey is the canonical form of a host in the history file.
+func historyKey(host string) string {
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// loadHistory reads the history file at path. A missing file is an empty
+// history.
+func loadHistory(path string) (*promptHistory, error) {
+	h := &promptHistory{Hosts: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, err
+	}
+	if h.Hosts == nil {
+		h.Hosts = map[string]string{}
+	}
+	return h, nil
+}
+
+// learn records prompt for host and writes the history back to path. The
+// file is replaced atomically, so concurrent runs can't leave half of it.
+// The latest entries of other runs may be lost, which only costs a little
+// detection speed.
+func (h *promptHistory) learn(path, host, prompt string) error {
+	h.Hosts[historyKey(host)] = strings.TrimSpace(prompt)
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0o600)
+}
+
+// preferPrompt makes r also match prompt, a line learned from an earlier
+// run, before falling back to its own check.
+func preferPrompt(r *shallpass.Rule, prompt string) {
+	match := r.Match
+	r.Name = prompt + "|" + r.Name
+	r.Match = func(line string) bool {
+		return strings.TrimSpace(line) == prompt || match(line)
+	}
+}
+
+// containsSecret reports whether line contains any of secrets, so that a
+// prompt which somehow echoes one is never written to the history.
+func containsSecret(line string, secrets []string) bool {
+	for _, secret := range secrets {
+		if secret != "" && strings.Contains(line, secret) {
+			return true
+		}
+	}
+	return false
+}
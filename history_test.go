@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLearnedPromptIsReused(t *testing.T) {
+	fake := fakeSSH(t, `printf 'Enter the token for web1: ' >&2
+read pw
+echo "got $pw"`)
+	history := filepath.Join(t.TempDir(), "history.json")
+	env := []string{"PW=secret"}
+	args := []string{"-password", "env:PW", "-prompt-history", history, "-prompt-timeout", "2s", "-ssh-bin", fake}
+
+	// Only -prompt knows the prompt the first time.
+	stdout, stderr, code := runMain(t, env, append(args, "-prompt", "token for", "--", "Web1")...)
+	if code != 0 || stdout != "got secret\n" {
+		t.Fatalf("first run: exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+	data, err := os.ReadFile(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"web1": "Enter the token for web1:"`) || strings.Contains(string(data), "secret") {
+		t.Errorf("history holds %s", data)
+	}
+
+	// The second time the history does, for the same host only.
+	stdout, stderr, code = runMain(t, env, append(args, "--", "web1")...)
+	if code != 0 || stdout != "got secret\n" {
+		t.Errorf("second run: exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+	if _, _, code = runMain(t, env, append(args, "--", "web2")...); code == 0 {
+		t.Error("another host was answered with the learned prompt")
+	}
+}
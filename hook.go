@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// runHook runs an -on-success or -on-failure command with sh, or cmd on
+// Windows, once the session is over. It gets the outcome in SHALLPASS_EXIT_CODE,
+// SHALLPASS_REASON and SHALLPASS_HOST, but not $SHALLPASS, $SSHPASS or any
+// other variable a secret was read from: the hook has no business with the
+// password. Its output goes to our stderr so that it never mixes with the
+// remote command's stdout.
+func runHook(command string, code int, reason, host string) error {
+	cmd := shellCommand(command)
+	for _, kv := range shallpass.Environ() {
+		if !strings.HasPrefix(kv, "SHALLPASS=") && !strings.HasPrefix(kv, "SSHPASS=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"SHALLPASS_EXIT_CODE="+strconv.Itoa(code),
+		"SHALLPASS_REASON="+reason,
+		"SHALLPASS_HOST="+host,
+	)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run()
+}
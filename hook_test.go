@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestShellCommand(t *testing.T) {
+	// Both sh and cmd take these the same way.
+	out, err := shellCommand("echo hook ran && exit 3").Output()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 3 {
+		t.Errorf("exit: %v, want code 3", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "hook ran" {
+		t.Errorf("output %q, want %q", got, "hook ran")
+	}
+}
+
+func TestOutcomeHooks(t *testing.T) {
+	hooks := []string{
+		"-on-success", `echo "success $SHALLPASS_EXIT_CODE $SHALLPASS_REASON $SHALLPASS_HOST"; exit 1`,
+		"-on-failure", `echo "failure $SHALLPASS_EXIT_CODE $SHALLPASS_REASON $SHALLPASS_HOST"; exit 1`,
+	}
+	for _, tc := range []struct {
+		script string
+		code   int
+		hook   string
+	}{
+		{"printf 'password: ' >&2\nread pw", 0, "success 0 ok db1\n"},
+		{"printf 'password: ' >&2\nread pw\nexit 3", 3, "failure 3 remote_command_failed db1\n"},
+		{"echo 'ssh: connect to host db1 port 22: Connection refused' >&2\nexit 255", 255, "failure 255 connection_refused db1\n"},
+	} {
+		args := append(append([]string{"-password", "env:PW", "-ssh-bin", fakeSSH(t, tc.script)}, hooks...), "--", "alice@db1")
+		_, stderr, code := runMain(t, []string{"PW=secret"}, args...)
+		other := "success "
+		if tc.code == 0 {
+			other = "failure "
+		}
+		// The hook failing leaves the exit code alone.
+		if code != tc.code || !strings.Contains(stderr, tc.hook) || strings.Contains(stderr, other) {
+			t.Errorf("exit %d, stderr %q; want exit %d and only %q from a hook", code, stderr, tc.code, tc.hook)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "os/exec"
+
+// shellCommand runs command with sh, as -on-success and -on-failure do.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand runs command with %ComSpec% /C, cmd.exe unless set
+// otherwise. The command line is handed to it as given: cmd does its own
+// parsing, which the usual quoting of arguments would get in the way of.
+func shellCommand(command string) *exec.Cmd {
+	shell := os.Getenv("ComSpec")
+	if shell == "" {
+		shell = "cmd.exe"
+	}
+	cmd := exec.Command(shell)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `"` + shell + `" /C ` + command}
+	return cmd
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// hostConfigPath is where per-host defaults are read from unless
+// -host-config says otherwise.
+func hostConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shallpass", "config.yaml"), nil
+}
+
+// loadHostConfig returns the sections of a host config file that apply to
+// host, in the order they are written. The file is a YAML mapping whose
+// keys are lists of host patterns, as on an ssh_config Host line:
+// blank-separated globs matched against the host name, where a pattern
+// starting with ! keeps the section from applying to the hosts it
+// matches. Each section maps our flag names to a value or a list of them:
+//
+//	"*.prod.example.com !bastion.prod.example.com":
+//	  password: vault:secret/data/prod#password
+//	  prompt-timeout: 30s
+//	  ssh-args: [-J, bastion.prod.example.com]
+//
+// A missing file is no error when it is the default one.
+func loadHostConfig(path, host string, explicit bool) ([]profileTable, error) {
+	tables, err := readYAMLSections(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var matched []profileTable
+	for _, t := range tables {
+		ok, err := matchHostPatterns(t.name, host)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q: %v", path, t.name, err)
+		}
+		if ok {
+			matched = append(matched, t)
+		}
+	}
+	return matched, nil
+}
+
+// readYAMLSections reads a YAML file that maps section names to mappings
+// of settings, keeping the sections and their settings in the order they
+// are written, as readTables does for the profiles format.
+func readYAMLSections(path string) ([]profileTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: want host patterns mapped to their settings", path, root.Line)
+	}
+	var tables []profileTable
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name, body := root.Content[i], root.Content[i+1]
+		settings, err := yamlSettings(body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q: %v", path, name.Value, err)
+		}
+		tables = append(tables, profileTable{name: name.Value, settings: settings})
+	}
+	return tables, nil
+}
+
+// yamlSettings turns a YAML mapping of keys to a value or a list of
+// values into settings. An empty value, as in "key:", is an empty string.
+func yamlSettings(node *yaml.Node) ([]profileSetting, error) {
+	if node.Tag == "!!null" {
+		return nil, nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: want key: value settings", node.Line)
+	}
+	var settings []profileSetting
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		var values []string
+		switch value.Kind {
+		case yaml.ScalarNode:
+			values = []string{yamlScalar(value)}
+		case yaml.SequenceNode:
+			for _, v := range value.Content {
+				if v.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("line %d: %s: list elements must be plain values", v.Line, key.Value)
+				}
+				values = append(values, yamlScalar(v))
+			}
+		default:
+			return nil, fmt.Errorf("line %d: %s: want a value or a list of values", value.Line, key.Value)
+		}
+		settings = append(settings, profileSetting{key: key.Value, values: values})
+	}
+	return settings, nil
+}
+
+// yamlScalar is the text of a scalar as written, with null as "".
+func yamlScalar(n *yaml.Node) string {
+	if n.Tag == "!!null" {
+		return ""
+	}
+	return n.Value
+}
+
+// matchHostPatterns reports whether host matches one of patterns and none
+// of its negated ones. Host names are matched without regard to case.
+func matchHostPatterns(patterns, host string) (bool, error) {
+	host = strings.ToLower(host)
+	matched := false
+	for _, p := range strings.Fields(strings.ToLower(patterns)) {
+		negated := strings.HasPrefix(p, "!")
+		ok, err := path.Match(strings.TrimPrefix(p, "!"), host)
+		switch {
+		case err != nil:
+			return false, fmt.Errorf("invalid host pattern %q", p)
+		case ok && negated:
+			return false, nil
+		case ok:
+			matched = true
+		}
+	}
+	return matched, nil
+}
+
+// applyHostConfig applies the sections loadHostConfig found, with what was
+// set before winning: each section only fills in options that the command
+// line, the profile and the sections before it left alone, as the first
+// value obtained wins in ssh_config. It returns the sections' ssh
+// arguments.
+func applyHostConfig(tables []profileTable) ([]string, error) {
+	var sshArgs []string
+	for _, t := range tables {
+		args, err := applyProfile(t.settings)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", t.name, err)
+		}
+		sshArgs = append(sshArgs, args...)
+	}
+	return sshArgs, nil
+}
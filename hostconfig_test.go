@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testHostConfig = `# Specific sections first: the first value obtained wins.
+"db*.prod.example.com !db-legacy.prod.example.com":
+  password: vault:secret/data/prod/db#password
+  reconnect-on-timeout: 2
+  ssh-args: [-J, bastion.prod.example.com]
+
+"*":
+  connect-timeout: 10
+  prompt:
+    - "(?i)passphrase for"
+    - 'Password: '
+`
+
+func writeHostConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadHostConfig(t *testing.T) {
+	path := writeHostConfig(t, testHostConfig)
+	for _, tc := range []struct {
+		host string
+		want []profileTable
+	}{
+		{"DB1.prod.example.com", []profileTable{
+			{"db*.prod.example.com !db-legacy.prod.example.com", []profileSetting{
+				{"password", []string{"vault:secret/data/prod/db#password"}},
+				{"reconnect-on-timeout", []string{"2"}},
+				{"ssh-args", []string{"-J", "bastion.prod.example.com"}},
+			}},
+			{"*", []profileSetting{
+				{"connect-timeout", []string{"10"}},
+				{"prompt", []string{"(?i)passphrase for", "Password: "}},
+			}},
+		}},
+		{"db-legacy.prod.example.com", []profileTable{
+			{"*", []profileSetting{
+				{"connect-timeout", []string{"10"}},
+				{"prompt", []string{"(?i)passphrase for", "Password: "}},
+			}},
+		}},
+	} {
+		got, err := loadHostConfig(path, tc.host, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestLoadHostConfigErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "config.yaml")
+	if tables, err := loadHostConfig(missing, "host", false); err != nil || tables != nil {
+		t.Errorf("missing default file: %v, %v; want neither", tables, err)
+	}
+	if _, err := loadHostConfig(missing, "host", true); err == nil {
+		t.Error("missing -host-config file: no error")
+	}
+	for _, config := range []string{
+		"- host\n",
+		"host: value\n",
+		"host:\n  ssh-args: [[-J, bastion]]\n",
+		"host: [unterminated\n",
+		"\"[\":\n  port: 22\n",
+	} {
+		if _, err := loadHostConfig(writeHostConfig(t, config), "host", true); err == nil {
+			t.Errorf("%q: no error", config)
+		}
+	}
+}
+
+func TestHostConfigReachesSSH(t *testing.T) {
+	fake := fakeSSH(t, `for a in "$@"; do printf '[%s]' "$a"; done`)
+	path := writeHostConfig(t, `"web*":
+  port: 2222
+  ssh-args: [-o, User=deploy]
+"*":
+  port: 22
+`)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--", "web1"}, "[-p][2222][-o][User=deploy][web1]"},
+		{[]string{"--", "db1"}, "[-p][22][db1]"},
+		// The command line wins over the file.
+		{[]string{"-port", "2200", "--", "web1"}, "[-p][2200][-o][User=deploy][web1]"},
+	} {
+		args := append([]string{"-password", "env:PW", "-host-config", path, "-ssh-bin", fake}, tc.args...)
+		stdout, stderr, code := runMain(t, []string{"PW=secret"}, args...)
+		if code != 0 || stdout != tc.want {
+			t.Errorf("shallpass %q: exit %d, ssh ran with %s, want %s; stderr: %s", tc.args, code, stdout, tc.want, stderr)
+		}
+	}
+}
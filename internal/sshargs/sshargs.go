@@ -0,0 +1,355 @@
+// Package sshargs takes ssh command lines apart, and puts options into
+// them, the way ssh(1) itself reads them.
+package sshargs
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// argFlags are the ssh options that take an argument, from ssh(1).
+const argFlags = "BbcDEeFIiJLlmOoPpQRSWw"
+
+// Option is one option found on an ssh command line.
+type Option struct {
+	Flag  byte
+	Value string // empty for options without an argument
+}
+
+// Options returns the options in an ssh argument list, the way ssh finds
+// them: parsing stops at "--" or at the first non-option argument, the
+// destination, and then, unless "--" came first, goes on with the words
+// after the destination, up to the remote command, whose own flags are
+// none of our business. So "host -p 2222 uptime" sets the port.
+func Options(args []string) []Option {
+	opts, _ := parse(args)
+	return opts
+}
+
+// Command returns the remote command in an ssh argument list: what follows
+// the destination and the options after it.
+func Command(args []string) []string {
+	_, command := parse(args)
+	return command
+}
+
+// parse reads args as ssh does, returning every option and the remote
+// command.
+func parse(args []string) ([]Option, []string) {
+	opts, rest, terminated := split(args)
+	if len(rest) == 0 {
+		return opts, nil
+	}
+	if terminated {
+		return opts, rest[1:]
+	}
+	// ssh goes back to reading options once it has the destination.
+	more, command, _ := split(rest[1:])
+	return append(opts, more...), command
+}
+
+// Split returns the options in front of the destination, and the arguments
+// from the destination on: the destination, any options after it and the
+// remote command.
+func Split(args []string) ([]Option, []string) {
+	opts, rest, _ := split(args)
+	return opts, rest
+}
+
+// split is Split that also reports whether "--" ended the options.
+func split(args []string) ([]Option, []string, bool) {
+	var opts []Option
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return opts, args[i+1:], true
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		// Options may be clustered (-tt, -vp22); an option that takes an
+		// argument consumes the rest of the word, or the next word.
+		for j := 1; j < len(arg); j++ {
+			c := arg[j]
+			if strings.IndexByte(argFlags, c) < 0 {
+				opts = append(opts, Option{Flag: c})
+				continue
+			}
+			value := arg[j+1:]
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			opts = append(opts, Option{Flag: c, Value: value})
+			break
+		}
+	}
+	return opts, args[i:], false
+}
+
+// Destination returns the host ssh will connect to, without the user or
+// an ssh:// URI's port, or "" if args name none.
+func Destination(args []string) string {
+	_, rest := Split(args)
+	if len(rest) == 0 {
+		return ""
+	}
+	dest := rest[0]
+	uri := strings.HasPrefix(dest, "ssh://")
+	dest = strings.TrimPrefix(dest, "ssh://")
+	if i := strings.LastIndexByte(dest, '@'); i >= 0 {
+		dest = dest[i+1:]
+	}
+	if uri {
+		if i := strings.LastIndexByte(dest, ':'); i >= 0 && !strings.HasSuffix(dest, "]") {
+			dest = dest[:i]
+		}
+	}
+	return dest
+}
+
+// Sets reports whether args already set something, either with the
+// command-line flag or with the equivalent -o keyword (matched
+// case-insensitively, as ssh does). Pass 0 or "" to skip either check.
+func Sets(args []string, flag byte, keyword string) bool {
+	for _, o := range Options(args) {
+		if flag != 0 && o.Flag == flag {
+			return true
+		}
+		if keyword != "" && o.Flag == 'o' && strings.EqualFold(ConfigKey(o.Value), keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitConfig splits an -o value, which may be written "Keyword=value" or
+// "Keyword value", into its keyword and value.
+func SplitConfig(option string) (key, value string) {
+	option = strings.TrimSpace(option)
+	i := strings.IndexAny(option, "= \t")
+	if i < 0 {
+		return option, ""
+	}
+	return option[:i], strings.TrimSpace(strings.TrimLeft(option[i:], "= \t"))
+}
+
+// ConfigKey returns just the keyword of an -o value.
+func ConfigKey(option string) string {
+	key, _ := SplitConfig(option)
+	return key
+}
+
+// Build builds the final ssh argument list: the convenience options go
+// first and the user's arguments follow untouched, word for word and in
+// order. A convenience option is dropped when the user's arguments already
+// set the same thing, in front of the destination or after it, so what
+// was spelled out for ssh always wins.
+func Build(user []string, port, identity string, connectTimeout, keepalive int, forcePassword, forwardAgent, forwardX11, trustedX11 bool) []string {
+	var args []string
+	if port != "" && !Sets(user, 'p', "Port") {
+		args = append(args, "-p", port)
+	}
+	if identity != "" && !Sets(user, 'i', "IdentityFile") {
+		args = append(args, "-i", identity)
+	}
+	if connectTimeout > 0 && !Sets(user, 0, "ConnectTimeout") {
+		args = append(args, "-o", "ConnectTimeout="+strconv.Itoa(connectTimeout))
+	}
+	// Each half is dropped on its own, so a user's count still gets our
+	// interval and the other way round.
+	if keepalive > 0 && !Sets(user, 0, "ServerAliveInterval") {
+		args = append(args, "-o", "ServerAliveInterval="+strconv.Itoa(keepalive))
+	}
+	if keepalive > 0 && !Sets(user, 0, "ServerAliveCountMax") {
+		args = append(args, "-o", "ServerAliveCountMax=3")
+	}
+	// A global config that turns password auth off, or a key agent that
+	// uses up the server's MaxAuthTries first, leaves us nothing to
+	// answer. PAM asks for passwords through keyboard-interactive, so
+	// that stays allowed after password.
+	if forcePassword {
+		for _, o := range [][2]string{
+			{"PasswordAuthentication", "yes"},
+			{"PubkeyAuthentication", "no"},
+			{"PreferredAuthentications", "password,keyboard-interactive"},
+		} {
+			if !Sets(user, 0, o[0]) {
+				args = append(args, "-o", o[0]+"="+o[1])
+			}
+		}
+	}
+	// A user's -a or -x turns forwarding off, which wins just as much as
+	// turning it on.
+	if forwardAgent && !Sets(user, 'A', "ForwardAgent") && !Sets(user, 'a', "") {
+		args = append(args, "-A")
+	}
+	if (forwardX11 || trustedX11) && !Sets(user, 'X', "ForwardX11") && !Sets(user, 'Y', "ForwardX11Trusted") && !Sets(user, 'x', "") {
+		if trustedX11 {
+			args = append(args, "-Y")
+		} else {
+			args = append(args, "-X")
+		}
+	}
+	return append(args, user...)
+}
+
+// IsMultiplexed reports whether args make ssh use a control master
+// connection: -M, -S path, or -o ControlMaster/ControlPath, unless they are
+// explicitly turned off ("no", "none").
+func IsMultiplexed(args []string) bool {
+	for _, o := range Options(args) {
+		switch o.Flag {
+		case 'M':
+			return true
+		case 'S':
+			if !strings.EqualFold(o.Value, "none") {
+				return true
+			}
+		case 'o':
+			key, value := SplitConfig(o.Value)
+			switch {
+			case strings.EqualFold(key, "ControlMaster") && !strings.EqualFold(value, "no"):
+				return true
+			case strings.EqualFold(key, "ControlPath") && !strings.EqualFold(value, "none"):
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsForwardOnly reports whether args run no remote command at all: -N, or
+// -o SessionType=none. Such a session only carries port forwards and may
+// run for as long as they are needed.
+func IsForwardOnly(args []string) bool {
+	for _, o := range Options(args) {
+		if o.Flag == 'N' {
+			return true
+		}
+		if key, value := SplitConfig(o.Value); o.Flag == 'o' && strings.EqualFold(key, "SessionType") && strings.EqualFold(value, "none") {
+			return true
+		}
+	}
+	return false
+}
+
+// A Listener is an address ssh listens on locally for a port forward.
+type Listener struct {
+	Network string // "tcp" or "unix"
+	Address string
+}
+
+// LocalListeners returns where ssh listens for the local and dynamic
+// forwards in args: -L, -D, and -o LocalForward or DynamicForward. A
+// forward bound to no address, or to all of them (*), is reached on
+// localhost. Ports ssh picks itself (0) are left out, as they can't be
+// known from the arguments.
+func LocalListeners(args []string) []Listener {
+	var ls []Listener
+	for _, o := range Options(args) {
+		var listen string
+		switch o.Flag {
+		case 'L':
+			listen = localForwardListen(o.Value)
+		case 'D':
+			listen = o.Value
+		case 'o':
+			key, value := SplitConfig(o.Value)
+			switch {
+			case strings.EqualFold(key, "LocalForward"), strings.EqualFold(key, "DynamicForward"):
+				listen, _, _ = strings.Cut(strings.TrimSpace(value), " ")
+			default:
+				continue
+			}
+		default:
+			continue
+		}
+		if l, ok := listener(listen); ok {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+// localForwardListen is the listening end of a -L argument, which is one
+// of [bind:]port:host:hostport, [bind:]port:socket, socket:host:hostport
+// and socket:socket.
+func localForwardListen(spec string) string {
+	fields := splitForward(spec)
+	switch {
+	case len(fields) == 4, len(fields) == 3 && strings.Contains(fields[2], "/"):
+		return fields[0] + ":" + fields[1]
+	case len(fields) > 0:
+		return fields[0]
+	}
+	return ""
+}
+
+// listener makes a Listener of [bind:]port or a socket path.
+func listener(listen string) (Listener, bool) {
+	if strings.Contains(listen, "/") {
+		return Listener{"unix", listen}, true
+	}
+	bind, port := "localhost", listen
+	if fields := splitForward(listen); len(fields) == 2 {
+		bind, port = fields[0], fields[1]
+		if bind == "" || bind == "*" {
+			bind = "localhost"
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return Listener{}, false
+	}
+	return Listener{"tcp", net.JoinHostPort(strings.Trim(bind, "[]"), port)}, true
+}
+
+// splitForward splits a forwarding spec at its colons, except those of an
+// IPv6 address in brackets.
+func splitForward(spec string) []string {
+	var fields []string
+	depth, start := 0, 0
+	for i := 0; i < len(spec); i++ {
+		switch spec[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				fields = append(fields, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, spec[start:])
+}
+
+// Insert puts extra options into the user's ssh arguments right after
+// the user's own options. ssh keeps the first value it sees for an option,
+// so the user's still win, and the destination and remote command stay
+// last.
+func Insert(user, extra []string) []string {
+	if len(extra) == 0 {
+		return user
+	}
+	_, rest := Split(user)
+	k := len(user) - len(rest)
+	if k > 0 && user[k-1] == "--" {
+		k--
+	}
+	args := append([]string{}, user[:k]...)
+	args = append(args, extra...)
+	return append(args, user[k:]...)
+}
+
+// Quote quotes s for a POSIX shell. Words of only safe characters are
+// left alone, so simple commands stay readable in ps and logs.
+func Quote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,@%+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,284 @@
+package sshargs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOptionsAfterDestination(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		opts    []Option
+		command []string
+	}{
+		{
+			[]string{"host", "-p", "2222", "-t", "uptime"},
+			[]Option{{'p', "2222"}, {'t', ""}},
+			[]string{"uptime"},
+		},
+		{
+			[]string{"-v", "host", "-oPort=2222", "--", "-t"},
+			[]Option{{'v', ""}, {'o', "Port=2222"}},
+			[]string{"-t"},
+		},
+		// "--" before the destination ends the options for good.
+		{
+			[]string{"-v", "--", "host", "-p", "2222"},
+			[]Option{{'v', ""}},
+			[]string{"-p", "2222"},
+		},
+		// The remote command's flags are its own.
+		{
+			[]string{"host", "ls", "-l"},
+			nil,
+			[]string{"ls", "-l"},
+		},
+		{[]string{"host"}, nil, nil},
+		{nil, nil, nil},
+	} {
+		if got := Options(tc.args); !reflect.DeepEqual(got, tc.opts) {
+			t.Errorf("Options(%q) = %v, want %v", tc.args, got, tc.opts)
+		}
+		if got := Command(tc.args); len(got)+len(tc.command) > 0 && !reflect.DeepEqual(got, tc.command) {
+			t.Errorf("Command(%q) = %q, want %q", tc.args, got, tc.command)
+		}
+	}
+}
+
+func TestBuildKeepsTheUsersArgumentsInOrder(t *testing.T) {
+	user := []string{"--", "host", "-t", "tmux attach"}
+	got := Build(user, "", "", 0, 0, false, false, false, false)
+	if !reflect.DeepEqual(got, user) {
+		t.Errorf("Build(%q) = %q, want it unchanged", user, got)
+	}
+	user = []string{"host", "-t", "tmux attach"}
+	got = Build(user, "2222", "", 0, 0, false, false, false, false)
+	if want := []string{"-p", "2222", "host", "-t", "tmux attach"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Build(%q) = %q, want %q", user, got, want)
+	}
+}
+
+func TestBuildYieldsToOptionsAfterDestination(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		user []string
+		got  []string
+	}{
+		{"port", []string{"host", "-p", "2222"}, Build([]string{"host", "-p", "2222"}, "22", "", 0, 0, false, false, false, false)},
+		{"identity", []string{"host", "-i", "key"}, Build([]string{"host", "-i", "key"}, "", "other", 0, 0, false, false, false, false)},
+		{"connect timeout", []string{"host", "-o", "ConnectTimeout=5"}, Build([]string{"host", "-o", "ConnectTimeout=5"}, "", "", 30, 0, false, false, false, false)},
+		{"agent", []string{"host", "-a"}, Build([]string{"host", "-a"}, "", "", 0, 0, false, true, false, false)},
+		{"x11", []string{"host", "-x"}, Build([]string{"host", "-x"}, "", "", 0, 0, false, false, true, false)},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.user) {
+			t.Errorf("%s: Build gave %q, want the user's %q alone", tc.name, tc.got, tc.user)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		opts []Option
+		rest []string
+	}{
+		{[]string{"-v", "-p", "22", "host", "ls"}, []Option{{'v', ""}, {'p', "22"}}, []string{"host", "ls"}},
+		// Clustered flags, and an argument in the same word.
+		{[]string{"-tt", "-vp2222", "host"}, []Option{{'t', ""}, {'t', ""}, {'v', ""}, {'p', "2222"}}, []string{"host"}},
+		{[]string{"-i", "-weird", "host"}, []Option{{'i', "-weird"}}, []string{"host"}},
+		{[]string{"-v", "--", "-host"}, []Option{{'v', ""}}, []string{"-host"}},
+		{[]string{"-", "host"}, nil, []string{"-", "host"}},
+		// An argument missing at the end is empty.
+		{[]string{"-p"}, []Option{{'p', ""}}, []string{}},
+	} {
+		opts, rest := Split(tc.args)
+		if !reflect.DeepEqual(opts, tc.opts) || !reflect.DeepEqual(rest, tc.rest) {
+			t.Errorf("Split(%q) = %v, %q, want %v, %q", tc.args, opts, rest, tc.opts, tc.rest)
+		}
+	}
+}
+
+func TestDestination(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"host"}, "host"},
+		{[]string{"-p", "22", "alice@db1", "uptime"}, "db1"},
+		{[]string{"-l", "bob", "--", "bob@jump"}, "jump"},
+		{[]string{"ssh://alice@example.com:2222"}, "example.com"},
+		{[]string{"ssh://[::1]"}, "[::1]"},
+		{[]string{"-v"}, ""},
+	} {
+		if got := Destination(tc.args); got != tc.want {
+			t.Errorf("Destination(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestInsert(t *testing.T) {
+	extra := []string{"-o", "BatchMode=no"}
+	for _, tc := range []struct {
+		user, want []string
+	}{
+		{[]string{"host", "ls"}, []string{"-o", "BatchMode=no", "host", "ls"}},
+		{[]string{"-v", "host"}, []string{"-v", "-o", "BatchMode=no", "host"}},
+		// The extra options go in front of "--", or they would be the
+		// destination.
+		{[]string{"-v", "--", "host"}, []string{"-v", "-o", "BatchMode=no", "--", "host"}},
+		{nil, []string{"-o", "BatchMode=no"}},
+	} {
+		if got := Insert(tc.user, extra); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Insert(%q) = %q, want %q", tc.user, got, tc.want)
+		}
+	}
+	if got := Insert([]string{"host"}, nil); !reflect.DeepEqual(got, []string{"host"}) {
+		t.Errorf("Insert with nothing to insert = %q", got)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"uptime":        "uptime",
+		"/srv/app-1.2":  "/srv/app-1.2",
+		"":              "''",
+		"tmux attach":   "'tmux attach'",
+		"it's":          `'it'\''s'`,
+		"$HOME":         "'$HOME'",
+		"a;rm -rf /":    "'a;rm -rf /'",
+		"user@host:22,": "user@host:22,",
+	} {
+		if got := Quote(s); got != want {
+			t.Errorf("Quote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestBuildPortAndIdentity(t *testing.T) {
+	got := Build([]string{"host"}, "2222", "id_web", 0, 0, false, false, false, false)
+	if want := []string{"-p", "2222", "-i", "id_web", "host"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Build gave %q, want %q", got, want)
+	}
+}
+
+func TestBuildRelativeIdentity(t *testing.T) {
+	// A relative -i is passed on as it is, for ssh to resolve against the
+	// directory it runs in, which -chdir sets; resolving it here, against
+	// our own, would find the wrong file.
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "keys"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "keys", "id_web"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range [][]string{{"host"}, {"-i", "keys/id_web", "host"}} {
+		identity := "keys/id_web"
+		if len(user) > 1 {
+			identity = ""
+		}
+		got := Build(user, "", identity, 0, 0, false, false, false, false)
+		if want := []string{"-i", "keys/id_web", "host"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Build(%q) gave %q, want %q", user, got, want)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, got[1])); err != nil {
+			t.Errorf("%s does not resolve against the -chdir directory: %v", got[1], err)
+		}
+	}
+}
+
+func TestBuildConnectTimeout(t *testing.T) {
+	got := Build([]string{"host"}, "", "", 10, 0, false, false, false, false)
+	if want := []string{"-o", "ConnectTimeout=10", "host"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Build gave %q, want %q", got, want)
+	}
+}
+
+func TestBuildKeepalive(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		user, want []string
+	}{
+		{"both halves", []string{"host"},
+			[]string{"-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3", "host"}},
+		{"the user's count", []string{"-o", "ServerAliveCountMax=9", "host"},
+			[]string{"-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=9", "host"}},
+		{"the user's interval", []string{"-o", "ServerAliveInterval=60", "host"},
+			[]string{"-o", "ServerAliveCountMax=3", "-o", "ServerAliveInterval=60", "host"}},
+	} {
+		if got := Build(tc.user, "", "", 0, 15, false, false, false, false); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: Build gave %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBuildForcePassword(t *testing.T) {
+	got := Build([]string{"-o", "pubkeyauthentication no", "host"}, "", "", 0, 0, true, false, false, false)
+	want := []string{"-o", "PasswordAuthentication=yes", "-o", "PreferredAuthentications=password,keyboard-interactive", "-o", "pubkeyauthentication no", "host"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Build gave %q, want %q", got, want)
+	}
+}
+
+func TestBuildForwarding(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"agent", Build([]string{"host"}, "", "", 0, 0, false, true, false, false), []string{"-A", "host"}},
+		{"x11", Build([]string{"host"}, "", "", 0, 0, false, false, true, false), []string{"-X", "host"}},
+		{"trusted x11", Build([]string{"host"}, "", "", 0, 0, false, false, true, true), []string{"-Y", "host"}},
+		{"the user's -X", Build([]string{"-X", "host"}, "", "", 0, 0, false, false, false, true), []string{"-X", "host"}},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s: Build gave %q, want %q", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestIsMultiplexed(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"host"}, false},
+		{[]string{"-M", "host"}, true},
+		{[]string{"-S", "/tmp/ctl", "host"}, true},
+		{[]string{"-S", "none", "host"}, false},
+		{[]string{"-o", "ControlMaster=auto", "host"}, true},
+		{[]string{"-o", "controlmaster no", "host"}, false},
+		{[]string{"-oControlPath=~/.ssh/%C", "host"}, true},
+		{[]string{"-o", "ControlPath=none", "host"}, false},
+		// After the destination too, as ssh reads them.
+		{[]string{"host", "-S", "/tmp/ctl"}, true},
+		// Not once the remote command has begun.
+		{[]string{"host", "ls", "-M"}, false},
+	} {
+		if got := IsMultiplexed(tc.args); got != tc.want {
+			t.Errorf("IsMultiplexed(%q) = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestIsForwardOnly(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"host"}, false},
+		{[]string{"-N", "-L", "8080:localhost:80", "host"}, true},
+		{[]string{"-fNT", "host"}, true},
+		{[]string{"-T", "host"}, false},
+		{[]string{"-o", "SessionType=none", "host"}, true},
+		{[]string{"-o", "sessiontype subsystem", "host", "sftp"}, false},
+		{[]string{"host", "ls", "-N"}, false},
+	} {
+		if got := IsForwardOnly(tc.args); got != tc.want {
+			t.Errorf("IsForwardOnly(%q) = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
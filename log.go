@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// openLogger sets up the -log-level logger: level is debug, info, warn or
+// error ("" is off, and nil is returned), written to the file at path, or
+// to stderr if path is "", as text or json. The file is appended to, so
+// runs from a loop end up in one log; records are written unbuffered, so
+// it needs no closing.
+func openLogger(level, path, format string) (*slog.Logger, error) {
+	if level == "" {
+		return nil, nil
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown level %q (want debug, info, warn or error)", level)
+	}
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("unknown -log-format %q (want text or json)", format)
+	}
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(h), nil
+}
@@ -1,107 +1,1379 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"github.com/plop-systems/shallpass/internal/sshargs"
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+	"golang.org/x/time/rate"
 )
 
+// usage prints the command line synopsis. Our own options come first; every
+// argument after them (or after "--") is handed to ssh untouched.
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: shallpass [options] [--] ssh-arguments...")
+	flag.PrintDefaults()
+}
+
 // main is the entry point of the SSH wrapper program.
 // This version is designed for non-interactive use, such as in provisioning scripts.
 func main() {
-	// This wrapper expects the password to be piped via standard input.
-	// It reads all of stdin until EOF to get the password.
-	passwordBytes, err := io.ReadAll(os.Stdin)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "shallpass: failed to read password from stdin:", err)
-		os.Exit(1)
+	// A bug must not print a secret on its way out. The Runner's output
+	// scanners, which run in goroutines of their own, do the same.
+	defer func() {
+		if recover() != nil {
+			shallpass.PanicReport(os.Stderr)
+			os.Exit(shallpass.ExitPanic)
+		}
+	}()
+	// Secrets end up in our memory however carefully they are handled, so
+	// keep it out of core dumps and away from other processes.
+	shallpass.Harden()
+	// When ssh runs us as its SSH_ASKPASS program, all we do is fetch the
+	// answer from the shallpass that started ssh.
+	if code, ok := shallpass.AskpassHelper(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
+	backend := flag.String("backend", "ssh", "how to connect: ssh runs the OpenSSH client, native uses the one built into shallpass, for hosts without OpenSSH")
+	sshBin := flag.String("ssh-bin", "ssh", "the ssh client to run, or a comma-separated list of candidates (e.g. ssh,/usr/local/bin/ssh,dbclient) of which the first that is found is run")
+	chdir := flag.String("chdir", "", "run ssh in this directory, so relative paths such as -i keyfile resolve against it")
+	promptSource := flag.String("prompt-source", "both", "where to look for the password prompt: stdout, stderr or both")
+	stderrOnly := flag.Bool("prompt-on-stderr-only", false, "look for the password prompt on stderr only, and give ssh our stdout as it is, so bulk output is not copied through shallpass (-prompt-source stderr, with a warning if something still needs to see stdout)")
+	allowPassthrough := flag.Bool("allow-passthrough", false, "if the pipes used for prompt detection can't be created, run ssh without it instead of failing")
+	promptFile := flag.String("prompt-regexp-file", "", "also treat lines matching any regular expression in this file (one per line, # for comments) as the password prompt")
+	var promptFlags patternsFlag
+	flag.Var(&promptFlags, "prompt", "also treat lines matching this regular expression as the password prompt; repeatable")
+	lang := flag.String("lang", "en", "comma-separated prompt languages to recognise ("+shallpass.LangNames()+")")
+	noPassthrough := flag.Bool("no-exit-code-passthrough", false, "exit 0 on success and 1 on any failure instead of passing ssh's status through")
+	sshpassCodes := flag.Bool("sshpass-exit-codes", false, "exit as sshpass does when ssh itself fails: 5 when the server refuses the login, 6 for an unknown host key, 7 for a changed one, instead of ssh's 255; and 1 for a bad command line, 2 for conflicting password sources")
+	connectionExit := flag.Int("connection-exit-code", shallpass.ExitFailure, "with -no-exit-code-passthrough, the code to use when ssh itself fails (status 255)")
+	username := flag.String("username", "", "send this to a Username:/login: prompt before the password (network devices)")
+	pressAnyKey := flag.Bool("press-any-key", false, "answer \"Press any key\" banners with a newline")
+	port := flag.String("port", "", "connect to this port (ssh -p), unless the ssh arguments set one")
+	identity := flag.String("identity", "", "use this identity file (ssh -i), unless the ssh arguments set one")
+	newPassword := flag.String("new-password", "", "if the password has expired, change it to the secret from this source (env:NAME, file:PATH, fd:N, pass:TEXT or keychain:SERVICE/ACCOUNT)")
+	mfaChoice := flag.String("mfa-choice", "", "answer a push-based second factor's \"Passcode or option (1-3):\" menu (Duo) with this option, e.g. 1 for a push")
+	mfaTimeout := flag.Duration("mfa-timeout", 0, "with -mfa-choice, give up (exit 21) if the second factor is not approved this long after the option was sent, e.g. 90s; 0 waits as long as the server does")
+	sudoSource := flag.String("sudo-password", "", "answer sudo's password prompt in the remote command with the secret from this source (env:NAME, file:PATH, fd:N, pass:TEXT or keychain:SERVICE/ACCOUNT); a prompt counts as sudo's once the login is over")
+	sudoLogin := flag.Bool("sudo", false, "answer sudo's password prompt in the remote command with the password the login took; use -sudo-password if it is a different one")
+	passphraseSource := flag.String("passphrase", "", "answer ssh's \"Enter passphrase for key ...\" prompt with the secret from this source (env:NAME, file:PATH, fd:N, pass:TEXT or keychain:SERVICE/ACCOUNT); with -forbid-prompt no password is used at all")
+	pinSource := flag.String("pin", "", "answer a smartcard's \"Enter PIN for ...\" prompt with the secret from this source (env:NAME, file:PATH, fd:N, pass:TEXT or keychain:SERVICE/ACCOUNT)")
+	stripANSIFlag := flag.Bool("strip-ansi-before-match", true, "remove terminal escape sequences (colours) from output before matching prompts; output itself is not changed")
+	prefix := flag.String("prefix", "", "put this in front of every line of ssh's output, writing whole lines only")
+	multiplexed := flag.Bool("multiplexed", false, "the session reuses an ssh control master, so only read the password from stdin if a prompt appears (implied by -S, -M, -o ControlPath/ControlMaster)")
+	persist := flag.Duration("persist", 0, "keep the connection open as an ssh control master for this long (e.g. 10m) after the last session, and reuse it for later sessions to the same destination, so the password is sent once (implies -multiplexed)")
+	waitForward := flag.String("wait-forward", "", "once the -L and -D forwards accept connections, say so: file:PATH creates PATH while they are up, fd:N writes a ready line, systemd sends sd_notify READY=1; implies -keepalive 15 and ExitOnForwardFailure=yes")
+	forwardRetries := flag.Int("forward-retries", 0, "with -wait-forward, when the forwards that were up drop (ssh exits 255), connect and log in again, up to N times in a row without them coming back; negative retries for ever")
+	closePersisted := flag.Bool("close", false, "end the -persist connection to the destination (ssh -O exit) instead of running a session")
+	requirePrompt := flag.Bool("require-prompt", false, "treat a successful session that never asked for the password as a failure (exit 9)")
+	// ssh.exe reads passwords from the console rather than its stdin, so
+	// on Windows SSH_ASKPASS is the way to hand them over unless -tty
+	// gives it a pseudoconsole.
+	askpass := flag.Bool("askpass", runtime.GOOS == "windows", "have ssh ask shallpass for the password through SSH_ASKPASS instead of scraping its output (OpenSSH 8.4+; the default on Windows)")
+	timestamps := flag.Bool("timestamps", false, "start every line of ssh's output with the time it was written")
+	binary := flag.Bool("binary", false, "keep ssh's stdout byte-for-byte: no -prefix/-timestamps on it, and stop scanning it once the password is sent")
+	maxPassword := flag.Int("max-password-bytes", 1024, "refuse passwords longer than this, which usually means the wrong thing was piped in; 0 disables the check")
+	requirePassword := flag.Bool("require-password", false, "refuse to run if the password is empty, which usually means the variable feeding it was unset (exit 2)")
+	promptTimeout := flag.Duration("prompt-timeout", 0, "give up (exit 15) if no password prompt appears this long after ssh starts, e.g. 30s; 0 waits forever")
+	bannerTimeout := flag.Duration("connect-banner-timeout", 0, "give up (exit 255, like an ssh connection error) if ssh writes nothing at all this long after it starts, e.g. 10s; 0 waits forever")
+	tool := flag.String("cmd", toolFromName(os.Args[0]), "the program to run: ssh, or scp, sftp or rsync, which get the ssh options shallpass adds in their own syntax and imply -tty; a link named shallscp, shallsftp or shallrsync picks the one in its name")
+	execFlag := flag.Bool("exec", false, "run the program after -- instead of ssh, with its arguments as they are, and answer its password prompts, e.g. shallpass -exec -- mysql -u root -p (implies -tty)")
+	tty := flag.Bool("tty", false, "run ssh on a pseudo-terminal of our own, so the prompts ssh writes to its terminal rather than stderr are seen and answered; all its output then comes out on stdout (a pseudoconsole on Windows)")
+	mergeStreams := flag.Bool("merge-streams", false, "merge ssh's stderr into stdout, as 2>&1 would, and scan the merged stream for prompts")
+	wake := flag.Duration("wake", 0, "send a newline this long after ssh starts, e.g. 2s, for consoles that only prompt after a keypress; not sent once anything has been answered")
+	wakeRepeat := flag.Int("wake-repeat", 0, "with -wake, send the newline up to N more times, -wake apart, while nothing has been answered")
+	retryWithoutPTY := flag.Bool("retry-without-pty", false, "if the server refuses the terminal asked for with -t and the session fails, run it once more with -T (only when stdin carries the password)")
+	reconnect := flag.Int("reconnect-on-timeout", 0, "after a -prompt-timeout or -connect-timeout, kill ssh and start it again up to N times")
+	retryBackoff := flag.Duration("retry-backoff", 0, "wait this long before connecting again for -max-tries or -reconnect-on-timeout, e.g. 2s, twice as long each time after that, up to a minute")
+	maxTries := flag.Int("max-tries", 1, "while the server refuses the password (exit 5), connect again up to N times in all, each time with the next line of stdin as the password")
+	audit := flag.Bool("audit", false, "print one summary line per session to stderr: host, whether a prompt was matched and answered, and the exit code")
+	approvalURL := flag.String("approval-url", "", "when the prompt appears, POST host, prompt and requester as JSON to this URL and send the secret it returns only if it approves (exit 20 if denied)")
+	approvalTimeout := flag.Duration("approval-timeout", 2*time.Minute, "with -approval-url, how long to wait for a decision before giving up (exit 10)")
+	passwordSocket := flag.String("password-socket", "", "when the prompt appears, read the password from the Unix socket at this path (a local secret broker) instead of stdin")
+	forbidPrompt := flag.Bool("forbid-prompt", false, "the host must accept a key: fail (exit 16) if it asks for a password; no password is read")
+	historyFile := flag.String("prompt-history", "", "remember in this JSON file which prompt each host showed on a successful login, and look for it first next time")
+	idleTimeout := flag.Duration("idle-timeout", 0, "give up (exit 22) once ssh has written nothing, and been sent nothing, for this long after the session got going, e.g. 10m, to catch remote commands that hang; 0 waits forever")
+	scanLimit := flag.Int("scan-limit", 0, "stop looking for the password prompt, and only pass output through, once ssh has written this many bytes without asking; 0 means no limit")
+	typeDelay := flag.Duration("type-delay", 0, "type passwords and -on responses one byte at a time this far apart, e.g. 50ms, for serial consoles that drop fast input")
+	promptGrace := flag.Duration("prompt-grace", 0, "ignore prompts for this long after ssh starts, e.g. 500ms, so a stale prompt replayed on connect is not answered")
+	var acceptHostKey hostKeyFlag
+	flag.Var(&acceptHostKey, "accept-hostkey", "answer ssh's \"continue connecting (yes/no)?\" about an unknown host key with yes; =no says no, =ask leaves the answer to whoever is at the terminal, and =fingerprint=SHA256:...[,...] says yes to those keys only (repeatable)")
+	rejectHostKey := flag.Bool("reject-hostkey", false, "answer ssh's unknown host key question with no, so the connection fails")
+	warnPasswordAuth := flag.Bool("warn-on-password-auth", false, "warn on stderr when a session only got in because a password was sent, to find hosts still to move to keys")
+	passwordHostsFile := flag.String("password-hosts-file", "", "add every host a password was sent to in a successful session to this file, once per host")
+	fingerprintFile := flag.String("fingerprint-file", "", "append \"host type fingerprint\" to this file for every unknown host key ssh shows, so what -accept-hostkey trusted can be pinned later")
+	maxInjections := flag.Int("max-injections", 0, "never send a secret more than N times in a session; the next prompt ends it (exit 17). 0 means no cap")
+	responseEncoding := flag.String("response-encoding", "raw", "how passwords are written: raw, escape (Go escapes such as \\r and \\x1b are decoded) or hex")
+	connectTimeout := flag.Int("connect-timeout", 0, "pass -o ConnectTimeout=N to ssh (unless the ssh arguments set it), and give up (exit 25) after about N seconds without any output from ssh")
+	timeout := flag.Duration("timeout", 0, "give up (exit 26) if the whole run, reconnects included, takes longer than this, e.g. 5m; 0 waits forever")
+	stdinLine := flag.Bool("stdin-line", false, "stdin carries the password on its first line, and the remote command's input after it, e.g. for tar c . | shallpass -stdin-line host 'tar x'")
+	stdinDelim := flag.String("stdin-delim", "", "stdin carries the password up to a line that is exactly this (e.g. ---END-PASSWORD---), and the remote command's input after it")
+	batchFile := flag.String("batch", "", "run one session per line of this file, each line the ssh arguments for it (host and command), one after the other with the same password, and print a summary of the exit codes")
+	hostsFile := flag.String("hosts", "", "run the command given after the ssh options on every host in this file, one per line and optionally followed by that host's password source, and print a summary of the exit codes")
+	startRate := flag.Float64("rate", 0, "with -batch or -hosts, start at most this many sessions per second, e.g. 2, or 0.5 for one every two seconds, however many -parallel lets run; 0 means no limit")
+	maxConcurrentAuth := flag.Int("max-concurrent-auth", 0, "with -parallel, let at most N sessions log in at the same time, each until the server has replied to its password; 0 means as many as run")
+	parallel := flag.Int("parallel", 1, "with -batch or -hosts, run up to N sessions at a time; their output lines are prefixed with the host unless -prefix is given")
+	recordFile := flag.String("record", "", "record the whole session, what is typed into ssh and what it writes, with timestamps and the secrets and -redact-pattern matches replaced by ***, in this file")
+	recordFormat := flag.String("record-format", "text", "the format of -record: text, a timestamped line per line of each stream, or asciicast, a v2 cast for asciinema to play back")
+	jsonDest := flag.String("json", "", "once each session is over, write a JSON record of it (host, command, exit code and reason, duration, bytes passed through, auth attempts and the prompts matched) as one line to this file, or to fd:N")
+	summaryFile := flag.String("summary-file", "", "with -batch or -hosts, write every session's host, exit code, reason and duration to this file as JSON")
+	forwardAgent := flag.Bool("forward-agent", false, "pass -A to ssh (unless the ssh arguments set -A, -a or ForwardAgent) to forward the key agent")
+	forwardX11 := flag.Bool("forward-x11", false, "pass -X to ssh (unless the ssh arguments set -X, -Y, -x or ForwardX11) to forward X11")
+	forwardX11Trusted := flag.Bool("forward-x11-trusted", false, "like -forward-x11, but pass -Y for trusted X11 forwarding")
+	forcePasswordAuth := flag.Bool("force-password-auth", false, "pass -o PasswordAuthentication=yes -o PubkeyAuthentication=no -o PreferredAuthentications=password,keyboard-interactive to ssh (each unless the ssh arguments set it), so ssh really asks for the password")
+	keepalive := flag.Int("keepalive", 0, "pass -o ServerAliveInterval=N -o ServerAliveCountMax=3 to ssh (each unless the ssh arguments set it), so idle sessions and port forwards are not dropped")
+	passwordSourceFlag := flag.String("password", "", "read the password from this source (env:NAME, file:PATH, fd:N, pass:TEXT or keychain:SERVICE/ACCOUNT) instead of stdin, which is then passed on to the remote command")
+	sshpassEnv := flag.Bool("e", false, "the password is in $SHALLPASS or, as in sshpass, $SSHPASS if that is unset or empty (-password env:SHALLPASS or env:SSHPASS)")
+	sshpassFile := flag.String("f", "", "as in sshpass: the password is the first line of this file (-password file:PATH)")
+	sshpassFD := flag.String("d", "", "as in sshpass: the password is the first line read from this file descriptor (-password fd:N)")
+	sourceOrder := flag.String("source-order", "", "comma-separated places to take the password from, first non-empty wins: stdin, env ($SHALLPASS, else $SSHPASS), socket (-password-socket)")
+	hostConfig := flag.String("host-config", "", "take defaults for options the command line and -profile leave out from the sections of this YAML file whose host patterns match the destination, instead of ~/.config/shallpass/config.yaml; none reads no file")
+	profile := flag.String("profile", "", "take defaults for these options, and extra ssh arguments, from the named profile in ~/.config/shallpass/profiles.toml")
+	metricsFile := flag.String("metrics-file", "", "after the session, update per-host metrics in this file in Prometheus text format (for node_exporter's textfile collector)")
+	otlpTraces := flag.String("otlp-traces", "", "after each session, send a trace of it (connect, auth and exec spans) to this OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces")
+	failureMarkerFlag := flag.String("failure-marker", "", "fail the session (exit 24) if ssh exits 0 but a line of its output matched this regular expression, e.g. 'Authentication failed', for gateways that swallow the real status")
+	requirePreambleFlag := flag.String("require-preamble", "", "only answer a password prompt once a line matching this regular expression has been seen, e.g. 'Authentication required'")
+	echoCheck := flag.Bool("echo-off-check", false, "warn if the server echoes a password back, which means the prompt did not turn echo off")
+	failOnEcho := flag.Bool("fail-on-echo", false, "like -echo-off-check, but end the session (exit 18) instead of warning")
+	dumpConfigFlag := flag.Bool("dump-config", false, "print the settings a session would run with, after the profile and flags are merged, as JSON (secrets redacted), and exit without connecting")
+	logLevel := flag.String("log-level", "", "log what each session does to stderr (or -log-file) at this level: debug (every line scanned), info, warn or error; secrets are always replaced by ***")
+	debugLog := flag.Bool("v", false, "-log-level debug")
+	logFile := flag.String("log-file", "", "append the -log-level log to this file instead of stderr")
+	logFormat := flag.String("log-format", "text", "the -log-level log format: text (key=value) or json")
+	verbose := flag.Bool("verbose", false, "report on stderr which prompt rule answered each prompt, and which of its patterns matched")
+	listMatchersFlag := flag.Bool("list-matchers", false, "print every prompt rule and -on trigger in the order they are tried, with what each sends (passwords redacted), and exit without connecting")
+	markerFile := flag.String("marker-file", "", "after a successful run (exit 0), write a marker to this file")
+	onSuccess := flag.String("on-success", "", "after a session that exits 0, run this command with sh; $SHALLPASS_EXIT_CODE, $SHALLPASS_REASON and $SHALLPASS_HOST describe the outcome")
+	onFailure := flag.String("on-failure", "", "after a session that fails, run this command with sh, like -on-success; it does not change the exit code")
+	skipIfMarked := flag.Bool("skip-if-marked", false, "if the -marker-file exists, exit 0 straight away without reading a password or connecting")
+	var on onFlag
+	flag.Var(&on, "on", "for the whole session, answer output matching PATTERN with response: 'PATTERN:response', 'PATTERN:response:N' to fire at most N times, and a last :lf, :cr, :crlf or :none for the line ending; repeatable")
+	scriptFile := flag.String("script", "", "hold the expect/send dialog in this YAML file (a list of expect/send steps) with the session, one step after the other, each waiting for its output; exit 27 if a step times out or the session ends first")
+	var passwordFor passwordForFlag
+	flag.Var(&passwordFor, "password-for", "answer prompts matching PATTERN with the secret from source (env:NAME, file:PATH, fd:N, pass:TEXT, keychain:SERVICE/ACCOUNT, or totp:KEY for the current one-time code); repeatable, first match wins, each answers once")
+	passwordCapture := flag.String("password-capture", "", "a prompt pattern with a named group, e.g. \"(?P<host>[^@ ]+)'s password:\"; what the group captures picks the secret from -password-map")
+	var passwordMap passwordMapFlag
+	flag.Var(&passwordMap, "password-map", "with -password-capture, answer prompts whose group captured VALUE with the secret from source: 'VALUE=source', or '*=source' for any other value; repeatable")
+	var hopPasswords passwordMapFlag
+	flag.Var(&hopPasswords, "hop-password", "answer ssh's password prompt for HOST, a hop of a -J chain or the destination, with the secret from source: 'HOST=source', or '*=source' for any other host; repeatable")
+	remapExit := remapFlag{}
+	flag.Var(remapExit, "remap-exit", "exit with TO where the session would have exited with FROM: 'FROM=TO', e.g. 255=2; applied last, after -no-exit-code-passthrough; repeatable")
+	refuseArgvSecrets := flag.Bool("refuse-argv-secrets", false, "exit 2 instead of warning when a pass: source puts a secret on the command line, where other users can read it")
+	var redactPatterns patternsFlag
+	flag.Var(&redactPatterns, "redact-pattern", "replace whatever matches REGEX with *** in what ssh writes to stdout and stderr; output then appears a line at a time; repeatable")
+	flag.Usage = usage
+	// A bad flag is a usage error like any other, in sshpass's numbering
+	// too if -sshpass-exit-codes came before it.
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	sshpassExit := func(code int) int {
+		if *sshpassCodes {
+			return shallpass.SSHPassExit(code)
+		}
+		return code
+	}
+	exit := func(code int) { os.Exit(sshpassExit(code)) }
+	if err := flag.CommandLine.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		exit(shallpass.ExitUsage)
+	}
+	if *execFlag {
+		if *tool != "ssh" {
+			fmt.Fprintln(os.Stderr, "shallpass: -exec runs a program of its own, so it can't be used with -cmd")
+			exit(shallpass.ExitUsage)
+		}
+		*tool = "exec"
+	}
+	// These only show what a session would do: no secret is read.
+	inspectOnly := *listMatchersFlag || *dumpConfigFlag
+	if argvSecret(os.Args[1 : len(os.Args)-flag.NArg()]) {
+		if *refuseArgvSecrets {
+			fmt.Fprintln(os.Stderr, "shallpass: a pass: source puts the secret in the process list (-refuse-argv-secrets); use env:, file: or fd: instead")
+			exit(shallpass.ExitUsage)
+		}
+		fmt.Fprintln(os.Stderr, "shallpass: warning: a pass: source puts the secret in the process list, where other users can read it; use env:, file: or fd: instead")
+	}
+
+	// A profile only fills in what the command line left out.
+	var profileArgs []string
+	if *profile != "" {
+		path, err := profilesPath()
+		var settings []profileSetting
+		if err == nil {
+			settings, err = loadProfile(path, *profile)
+		}
+		if err == nil {
+			profileArgs, err = applyProfile(settings)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -profile:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	// Then the host config fills in what is still left, for the one host
+	// on the command line.
+	if dest := toolDestination(*tool, flag.Args()); dest != "" && *hostConfig != "none" {
+		path, err := *hostConfig, error(nil)
+		if path == "" {
+			path, err = hostConfigPath()
+		}
+		var tables []profileTable
+		if err == nil {
+			tables, err = loadHostConfig(path, dest, *hostConfig != "")
+		}
+		var hostArgs []string
+		if err == nil {
+			hostArgs, err = applyHostConfig(tables)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -host-config:", err)
+			exit(shallpass.ExitUsage)
+		}
+		profileArgs = append(profileArgs, hostArgs...)
 	}
-	password := string(passwordBytes)
 
-	// Prepare the ssh command, passing through all command-line arguments.
-	// There is no argument parsing or handling, as requested.
-	cmd := exec.Command("ssh", os.Args[1:]...)
+	scanStdout, scanStderr, ok := parsePromptSource(*promptSource)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -prompt-source %q (want stdout, stderr or both)\n", *promptSource)
+		exit(shallpass.ExitUsage)
+	}
+	if *stderrOnly {
+		// "both" is the default, so only an explicit stdout conflicts.
+		if *promptSource == "stdout" || *mergeStreams {
+			fmt.Fprintln(os.Stderr, "shallpass: -prompt-on-stderr-only can't be combined with -prompt-source stdout or -merge-streams, which scan stdout")
+			exit(shallpass.ExitUsage)
+		}
+		scanStdout = false
+		// Any of these wraps stdout, and ssh's output is copied anyway.
+		var wrappers []string
+		if (*prefix != "" || *timestamps) && !*binary {
+			wrappers = append(wrappers, "-prefix/-timestamps")
+		}
+		if len(redactPatterns) > 0 && !*binary {
+			wrappers = append(wrappers, "-redact-pattern")
+		}
+		if *idleTimeout > 0 {
+			wrappers = append(wrappers, "-idle-timeout")
+		}
+		if len(wrappers) > 0 {
+			fmt.Fprintf(os.Stderr, "shallpass: warning: with %s, stdout is still copied through shallpass\n", strings.Join(wrappers, ", "))
+		}
+	}
 
-	// We need to control ssh's stdin to send the password, so we get a pipe.
-	stdinPipe, err := cmd.StdinPipe()
+	prompts, err := shallpass.PromptsForLangs(*lang)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "shallpass: failed to create stdin pipe:", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "shallpass: invalid -lang:", err)
+		exit(shallpass.ExitUsage)
 	}
 
-	// Create a pipe. We will use this to read ssh's stdout in our goroutine
-	// while it also goes to the user's terminal.
-	stdoutReader, stdoutWriter, err := os.Pipe()
+	if *debugLog && *logLevel == "" {
+		*logLevel = "debug"
+	}
+	logger, err := openLogger(*logLevel, *logFile, *logFormat)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "shallpass: failed to create stdout pipe:", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "shallpass: invalid -log-level:", err)
+		exit(shallpass.ExitUsage)
+	}
+
+	var failureMarker *regexp.Regexp
+	if *failureMarkerFlag != "" {
+		failureMarker, err = regexp.Compile(*failureMarkerFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -failure-marker:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+
+	var script []*shallpass.Step
+	if *scriptFile != "" {
+		script, err = loadScript(*scriptFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -script:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+
+	var promptPatterns []*regexp.Regexp
+	if *promptFile != "" {
+		promptPatterns, err = shallpass.LoadPromptPatterns(*promptFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -prompt-regexp-file:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	promptPatterns = append(promptPatterns, promptFlags...)
+
+	if acceptHostKey.answer != "" && *rejectHostKey {
+		fmt.Fprintln(os.Stderr, "shallpass: -accept-hostkey and -reject-hostkey are mutually exclusive")
+		exit(shallpass.ExitUsage)
+	}
+	if *skipIfMarked && *markerFile == "" {
+		fmt.Fprintln(os.Stderr, "shallpass: -skip-if-marked needs -marker-file")
+		exit(shallpass.ExitUsage)
+	}
+	if !isWrappedTool(*tool) && *tool != "exec" {
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -cmd %q (want %s)\n", *tool, strings.Join(wrappedTools, ", "))
+		exit(shallpass.ExitUsage)
+	}
+	if *backend != "ssh" && *backend != "native" {
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -backend %q (want ssh or native)\n", *backend)
+		exit(shallpass.ExitUsage)
+	}
+	if *backend == "native" && *tool != "ssh" {
+		fmt.Fprintln(os.Stderr, "shallpass: -cmd and -exec can't be used with -backend native, which only runs remote commands")
+		exit(shallpass.ExitUsage)
+	}
+	if *tool == "exec" && flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "shallpass: -exec needs the program to run after --")
+		exit(shallpass.ExitUsage)
+	}
+	switch {
+	case *persist < 0:
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -persist %v: want a positive duration\n", *persist)
+		exit(shallpass.ExitUsage)
+	case (*persist > 0 || *closePersisted) && *backend == "native":
+		fmt.Fprintln(os.Stderr, "shallpass: -persist and -close use OpenSSH's control master, which -backend native does not have")
+		exit(shallpass.ExitUsage)
+	case *closePersisted && *tool != "ssh":
+		fmt.Fprintln(os.Stderr, "shallpass: -close takes ssh arguments, not -cmd or -exec ones")
+		exit(shallpass.ExitUsage)
+	case *waitForward != "" && *tool != "ssh":
+		fmt.Fprintln(os.Stderr, "shallpass: -wait-forward watches ssh's own -L and -D forwards, so it can't be used with -cmd or -exec")
+		exit(shallpass.ExitUsage)
+	case *retryBackoff < 0:
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -retry-backoff %v: want a positive duration\n", *retryBackoff)
+		exit(shallpass.ExitUsage)
+	case *startRate < 0:
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -rate %v: want a positive number of sessions per second, or 0 for no limit\n", *startRate)
+		exit(shallpass.ExitUsage)
+	case *maxConcurrentAuth < 0:
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -max-concurrent-auth %d: want at least 1, or 0 for no limit\n", *maxConcurrentAuth)
+		exit(shallpass.ExitUsage)
+	case *forwardRetries != 0 && *waitForward == "":
+		fmt.Fprintln(os.Stderr, "shallpass: -forward-retries needs -wait-forward, which tells when the forwards are up")
+		exit(shallpass.ExitUsage)
+	}
+	var notifier readyNotifier
+	if *waitForward != "" {
+		notifier, err = openNotifier(*waitForward)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -wait-forward:", err)
+			exit(shallpass.ExitUsage)
+		}
+		if *keepalive == 0 {
+			*keepalive = forwardKeepalive
+		}
+	}
+	// The tools run ssh with pipes of their own, so its prompts only ever
+	// go to its terminal. Programs run with -exec mostly read passwords
+	// from their terminal too.
+	if *tool != "ssh" {
+		*tty = true
+	}
+	if *tty && (*binary || *stderrOnly) {
+		fmt.Fprintln(os.Stderr, "shallpass: -tty (implied by -cmd scp, sftp and rsync) can't be combined with -binary or -prompt-on-stderr-only: a terminal has one output stream, and it is not byte-for-byte")
+		exit(shallpass.ExitUsage)
+	}
+	if *binary && *mergeStreams {
+		fmt.Fprintln(os.Stderr, "shallpass: -binary and -merge-streams are mutually exclusive: merged output is not byte-for-byte")
+		exit(shallpass.ExitUsage)
+	}
+
+	if err := shallpass.CheckEncoding(*responseEncoding); err != nil {
+		fmt.Fprintln(os.Stderr, "shallpass: invalid -response-encoding:", err)
+		exit(shallpass.ExitUsage)
+	}
+
+	// With several candidates the first one there is run. A single one is
+	// left to the Runner, which explains what is wrong with it.
+	if strings.Contains(*sshBin, ",") && !*listMatchersFlag && *backend == "ssh" {
+		path, err := pickSSHBin(strings.Split(*sshBin, ","))
+		switch {
+		case err == nil:
+			*sshBin = path
+		case !*dumpConfigFlag:
+			fmt.Fprintln(os.Stderr, "shallpass:", err)
+			os.Exit(shallpass.ExitNotFound)
+		}
+	}
+
+	// Check the working directory up front so a typo is reported as such
+	// rather than as a confusing failure to start ssh.
+	if *chdir != "" {
+		if err := checkDir(*chdir); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -chdir:", err)
+			exit(shallpass.ExitUsage)
+		}
 	}
 
-	// Create a MultiWriter. This sends ssh's stdout to two places:
-	// 1. os.Stdout: The user's terminal, for direct feedback.
-	// 2. stdoutWriter: The write-end of our pipe, so our goroutine can scan it.
-	multiWriter := io.MultiWriter(os.Stdout, stdoutWriter)
-	cmd.Stdout = multiWriter
+	var changeTo string
+	if *newPassword != "" {
+		changeTo, err = shallpass.ReadSecret(*newPassword)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -new-password:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	var sudo string
+	if *sudoLogin && *sudoSource != "" {
+		fmt.Fprintln(os.Stderr, "shallpass: -sudo answers sudo with the login password and -sudo-password with another; give only one")
+		exit(shallpass.ExitConflictingSources)
+	}
+	if *sudoSource != "" {
+		sudo, err = shallpass.ReadSecret(*sudoSource)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -sudo-password:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	var pin string
+	if *pinSource != "" {
+		pin, err = shallpass.ReadSecret(*pinSource)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -pin:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	var passphrase string
+	if *passphraseSource != "" {
+		passphrase, err = shallpass.ReadSecret(*passphraseSource)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -passphrase:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+
+	// The control master comes after the profile and host config, whose
+	// own ControlPath, if any, wins.
+	if *persist > 0 || *closePersisted {
+		opts, err := persistOptions(*persist)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: -persist:", err)
+			exit(shallpass.ExitUsage)
+		}
+		profileArgs = append(profileArgs, opts...)
+	}
+	// A tunnel that is missing a forward is not up, so ssh had better
+	// exit than carry on without it.
+	if notifier != nil {
+		profileArgs = append(profileArgs, "-o", "ExitOnForwardFailure=yes")
+	}
+
+	// With -batch the ssh arguments given here are options shared by
+	// every line, and each line brings its own host and command. The
+	// tools get the ssh options we would add in their own syntax.
+	argsFor := func(user []string) []string {
+		if *tool == "ssh" {
+			return sshargs.Build(sshargs.Insert(user, profileArgs), *port, *identity, *connectTimeout, *keepalive, *forcePasswordAuth, *forwardAgent, *forwardX11, *forwardX11Trusted)
+		}
+		opts := sshargs.Build(profileArgs, *port, *identity, *connectTimeout, *keepalive, *forcePasswordAuth, *forwardAgent, *forwardX11, *forwardX11Trusted)
+		args, err := toolArgs(*tool, *sshBin, opts, user)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass:", err)
+			exit(shallpass.ExitUsage)
+		}
+		if len(opts) > 0 && *tool == "rsync" && rsyncSetsShell(user) {
+			fmt.Fprintln(os.Stderr, "shallpass: warning: the rsync arguments choose their own -e, so the ssh options shallpass would add are left out")
+		}
+		return args
+	}
+	args := argsFor(flag.Args())
+	host := toolDestination(*tool, args)
+	if *closePersisted {
+		if host == "" || *batchFile != "" || *hostsFile != "" {
+			fmt.Fprintln(os.Stderr, "shallpass: -close needs the destination on the command line, with the ssh options it was reached with")
+			exit(shallpass.ExitUsage)
+		}
+		os.Exit(closeMaster(*sshBin, args))
+	}
+	// With -hosts the ssh arguments are the options and the command, and
+	// each host goes in between.
+	var batch []batchLine
+	batchName, shared, command := "", flag.Args(), []string(nil)
+	switch {
+	case notifier != nil && (*batchFile != "" || *hostsFile != ""):
+		fmt.Fprintln(os.Stderr, "shallpass: -wait-forward watches one tunnel, so it can't be used with -batch or -hosts")
+		exit(shallpass.ExitUsage)
+	case notifier != nil && len(sshargs.LocalListeners(args)) == 0:
+		fmt.Fprintln(os.Stderr, "shallpass: -wait-forward needs a -L or -D forward to a fixed local port or socket, which it can try to connect to")
+		exit(shallpass.ExitUsage)
+	case *tool == "exec" && (*batchFile != "" || *hostsFile != ""):
+		fmt.Fprintln(os.Stderr, "shallpass: -exec runs one program, so it can't be used with -batch or -hosts")
+		exit(shallpass.ExitUsage)
+	case *batchFile != "" && *hostsFile != "":
+		fmt.Fprintln(os.Stderr, "shallpass: -batch and -hosts each list the sessions to run; give only one")
+		exit(shallpass.ExitUsage)
+	case *batchFile != "":
+		if host != "" {
+			fmt.Fprintf(os.Stderr, "shallpass: with -batch the ssh arguments can only be options, not a host (%s)\n", host)
+			exit(shallpass.ExitUsage)
+		}
+		batchName = "batch"
+		batch, err = readBatch(*batchFile)
+	case *hostsFile != "":
+		if *tool != "ssh" {
+			fmt.Fprintf(os.Stderr, "shallpass: -hosts runs a command with ssh, not %s; use -batch\n", *tool)
+			exit(shallpass.ExitUsage)
+		}
+		_, rest := sshargs.Split(shared)
+		shared, command = shared[:len(shared)-len(rest)], rest
+		batchName, host = "hosts", ""
+		batch, err = readHosts(*hostsFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -%s: %v\n", batchName, err)
+		exit(shallpass.ExitUsage)
+	}
+	hostSecrets := false
+	for _, line := range batch {
+		hostSecrets = hostSecrets || line.source != ""
+	}
+	switch {
+	case batchName == "":
+		if *parallel != 1 || *summaryFile != "" {
+			fmt.Fprintln(os.Stderr, "shallpass: -parallel and -summary-file are for -batch and -hosts")
+			exit(shallpass.ExitUsage)
+		}
+	case *historyFile != "" || *markerFile != "" || *approvalURL != "" || *recordFile != "":
+		fmt.Fprintf(os.Stderr, "shallpass: -prompt-history, -marker-file, -approval-url and -record are for one host and can't be used with -%s\n", batchName)
+		exit(shallpass.ExitUsage)
+	case *parallel < 1:
+		fmt.Fprintf(os.Stderr, "shallpass: invalid -parallel %d: want at least 1\n", *parallel)
+		exit(shallpass.ExitUsage)
+	case *parallel > 1 && (*tty || *multiplexed || *tool != "exec" && sshargs.IsMultiplexed(args)):
+		// These share the terminal or stdin between sessions.
+		fmt.Fprintln(os.Stderr, "shallpass: -tty and -multiplexed run one session at a time and can't be used with -parallel")
+		exit(shallpass.ExitUsage)
+	case hostSecrets && (len(passwordFor) > 0 || len(passwordMap) > 0 || len(hopPasswords) > 0 || *forbidPrompt):
+		fmt.Fprintln(os.Stderr, "shallpass: a password source in -hosts replaces the password, so it can't be used with -password-for, -password-map, -hop-password or -forbid-prompt")
+		exit(shallpass.ExitConflictingSources)
+	}
+	allHostSecrets := hostSecrets
+	for i, line := range batch {
+		if line.source == "" {
+			allHostSecrets = false
+			continue
+		}
+		if !inspectOnly {
+			batch[i].secret, err = shallpass.ReadSecret(line.source)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "shallpass: failed to read the password for %s (-hosts line %d): %v\n", line.args[0], line.n, err)
+			os.Exit(shallpass.ExitReadPassword)
+		}
+		if err := shallpass.CheckSecretSize(batch[i].secret, *maxPassword); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	if *forwardAgent && host != "" && sshargs.Sets(args, 'A', "") && !sshargs.Sets(args, 'a', "") {
+		fmt.Fprintf(os.Stderr, "shallpass: note: -forward-agent lets anyone with root on %s use your keys for as long as the session lasts\n", host)
+	}
 
-	// Standard error from the ssh process can be passed through directly.
-	cmd.Stderr = os.Stderr
+	// A step that already succeeded is not run again.
+	if *skipIfMarked {
+		marked, err := isMarked(*markerFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -marker-file:", err)
+			exit(shallpass.ExitUsage)
+		}
+		if marked {
+			fmt.Fprintf(os.Stderr, "shallpass: %s exists, skipping (-skip-if-marked)\n", *markerFile)
+			os.Exit(0)
+		}
+	}
 
-	// Start the ssh command in the background.
-	if err := cmd.Start(); err != nil {
-		fmt.Fprintln(os.Stderr, "shallpass: failed to start ssh command:", err)
-		os.Exit(1)
+	// With -password-for and -password-map every secret comes from its own
+	// source, and with -password-socket the broker is only asked once the
+	// prompt appears. -source-order resolves the password up front from the
+	// first of its sources that has one. Otherwise the password is expected
+	// to be piped via standard input, and we read all of stdin until EOF to
+	// get it.
+	//
+	// A session that reuses an ssh control master is normally already
+	// authenticated and won't prompt at all, so there we only read the
+	// first line of stdin if a prompt actually shows up.
+	//
+	// When the password comes from anywhere but stdin, stdin is the
+	// remote command's: it is passed on once the password has been sent.
+	// With -stdin-delim stdin is both, split at the delimiter line.
+	// source records where the password came from, for -audit.
+	rules := []*shallpass.Rule(passwordFor)
+	if (*passwordCapture == "") != (len(passwordMap) == 0) {
+		fmt.Fprintln(os.Stderr, "shallpass: -password-capture and -password-map go together")
+		exit(shallpass.ExitUsage)
+	}
+	if *passwordCapture != "" {
+		mapped, err := shallpass.CaptureRules(*passwordCapture, passwordMap)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -password-capture:", err)
+			exit(shallpass.ExitUsage)
+		}
+		rules = append(rules, mapped...)
+	}
+	if len(hopPasswords) > 0 {
+		hops, err := shallpass.HopRules(hopPasswords)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -hop-password:", err)
+			exit(shallpass.ExitUsage)
+		}
+		rules = append(rules, hops...)
+	}
+	// sshpass's -e, -f and -d are spellings of -password.
+	passwordSource := *passwordSourceFlag
+	given := 0
+	for _, s := range []struct {
+		set    bool
+		source string
+	}{
+		{*passwordSourceFlag != "", *passwordSourceFlag},
+		{*sshpassEnv, envSource()},
+		{*sshpassFile != "", "file:" + *sshpassFile},
+		{*sshpassFD != "", "fd:" + *sshpassFD},
+	} {
+		if s.set {
+			passwordSource = s.source
+			given++
+		}
+	}
+	if given > 1 {
+		fmt.Fprintln(os.Stderr, "shallpass: -password, -e, -f and -d each name the password source; give only one")
+		exit(shallpass.ExitConflictingSources)
+	}
+	var forward io.Reader
+	var source string
+	var approval *shallpass.ApprovalSource
+	switch {
+	case *forbidPrompt:
+		rules = []*shallpass.Rule{shallpass.PasswordRule("", prompts)}
+		forward, source = os.Stdin, "none"
+	case len(passwordFor) > 0:
+		forward, source = os.Stdin, "password-for"
+	case len(passwordMap) == 0 && len(hopPasswords) > 0:
+		forward, source = os.Stdin, "hop-password"
+	case len(rules) > 0:
+		forward, source = os.Stdin, "password-map"
+	case passwordSource != "":
+		var password string
+		if !inspectOnly {
+			password, err = shallpass.ReadSecret(passwordSource)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: failed to read the password:", err)
+			os.Exit(shallpass.ExitReadPassword)
+		}
+		kind, _, _ := strings.Cut(passwordSource, ":")
+		rules = []*shallpass.Rule{shallpass.PasswordRule(password, prompts)}
+		forward, source = os.Stdin, kind
+	case allHostSecrets:
+		// Every host has its own, so there is no password to read.
+		rules = []*shallpass.Rule{shallpass.PasswordRule("", prompts)}
+		forward, source = os.Stdin, "hosts"
+	case *sourceOrder != "":
+		var sources []secretSource
+		usesStdin := false
+		for _, name := range strings.Split(*sourceOrder, ",") {
+			switch name = strings.TrimSpace(name); name {
+			case "stdin":
+				usesStdin = true
+				sources = append(sources, secretSource{name, func() (string, error) { return readStdinPassword(*maxPassword) }})
+			case "env":
+				sources = append(sources, secretSource{name, func() (string, error) {
+					source := envSource()
+					if _, name, _ := strings.Cut(source, ":"); os.Getenv(name) == "" {
+						return "", nil
+					}
+					return shallpass.ReadSecret(source)
+				}})
+			case "socket":
+				if *passwordSocket == "" {
+					fmt.Fprintln(os.Stderr, "shallpass: invalid -source-order: socket needs -password-socket")
+					exit(shallpass.ExitUsage)
+				}
+				sources = append(sources, secretSource{name, func() (string, error) {
+					return shallpass.ReadLine(&shallpass.SocketSource{Path: *passwordSocket}, 0)
+				}})
+			default:
+				fmt.Fprintf(os.Stderr, "shallpass: invalid -source-order: unknown source %q (want stdin, env or socket)\n", name)
+				exit(shallpass.ExitUsage)
+			}
+		}
+		// Nothing is sent with -list-matchers, so there is no need to go
+		// looking.
+		secret, used := "", *sourceOrder
+		if !inspectOnly {
+			secret, used, err = firstSecret(sources)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: -source-order:", err)
+			os.Exit(shallpass.ExitReadPassword)
+		}
+		rules, source = []*shallpass.Rule{shallpass.PasswordRule(strings.TrimRight(secret, "\r\n")+"\n", prompts)}, used
+		if !usesStdin {
+			forward = os.Stdin
+		}
+	case *stdinLine:
+		if *stdinDelim != "" {
+			fmt.Fprintln(os.Stderr, "shallpass: -stdin-line and -stdin-delim each say where the password ends in stdin; give only one")
+			exit(shallpass.ExitConflictingSources)
+		}
+		var password string
+		if !inspectOnly {
+			password, err = readFirstLine(os.Stdin, *maxPassword)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: failed to read password from stdin:", err)
+			os.Exit(shallpass.ExitReadPassword)
+		}
+		rules = []*shallpass.Rule{shallpass.PasswordRule(password+"\n", prompts)}
+		forward, source = os.Stdin, "stdin"
+	case *stdinDelim != "":
+		var password string
+		if !inspectOnly {
+			password, err = readUntilDelim(os.Stdin, *stdinDelim, *maxPassword)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: failed to read password from stdin:", err)
+			os.Exit(shallpass.ExitReadPassword)
+		}
+		rules = []*shallpass.Rule{shallpass.PasswordRule(password+"\n", prompts)}
+		forward, source = os.Stdin, "stdin"
+	case *approvalURL != "":
+		approval = &shallpass.ApprovalSource{URL: *approvalURL, Host: host, Timeout: *approvalTimeout}
+		r := shallpass.PasswordRule("", prompts)
+		r.Source = approval
+		rules = []*shallpass.Rule{r}
+		forward, source = os.Stdin, "approval"
+	case *passwordSocket != "":
+		r := shallpass.PasswordRule("", prompts)
+		r.Source = &shallpass.SocketSource{Path: *passwordSocket}
+		rules = []*shallpass.Rule{r}
+		forward, source = os.Stdin, "socket"
+	case *multiplexed || *tool != "exec" && sshargs.IsMultiplexed(args):
+		r := shallpass.PasswordRule("", prompts)
+		r.Source = os.Stdin
+		rules, source = []*shallpass.Rule{r}, "stdin"
+	case *maxTries <= 1 && !inspectOnly && stdinIsTerminal():
+		// Run by hand with nothing else to go on: ask, and leave the
+		// terminal to the session.
+		prompt := "shallpass: password: "
+		if host != "" {
+			prompt = fmt.Sprintf("shallpass: password for %s: ", host)
+		}
+		password, err := askTerminal(prompt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: failed to read the password from the terminal:", err)
+			os.Exit(shallpass.ExitReadPassword)
+		}
+		rules = []*shallpass.Rule{shallpass.PasswordRule(password, prompts)}
+		forward, source = os.Stdin, "terminal"
+	default:
+		var password string
+		if !inspectOnly {
+			password, err = readStdinPasswords(*maxPassword, *maxTries)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: failed to read password from stdin:", err)
+			os.Exit(shallpass.ExitReadPassword)
+		}
+		rule := shallpass.PasswordRule(password, prompts)
+		if *maxTries > 1 {
+			// One password per line, the first tried first.
+			lines := strings.SplitAfter(strings.TrimRight(password, "\r\n")+"\n", "\n")
+			rule.Secret, rule.Alternates = lines[0], lines[1:len(lines)-1]
+			if len(rule.Alternates) > *maxTries-1 {
+				rule.Alternates = rule.Alternates[:*maxTries-1]
+			}
+		}
+		rules, source = []*shallpass.Rule{rule}, "stdin"
+	}
+	// A password source in -hosts stands in for this one's secret.
+	passwordRule := rules[0]
+	if *maxTries > 1 && (source != "stdin" || forward != nil) {
+		fmt.Fprintln(os.Stderr, "shallpass: -max-tries takes the passwords from stdin, one per line, so it can't be used with another password source")
+		exit(shallpass.ExitConflictingSources)
 	}
 
-	// This goroutine's job is to scan the output for the password prompt,
-	// send the password, and then exit. It doesn't need to stay alive
-	// for the whole session.
+	// Check every secret we already have; lazily read ones are checked by
+	// the Runner when they are read.
+	for _, secret := range append(shallpass.Secrets(rules), changeTo, pin, passphrase) {
+		if err := shallpass.CheckSecretSize(secret, *maxPassword); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	// An empty password is most often an unset variable upstream.
+	if *requirePassword && !inspectOnly {
+		for _, r := range rules {
+			if r.Source == nil && strings.TrimSpace(r.Secret) == "" {
+				fmt.Fprintln(os.Stderr, "shallpass: the password is empty (-require-password)")
+				exit(shallpass.ExitUsage)
+			}
+		}
+	}
+
+	// A prompt learned from an earlier run is recognised on top of the
+	// usual ones. With -password-for the rules already say which prompt
+	// gets which secret, so they are left alone.
+	var history *promptHistory
+	if *historyFile != "" {
+		history, err = loadHistory(*historyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: warning: ignoring -prompt-history:", err)
+		} else if learned := history.Hosts[historyKey(host)]; learned != "" && len(passwordFor) == 0 && len(passwordMap) == 0 && len(hopPasswords) == 0 {
+			preferPrompt(rules[0], learned)
+		}
+	}
+
+	// The -prompt patterns add to the -lang prompts, which -password-for
+	// and -password-map do without.
+	if len(promptPatterns) > 0 {
+		if len(passwordFor) > 0 || len(passwordMap) > 0 || len(hopPasswords) > 0 {
+			fmt.Fprintln(os.Stderr, "shallpass: -prompt and -prompt-regexp-file can't be combined with -password-for, -password-map or -hop-password, whose patterns say which prompt gets which secret")
+			exit(shallpass.ExitUsage)
+		}
+		shallpass.AddPromptPatterns(rules[0], promptPatterns)
+	}
+	if *tool == "exec" && len(passwordFor) == 0 && len(passwordMap) == 0 && len(hopPasswords) == 0 {
+		shallpass.AddPromptPatterns(rules[0], execPromptPatterns(flag.Arg(0)))
+	}
+
+	// The preamble gates every password rule, learned prompts included.
+	if *requirePreambleFlag != "" {
+		re, err := regexp.Compile(*requirePreambleFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -require-preamble:", err)
+			exit(shallpass.ExitUsage)
+		}
+		shallpass.RequirePreamble(rules, re)
+	}
+
+	// The token asks for its PIN, and the key for its passphrase, before
+	// the server is even contacted, so no preamble can come first. A
+	// second factor comes after the password, and sudo after the login.
+	if pin != "" {
+		rules = append([]*shallpass.Rule{shallpass.PINRule(pin)}, rules...)
+	}
+	if passphrase != "" {
+		rules = append([]*shallpass.Rule{shallpass.PassphraseRule(passphrase)}, rules...)
+	}
+	if *mfaChoice != "" {
+		if n, err := strconv.Atoi(*mfaChoice); err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "shallpass: invalid -mfa-choice %q: want the number of an option\n", *mfaChoice)
+			exit(shallpass.ExitUsage)
+		}
+		rules = append(rules, shallpass.MFARule(*mfaChoice))
+	}
+	if sudo != "" || *sudoLogin {
+		r := shallpass.SudoRule(sudo, prompts)
+		if *sudoLogin {
+			r = shallpass.SudoLoginRule(prompts)
+		}
+		shallpass.AddPromptPatterns(r, promptPatterns)
+		rules = append(rules, r)
+	}
+
+	// Device-style logins answer a banner and a username before the
+	// password, and a new host asks about its key. These responders go
+	// first and stop once a password is sent.
+	var prelude []*shallpass.Rule
+	if r := acceptHostKey.rule(); r != nil {
+		prelude = append(prelude, r)
+	} else if *rejectHostKey {
+		prelude = append(prelude, shallpass.HostKeyRule(false))
+	}
+	if *pressAnyKey {
+		prelude = append(prelude, shallpass.PressAnyKeyRule())
+	}
+	if *username != "" {
+		prelude = append(prelude, shallpass.UsernameRule(*username))
+	}
+	rules = append(prelude, rules...)
+
+	if *listMatchersFlag {
+		if changeTo != "" {
+			// The Runner tries these first, once the password has expired.
+			rules = append(shallpass.PasswordChangeRules(changeTo), rules...)
+		}
+		if *forbidPrompt {
+			fmt.Println("# a password prompt ends the session (-forbid-prompt)")
+		}
+		if *requirePreambleFlag != "" {
+			fmt.Printf("# password rules wait for a line matching %s (-require-preamble)\n", *requirePreambleFlag)
+		}
+		if err := listMatchers(os.Stdout, rules, script, on); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass:", err)
+			os.Exit(shallpass.ExitFailure)
+		}
+		os.Exit(0)
+	}
+
+	var authLimiter *shallpass.AuthLimiter
+	if *maxConcurrentAuth > 0 {
+		authLimiter = shallpass.NewAuthLimiter(*maxConcurrentAuth)
+	}
+	sshPath, sshArgs := commandLine(*tool, *sshBin, args)
+	runner := &shallpass.Runner{
+		SSHPath:            sshPath,
+		Args:               sshArgs,
+		Dir:                *chdir,
+		Native:             *backend == "native",
+		Rules:              rules,
+		ScanStdout:         scanStdout,
+		ScanStderr:         scanStderr,
+		KeepANSI:           !*stripANSIFlag,
+		NewPassword:        changeTo,
+		MaxPasswordBytes:   *maxPassword,
+		Askpass:            *askpass,
+		AllowPassthrough:   *allowPassthrough,
+		Prefix:             *prefix,
+		Timestamps:         *timestamps,
+		Binary:             *binary,
+		MergeStreams:       *mergeStreams,
+		TTY:                *tty,
+		RedactPatterns:     redactPatterns,
+		Script:             script,
+		Triggers:           on,
+		ResponseEncoding:   *responseEncoding,
+		KeepStdin:          *tool == "ssh" && sshargs.IsForwardOnly(args),
+		MaxInjections:      *maxInjections,
+		ForbidPrompt:       *forbidPrompt,
+		EchoCheck:          *echoCheck,
+		FailOnEcho:         *failOnEcho,
+		ConnectTimeout:     time.Duration(*connectTimeout) * time.Second,
+		PromptGrace:        *promptGrace,
+		TypeDelay:          *typeDelay,
+		ScanLimit:          *scanLimit,
+		IdleTimeout:        *idleTimeout,
+		FailureMarker:      failureMarker,
+		PromptTimeout:      *promptTimeout,
+		Timeout:            *timeout,
+		BannerTimeout:      *bannerTimeout,
+		ReconnectOnTimeout: *reconnect,
+		MaxTries:           *maxTries,
+		RetryBackoff:       *retryBackoff,
+		AuthLimiter:        authLimiter,
+		SSHPassCodes:       *sshpassCodes,
+		RetryWithoutPTY:    *retryWithoutPTY,
+		MFAWait:            *mfaTimeout,
+		Wake:               *wake,
+		WakeRepeat:         *wakeRepeat,
+		CountBytes:         *jsonDest != "" || *metricsFile != "" || *otlpTraces != "",
+	}
+	if logger != nil {
+		runner.Logger = logger
+		logger.Info("password source", "source", source, "rules", len(rules), "host", host)
+	}
+	if *verbose {
+		runner.OnMatch = func(r *shallpass.Rule, line string) {
+			reportMatch(os.Stderr, r, line)
+		}
+	}
+	if *dumpConfigFlag {
+		remaps := map[string]int{}
+		for from, to := range remapExit {
+			remaps[strconv.Itoa(from)] = to
+		}
+		extra := map[string]any{
+			"audit":                    *audit,
+			"require_prompt":           *requirePrompt,
+			"no_exit_code_passthrough": *noPassthrough,
+			"connection_exit_code":     *connectionExit,
+			"sshpass_exit_codes":       *sshpassCodes,
+			"remap_exit":               remaps,
+			"cmd":                      *tool,
+			"backend":                  *backend,
+			"batch":                    *batchFile,
+			"host_config":              *hostConfig,
+			"json":                     *jsonDest,
+			"prompt_history":           *historyFile,
+			"metrics_file":             *metricsFile,
+			"otlp_traces":              *otlpTraces,
+			"marker_file":              *markerFile,
+			"fingerprint_file":         *fingerprintFile,
+			"password_hosts_file":      *passwordHostsFile,
+			"on_success":               *onSuccess,
+			"on_failure":               *onFailure,
+		}
+		if err := dumpConfig(os.Stdout, runner, source, extra); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass:", err)
+			os.Exit(shallpass.ExitFailure)
+		}
+		os.Exit(0)
+	}
+	var recorder sessionRecorder
+	if *recordFile != "" {
+		if recorder, err = openRecorder(*recordFile, *recordFormat, "shallpass "+remoteCommand(*tool, args)); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -record:", err)
+			exit(shallpass.ExitUsage)
+		}
+		runner.Recorder = recorder
+	}
+	var jsonOut *resultWriter
+	if *jsonDest != "" {
+		if jsonOut, err = openResults(*jsonDest); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -json:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	var traces *tracer
+	if *otlpTraces != "" {
+		if traces, err = newTracer(*otlpTraces); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: invalid -otlp-traces:", err)
+			exit(shallpass.ExitUsage)
+		}
+	}
+	// SIGINT, SIGTERM, SIGHUP and SIGQUIT are passed on to ssh, so that it
+	// can end the session cleanly. If it hasn't within signalGrace, or on a
+	// second signal, the session is ended through the Runner, which makes
+	// sure ssh is not killed halfway through typing a secret.
+	ctx, cancel := context.WithCancel(context.Background())
+	var caught atomic.Int32
+	signals := make(chan os.Signal, 2)
+	relay := new(signalRelay)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 	go func() {
-		// Ensure pipes are closed when the goroutine finishes.
-		defer stdinPipe.Close()
-		defer stdoutWriter.Close()
-
-		// We scan the output from the read-end of our pipe.
-		scanner := bufio.NewScanner(stdoutReader)
-		for scanner.Scan() {
-			line := scanner.Text()
-			// Check for the password prompt. This is a simple, case-insensitive check.
-			if strings.Contains(strings.ToLower(line), "password:") {
-				// The prompt has been detected. Write the password we read earlier
-				// into the ssh process's standard input.
-				io.WriteString(stdinPipe, password)
-
-				// Our job is done. The goroutine can now exit ("bail").
-				// The MultiWriter will continue to pass ssh's stdout to the user's terminal.
+		sig := <-signals
+		caught.Store(int32(sig.(syscall.Signal)))
+		relay.send(sig)
+		select {
+		case <-signals:
+		case <-time.After(signalGrace):
+		}
+		cancel()
+	}()
+	runner.Context = ctx
+	if approval != nil {
+		approval.Context = ctx
+	}
+
+	// session runs ssh for line and does everything that follows it,
+	// returning the exit code and its reason. Without -batch or -hosts
+	// there is just the one. Each session has its own copy of the Runner,
+	// so that with -parallel they can run side by side; records sets the
+	// files that sessions add to one at a time.
+	var records sync.Mutex
+	// A host that locked a session out is not tried again by the rest.
+	var lockedHosts sync.Map
+	session := func(line batchLine) (int, string) {
+		args := line.args
+		if batchName != "" {
+			args = argsFor(slices.Concat(shared, line.args, command))
+		}
+		host := toolDestination(*tool, args)
+		if _, ok := lockedHosts.Load(historyKey(host)); ok {
+			fmt.Fprintf(os.Stderr, "shallpass: skipping %s: an earlier session was locked out of it\n", host)
+			return shallpass.ExitLockedOut, shallpass.ExitReason(shallpass.ExitLockedOut)
+		}
+		run := runner.Clone()
+		run.KeepStdin = *tool == "ssh" && sshargs.IsForwardOnly(args)
+		run.SSHPath, run.Args = commandLine(*tool, *sshBin, args)
+		if logger != nil && batchName != "" {
+			run.Logger = logger.With("host", host)
+		}
+		if line.source != "" {
+			for i, r := range runner.Rules {
+				if r == passwordRule {
+					run.Rules[i].Secret, run.Rules[i].Alternates = line.secret, nil
+				}
+			}
+		}
+		if *parallel > 1 && *prefix == "" {
+			run.Prefix = host + ": "
+		}
+		var matches []recordMatch
+		if jsonOut != nil {
+			onMatch := run.OnMatch
+			run.OnMatch = func(r *shallpass.Rule, line string) {
+				kind, _ := r.Describe()
+				matches = append(matches, recordMatch{kind, r.Name, r.MatchedBy(line)})
+				if onMatch != nil {
+					onMatch(r, line)
+				}
+			}
+		}
+		// record writes the -json line for the session and sends its
+		// -otlp-traces spans, if they are wanted.
+		start := time.Now()
+		record := func(res *shallpass.Result, code int, reason string) {
+			end := time.Now()
+			if traces != nil {
+				if err := traces.session(host, remoteCommand(*tool, args), start, end, res, code, reason); err != nil {
+					fmt.Fprintln(os.Stderr, "shallpass: warning: could not send -otlp-traces:", err)
+				}
+			}
+			if jsonOut == nil {
 				return
 			}
+			if err := jsonOut.write(newRecord(host, remoteCommand(*tool, args), res, code, reason, matches, end.Sub(start))); err != nil {
+				fmt.Fprintln(os.Stderr, "shallpass: warning: could not write -json:", err)
+			}
+		}
+		var stopRelay func()
+		run.Signals, stopRelay = relay.add()
+		defer stopRelay()
+		var res *shallpass.Result
+		var err error
+		if notifier != nil {
+			res, err = runForwarded(ctx, run, forward, notifier, sshargs.LocalListeners(args), *forwardRetries)
+		} else {
+			res, err = run.RunWithStdio(forward, os.Stdout, os.Stderr)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass:", err)
+			code := shallpass.ExitCodeOf(err)
+			reason := shallpass.ExitReason(code)
+			if *audit {
+				fmt.Fprintln(os.Stderr, auditLine(host, source, false, false, code, reason))
+			}
+			record(nil, code, reason)
+			hook(*onFailure, code, reason, host)
+			return code, reason
 		}
-	}()
 
-	// Wait for the ssh command to complete.
-	waitErr := cmd.Wait()
+		if res.ExitCode == shallpass.ExitLockedOut && host != "" {
+			lockedHosts.Store(historyKey(host), true)
+		}
+		if history != nil && host != "" && res.ExitCode == 0 && res.PromptLine != "" && !containsSecret(res.PromptLine, shallpass.Secrets(rules)) {
+			if err := history.learn(*historyFile, host, res.PromptLine); err != nil {
+				fmt.Fprintln(os.Stderr, "shallpass: warning: could not update -prompt-history:", err)
+			}
+		}
 
-	// If the command completed successfully (exit code 0), waitErr will be nil.
-	// In this case, we exit with 0.
-	if waitErr == nil {
-		os.Exit(0)
+		// Exit with ssh's status, collapsed to plain success/failure if asked to.
+		// A caller that expects password auth can ask to hear about sessions
+		// that got in some other way, which usually means config drift.
+		// The reason describes the status before it is collapsed.
+		code, reason := res.ExitCode, res.Reason
+		if sig := caught.Load(); sig != 0 {
+			code, reason = 128+int(sig), shallpass.ExitReason(shallpass.ExitInterrupted)
+		}
+		if *requirePrompt && code == 0 && !res.Prompted {
+			fmt.Fprintln(os.Stderr, "shallpass: ssh succeeded but never asked for the password")
+			code, reason = shallpass.ExitNoPrompt, shallpass.ExitReason(shallpass.ExitNoPrompt)
+		}
+		if *noPassthrough {
+			code = normalizeExit(code, *connectionExit)
+		}
+		if *audit {
+			fmt.Fprintln(os.Stderr, auditLine(host, source, res.PromptMatched, res.Prompted, code, reason))
+		}
+		record(res, code, reason)
+		records.Lock()
+		if *metricsFile != "" {
+			if err := recordMetrics(*metricsFile, host, res, code); err != nil {
+				fmt.Fprintln(os.Stderr, "shallpass: warning: could not update -metrics-file:", err)
+			}
+		}
+		// Hosts that still want a password are what a migration to keys has
+		// left to do. Neither notice says anything about the password itself.
+		if code == 0 && res.Prompted && host != "" {
+			if *warnPasswordAuth {
+				fmt.Fprintf(os.Stderr, "shallpass: warning: password-auth: %s still uses password authentication\n", historyKey(host))
+			}
+			if *passwordHostsFile != "" {
+				if err := recordPasswordHost(*passwordHostsFile, host); err != nil {
+					fmt.Fprintln(os.Stderr, "shallpass: warning: could not update -password-hosts-file:", err)
+				}
+			}
+		}
+		if *fingerprintFile != "" && res.HostKeyFingerprint != "" {
+			if err := recordFingerprint(*fingerprintFile, host, res.HostKeyType, res.HostKeyFingerprint); err != nil {
+				fmt.Fprintln(os.Stderr, "shallpass: warning: could not update -fingerprint-file:", err)
+			}
+		}
+		if *markerFile != "" && code == 0 {
+			if err := mark(*markerFile, host); err != nil {
+				fmt.Fprintln(os.Stderr, "shallpass: warning: could not write -marker-file:", err)
+			}
+		}
+		records.Unlock()
+		if code == 0 {
+			hook(*onSuccess, code, reason, host)
+		} else {
+			hook(*onFailure, code, reason, host)
+		}
+		return code, reason
+	}
+	if batchName == "" {
+		code, _ := session(batchLine{args: args})
+		if recorder != nil {
+			if err := recorder.Close(); err != nil {
+				fmt.Fprintln(os.Stderr, "shallpass: warning: could not write -record:", err)
+			}
+		}
+		os.Exit(remapExit.remap(sshpassExit(code)))
+	}
+	// Stdin is not the remote commands' in a batch: there are several.
+	forward = nil
+	var limiter *rate.Limiter
+	if *startRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*startRate), 1)
+	}
+	results, code := runBatch(os.Stderr, batchName, batch, *parallel, limiter, session, func() bool { return caught.Load() != 0 })
+	if *summaryFile != "" {
+		if err := writeSummary(*summaryFile, results, code); err != nil {
+			fmt.Fprintln(os.Stderr, "shallpass: warning: could not write -summary-file:", err)
+		}
 	}
+	os.Exit(remapExit.remap(sshpassExit(code)))
+}
 
-	// If the command failed, we try to extract the exit code.
-	// We can only do this if the error is of type *exec.ExitError.
-	if exitError, ok := waitErr.(*exec.ExitError); ok {
-		// The command returned a non-zero exit code.
-		// We can get the system-dependent exit status.
-		if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
-			// Exit our program with the same code as the ssh process.
-			os.Exit(status.ExitStatus())
+// hook runs an -on-success or -on-failure command, if one was given. A
+// hook that fails is reported but never changes our exit code.
+func hook(command string, code int, reason, host string) {
+	if command == "" {
+		return
+	}
+	if err := runHook(command, code, reason, host); err != nil {
+		fmt.Fprintln(os.Stderr, "shallpass: warning: hook failed:", err)
+	}
+}
+
+// auditLine is the -audit summary of a session. It never includes a
+// secret, only whether one was sent.
+func auditLine(host, source string, matched, injected bool, code int, reason string) string {
+	return fmt.Sprintf("shallpass: audit host=%s source=%s prompt_matched=%t injected=%t exit_code=%d reason=%s", host, source, matched, injected, code, reason)
+}
+
+// readStdinPassword reads all of stdin as the password. It reads at most a
+// little past max, so a whole file piped in by mistake is not slurped into
+// memory first; the size check proper comes later.
+func readStdinPassword(max int) (string, error) {
+	return readStdinPasswords(max, 1)
+}
+
+// readStdinPasswords is readStdinPassword for n passwords, one per line,
+// each of which may be max bytes long.
+func readStdinPasswords(max, n int) (string, error) {
+	if n < 1 {
+		n = 1
+	}
+	var in io.Reader = os.Stdin
+	if max > 0 {
+		in = io.LimitReader(os.Stdin, int64(max+3)*int64(n))
+	}
+	password, err := io.ReadAll(in)
+	return string(password), err
+}
+
+// parsePromptSource maps the -prompt-source value to which of ssh's output
+// streams should be scanned.
+func parsePromptSource(s string) (stdout, stderr, ok bool) {
+	switch s {
+	case "stdout":
+		return true, false, true
+	case "stderr":
+		return false, true, true
+	case "both":
+		return true, true, true
+	}
+	return false, false, false
+}
+
+// pickSSHBin returns the first of candidates that is an executable file,
+// looked up in PATH unless it has a slash in it, or an error listing why
+// each one was passed over.
+func pickSSHBin(candidates []string) (string, error) {
+	var tried []string
+	for _, c := range candidates {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		path, err := exec.LookPath(c)
+		if err == nil {
+			return path, nil
+		}
+		switch {
+		case errors.Is(err, exec.ErrNotFound) && !strings.ContainsRune(c, os.PathSeparator):
+			tried = append(tried, c+" (not in PATH)")
+		case errors.Is(err, fs.ErrNotExist):
+			tried = append(tried, c+" (not found)")
+		case errors.Is(err, fs.ErrPermission), errors.Is(err, exec.ErrNotFound):
+			tried = append(tried, c+" (not executable)")
+		default:
+			tried = append(tried, fmt.Sprintf("%s (%v)", c, err))
 		}
 	}
+	return "", fmt.Errorf("no ssh client found; tried %s; install one or fix -ssh-bin", strings.Join(tried, ", "))
+}
 
-	// If we couldn't get the exit code for some reason, exit with a generic
-	// failure code of 1.
-	os.Exit(1)
+// checkDir makes sure path exists and is a directory.
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+// signalRelay passes a signal on to every session running when it comes.
+type signalRelay struct {
+	mu       sync.Mutex
+	sessions []chan os.Signal
+}
+
+// add returns the channel for a session's Runner.Signals, and the function
+// to call once the session is over.
+func (sr *signalRelay) add() (<-chan os.Signal, func()) {
+	ch := make(chan os.Signal, 1)
+	sr.mu.Lock()
+	sr.sessions = append(sr.sessions, ch)
+	sr.mu.Unlock()
+	return ch, func() {
+		sr.mu.Lock()
+		sr.sessions = slices.DeleteFunc(sr.sessions, func(c chan os.Signal) bool { return c == ch })
+		sr.mu.Unlock()
+	}
+}
+
+// send passes sig on without waiting: a session that has not taken the
+// last one yet does not need another.
+func (sr *signalRelay) send(sig os.Signal) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for _, ch := range sr.sessions {
+		select {
+		case ch <- sig:
+		default:
+		}
+	}
+}
+
+// signalGrace is how long ssh has to end the session by itself once it
+// was passed a signal.
+const signalGrace = 2 * time.Second
+
+// normalizeExit collapses code for callers that only care about success or
+// failure: 0 stays 0, ssh's own error status 255 becomes connectionCode, and
+// every other failure becomes 1.
+func normalizeExit(code, connectionCode int) int {
+	switch code {
+	case 0:
+		return 0
+	case shallpass.ExitSSHError:
+		return connectionCode
+	}
+	return shallpass.ExitFailure
 }
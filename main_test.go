@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the command itself when a test starts the test binary
+// with SHALLPASS_RUN_MAIN set, so tests can see what reaches ssh.
+func TestMain(m *testing.M) {
+	if os.Getenv("SHALLPASS_RUN_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeSSH writes script to a file ssh can be run as with -ssh-bin.
+func fakeSSH(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ssh is a shell script")
+	}
+	fake := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+// runMain runs shallpass with args and env on top of the test's own
+// environment, and returns what it wrote and its exit code.
+func runMain(t *testing.T, env []string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	return runMainStdin(t, nil, env, args...)
+}
+
+// runMainStdin is runMain with stdin read from in.
+func runMainStdin(t *testing.T, in io.Reader, env []string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), "SHALLPASS_RUN_MAIN=1"), env...)
+	cmd.Stdin = in
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), cmd.ProcessState.ExitCode()
+}
+
+func TestParsePromptSource(t *testing.T) {
+	for _, tc := range []struct {
+		value                  string
+		stdout, stderr, wantOK bool
+	}{
+		{"stdout", true, false, true},
+		{"stderr", false, true, true},
+		{"both", true, true, true},
+		{"Both", false, false, false},
+		{"", false, false, false},
+	} {
+		stdout, stderr, ok := parsePromptSource(tc.value)
+		if stdout != tc.stdout || stderr != tc.stderr || ok != tc.wantOK {
+			t.Errorf("parsePromptSource(%q) = %v, %v, %v; want %v, %v, %v", tc.value, stdout, stderr, ok, tc.stdout, tc.stderr, tc.wantOK)
+		}
+	}
+}
+
+func TestConvenienceOptionsReachSSH(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ssh is a shell script")
+	}
+	fake := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(fake, []byte(`#!/bin/sh
+for a in "$@"; do printf '[%s]' "$a"; done`), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-port", "2222", "--", "host"}, "[-p][2222][host]"},
+		{[]string{"-port", "2222", "-identity", "id_web", "--", "host", "-t", "tmux attach"}, "[-p][2222][-i][id_web][host][-t][tmux attach]"},
+		// What the user gives ssh wins, before the destination or after.
+		{[]string{"-port", "2222", "--", "-p", "22", "host"}, "[-p][22][host]"},
+		{[]string{"-port", "2222", "--", "host", "-p", "22"}, "[host][-p][22]"},
+	} {
+		cmd := exec.Command(os.Args[0], append([]string{"-e", "-ssh-bin", fake}, tc.args...)...)
+		cmd.Env = append(os.Environ(), "SHALLPASS_RUN_MAIN=1", "SSHPASS=secret")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("shallpass %q: %v", tc.args, err)
+			continue
+		}
+		if string(out) != tc.want {
+			t.Errorf("shallpass %q ran ssh with %s, want %s", tc.args, out, tc.want)
+		}
+	}
+}
+
+func TestEnvPassword(t *testing.T) {
+	fake := fakeSSH(t, `printf 'password: ' >&2
+read pw
+echo "got $pw"`)
+	for _, tc := range []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{"SHALLPASS", []string{"SHALLPASS=mine", "SSHPASS=theirs"}, "got mine\n"},
+		{"SSHPASS", []string{"SHALLPASS=", "SSHPASS=theirs"}, "got theirs\n"},
+	} {
+		for _, flag := range []string{"-e", "-source-order=env"} {
+			stdout, stderr, code := runMain(t, tc.env, flag, "-ssh-bin", fake, "--", "host")
+			if code != 0 || stdout != tc.want {
+				t.Errorf("%s with %s: exit %d, stdout %q, want %q; stderr: %s", tc.name, flag, code, stdout, tc.want, stderr)
+			}
+		}
+	}
+}
+
+func TestHookGetsNoEnvPassword(t *testing.T) {
+	fake := fakeSSH(t, `printf 'password: ' >&2
+read pw`)
+	// Neither variable is the password source here, and the hook is still
+	// kept from both.
+	_, stderr, code := runMain(t, []string{"SHALLPASS=mine", "SSHPASS=theirs"},
+		"-password", "pass:other", "-ssh-bin", fake, "-on-success", `echo "hook ${SHALLPASS-unset} ${SSHPASS-unset}"`, "--", "host")
+	if code != 0 || !strings.Contains(stderr, "hook unset unset\n") {
+		t.Errorf("exit %d, stderr %q; want the hook to see neither variable", code, stderr)
+	}
+}
+
+func TestMissingSSHExits127(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "ssh")
+	_, stderr, code := runMain(t, []string{"PW=secret"}, "-password", "env:PW", "-ssh-bin", missing, "--", "host")
+	if want := "ssh not found at " + missing; code != 127 || !strings.Contains(stderr, want) {
+		t.Errorf("exit %d, stderr %q; want 127 and %q", code, stderr, want)
+	}
+}
+
+func TestMultiplexedReadsNoPassword(t *testing.T) {
+	// The master is already logged in, so ssh never prompts, and stdin,
+	// which never ends, must not be waited on for a password.
+	fake := fakeSSH(t, `echo "reused the master"`)
+	for _, args := range [][]string{
+		{"-multiplexed", "--", "host"},
+		{"--", "-o", "ControlPath=/tmp/ctl-%C", "host"},
+		{"--", "-S", "/tmp/ctl", "host"},
+	} {
+		cmd := exec.Command(os.Args[0], append([]string{"-ssh-bin", fake}, args...)...)
+		cmd.Env = append(os.Environ(), "SHALLPASS_RUN_MAIN=1")
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			if err != nil || stdout.String() != "reused the master\n" {
+				t.Errorf("shallpass %q: %v, stdout %q; stderr: %s", args, err, stdout.String(), stderr.String())
+			}
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-done
+			t.Errorf("shallpass %q is still waiting for stdin", args)
+		}
+		stdin.Close()
+	}
+}
+
+func TestAuditLine(t *testing.T) {
+	for _, tc := range []struct {
+		script string
+		want   string
+	}{
+		{"echo 'password:' >&2\nread pw\necho ok",
+			"shallpass: audit host=db01 source=env prompt_matched=true injected=true exit_code=0 reason=ok\n"},
+		{"echo 'ssh: connect to host db01 port 22: Connection refused' >&2\nexit 255",
+			"shallpass: audit host=db01 source=env prompt_matched=false injected=false exit_code=255 reason=connection_refused\n"},
+	} {
+		fake := fakeSSH(t, tc.script)
+		_, stderr, _ := runMain(t, []string{"PW=secret"}, "-audit", "-password", "env:PW", "-ssh-bin", fake, "--", "deploy@db01")
+		// The audit line is the last one, after whatever ssh wrote.
+		if got := stderr[strings.LastIndex(strings.TrimSuffix(stderr, "\n"), "\n")+1:]; got != tc.want {
+			t.Errorf("audit line\n%q\nwant\n%q", got, tc.want)
+		}
+		if strings.Contains(stderr, "secret") {
+			t.Errorf("the password is in stderr: %q", stderr)
+		}
+	}
+}
+
+func TestPasswordSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "shallpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "broker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("no Unix sockets here:", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "from-the-broker\n")
+			conn.Close()
+		}
+	}()
+	fake := fakeSSH(t, `printf 'password: ' >&2
+read pw
+echo "got $pw"`)
+	stdout, stderr, code := runMain(t, nil, "-password-socket", path, "-ssh-bin", fake, "--", "host")
+	if code != 0 || stdout != "got from-the-broker\n" {
+		t.Errorf("exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+}
+
+func TestChdirResolvesARelativeIdentity(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "keys"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "keys", "id_web"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// ssh reads the identity file relative to where it runs.
+	fake := fakeSSH(t, `while [ $# -gt 0 ]; do
+	if [ "$1" = -i ]; then
+		if [ -f "$2" ]; then echo "found $2"; else echo "no $2 in $(pwd)"; fi
+	fi
+	shift
+done`)
+	for _, args := range [][]string{
+		{"-identity", "keys/id_web", "--", "host"},
+		{"--", "-i", "keys/id_web", "host"},
+	} {
+		stdout, stderr, code := runMain(t, []string{"PW=secret"}, append([]string{"-password", "env:PW", "-chdir", dir, "-ssh-bin", fake}, args...)...)
+		if code != 0 || stdout != "found keys/id_web\n" {
+			t.Errorf("shallpass %q: exit %d, stdout %q; stderr: %s", args, code, stdout, stderr)
+		}
+	}
+	if _, stderr, code := runMain(t, nil, "-chdir", filepath.Join(dir, "missing"), "-ssh-bin", fake, "--", "host"); code != 2 || !strings.Contains(stderr, "invalid -chdir") {
+		t.Errorf("missing -chdir: exit %d, stderr %q", code, stderr)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	ran := filepath.Join(t.TempDir(), "ran")
+	fake := fakeSSH(t, `touch '`+ran+`'`)
+	long := "PW=" + strings.Repeat("a", 2000)
+	for _, tc := range []struct {
+		env  []string
+		args []string
+		code int
+		want string
+	}{
+		{nil, []string{"-merge-streams", "-binary"}, 2, "-binary and -merge-streams are mutually exclusive"},
+		{nil, []string{"-prompt-source", "stdout", "-prompt-on-stderr-only"}, 2, "-prompt-on-stderr-only can't be combined with -prompt-source stdout"},
+		{nil, []string{"-tty", "-binary"}, 2, "-tty (implied by -cmd scp, sftp and rsync) can't be combined with -binary"},
+		{nil, []string{"-prompt-source", "neither"}, 2, `invalid -prompt-source "neither"`},
+		{nil, []string{"-no-such-flag"}, 2, "flag provided but not defined: -no-such-flag"},
+		{[]string{long}, []string{"-password", "env:PW"}, 2, "longer than -max-password-bytes (1024 bytes)"},
+		{[]string{"SSHPASS=x"}, []string{"-e", "-f", "/dev/null"}, 3, "-password, -e, -f and -d each name the password source; give only one"},
+	} {
+		args := append(append([]string{"-ssh-bin", fake}, tc.args...), "--", "host")
+		_, stderr, code := runMain(t, tc.env, args...)
+		if code != tc.code || !strings.Contains(stderr, tc.want) {
+			t.Errorf("shallpass %q: exit %d, stderr %q; want %d and %q", tc.args, code, stderr, tc.code, tc.want)
+		}
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("ssh was started despite a usage error")
+	}
+}
+
+func TestRequirePrompt(t *testing.T) {
+	prompts := fakeSSH(t, `printf 'password: ' >&2
+read pw
+echo ok`)
+	keyOnly := fakeSSH(t, `echo ok`)
+	fails := fakeSSH(t, `echo 'Permission denied (publickey).' >&2; exit 255`)
+	for _, tc := range []struct {
+		name    string
+		fake    string
+		require bool
+		code    int
+	}{
+		{"asked", prompts, true, 0},
+		{"never asked", keyOnly, true, 9},
+		{"never asked, not required", keyOnly, false, 0},
+		// A failure keeps its own code.
+		{"failed", fails, true, 255},
+	} {
+		args := []string{"-password", "env:PW", "-ssh-bin", tc.fake}
+		if tc.require {
+			args = append(args, "-require-prompt")
+		}
+		_, stderr, code := runMain(t, []string{"PW=secret"}, append(args, "--", "host")...)
+		if code != tc.code {
+			t.Errorf("%s: exit %d, want %d; stderr: %s", tc.name, code, tc.code, stderr)
+		}
+	}
+}
+
+func TestAskpass(t *testing.T) {
+	// ssh runs the program in SSH_ASKPASS with its prompt, and reads the
+	// answer from its stdout; nothing is written to its terminal or stdin.
+	fake := fakeSSH(t, `[ "$SSH_ASKPASS_REQUIRE" = force ] || echo "SSH_ASKPASS_REQUIRE=$SSH_ASKPASS_REQUIRE"
+pw=$("$SSH_ASKPASS" "alice@host's password: ") || echo "askpass failed"
+echo "got $pw"
+# A helper without the token gets nothing.
+pw=$(SHALLPASS_ASKPASS_TOKEN=guess "$SSH_ASKPASS" "alice@host's password: ") && echo "guess got $pw"
+read rest
+echo "then [$rest]"`)
+	stdout, stderr, code := runMain(t, []string{"PW=secret"}, "-askpass", "-password", "env:PW", "-ssh-bin", fake, "--", "host")
+	if want := "got secret\nthen []\n"; code != 0 || stdout != want {
+		t.Errorf("exit %d, stdout %q, want %q; stderr: %s", code, stdout, want, stderr)
+	}
+}
+
+func TestRequirePassword(t *testing.T) {
+	ran := filepath.Join(t.TempDir(), "ran")
+	fake := fakeSSH(t, `touch '`+ran+`'
+printf 'password: ' >&2
+read pw
+echo "got [$pw]"`)
+	// Empty stdin, and a variable holding nothing but blanks.
+	for _, tc := range [][]string{
+		{},
+		{"-password", "env:PW"},
+	} {
+		_, stderr, code := runMain(t, []string{"PW= \t"}, append(append([]string{"-require-password", "-ssh-bin", fake}, tc...), "--", "host")...)
+		if code != 2 || !strings.Contains(stderr, "the password is empty (-require-password)") {
+			t.Errorf("shallpass %q: exit %d, stderr %q", tc, code, stderr)
+		}
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("ssh was started with an empty password")
+	}
+	// Without the flag the empty password is sent as it is.
+	if stdout, stderr, code := runMain(t, nil, "-ssh-bin", fake, "--", "host"); code != 0 || stdout != "got []\n" {
+		t.Errorf("without -require-password: exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+}
+
+func TestForbidPrompt(t *testing.T) {
+	// No password source is needed, and ssh is killed on the prompt
+	// rather than left waiting for an answer.
+	fake := fakeSSH(t, `printf "alice@host's password: " >&2
+exec sleep 5`)
+	start := time.Now()
+	stdout, stderr, code := runMain(t, nil, "-forbid-prompt", "-ssh-bin", fake, "--", "host")
+	if code != 16 || stdout != "" || !strings.Contains(stderr, "should only accept keys (-forbid-prompt)") {
+		t.Errorf("exit %d, stdout %q, stderr %q; want exit 16", code, stdout, stderr)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("ssh ran on for %v after the prompt", d)
+	}
+	// A host that takes the key passes.
+	fake = fakeSSH(t, `echo "logged in"`)
+	if stdout, stderr, code := runMain(t, nil, "-forbid-prompt", "-ssh-bin", fake, "--", "host"); code != 0 || stdout != "logged in\n" {
+		t.Errorf("key login: exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+}
+
+func TestStdinReachesTheRemoteCommand(t *testing.T) {
+	// shallpass host 'bash -s' < script.sh, with the password from
+	// elsewhere: ssh gets the password, then the script, then EOF.
+	fake := fakeSSH(t, `printf 'password: ' >&2
+read pw
+echo "got $pw"
+cat`)
+	file := filepath.Join(t.TempDir(), "pw")
+	if err := os.WriteFile(file, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	script := "echo one\necho two\n"
+	for _, source := range []string{"env:PW", "file:" + file} {
+		stdout, stderr, code := runMainStdin(t, strings.NewReader(script), []string{"PW=secret"}, "-password", source, "-ssh-bin", fake, "--", "host", "bash -s")
+		if want := "got secret\n" + script; code != 0 || stdout != want {
+			t.Errorf("-password %s: exit %d, stdout %q, want %q; stderr: %s", source, code, stdout, want, stderr)
+		}
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// ssh that hangs without a word, as on a dropped SYN: given up on
+	// after the timeout, with ssh told the same number.
+	argsFile := filepath.Join(t.TempDir(), "args")
+	fake := fakeSSH(t, `echo "$@" > '`+argsFile+`'
+exec sleep 10`)
+	start := time.Now()
+	_, stderr, code := runMain(t, []string{"PW=secret"}, "-connect-timeout", "1", "-password", "env:PW", "-ssh-bin", fake, "--", "host")
+	if code != 25 {
+		t.Errorf("exit %d, want 25; stderr: %s", code, stderr)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("gave up after %v, want about a second", d)
+	}
+	if args, _ := os.ReadFile(argsFile); string(args) != "-o ConnectTimeout=1 host\n" {
+		t.Errorf("ssh ran with %q", args)
+	}
+
+	// The one in the ssh arguments wins, and is not repeated.
+	fake = fakeSSH(t, `echo "$@"`)
+	if stdout, stderr, code := runMain(t, []string{"PW=secret"}, "-connect-timeout", "1", "-password", "env:PW", "-ssh-bin", fake, "--", "-o", "ConnectTimeout=7", "host"); code != 0 || stdout != "-o ConnectTimeout=7 host\n" {
+		t.Errorf("exit %d, ssh ran with %q; stderr: %s", code, stdout, stderr)
+	}
+}
+
+func TestListMatchers(t *testing.T) {
+	ran := filepath.Join(t.TempDir(), "ran")
+	fake := fakeSSH(t, `touch '`+ran+`'`)
+	stdout, stderr, code := runMain(t, []string{"PW=hunter2", "BPW=bastionpw"}, "-list-matchers",
+		"-username", "admin", "-accept-hostkey", "-password", "env:PW", "-password-for", "bastion=env:BPW", "-on", `Continue\?:y:1`,
+		"-ssh-bin", fake, "--", "host")
+	// The prelude first, then the passwords, then the triggers.
+	want := `#  KIND      PATTERN     SENDS
+1  prelude   host key    "yes\n"
+2  prelude   username    "admin\n"
+3  password  bastion     <redacted>
+4  trigger   Continue\?  "y\n" (max 1)
+`
+	if code != 0 || stdout != want {
+		t.Errorf("exit %d, stdout:\n%s\nwant:\n%s\nstderr: %s", code, stdout, want, stderr)
+	}
+	if strings.Contains(stdout+stderr, "hunter2") || strings.Contains(stdout+stderr, "bastionpw") {
+		t.Error("a password was printed")
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("ssh was started")
+	}
+}
+
+func TestStdinDelim(t *testing.T) {
+	// One pipe: the password, the delimiter, then the remote command's
+	// input.
+	fake := fakeSSH(t, `printf 'password: ' >&2
+read pw
+echo "got $pw"
+cat`)
+	in := "secret\n---END-PASSWORD---\ntar data\nmore data\n"
+	stdout, stderr, code := runMainStdin(t, strings.NewReader(in), nil, "-stdin-delim", "---END-PASSWORD---", "-ssh-bin", fake, "--", "host", "tar x")
+	if want := "got secret\ntar data\nmore data\n"; code != 0 || stdout != want {
+		t.Errorf("exit %d, stdout %q, want %q; stderr: %s", code, stdout, want, stderr)
+	}
+}
+
+func TestJSONRecordReason(t *testing.T) {
+	for _, tc := range []struct {
+		script, reason string
+		code           int
+	}{
+		{"printf 'password: ' >&2\nread pw", "ok", 0},
+		{"printf 'password: ' >&2\nread pw\nexit 4", "remote_command_failed", 4},
+		{"echo 'ssh: connect to host h port 22: Connection refused' >&2\nexit 255", "connection_refused", 255},
+	} {
+		path := filepath.Join(t.TempDir(), "sessions.json")
+		_, stderr, code := runMain(t, []string{"PW=secret"}, "-json", path, "-password", "env:PW", "-ssh-bin", fakeSSH(t, tc.script), "--", "host")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record sessionRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			t.Fatalf("%v in %q", err, data)
+		}
+		if code != tc.code || record.ExitCode != tc.code || record.Reason != tc.reason {
+			t.Errorf("exit %d, record %+v; want %d, %q; stderr: %s", code, record, tc.code, tc.reason, stderr)
+		}
+	}
+}
+
+func TestFingerprintFile(t *testing.T) {
+	fake := fakeSSH(t, `echo "ECDSA key fingerprint is SHA256:mzY5bKyUYjyQ3ieEtJom1o0mP3FrT8leYibgCdJWRhE." >&2
+printf 'Are you sure you want to continue connecting (yes/no)? ' >&2
+read answer
+printf 'password: ' >&2
+read pw`)
+	path := filepath.Join(t.TempDir(), "fingerprints")
+	for i := 0; i < 2; i++ {
+		if _, stderr, code := runMain(t, []string{"PW=secret"}, "-accept-hostkey", "-fingerprint-file", path, "-password", "env:PW", "-ssh-bin", fake, "--", "alice@db1"); code != 0 {
+			t.Fatalf("exit %d; stderr: %s", code, stderr)
+		}
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each session adds its line.
+	line := "db1 ECDSA SHA256:mzY5bKyUYjyQ3ieEtJom1o0mP3FrT8leYibgCdJWRhE\n"
+	if string(got) != line+line {
+		t.Errorf("fingerprint file holds %q, want %q twice", got, line)
+	}
+}
+
+func TestPasswordHostsFile(t *testing.T) {
+	prompting := fakeSSH(t, `printf 'password: ' >&2
+read pw`)
+	keyed := fakeSSH(t, `echo "in with a key"`)
+	refused := fakeSSH(t, `printf 'password: ' >&2
+read pw
+echo "Permission denied (publickey,password)." >&2
+exit 255`)
+	path := filepath.Join(t.TempDir(), "password-hosts")
+	for _, tc := range []struct {
+		fake, host string
+		warns      bool
+	}{
+		{prompting, "alice@web1", true},
+		{prompting, "web1", true},
+		{keyed, "db1", false},
+		{refused, "mail1", false},
+	} {
+		_, stderr, _ := runMain(t, []string{"PW=secret"}, "-warn-on-password-auth", "-password-hosts-file", path, "-password", "env:PW", "-ssh-bin", tc.fake, "--", tc.host)
+		if warned := strings.Contains(stderr, "still uses password authentication"); warned != tc.warns {
+			t.Errorf("%s: warned %v, want %v; stderr: %s", tc.host, warned, tc.warns, stderr)
+		}
+		if strings.Contains(stderr, "secret") {
+			t.Errorf("%s: the password is in the warning: %s", tc.host, stderr)
+		}
+	}
+	// Only the host that took a password, once.
+	if got, err := os.ReadFile(path); err != nil || string(got) != "web1\n" {
+		t.Errorf("-password-hosts-file holds %q, %v; want web1 alone", got, err)
+	}
+}
+
+func TestPasswordMapAcrossHops(t *testing.T) {
+	// ssh -J bastion db: each hop's prompt names its host, which picks
+	// its password; a host without one of its own gets the fallback.
+	fake := fakeSSH(t, `printf "alice@bastion's password: " >&2
+read one
+printf "alice@db's password: " >&2
+read two
+printf "alice@cache's password: " >&2
+read three
+echo "$one $two $three"`)
+	stdout, stderr, code := runMain(t, []string{"BASTION_PW=b-pw", "DB_PW=d-pw", "OTHER_PW=o-pw"},
+		"-password-capture", `\w+@(?P<host>[\w.-]+)'s password:`,
+		"-password-map", "bastion=env:BASTION_PW", "-password-map", "db=env:DB_PW", "-password-map", "*=env:OTHER_PW",
+		"-ssh-bin", fake, "--", "-J", "bastion", "db")
+	if want := "b-pw d-pw o-pw\n"; code != 0 || stdout != want {
+		t.Errorf("exit %d, stdout %q, want %q; stderr: %s", code, stdout, want, stderr)
+	}
+}
+
+func TestKeepaliveReachesSSH(t *testing.T) {
+	fake := fakeSSH(t, `for a in "$@"; do printf '[%s]' "$a"; done`)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"host"}, "[-o][ServerAliveInterval=30][-o][ServerAliveCountMax=3][host]"},
+		// What the ssh arguments set is kept, and not set twice.
+		{[]string{"-o", "serveraliveinterval=5", "host"}, "[-o][ServerAliveCountMax=3][-o][serveraliveinterval=5][host]"},
+		{[]string{"-o", "ServerAliveInterval=5", "-o", "ServerAliveCountMax=10", "host"}, "[-o][ServerAliveInterval=5][-o][ServerAliveCountMax=10][host]"},
+		// A forward keeps its -N.
+		{[]string{"-N", "-L", "8080:localhost:80", "host"}, "[-o][ServerAliveInterval=30][-o][ServerAliveCountMax=3][-N][-L][8080:localhost:80][host]"},
+	} {
+		args := append([]string{"-keepalive", "30", "-password", "env:PW", "-ssh-bin", fake, "--"}, tc.args...)
+		if stdout, stderr, code := runMain(t, []string{"PW=secret"}, args...); code != 0 || stdout != tc.want {
+			t.Errorf("ssh arguments %q: exit %d, ssh ran with %s, want %s; stderr: %s", tc.args, code, stdout, tc.want, stderr)
+		}
+	}
+}
+
+func TestForcePasswordAuthReachesSSH(t *testing.T) {
+	fake := fakeSSH(t, `for a in "$@"; do printf '[%s]' "$a"; done`)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"host"}, "[-o][PasswordAuthentication=yes][-o][PubkeyAuthentication=no][-o][PreferredAuthentications=password,keyboard-interactive][host]"},
+		// Each option the ssh arguments set is theirs alone.
+		{[]string{"-o", "PubkeyAuthentication=yes", "host"}, "[-o][PasswordAuthentication=yes][-o][PreferredAuthentications=password,keyboard-interactive][-o][PubkeyAuthentication=yes][host]"},
+		{[]string{"-o", "preferredauthentications=keyboard-interactive", "host"}, "[-o][PasswordAuthentication=yes][-o][PubkeyAuthentication=no][-o][preferredauthentications=keyboard-interactive][host]"},
+	} {
+		args := append([]string{"-force-password-auth", "-password", "env:PW", "-ssh-bin", fake, "--"}, tc.args...)
+		if stdout, stderr, code := runMain(t, []string{"PW=secret"}, args...); code != 0 || stdout != tc.want {
+			t.Errorf("ssh arguments %q: exit %d, ssh ran with %s, want %s; stderr: %s", tc.args, code, stdout, tc.want, stderr)
+		}
+	}
+}
+
+func TestForwardingFlagsReachSSH(t *testing.T) {
+	fake := fakeSSH(t, `for a in "$@"; do printf '[%s]' "$a"; done`)
+	for _, tc := range []struct {
+		flag  string
+		args  []string
+		want  string
+		notes bool
+	}{
+		{"-forward-agent", []string{"host"}, "[-A][host]", true},
+		// What the ssh arguments say is left as it is, once.
+		{"-forward-agent", []string{"-A", "host"}, "[-A][host]", true},
+		{"-forward-agent", []string{"-a", "host"}, "[-a][host]", false},
+		{"-forward-agent", []string{"-o", "ForwardAgent=no", "host"}, "[-o][ForwardAgent=no][host]", false},
+		{"-forward-x11", []string{"host"}, "[-X][host]", false},
+		{"-forward-x11", []string{"-x", "host"}, "[-x][host]", false},
+		{"-forward-x11-trusted", []string{"host"}, "[-Y][host]", false},
+		{"-forward-x11-trusted", []string{"-X", "host"}, "[-X][host]", false},
+	} {
+		args := append([]string{tc.flag, "-password", "env:PW", "-ssh-bin", fake, "--"}, tc.args...)
+		stdout, stderr, code := runMain(t, []string{"PW=secret"}, args...)
+		if code != 0 || stdout != tc.want {
+			t.Errorf("%s with %q: exit %d, ssh ran with %s, want %s; stderr: %s", tc.flag, tc.args, code, stdout, tc.want, stderr)
+		}
+		if notes := strings.Contains(stderr, "use your keys"); notes != tc.notes {
+			t.Errorf("%s with %q: agent forwarding note %v, want %v", tc.flag, tc.args, notes, tc.notes)
+		}
+	}
+}
+
+func TestLoginThenSudo(t *testing.T) {
+	// shallpass host sudo ...: sudo asks with the same word as the login
+	// did, and gets its own secret because the login is over by then.
+	fake := fakeSSH(t, `printf "alice@db1's password: " >&2
+read login
+echo "Last login: Mon Oct 12 09:14:03 2026 from 10.0.0.7"
+printf "Password: " >&2
+read sudo
+echo "login $login, sudo $sudo"`)
+	stdout, stderr, code := runMain(t, []string{"PW=login-pw", "SUDO_PW=sudo-pw"}, "-password", "env:PW", "-sudo-password", "env:SUDO_PW", "-ssh-bin", fake, "--", "db1", "sudo systemctl restart app")
+	if want := "Last login: Mon Oct 12 09:14:03 2026 from 10.0.0.7\nlogin login-pw, sudo sudo-pw\n"; code != 0 || stdout != want {
+		t.Errorf("exit %d, stdout %q, want %q; stderr: %s", code, stdout, want, stderr)
+	}
+	// With -sudo the login's password serves both.
+	stdout, stderr, code = runMain(t, []string{"PW=login-pw"}, "-password", "env:PW", "-sudo", "-ssh-bin", fake, "--", "db1", "sudo systemctl restart app")
+	if !strings.HasSuffix(stdout, "login login-pw, sudo login-pw\n") || code != 0 {
+		t.Errorf("-sudo: exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+}
+
+func TestPromptRegexpFile(t *testing.T) {
+	patterns := filepath.Join(t.TempDir(), "prompts")
+	if err := os.WriteFile(patterns, []byte("# switches\n^Login key:\n\n# serial console bridges\n(?i)^secret please>\\s*$\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, prompt := range []string{"Login key:", "SECRET please> "} {
+		fake := fakeSSH(t, `printf '`+prompt+`' >&2
+read pw
+echo "got $pw"`)
+		if stdout, stderr, code := runMain(t, []string{"PW=secret"}, "-prompt-regexp-file", patterns, "-password", "env:PW", "-ssh-bin", fake, "--", "switch1"); code != 0 || stdout != "got secret\n" {
+			t.Errorf("prompt %q: exit %d, stdout %q; stderr: %s", prompt, code, stdout, stderr)
+		}
+	}
+	// A pattern that doesn't compile is reported with its line.
+	if err := os.WriteFile(patterns, []byte("# ok\nLogin key:\n[bad(\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, stderr, code := runMain(t, nil, "-prompt-regexp-file", patterns, "-ssh-bin", fakeSSH(t, ""), "--", "switch1"); code != 2 || !strings.Contains(stderr, patterns+":3: ") {
+		t.Errorf("bad pattern: exit %d, stderr %q", code, stderr)
+	}
+}
+
+func TestRemapExit(t *testing.T) {
+	remaps := []string{"-remap-exit", "5=1", "-remap-exit", "255=2"}
+	for _, tc := range []struct {
+		script string
+		code   int
+	}{
+		// The server refuses the password: our 5, remapped.
+		{"printf 'password: ' >&2\nread pw\necho 'Permission denied, please try again.' >&2\nprintf 'password: ' >&2\nread pw\nexit 255", 1},
+		// ssh's own failure, remapped.
+		{"echo 'ssh: connect to host h port 22: Connection refused' >&2\nexit 255", 2},
+		// The remote command's status, passed through.
+		{"printf 'password: ' >&2\nread pw\nexit 3", 3},
+		{"printf 'password: ' >&2\nread pw", 0},
+	} {
+		args := append(append([]string{"-password", "env:PW", "-ssh-bin", fakeSSH(t, tc.script)}, remaps...), "--", "host")
+		if _, stderr, code := runMain(t, []string{"PW=secret"}, args...); code != tc.code {
+			t.Errorf("exit %d, want %d; stderr: %s", code, tc.code, stderr)
+		}
+	}
+}
+
+func TestSSHBinCandidates(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "ssh")
+	notExecutable := filepath.Join(dir, "dbclient")
+	if err := os.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fake := fakeSSH(t, `printf 'password: ' >&2
+read pw
+echo "second candidate got $pw"`)
+	// The first candidates aren't there, or can't run; the next one is used.
+	candidates := strings.Join([]string{missing, notExecutable, fake}, ",")
+	if stdout, stderr, code := runMain(t, []string{"PW=secret"}, "-password", "env:PW", "-ssh-bin", candidates, "--", "host"); code != 0 || stdout != "second candidate got secret\n" {
+		t.Errorf("exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+	// None of them: 127, with what was wrong with each.
+	_, stderr, code := runMain(t, []string{"PW=secret"}, "-password", "env:PW", "-ssh-bin", missing+",no-such-ssh-client,"+notExecutable, "--", "host")
+	want := "no ssh client found; tried " + missing + " (not found), no-such-ssh-client (not in PATH), " + notExecutable + " (not executable)"
+	if code != 127 || !strings.Contains(stderr, want) {
+		t.Errorf("exit %d, stderr %q; want 127 and %q", code, stderr, want)
+	}
+}
+
+func TestFailureMarker(t *testing.T) {
+	const login = "printf 'password: ' >&2\nread pw\n"
+	for _, tc := range []struct {
+		name, command string
+		code          int
+	}{
+		// The gateway swallows the failure and exits 0.
+		{"swallowed", "echo 'gateway: Authentication failed for alice' >&2\nexit 0", 24},
+		{"on stdout", "echo 'Authentication failed'\nexit 0", 24},
+		{"clean", "echo 'all good'\nexit 0", 0},
+		// A real failure keeps its own code.
+		{"failing anyway", "echo 'Authentication failed' >&2\nexit 3", 3},
+	} {
+		_, stderr, code := runMain(t, []string{"PW=secret"}, "-failure-marker", "Authentication failed", "-password", "env:PW", "-ssh-bin", fakeSSH(t, login+tc.command), "--", "gw")
+		if code != tc.code {
+			t.Errorf("%s: exit %d, want %d; stderr: %s", tc.name, code, tc.code, stderr)
+		}
+		if marked := strings.Contains(stderr, "matched the failure marker"); marked != (tc.code == 24) {
+			t.Errorf("%s: stderr %q", tc.name, stderr)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// isMarked reports whether the -marker-file of an earlier successful run
+// is there.
+func isMarked(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// mark writes the -marker-file after a successful run. Like the prompt
+// history it is replaced atomically, so a run that dies halfway never
+// leaves a marker behind.
+func mark(path, host string) error {
+	line := fmt.Sprintf("host=%s finished=%s\n", host, time.Now().UTC().Format(time.RFC3339))
+	return writeFileAtomic(path, []byte(line), 0o600)
+}
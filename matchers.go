@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// listMatchers prints every rule, script step and trigger a session would
+// use, in the order they are tried, for -list-matchers. Passwords are never
+// printed; prelude answers, step and trigger responses are not secrets, so
+// they are.
+func listMatchers(w io.Writer, rules []*shallpass.Rule, script []*shallpass.Step, triggers []*shallpass.Trigger) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tKIND\tPATTERN\tSENDS")
+	n := 0
+	for _, r := range rules {
+		n++
+		kind, sends := r.Describe()
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", n, kind, r.Name, sends)
+	}
+	for _, s := range script {
+		n++
+		fmt.Fprintf(tw, "%d\tstep\t%s\t%s\n", n, s.Name, s.Describe())
+	}
+	for _, t := range triggers {
+		n++
+		fmt.Fprintf(tw, "%d\ttrigger\t%s\t%s\n", n, t.Name, t.Describe())
+	}
+	return tw.Flush()
+}
+
+// reportMatch says, for -verbose, which rule is answering line and which
+// of its patterns matched it.
+func reportMatch(w io.Writer, r *shallpass.Rule, line string) {
+	kind, _ := r.Describe()
+	fmt.Fprintf(w, "shallpass: %s rule answers %q: matched %q\n", kind, strings.TrimSpace(line), r.MatchedBy(line))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// sessionMetrics are written by -metrics-file in the Prometheus text
+// format, for node_exporter's textfile collector. Every series is labelled
+// with the host only; nothing in them comes near a secret.
+var sessionMetrics = []struct {
+	name, kind, help string
+}{
+	{"shallpass_sessions_total", "counter", "Sessions run against the host."},
+	{"shallpass_failures_total", "counter", "Sessions that ended with a non-zero exit status."},
+	{"shallpass_auth_failures_total", "counter", "Sessions where ssh itself failed after the password was sent."},
+	{"shallpass_auth_attempts_total", "counter", "Passwords and other secrets typed, over every connection."},
+	{"shallpass_connections_total", "counter", "Times ssh was started, reconnects included."},
+	{"shallpass_stdin_bytes_total", "counter", "Bytes of stdin passed on to ssh."},
+	{"shallpass_stdout_bytes_total", "counter", "Bytes ssh wrote to stdout."},
+	{"shallpass_stderr_bytes_total", "counter", "Bytes ssh wrote to stderr."},
+	{"shallpass_connect_seconds", "gauge", "Time from starting ssh to the password prompt, or to its first output without one, in the last session."},
+	{"shallpass_auth_seconds", "gauge", "Time the server took to answer the password in the last session."},
+	{"shallpass_session_duration_seconds", "gauge", "Duration of the last session."},
+	{"shallpass_last_exit_code", "gauge", "Exit status of the last session."},
+}
+
+// connectTime is how long the last connection of a session took to get to
+// the point of logging in: until the password prompt, or until ssh's first
+// output if nothing asked for one. It is zero if ssh never got that far.
+func connectTime(t shallpass.Timings) time.Duration {
+	if t.Prompt > 0 {
+		return t.Prompt
+	}
+	return t.FirstOutput
+}
+
+// metricLineRE matches the samples we write ourselves.
+var metricLineRE = regexp.MustCompile(`^(\w+)\{host="((?:[^"\\]|\\.)*)"\} (\S+)$`)
+
+// recordMetrics folds one session into the metrics file at path: the
+// counters for host go up, its gauges are replaced, and other hosts' series
+// are kept. The file is replaced atomically so the collector never reads
+// half of it.
+func recordMetrics(path, host string, res *shallpass.Result, code int) error {
+	samples := map[string]map[string]float64{}
+	for _, m := range sessionMetrics {
+		samples[m.name] = map[string]float64{}
+	}
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			m := metricLineRE.FindStringSubmatch(scanner.Text())
+			if m == nil || samples[m[1]] == nil {
+				continue
+			}
+			if v, err := strconv.ParseFloat(m[3], 64); err == nil {
+				samples[m[1]][unescapeLabel(m[2])] = v
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	// ssh's own error status after the password went out is as close to
+	// "wrong password" as the exit status gets.
+	failed := 0.0
+	if res.Prompted && res.ExitCode == shallpass.ExitSSHError {
+		failed = 1
+	}
+	failures := 0.0
+	if code != 0 {
+		failures = 1
+	}
+	samples["shallpass_sessions_total"][host]++
+	samples["shallpass_failures_total"][host] += failures
+	samples["shallpass_auth_failures_total"][host] += failed
+	samples["shallpass_auth_attempts_total"][host] += float64(res.SecretsSent)
+	samples["shallpass_connections_total"][host] += float64(res.Attempts)
+	samples["shallpass_stdin_bytes_total"][host] += float64(res.BytesIn)
+	samples["shallpass_stdout_bytes_total"][host] += float64(res.BytesOut)
+	samples["shallpass_stderr_bytes_total"][host] += float64(res.BytesErr)
+	samples["shallpass_connect_seconds"][host] = connectTime(res.Timings).Seconds()
+	samples["shallpass_auth_seconds"][host] = res.Timings.Auth.Seconds()
+	samples["shallpass_session_duration_seconds"][host] = res.Timings.Total.Seconds()
+	samples["shallpass_last_exit_code"][host] = float64(code)
+
+	var b strings.Builder
+	for _, m := range sessionMetrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		var hosts []string
+		for h := range samples[m.name] {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		for _, h := range hosts {
+			fmt.Fprintf(&b, "%s{host=\"%s\"} %s\n", m.name, escapeLabel(h), strconv.FormatFloat(samples[m.name][h], 'g', -1, 64))
+		}
+	}
+
+	// The collector runs as another user, and needs to read the file.
+	return writeFileAtomic(path, []byte(b.String()), 0o644)
+}
+
+// escapeLabel and unescapeLabel convert a label value to and from the
+// exposition format, which escapes backslash, double quote and newline.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func unescapeLabel(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n").Replace(s)
+}
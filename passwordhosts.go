@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// recordPasswordHost adds host to the -password-hosts-file, the worklist of
+// hosts that still take a password, unless it is already listed. Hosts are
+// written in their canonical form, one per line. Two runs adding the same
+// new host at once may both append it; the list is still usable.
+func recordPasswordHost(path, host string) error {
+	host = historyKey(host)
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		lines := bufio.NewScanner(f)
+		for lines.Scan() {
+			if strings.TrimSpace(lines.Text()) == host {
+				f.Close()
+				return nil
+			}
+		}
+		f.Close()
+		if err := lines.Err(); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := out.WriteString(host + "\n"); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/plop-systems/shallpass/internal/sshargs"
+)
+
+// controlDir is where -persist keeps its control sockets. Only the owner
+// may use them: a socket lets anyone who can reach it run commands on
+// the host without a password.
+func controlDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "shallpass")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return dir, os.Chmod(dir, 0o700)
+}
+
+// persistOptions are the ssh options -persist adds: a control master that
+// the first session starts and later ones to the same destination, user
+// and port reuse, which stays up for lifetime after the last of them.
+// With a zero lifetime there is only the ControlPath, which is what
+// -close needs to find the master.
+func persistOptions(lifetime time.Duration) ([]string, error) {
+	dir, err := controlDir()
+	if err != nil {
+		return nil, err
+	}
+	// %C is a hash of the connection, short enough for a socket path.
+	opts := []string{"-o", "ControlPath=" + filepath.Join(dir, "%C")}
+	if lifetime > 0 {
+		secs := int((lifetime + time.Second - 1) / time.Second)
+		opts = append(opts, "-o", "ControlMaster=auto", "-o", "ControlPersist="+strconv.Itoa(secs))
+	}
+	return opts, nil
+}
+
+// closeMaster tells the control master for args to exit, as -close does,
+// and returns the exit code of ssh -O exit: 255 when there is none.
+func closeMaster(sshBin string, args []string) int {
+	cmd := exec.Command(sshBin, sshargs.Insert(args, []string{"-O", "exit"})...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintln(os.Stderr, "shallpass:", err)
+		return 1
+	}
+	return 0
+}
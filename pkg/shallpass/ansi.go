@@ -0,0 +1,14 @@
+package shallpass
+
+import "regexp"
+
+// ansiRE matches the terminal escape sequences servers wrap prompts in:
+// CSI sequences such as colours (ESC [ ... final byte), OSC sequences such
+// as window titles (ESC ] ... BEL or ESC \), and two-byte escapes.
+var ansiRE = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// stripANSI removes escape sequences from line so "\x1b[1;32mPassword:\x1b[0m"
+// matches like "Password:".
+func stripANSI(line string) string {
+	return ansiRE.ReplaceAllString(line, "")
+}
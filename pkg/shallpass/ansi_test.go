@@ -0,0 +1,40 @@
+package shallpass
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripANSI(t *testing.T) {
+	for _, tc := range []struct{ line, want string }{
+		{"\x1b[1;32mPassword:\x1b[0m ", "Password: "},
+		{"\x1b[1;32mPassword\x1b[0m: ", "Password: "},
+		{"\x1b]0;db01\x07alice@db01's password: ", "alice@db01's password: "},
+		{"\x1b]0;db01\x1b\\password: ", "password: "},
+		{"\x1bMpass\x1b[Kword:", "password:"},
+		{"plain password: ", "plain password: "},
+	} {
+		if got := stripANSI(tc.line); got != tc.want {
+			t.Errorf("stripANSI(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestColouredPromptIsAnswered(t *testing.T) {
+	// The colour ends between the word and its colon, where it splits
+	// "password:" in two until it is stripped.
+	r := fakeRunner(t, `printf '\033[1;32mPassword\033[0m: ' >&2
+read pw
+echo "got $pw"`)
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "got secret\n" {
+		t.Errorf("exit %d, stdout %q; stderr %q", res.ExitCode, stdout, stderr)
+	}
+	// What is passed on keeps its colours.
+	if !strings.Contains(stderr, "\x1b[1;32mPassword\x1b[0m: ") {
+		t.Errorf("stderr %q lost its escapes", stderr)
+	}
+	if PasswordRule("secret\n", []string{"password:"}).Match("\x1b[1;32mPassword\x1b[0m: ") {
+		t.Error("the coloured prompt matches even unstripped; the test shows nothing")
+	}
+}
@@ -0,0 +1,114 @@
+package shallpass
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// errApprovalDenied means the approval service said no.
+var errApprovalDenied = errors.New("approval denied")
+
+// approvalRequest is what we POST to the -approval-url when a prompt
+// appears.
+type approvalRequest struct {
+	Host      string `json:"host"`
+	Prompt    string `json:"prompt"`
+	Requester string `json:"requester"`
+}
+
+// approvalResponse is the service's answer. The secret is only looked at
+// when the request was approved.
+type approvalResponse struct {
+	Approved bool   `json:"approved"`
+	Secret   string `json:"secret"`
+	Reason   string `json:"reason"`
+}
+
+// maxApprovalResponse bounds what we read from the service.
+const maxApprovalResponse = 64 << 10
+
+// ApprovalSource is a Rule.Source that asks an approval service for the
+// secret once the prompt appears, for just-in-time access: a person or a
+// policy engine decides, and the secret is only released to sessions it
+// approves. It is asked on behalf of Host, at URL.
+type ApprovalSource struct {
+	URL, Host string
+	// Timeout bounds the request, and Context, if set, cancels it.
+	Timeout time.Duration
+	Context context.Context
+
+	prompt string
+	line   io.Reader
+}
+
+// prompted is the prompt the secret is asked for; see secretFor.
+func (s *ApprovalSource) prompted(line string) { s.prompt = line }
+
+func (s *ApprovalSource) Read(p []byte) (int, error) {
+	if s.line == nil {
+		secret, err := s.ask()
+		if err != nil {
+			return 0, err
+		}
+		s.line = strings.NewReader(strings.TrimRight(secret, "\r\n") + "\n")
+	}
+	return s.line.Read(p)
+}
+
+// ask posts the request and waits for the decision. Errors never contain
+// the secret.
+func (s *ApprovalSource) ask() (string, error) {
+	body, err := json.Marshal(approvalRequest{Host: s.Host, Prompt: strings.TrimSpace(s.prompt), Requester: requester()})
+	if err != nil {
+		return "", err
+	}
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("approval: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("approval: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("approval: %s answered %s", s.URL, resp.Status)
+	}
+	var answer approvalResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxApprovalResponse)).Decode(&answer); err != nil {
+		return "", fmt.Errorf("approval: invalid response from %s: %v", s.URL, err)
+	}
+	if !answer.Approved {
+		if answer.Reason != "" {
+			return "", fmt.Errorf("%w: %s", errApprovalDenied, answer.Reason)
+		}
+		return "", errApprovalDenied
+	}
+	return answer.Secret, nil
+}
+
+// requester names who is asking for approval: user@machine.
+func requester() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	machine, _ := os.Hostname()
+	return name + "@" + machine
+}
@@ -0,0 +1,66 @@
+package shallpass
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// approvalService answers approval requests with answer, after delay, and
+// passes on each request it gets.
+func approvalService(t *testing.T, answer string, delay time.Duration) (url string, requests <-chan approvalRequest) {
+	got := make(chan approvalRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var r approvalRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			t.Errorf("approval request: %v", err)
+		}
+		got <- r
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+		w.Write([]byte(answer))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, got
+}
+
+func TestApprovalSource(t *testing.T) {
+	const script = `printf "alice@db1's password: " >&2
+read pw
+echo "got $pw"`
+	for _, tc := range []struct {
+		name, answer string
+		delay        time.Duration
+		code         int
+		stdout, msg  string
+	}{
+		{"approved", `{"approved":true,"secret":"jit-pw"}`, 0, 0, "got jit-pw\n", ""},
+		{"denied", `{"approved":false,"reason":"outside the change window"}`, 0, ExitApprovalDenied, "", "approval denied: outside the change window"},
+		{"no decision in time", `{"approved":true,"secret":"jit-pw"}`, 5 * time.Second, ExitReadPassword, "", "context deadline exceeded"},
+	} {
+		url, requests := approvalService(t, tc.answer, tc.delay)
+		r := fakeRunner(t, script)
+		r.Rules[0].Source = &ApprovalSource{URL: url, Host: "db1", Timeout: 300 * time.Millisecond}
+		start := time.Now()
+		res, stdout, stderr := runFake(t, r)
+		if res.ExitCode != tc.code || stdout != tc.stdout || !strings.Contains(stderr, tc.msg) {
+			t.Errorf("%s: exit %d, stdout %q, stderr %q; want exit %d, stdout %q and %q", tc.name, res.ExitCode, stdout, stderr, tc.code, tc.stdout, tc.msg)
+		}
+		if strings.Contains(stderr, "jit-pw") {
+			t.Errorf("%s: the secret is in stderr: %q", tc.name, stderr)
+		}
+		// Denied or undecided, ssh is not left waiting at the prompt.
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: the session took %v", tc.name, d)
+		}
+		if got := <-requests; got.Host != "db1" || got.Prompt != "alice@db1's password:" || got.Requester == "" {
+			t.Errorf("%s: the service was asked %+v", tc.name, got)
+		}
+	}
+}
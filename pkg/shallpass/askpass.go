@@ -0,0 +1,148 @@
+package shallpass
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// askpassEnv tells a shallpass process that ssh started it as its
+// SSH_ASKPASS program. The value is the socket the parent listens on.
+const askpassEnv = "SHALLPASS_ASKPASS"
+
+// askpassTokenEnv carries a random token the helper has to present with
+// each prompt, so that only the ssh we started can ask for a secret, not
+// whatever else finds the socket.
+const askpassTokenEnv = "SHALLPASS_ASKPASS_TOKEN"
+
+// Replies from the parent start with one of these bytes.
+const (
+	askpassOK   = '+'
+	askpassNone = '-'
+)
+
+// AskpassHelper must come first in the main function of a program whose
+// Runners set Askpass: ssh runs that same program as its SSH_ASKPASS, and
+// this is what answers it then. If the process is such a helper, it passes
+// the prompt ssh gave it in args to the Runner, prints the secret it gets
+// back for ssh to read, and returns the status to exit with and true;
+// non-zero tells ssh there is no answer. Otherwise it returns false.
+func AskpassHelper(args []string) (int, bool) {
+	socket := os.Getenv(askpassEnv)
+	if socket == "" {
+		return 0, false
+	}
+	return askpassHelper(socket, args), true
+}
+
+func askpassHelper(socket string, args []string) int {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shallpass askpass:", err)
+		return 1
+	}
+	defer conn.Close()
+
+	prompt := strings.ReplaceAll(strings.Join(args, " "), "\n", " ")
+	if _, err := io.WriteString(conn, os.Getenv(askpassTokenEnv)+"\n"+prompt+"\n"); err != nil {
+		fmt.Fprintln(os.Stderr, "shallpass askpass:", err)
+		return 1
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "shallpass askpass:", err)
+		return 1
+	}
+	if len(reply) == 0 || reply[0] != askpassOK {
+		return 1
+	}
+	os.Stdout.Write(append(reply[1:], '\n'))
+	return 0
+}
+
+// askpassServer answers the helper's requests on behalf of a session.
+type askpassServer struct {
+	dir      string
+	listener net.Listener
+	token    string
+}
+
+// startAskpass listens on a socket in a fresh private directory and returns
+// the environment ssh needs to use our helper.
+func startAskpass(inj *injector) (*askpassServer, []string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := os.MkdirTemp("", "shallpass-")
+	if err != nil {
+		return nil, nil, err
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	socket := filepath.Join(dir, "askpass.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	srv := &askpassServer{dir: dir, listener: l, token: hex.EncodeToString(token)}
+	go srv.serve(inj)
+
+	env := []string{
+		"SSH_ASKPASS=" + self,
+		"SSH_ASKPASS_REQUIRE=force",
+		askpassEnv + "=" + socket,
+		askpassTokenEnv + "=" + srv.token,
+	}
+	// Before SSH_ASKPASS_REQUIRE, ssh only used the helper when DISPLAY
+	// was set; any value will do.
+	if os.Getenv("DISPLAY") == "" {
+		env = append(env, "DISPLAY=shallpass:0")
+	}
+	return srv, env, nil
+}
+
+// serve answers one prompt per connection until the listener is closed.
+// A connection without the token gets nothing.
+func (srv *askpassServer) serve(inj *injector) {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			token, err := br.ReadString('\n')
+			if err != nil || subtle.ConstantTimeCompare([]byte(strings.TrimSuffix(token, "\n")), []byte(srv.token)) != 1 {
+				return
+			}
+			prompt, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if secret, ok := inj.askpass(strings.TrimSuffix(prompt, "\n")); ok {
+				io.WriteString(conn, string(askpassOK)+secret)
+				return
+			}
+			io.WriteString(conn, string(askpassNone))
+		}()
+	}
+}
+
+// Close stops serving and removes the socket.
+func (srv *askpassServer) Close() {
+	srv.listener.Close()
+	os.RemoveAll(srv.dir)
+}
@@ -0,0 +1,42 @@
+package shallpass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errNotAsked means ssh never asked for the password, so it was not
+// tested: the host let us in some other way, or failed before auth.
+var errNotAsked = errors.New("ssh did not ask for a password")
+
+// Authenticate reports whether password logs in to target. It connects,
+// answers the password prompt, and disconnects again without running
+// anything remotely but "true". A refused password is (false, nil); an
+// error means the check itself could not be made, including a host that
+// never asked for a password. The Runner is built by New from opts, so
+// they all apply as they do there, except that target and password take
+// the place of WithTarget and WithPassword, and "true" that of
+// WithCommand. A nil ctx is context.Background().
+func Authenticate(ctx context.Context, target string, password []byte, opts ...Option) (bool, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	r := New(append(opts[:len(opts):len(opts)], WithPassword(password), WithTarget(target), func(r *Runner) {
+		r.Args = append(r.Args, "-T")
+		r.command = []string{"true"}
+	})...)
+	r.Context = ctx
+
+	res, err := r.RunWithStdio(nil, io.Discard, io.Discard)
+	switch {
+	case err != nil:
+		return false, err
+	case ctx.Err() != nil:
+		return false, ctx.Err()
+	case !res.Prompted:
+		return false, fmt.Errorf("%w (ssh exited %d)", errNotAsked, res.ExitCode)
+	}
+	return res.ExitCode == 0, nil
+}
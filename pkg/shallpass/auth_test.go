@@ -0,0 +1,68 @@
+package shallpass
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// loginSSH is a fake ssh that takes "secret" and refuses anything else
+// the way OpenSSH does.
+const loginSSH = `printf 'password: ' >&2
+read pw
+[ "$pw" = secret ] && exit 0
+echo 'Permission denied, please try again.' >&2
+printf 'password: ' >&2
+read pw
+echo 'Permission denied (publickey,password).' >&2
+exit 255`
+
+func TestAuthenticate(t *testing.T) {
+	ssh := fakeSSH(t, loginSSH)
+	for _, tc := range []struct {
+		password string
+		want     bool
+	}{
+		{"secret", true},
+		{"wrong", false},
+	} {
+		ok, err := Authenticate(context.Background(), "host", []byte(tc.password), WithSSHPath(ssh))
+		if ok != tc.want || err != nil {
+			t.Errorf("Authenticate with %q = %v, %v; want %v, nil", tc.password, ok, err, tc.want)
+		}
+	}
+}
+
+func TestAuthenticateContextTimeout(t *testing.T) {
+	ssh := fakeSSH(t, "sleep 10")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	ok, err := Authenticate(ctx, "host", []byte("secret"), WithSSHPath(ssh))
+	if ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Authenticate = %v, %v; want false, %v", ok, err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Authenticate took %v after the deadline", d)
+	}
+}
+
+func TestAuthenticateNilContext(t *testing.T) {
+	ssh := fakeSSH(t, loginSSH)
+	ok, err := Authenticate(nil, "host", []byte("secret"), WithSSHPath(ssh))
+	if !ok || err != nil {
+		t.Errorf("Authenticate(nil, ...) = %v, %v; want true, nil", ok, err)
+	}
+}
+
+func TestAuthenticateArguments(t *testing.T) {
+	// Nothing runs remotely but true, whatever WithCommand says.
+	ssh := fakeSSH(t, `printf 'password: ' >&2
+read pw
+[ "$*" = "-p 2222 -T -- alice@host true" ]`)
+	ok, err := Authenticate(context.Background(), "alice@host", []byte("secret"), WithSSHPath(ssh), WithSSHArgs("-p", "2222"), WithCommand([]string{"rm", "-rf", "/"}))
+	if !ok || err != nil {
+		t.Errorf("Authenticate = %v, %v; want true, nil", ok, err)
+	}
+}
@@ -0,0 +1,19 @@
+// Package shallpass runs ssh and answers its password prompts, the way the
+// shallpass command does, for programs that want to do it themselves.
+//
+// A Runner holds the ssh command line and the Rules it answers prompts
+// with. New builds one from Options:
+//
+//	r := shallpass.New(
+//		shallpass.WithTarget("alice@example.com"),
+//		shallpass.WithPassword(password),
+//		shallpass.WithCommand([]string{"uptime"}),
+//	)
+//	code, err := r.Run(ctx)
+//
+// Run connects ssh to the process's own standard streams and returns the
+// code the shallpass command would exit with; RunWithStdio takes the
+// streams and returns the whole Result. Authenticate only checks that a
+// password is accepted; it takes the same Options, with its own target
+// and password in place of WithTarget and WithPassword.
+package shallpass
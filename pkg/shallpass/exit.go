@@ -0,0 +1,259 @@
+package shallpass
+
+import (
+	"errors"
+	"os/exec"
+	"regexp"
+	"syscall"
+)
+
+// Exit codes used by shallpass itself. Any other status is ssh's own, which
+// we pass through unchanged.
+const (
+	// ExitFailure is the catch-all when no better status is available.
+	ExitFailure = 1
+	// ExitUsage means the command line was invalid.
+	ExitUsage = 2
+	// ExitConflictingSources means the command line named more than one
+	// place to take the same secret from.
+	ExitConflictingSources = 3
+	// ExitWrongPassword means the server refused the password we sent,
+	// and every alternate -max-tries allowed. It is sshpass's code for
+	// the same thing.
+	ExitWrongPassword = 5
+	// ExitHostKeyUnknown and ExitHostKeyChanged are sshpass's codes for
+	// ssh refusing an unknown host key and a changed one, which
+	// Runner.SSHPassCodes reports instead of ExitSSHError.
+	ExitHostKeyUnknown = 6
+	ExitHostKeyChanged = 7
+	// ExitPasswordExpired means the server asked for a password change and
+	// no -new-password was given.
+	ExitPasswordExpired = 8
+	// ExitNoPrompt means ssh succeeded without ever asking for the
+	// password, and -require-prompt said it should have.
+	ExitNoPrompt = 9
+	// ExitPromptTimeout means no password prompt appeared within
+	// -prompt-timeout, on any attempt.
+	ExitPromptTimeout = 15
+	// ExitPromptForbidden means a password prompt appeared although
+	// -forbid-prompt said the host only takes keys.
+	ExitPromptForbidden = 16
+	// ExitTooManyInjections means the session asked for secrets more often
+	// than -max-injections allows.
+	ExitTooManyInjections = 17
+	// ExitPasswordEchoed means the server echoed a password back and
+	// -fail-on-echo was given.
+	ExitPasswordEchoed = 18
+	// ExitInternal means our own plumbing broke while ssh ran, for
+	// example copying its output failed, as opposed to ssh failing.
+	ExitInternal = 19
+	// ExitApprovalDenied means the -approval-url service turned the
+	// request for the secret down.
+	ExitApprovalDenied = 20
+	// ExitMFATimeout means a second factor answered with -mfa-choice was
+	// not approved within -mfa-timeout.
+	ExitMFATimeout = 21
+	// ExitIdleTimeout means the session wrote nothing, and was sent
+	// nothing, for -idle-timeout once it was under way.
+	ExitIdleTimeout = 22
+	// ExitPanic means shallpass itself crashed, which is a bug. The panic
+	// is reported without anything that could hold a secret.
+	ExitPanic = 23
+	// ExitFailureMarker means ssh exited 0 but its output matched
+	// -failure-marker, for gateways that swallow the real status.
+	ExitFailureMarker = 24
+	// ExitConnectTimeout means ssh wrote nothing at all for the
+	// -connect-timeout, so it never got as far as talking to the server.
+	ExitConnectTimeout = 25
+	// ExitTimeout means the whole run took longer than -timeout.
+	ExitTimeout = 26
+	// ExitScript means a -script step did not see what it expects in
+	// time, or the session ended before the script did.
+	ExitScript = 27
+	// ExitLockedOut means the server said it no longer takes logins from
+	// us, too many authentication failures or a locked account, so no
+	// more attempts were made.
+	ExitLockedOut = 28
+
+	// The wrapper failed while setting up the session, one code per step so
+	// a bare status in a CI log still says which step broke.
+	ExitReadPassword = 10
+	ExitStdinPipe    = 11
+	ExitOutputPipe   = 12
+	ExitStart        = 13
+	ExitAskpass      = 14
+
+	// ExitInterrupted means the session was cancelled, by a signal in the
+	// CLI; the CLI reports the usual 128+signal instead where it can.
+	ExitInterrupted = 130
+
+	// The ssh client could not be run at all. These follow the shell's
+	// conventions for "not executable" and "command not found".
+	ExitNotExecutable = 126
+	ExitNotFound      = 127
+)
+
+// ExitSSHError is the status ssh uses for its own errors (connection
+// refused, host key mismatch, ...) as opposed to the remote command's.
+const ExitSSHError = 255
+
+// exitReasons names our own exit codes for machine-readable output, where
+// the names stay put even if a number has to change. A new code gets its
+// name here.
+var exitReasons = map[int]string{
+	ExitFailure:            "failure",
+	ExitUsage:              "usage",
+	ExitConflictingSources: "conflicting_sources",
+	ExitWrongPassword:      "wrong_password",
+	ExitHostKeyUnknown:     "host_key_unknown",
+	ExitHostKeyChanged:     "host_key_changed",
+	ExitPasswordExpired:    "password_expired",
+	ExitNoPrompt:           "no_prompt",
+	ExitReadPassword:       "read_password_failed",
+	ExitStdinPipe:          "stdin_pipe_failed",
+	ExitOutputPipe:         "output_pipe_failed",
+	ExitStart:              "start_failed",
+	ExitAskpass:            "askpass_failed",
+	ExitPromptTimeout:      "prompt_timeout",
+	ExitPromptForbidden:    "prompt_forbidden",
+	ExitTooManyInjections:  "too_many_injections",
+	ExitPasswordEchoed:     "password_echoed",
+	ExitInternal:           "internal_error",
+	ExitApprovalDenied:     "approval_denied",
+	ExitMFATimeout:         "mfa_timeout",
+	ExitIdleTimeout:        "idle_timeout",
+	ExitFailureMarker:      "failure_marker",
+	ExitConnectTimeout:     "connect_timeout",
+	ExitTimeout:            "timeout",
+	ExitScript:             "script_failed",
+	ExitLockedOut:          "locked_out",
+	ExitPanic:              "panic",
+	ExitInterrupted:        "interrupted",
+	ExitNotExecutable:      "ssh_not_executable",
+	ExitNotFound:           "ssh_not_found",
+	ExitSSHError:           "ssh_error",
+}
+
+// sshFailures tell ssh's own failures (ExitSSHError) apart by the message
+// ssh printed, first match wins.
+var sshFailures = []struct {
+	re     *regexp.Regexp
+	reason string
+}{
+	{regexp.MustCompile(`Permission denied \(`), "auth_failed"},
+	{regexp.MustCompile(`Connection refused`), "connection_refused"},
+	// ssh warns about a changed key before it fails, so its warning is
+	// the first message seen; for an unknown key only the failure is.
+	{regexp.MustCompile(`REMOTE HOST IDENTIFICATION HAS CHANGED`), "host_key_changed"},
+	{regexp.MustCompile(`Host key verification failed`), "host_key_unknown"},
+	{regexp.MustCompile(`Connection timed out|Operation timed out`), "connection_timeout"},
+	{regexp.MustCompile(`Could not resolve hostname`), "host_not_found"},
+}
+
+// sshFailure returns the reason for the ssh error message in line, or "".
+func sshFailure(line string) string {
+	for _, f := range sshFailures {
+		if f.re.MatchString(line) {
+			return f.reason
+		}
+	}
+	return ""
+}
+
+// sshpassCodes are the codes sshpass gives ssh's own failures, by the
+// reason sshFailure found, for Runner.SSHPassCodes. sshpass has no code for
+// the other reasons, so those stay ExitSSHError.
+var sshpassCodes = map[string]int{
+	"auth_failed":      ExitWrongPassword,
+	"host_key_unknown": ExitHostKeyUnknown,
+	"host_key_changed": ExitHostKeyChanged,
+}
+
+// sshpassFailure is the failure Runner.SSHPassCodes makes of ssh exiting
+// with code for reason, or nil if the code stands.
+func (r *Runner) sshpassFailure(code int, reason string) *failure {
+	if !r.SSHPassCodes || code != ExitSSHError {
+		return nil
+	}
+	if c, ok := sshpassCodes[reason]; ok {
+		return &failure{code: c}
+	}
+	return nil
+}
+
+// SSHPassExit translates the codes shallpass gives a bad command line to
+// sshpass's, for callers that asked for sshpass's codes: ExitUsage becomes
+// 1, sshpass's "invalid arguments", and ExitConflictingSources 2, its
+// "conflicting arguments". Every other code is returned as it is.
+func SSHPassExit(code int) int {
+	switch code {
+	case ExitUsage:
+		return 1
+	case ExitConflictingSources:
+		return 2
+	}
+	return code
+}
+
+// ExitReason names one of our exit codes, as Result.Reason would: "usage",
+// "prompt_timeout" and so on.
+func ExitReason(code int) string {
+	return exitReason(code, true, "")
+}
+
+// exitReason names the status a session ended with. ours says the code is
+// one of ours rather than ssh's or the remote command's, and sshReason is
+// what sshFailure made of ssh's output.
+func exitReason(code int, ours bool, sshReason string) string {
+	switch {
+	case ours:
+		if name, ok := exitReasons[code]; ok {
+			return name
+		}
+		return exitReasons[ExitFailure]
+	case code == 0:
+		return "ok"
+	case code == ExitSSHError && sshReason != "":
+		return sshReason
+	case code == ExitSSHError:
+		return exitReasons[ExitSSHError]
+	}
+	return "remote_command_failed"
+}
+
+// pipeHint adds an explanation to errors that mean we ran out of file
+// descriptors, which is the usual reason creating a pipe fails.
+func pipeHint(err error) string {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return " (out of file descriptors; check ulimit -n)"
+	}
+	return ""
+}
+
+// exitStatus turns the result of cmd.Wait into the code we exit with.
+func exitStatus(waitErr error) int {
+	// If the command completed successfully (exit code 0), waitErr will be nil.
+	// In this case, we exit with 0.
+	if waitErr == nil {
+		return 0
+	}
+
+	// If the command failed, we try to extract the exit code.
+	// We can only do this if the error is of type *exec.ExitError.
+	if exitError, ok := waitErr.(*exec.ExitError); ok {
+		// A signal leaves no exit status; report it the way the shell
+		// would. Only Unix has them.
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		// Exit our program with the same code as the ssh process.
+		if code := exitError.ExitCode(); code >= 0 {
+			return code
+		}
+		return ExitFailure
+	}
+
+	// Any other error is ours: ssh may have been fine, but we could not
+	// deliver its output or collect its status.
+	return ExitInternal
+}
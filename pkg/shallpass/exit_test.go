@@ -0,0 +1,70 @@
+package shallpass
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSSHPassExit(t *testing.T) {
+	for code, want := range map[int]int{
+		ExitUsage:              1,
+		ExitConflictingSources: 2,
+		ExitWrongPassword:      ExitWrongPassword,
+		ExitHostKeyUnknown:     ExitHostKeyUnknown,
+		0:                      0,
+		ExitSSHError:           ExitSSHError,
+	} {
+		if got := SSHPassExit(code); got != want {
+			t.Errorf("SSHPassExit(%d) = %d, want %d", code, got, want)
+		}
+	}
+}
+
+func TestExitReason(t *testing.T) {
+	for _, tc := range []struct {
+		code      int
+		ours      bool
+		sshReason string
+		want      string
+	}{
+		{ExitWrongPassword, true, "", "wrong_password"},
+		{ExitSSHError, true, "", "ssh_error"},
+		{200, true, "", "failure"},
+		{0, false, "", "ok"},
+		{ExitSSHError, false, "auth_failed", "auth_failed"},
+		{ExitSSHError, false, "", "ssh_error"},
+		{1, false, "auth_failed", "remote_command_failed"},
+	} {
+		if got := exitReason(tc.code, tc.ours, tc.sshReason); got != tc.want {
+			t.Errorf("exitReason(%d, %v, %q) = %q, want %q", tc.code, tc.ours, tc.sshReason, got, tc.want)
+		}
+	}
+	if got := ExitReason(ExitPromptTimeout); got != "prompt_timeout" {
+		t.Errorf("ExitReason(ExitPromptTimeout) = %q", got)
+	}
+}
+
+func TestResultReason(t *testing.T) {
+	const login = "printf 'password: ' >&2\nread pw\n"
+	for _, tc := range []struct {
+		name, script string
+		code         int
+		reason       string
+	}{
+		{"ok", login + "echo hi", 0, "ok"},
+		{"the remote command fails", login + "exit 3", 3, "remote_command_failed"},
+		{"wrong password", login + "echo 'Permission denied, please try again.' >&2\nprintf 'password: ' >&2\nread pw\necho 'Permission denied (publickey,password).' >&2\nexit 255", ExitWrongPassword, "wrong_password"},
+		{"no method left", "echo 'user@host: Permission denied (publickey).' >&2\nexit 255", ExitSSHError, "auth_failed"},
+		{"connection refused", "echo 'ssh: connect to host h port 22: Connection refused' >&2\nexit 255", ExitSSHError, "connection_refused"},
+		{"host key changed", "echo '@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @' >&2\necho 'Host key verification failed.' >&2\nexit 255", ExitSSHError, "host_key_changed"},
+		{"unknown host key", "echo 'Host key verification failed.' >&2\nexit 255", ExitSSHError, "host_key_unknown"},
+		{"some other ssh error", "echo 'ssh: something broke' >&2\nexit 255", ExitSSHError, "ssh_error"},
+		{"prompt timeout", "exec sleep 5", ExitPromptTimeout, "prompt_timeout"},
+	} {
+		r := fakeRunner(t, tc.script)
+		r.PromptTimeout = 200 * time.Millisecond
+		if res, _, stderr := runFake(t, r); res.ExitCode != tc.code || res.Reason != tc.reason {
+			t.Errorf("%s: exit %d, reason %q; want %d, %q; stderr: %s", tc.name, res.ExitCode, res.Reason, tc.code, tc.reason, stderr)
+		}
+	}
+}
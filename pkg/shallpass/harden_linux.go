@@ -0,0 +1,17 @@
+package shallpass
+
+import "syscall"
+
+// prSetDumpable is PR_SET_DUMPABLE from <linux/prctl.h>.
+const prSetDumpable = 4
+
+// Harden keeps the secrets in this process's memory from leaking out of
+// it: the process is made non-dumpable, which leaves no core file when it
+// crashes and puts /proc/PID/mem, /proc/PID/environ and ptrace out of
+// reach of other processes running as the same user. Go strings can't be
+// wiped, so this is what keeps a secret that has been read from lying
+// around where it can be found. The programs we start are dumpable again
+// once they exec. It is best effort; an error is ignored.
+func Harden() {
+	syscall.RawSyscall(syscall.SYS_PRCTL, prSetDumpable, 0, 0)
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package shallpass
+
+// Harden does nothing outside Linux, where there is no portable way to
+// keep other processes of the same user out of ours.
+func Harden() {}
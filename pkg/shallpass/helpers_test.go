@@ -0,0 +1,80 @@
+package shallpass
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeSSH writes script to an executable shell script that stands in for
+// ssh, and returns its path. The script gets the Runner's Args as "$@".
+func fakeSSH(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ssh programs are shell scripts")
+	}
+	path := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fixtureSSH is fakeSSH for the script in testdata/name.
+func fixtureSSH(t *testing.T, name string) string {
+	t.Helper()
+	script, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fakeSSH(t, string(script))
+}
+
+// fakeRunner is a Runner for the fake ssh in script, scanning both streams
+// for a "password:" prompt answered with "secret".
+func fakeRunner(t *testing.T, script string) *Runner {
+	return &Runner{
+		SSHPath:    fakeSSH(t, script),
+		Rules:      []*Rule{PasswordRule("secret\n", []string{"password:"})},
+		ScanStdout: true,
+		ScanStderr: true,
+	}
+}
+
+// runFake runs r with no stdin and returns its Result and what it wrote
+// to stdout and stderr.
+func runFake(t *testing.T, r *Runner) (*Result, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	res, err := r.RunWithStdio(nil, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("RunWithStdio: %v\nstderr: %s", err, stderr.String())
+	}
+	return res, stdout.String(), stderr.String()
+}
+
+// triggerOn is a trigger that answers lines containing text with response,
+// at most max times.
+func triggerOn(text, response string, max int) *Trigger {
+	return &Trigger{
+		Name:     text,
+		Match:    func(line string) bool { return strings.Contains(line, text) },
+		Response: response,
+		Max:      max,
+	}
+}
+
+// testInjector is an injector for rules alone, writing to nowhere.
+func testInjector(rules ...*Rule) *injector {
+	return &injector{rules: rules, stdin: nopWriteCloser{}, stderr: io.Discard, times: &timeline{}, log: (&Runner{}).logger()}
+}
+
+// nopWriteCloser stands in for ssh's stdin in tests of the injector alone.
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopWriteCloser) Close() error                { return nil }
@@ -0,0 +1,82 @@
+package shallpass
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A PromptMatch is a line of scanned output that no Rule answered, for
+// Runner.OnPrompt to answer if it knows how.
+type PromptMatch struct {
+	// Stream is where the line was written: "stdout", "stderr", or
+	// "terminal" under TTY.
+	Stream string
+	// Line is the line without its line ending and, unless KeepANSI is
+	// set, without terminal escape sequences.
+	Line string
+	// Partial says no newline has come yet, so the line may still grow.
+	// A prompt waiting for its answer does not.
+	Partial bool
+	// Prompted says a secret has already been sent, so the login is past
+	// its password: a second factor asks then.
+	Prompted bool
+}
+
+// askHook offers line, from stream, to Runner.OnPrompt and sends its
+// response, reporting whether it gave one. An unfinished line it answered
+// is not offered again while it grows. The lock must be held.
+func (inj *injector) askHook(stream, line string, partial bool) bool {
+	if inj.onPrompt == nil {
+		return false
+	}
+	if inj.promptHold {
+		inj.promptHold = partial
+		return false
+	}
+	response, err := inj.onPrompt(PromptMatch{Stream: stream, Line: line, Partial: partial, Prompted: inj.injections > 0})
+	if err != nil {
+		inj.fail(ExitReadPassword, fmt.Sprintf("OnPrompt failed to answer %q: %v", strings.TrimSpace(line), err))
+		return true
+	}
+	if response == nil {
+		return false
+	}
+	inj.promptHold = partial
+	// Like a rule's secret, it is registered for redaction before it is
+	// sent.
+	if s := bytes.TrimRight(response, "\r\n"); len(s) > 0 {
+		inj.secrets = append(inj.secrets, s)
+		if inj.onSecret != nil {
+			inj.onSecret(s)
+		}
+		inj.guard.arm(response, time.Now())
+	}
+	inj.log.Info("OnPrompt answers", "line", inj.logText(strings.TrimSpace(line)))
+	inj.write(response)
+	return true
+}
+
+// outputHook is an io.Writer handing what it gets to Runner.OnOutput, for
+// the output of a stream that is no longer scanned.
+type outputHook struct {
+	stream   string
+	onOutput func(stream string, chunk []byte)
+}
+
+func (h outputHook) Write(p []byte) (int, error) {
+	h.onOutput(h.stream, p)
+	return len(p), nil
+}
+
+// drain reads the rest of r, a stream that is no longer scanned, so the
+// terminal still gets it all, passing it to OnOutput if that is set.
+func (inj *injector) drain(r io.Reader, stream string) {
+	if inj.onOutput == nil {
+		io.Copy(io.Discard, r)
+		return
+	}
+	io.Copy(outputHook{stream, inj.onOutput}, r)
+}
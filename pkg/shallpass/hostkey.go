@@ -0,0 +1,32 @@
+package shallpass
+
+import (
+	"fmt"
+)
+
+// TrustedHostKeyRule is HostKeyRule for a host whose key is known ahead
+// of time: it answers yes only if the fingerprint ssh printed for the
+// unknown key, such as "SHA256:...", is one of fingerprints, and no, with a
+// warning, for any other.
+func TrustedHostKeyRule(fingerprints []string) *Rule {
+	r := HostKeyRule(true)
+	r.hostKeys = append([]string{}, fingerprints...)
+	return r
+}
+
+// hostKeyAnswer is the answer to the host key question under a rule that
+// only accepts the fingerprints allowed: yes for one of those, no for any
+// other key or if ssh showed none. The lock must be held.
+func (inj *injector) hostKeyAnswer(allowed []string) string {
+	for _, fp := range allowed {
+		if inj.fingerprint == fp {
+			return "yes\n"
+		}
+	}
+	if inj.fingerprint == "" {
+		fmt.Fprintln(inj.stderr, "shallpass: warning: ssh showed no fingerprint for the unknown host key, so it is not trusted (-accept-hostkey)")
+	} else {
+		fmt.Fprintf(inj.stderr, "shallpass: warning: the host key %s %s is not one -accept-hostkey allows, so it is not trusted\n", inj.keyType, inj.fingerprint)
+	}
+	return "no\n"
+}
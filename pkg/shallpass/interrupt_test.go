@@ -0,0 +1,86 @@
+package shallpass
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// typedSSH is a fake ssh that prompts after pause and copies everything
+// typed at it to got. The copy runs in a process of its own, which outlives
+// ssh being killed: got ends up with every byte that reached ssh's stdin,
+// and got.done shows up once there can be no more.
+func typedSSH(t *testing.T, got, pause string) *Runner {
+	r := fakeRunner(t, fmt.Sprintf(`exec 3<&0
+{ cat >'%[1]s'; touch '%[1]s.done'; } <&3 >/dev/null 2>&1 &
+sleep %[2]s
+printf 'password: '
+wait`, got, pause))
+	r.TypeDelay = 30 * time.Millisecond
+	return r
+}
+
+func TestInterruptDuringTyping(t *testing.T) {
+	for _, tc := range []struct {
+		name, pause string
+		// cancel is called with the bytes that have got to ssh so far, until
+		// it reports that it has cancelled.
+		cancel func(typed int) bool
+		want   string
+	}{
+		{"while the secret is typed", "0", func(typed int) bool { return typed > 0 }, "secret\n"},
+		{"before the prompt", "5", func(int) bool { return true }, ""},
+	} {
+		got := filepath.Join(t.TempDir(), "typed")
+		r := typedSSH(t, got, tc.pause)
+		ctx, cancel := context.WithCancel(context.Background())
+		r.Context = ctx
+		go func() {
+			for {
+				fi, err := os.Stat(got)
+				if err == nil && tc.cancel(int(fi.Size())) {
+					cancel()
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+		res, _, stderr := runFake(t, r)
+		cancel()
+		if res.ExitCode != ExitInterrupted {
+			t.Errorf("%s: exit %d, want %d; stderr: %s", tc.name, res.ExitCode, ExitInterrupted, stderr)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for _, err := os.Stat(got + ".done"); err != nil; _, err = os.Stat(got + ".done") {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: ssh's stdin was never closed", tc.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if typed, _ := os.ReadFile(got); string(typed) != tc.want {
+			t.Errorf("%s: ssh got %q, want %q", tc.name, typed, tc.want)
+		}
+	}
+}
+
+func TestTypeDelaySpacesTheBytes(t *testing.T) {
+	// The fake reads the answer a byte at a time, a line for each.
+	r := fakeRunner(t, `printf 'password: ' >&2
+for i in 1 2 3 4 5 6 7; do
+	dd bs=1 count=1 2>/dev/null
+	echo
+done`)
+	r.TypeDelay = 50 * time.Millisecond
+	start := time.Now()
+	res, stdout, stderr := runFake(t, r)
+	if want := "s\ne\nc\nr\ne\nt\n\n\n"; res.ExitCode != 0 || stdout != want {
+		t.Fatalf("exit %d, stdout %q, want %q; stderr: %s", res.ExitCode, stdout, want, stderr)
+	}
+	// Seven bytes, six pauses between them.
+	if d := time.Since(start); d < 6*r.TypeDelay {
+		t.Errorf("the secret was typed in %v, want at least %v", d, 6*r.TypeDelay)
+	}
+}
@@ -0,0 +1,51 @@
+package shallpass
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keychainSecret looks up the secret stored in the OS keychain under
+// spec, written SERVICE or SERVICE/ACCOUNT: through security(1) in the
+// login keychain on macOS, and elsewhere through secret-tool(1) in the
+// Secret Service (GNOME Keyring, KWallet), where it is stored with
+// "secret-tool store --label=... service SERVICE account ACCOUNT".
+func keychainSecret(spec string) (string, error) {
+	service, account, _ := strings.Cut(spec, "/")
+	if service == "" {
+		return "", fmt.Errorf("keychain:%s names no service", spec)
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		args := []string{"find-generic-password", "-s", service, "-w"}
+		if account != "" {
+			args = append(args, "-a", account)
+		}
+		cmd = exec.Command("security", args...)
+	} else {
+		args := []string{"lookup", "service", service}
+		if account != "" {
+			args = append(args, "account", account)
+		}
+		cmd = exec.Command("secret-tool", args...)
+	}
+	// Only what the tool says about a failure is reported, never what it
+	// printed on stdout.
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", fmt.Errorf("keychain:%s: %s: %v", spec, cmd.Args[0], err)
+	}
+	if len(out) == 0 {
+		return "", fmt.Errorf("keychain:%s: no secret stored", spec)
+	}
+	secret, _, _ := strings.Cut(string(out), "\n")
+	return secret, nil
+}
@@ -0,0 +1,100 @@
+package shallpass
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// promptLanguages lists known password prompts by language. Entries are
+// matched as lowercase substrings of a line, so adding a language is just a
+// new row here.
+var promptLanguages = []struct {
+	lang    string
+	prompts []string
+}{
+	{"en", []string{"password:"}},
+	{"de", []string{"passwort:", "kennwort:"}},
+	{"fr", []string{"mot de passe:", "mot de passe :"}},
+	{"es", []string{"contraseña:", "clave:"}},
+	{"pt", []string{"senha:"}},
+	{"nl", []string{"wachtwoord:"}},
+	// Network gear and appliances that don't use the usual wording.
+	{"appliance", []string{"passcode:", "enter password", "login password"}},
+}
+
+// PromptsForLangs resolves a -lang value (a comma-separated list of table
+// keys, or "all") to the prompt strings to look for.
+func PromptsForLangs(value string) ([]string, error) {
+	var prompts []string
+	for _, lang := range strings.Split(value, ",") {
+		lang = strings.TrimSpace(lang)
+		found := false
+		for _, l := range promptLanguages {
+			if lang == "all" || lang == l.lang {
+				prompts = append(prompts, l.prompts...)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown language %q", lang)
+		}
+	}
+	return prompts, nil
+}
+
+// LangNames lists the keys accepted by -lang, for the usage message.
+func LangNames() string {
+	names := []string{"all"}
+	for _, l := range promptLanguages {
+		names = append(names, l.lang)
+	}
+	return strings.Join(names, ", ")
+}
+
+// LoadPromptPatterns reads a -prompt-regexp-file: one regular expression
+// per line, for prompts of device types no language pack knows. Blank
+// lines and lines starting with # are skipped.
+func LoadPromptPatterns(path string) ([]*regexp.Regexp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []*regexp.Regexp
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, sc.Err()
+}
+
+// AddPromptPatterns makes r also answer lines matching any of patterns.
+func AddPromptPatterns(r *Rule, patterns []*regexp.Regexp) {
+	match := r.Match
+	if len(r.patterns) == 0 {
+		r.patterns = []pattern{{r.Name, match}}
+	}
+	for _, re := range patterns {
+		r.Name += "|" + re.String()
+		r.patterns = append(r.patterns, pattern{re.String(), re.MatchString})
+	}
+	r.Match = func(line string) bool {
+		for _, re := range patterns {
+			if re.MatchString(line) {
+				return true
+			}
+		}
+		return match(line)
+	}
+}
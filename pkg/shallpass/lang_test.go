@@ -0,0 +1,58 @@
+package shallpass
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPromptsForLangs(t *testing.T) {
+	all, err := PromptsForLangs("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range promptLanguages {
+		for _, p := range l.prompts {
+			if !slices.Contains(all, p) {
+				t.Errorf("all lacks %s's %q", l.lang, p)
+			}
+		}
+	}
+	if got, err := PromptsForLangs("en, de"); err != nil || !slices.Equal(got, []string{"password:", "passwort:", "kennwort:"}) {
+		t.Errorf(`PromptsForLangs("en, de") = %q, %v`, got, err)
+	}
+	if _, err := PromptsForLangs("en,xx"); err == nil {
+		t.Error("no error for an unknown language")
+	}
+
+	en, _ := PromptsForLangs("en")
+	for _, tc := range []struct {
+		prompts []string
+		line    string
+		want    bool
+	}{
+		{all, "Passwort: ", true},
+		{all, "alice@db01's PASSWORT:", true},
+		{all, "Mot de passe : ", true},
+		{en, "Passwort: ", false},
+		{all, "Passwortänderung erforderlich", false},
+	} {
+		if got := PasswordRule("secret\n", tc.prompts).Match(tc.line); got != tc.want {
+			t.Errorf("%q with %d prompts: match %v, want %v", tc.line, len(tc.prompts), got, tc.want)
+		}
+	}
+}
+
+func TestGermanPromptIsAnswered(t *testing.T) {
+	all, err := PromptsForLangs("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := fakeRunner(t, `printf 'Passwort: ' >&2
+read pw
+echo "got $pw"`)
+	r.Rules = []*Rule{PasswordRule("geheim\n", all)}
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || !res.Prompted || stdout != "got geheim\n" {
+		t.Errorf("exit %d, prompted %v, stdout %q; stderr: %s", res.ExitCode, res.Prompted, stdout, stderr)
+	}
+}
@@ -0,0 +1,104 @@
+package shallpass
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// An AuthLimiter caps how many sessions may be logging in at once, across
+// the Runners that share it. Hosts behind one authentication service, or
+// one lockout policy, tend to take a burst of logins for an attack. A
+// session holds its slot from before ssh starts until the server has
+// replied to its password, or until it ends, which for one that logs in
+// with a key and never prompts is the whole session.
+type AuthLimiter struct {
+	slots chan struct{}
+}
+
+// NewAuthLimiter returns an AuthLimiter for n sessions at a time.
+func NewAuthLimiter(n int) *AuthLimiter {
+	return &AuthLimiter{slots: make(chan struct{}, max(n, 1))}
+}
+
+// acquire waits for a free slot, or for ctx to be done, and returns the
+// function that hands the slot back, which may be called more than once.
+// A nil AuthLimiter has a slot for everyone.
+func (l *AuthLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-l.slots }) }, nil
+}
+
+// lockoutRE matches what servers say when they stop taking logins from
+// us: OpenSSH disconnecting after MaxAuthTries, and PAM reporting an
+// account locked after too many failures.
+var lockoutRE = regexp.MustCompile(`(?i)too many authentication failures|maximum authentication attempts exceeded|account (?:is |has been )?(?:temporarily )?locked`)
+
+// maxRetryBackoff caps the doubling RetryBackoff.
+const maxRetryBackoff = time.Minute
+
+// retryDelay is how long to wait before connection number attempt+1, for
+// a first wait of base: base, then twice that each time, up to
+// maxRetryBackoff.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+// backOff waits the RetryBackoff before connection number attempt+1,
+// reporting false if the Context was done first.
+func (r *Runner) backOff(attempt int) bool {
+	if r.RetryBackoff <= 0 {
+		return true
+	}
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := time.NewTimer(retryDelay(r.RetryBackoff, attempt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// lockedOut reports whether a session that ended with code, or failure f,
+// did so because the server locked it out: ssh gave up (ExitSSHError), or
+// we did after a refused password, once a lockout message was seen.
+// Output from a remote command that got in never counts.
+func lockedOut(f *failure, code int, inj *injector) bool {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if !inj.lockout {
+		return false
+	}
+	if f != nil {
+		return f.code == ExitWrongPassword
+	}
+	return code == ExitSSHError
+}
+
+// limitError is the SetupError for a session whose context was done
+// while it waited for an AuthLimiter slot.
+func limitError(err error) error {
+	if errors.Is(err, errTimeout) {
+		return &SetupError{ExitTimeout, errors.New("the run took too long waiting for its turn to log in")}
+	}
+	return &SetupError{ExitInterrupted, errors.New("interrupted while waiting for a turn to log in")}
+}
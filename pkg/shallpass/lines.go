@@ -0,0 +1,163 @@
+package shallpass
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// timestampLayout is what -timestamps puts in front of each line: RFC 3339
+// with milliseconds, which is precise enough to see latency and still sorts.
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// PrefixWriter writes every complete line to an underlying writer as
+// prefix+line in a single Write, holding a mutex while it does so. Writers
+// for several sessions that share the mutex and the terminal therefore
+// never mix parts of their lines.
+type PrefixWriter struct {
+	// Timestamp, if set, is a time layout; each line then starts with the
+	// time it was completed, before the prefix.
+	Timestamp string
+
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+// NewPrefixWriter returns a PrefixWriter for w. Pass the same mu to every
+// writer that ends up on the same output; nil gives the writer its own.
+func NewPrefixWriter(w io.Writer, prefix string, mu *sync.Mutex) *PrefixWriter {
+	if mu == nil {
+		mu = new(sync.Mutex)
+	}
+	return &PrefixWriter{mu: mu, w: w, prefix: prefix}
+}
+
+// Write buffers p and writes out each complete line it finishes.
+func (pw *PrefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := pw.writeLine(pw.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		pw.buf = pw.buf[i+1:]
+	}
+}
+
+// Flush writes out a final line that never got its newline, adding one.
+// Call it once the session is over.
+func (pw *PrefixWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	err := pw.writeLine(append(pw.buf, '\n'))
+	pw.buf = nil
+	return err
+}
+
+func (pw *PrefixWriter) writeLine(line []byte) error {
+	out := make([]byte, 0, len(pw.prefix)+len(line))
+	if pw.Timestamp != "" {
+		out = time.Now().AppendFormat(out, pw.Timestamp)
+		out = append(out, ' ')
+	}
+	out = append(out, pw.prefix...)
+	out = append(out, line...)
+	_, err := pw.w.Write(out)
+	return err
+}
+
+// traffic counts the bytes of one session for Runner.CountBytes: what was
+// passed on to ssh from stdin, and what it wrote to stdout and stderr.
+type traffic struct {
+	in, out, err atomic.Int64
+}
+
+// writer returns a writer that counts into out, or err for stderr.
+func (t *traffic) writer(stderr bool) io.Writer {
+	if stderr {
+		return byteCounter{&t.err}
+	}
+	return byteCounter{&t.out}
+}
+
+// record puts the counts, and how many secrets inj sent, into res. The
+// lock must not be held.
+func (t *traffic) record(res *Result, inj *injector) {
+	res.BytesIn, res.BytesOut, res.BytesErr = t.in.Load(), t.out.Load(), t.err.Load()
+	inj.mu.Lock()
+	res.SecretsSent = inj.injections
+	inj.mu.Unlock()
+}
+
+// byteCounter adds the length of every write to n and discards it.
+type byteCounter struct{ n *atomic.Int64 }
+
+func (c byteCounter) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// countingReader adds the length of every read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// cutoffWriter forwards writes to w until cut is called. The next write
+// after that closes w instead, so whoever reads the other end sees EOF,
+// and everything from then on is dropped. Writes must come from a single
+// goroutine; cut may be called from any.
+type cutoffWriter struct {
+	w      io.WriteCloser
+	done   atomic.Bool
+	closed bool
+}
+
+func (cw *cutoffWriter) Write(p []byte) (int, error) {
+	if !cw.done.Load() {
+		return cw.w.Write(p)
+	}
+	if !cw.closed {
+		cw.w.Close()
+		cw.closed = true
+	}
+	return len(p), nil
+}
+
+// cut stops forwarding.
+func (cw *cutoffWriter) cut() {
+	cw.done.Store(true)
+}
+
+// lockedWriter serialises writes to w, for a writer that ssh's output and
+// our own messages reach from different goroutines.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
@@ -0,0 +1,110 @@
+package shallpass
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"one line", []string{"up 3 days\n"}, "[web1] up 3 days\n"},
+		{"several in one write", []string{"a\nb\n"}, "[web1] a\n[web1] b\n"},
+		{"a line over writes", []string{"up ", "3 days", "\n"}, "[web1] up 3 days\n"},
+		{"no newline at the end", []string{"a\nb"}, "[web1] a\n[web1] b\n"},
+		{"an empty line", []string{"\n"}, "[web1] \n"},
+		{"nothing", nil, ""},
+	} {
+		var out bytes.Buffer
+		pw := NewPrefixWriter(&out, "[web1] ", nil)
+		for _, w := range tc.writes {
+			if n, err := pw.Write([]byte(w)); n != len(w) || err != nil {
+				t.Fatalf("%s: Write(%q) = %d, %v", tc.name, w, n, err)
+			}
+		}
+		pw.Flush()
+		if out.String() != tc.want {
+			t.Errorf("%s: wrote %q, want %q", tc.name, out.String(), tc.want)
+		}
+	}
+}
+
+func TestPrefixWritersShareLines(t *testing.T) {
+	// Sessions on one output never mix parts of their lines, and none is
+	// lost. Run with -race.
+	const writers, lines = 8, 200
+	var out bytes.Buffer
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		pw := NewPrefixWriter(&out, fmt.Sprintf("[%d] ", i), &mu)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				pw.Write([]byte("one "))
+				pw.Write([]byte("line\nand "))
+				pw.Write([]byte("another\n"))
+			}
+			pw.Flush()
+		}()
+	}
+	wg.Wait()
+	seen := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		prefix, text, _ := strings.Cut(line, " ")
+		if text != "one line" && text != "and another" {
+			t.Fatalf("mixed line %q", line)
+		}
+		seen[prefix]++
+	}
+	for i := 0; i < writers; i++ {
+		if n := seen[fmt.Sprintf("[%d]", i)]; n != 2*lines {
+			t.Errorf("[%d] wrote %d lines, want %d", i, n, 2*lines)
+		}
+	}
+}
+
+func TestPrefixWriterTimestamp(t *testing.T) {
+	var out bytes.Buffer
+	pw := NewPrefixWriter(&out, "[db] ", nil)
+	pw.Timestamp = timestampLayout
+	pw.Write([]byte("ready\n"))
+	if !regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}(Z|[+-]\d\d:\d\d) \[db\] ready\n$`).MatchString(out.String()) {
+		t.Errorf("wrote %q", out.String())
+	}
+}
+
+func TestTimestampsOnEveryLine(t *testing.T) {
+	// The prompt has no newline, and is answered all the same: it is
+	// matched as it arrives, not once a stamped line is complete.
+	r := fakeRunner(t, `echo 'Connected to db01.'
+printf 'password: ' >&2
+read pw
+echo "got $pw"
+printf 'one\ntwo\n'`)
+	r.Timestamps = true
+	r.PromptTimeout = 5 * time.Second
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || !res.Prompted {
+		t.Fatalf("exit %d, prompted %v; stderr %q", res.ExitCode, res.Prompted, stderr)
+	}
+	stamp := `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}(Z|[+-]\d\d:\d\d) `
+	if !regexp.MustCompile(`^` + stamp + `Connected to db01\.\n` + stamp + `got secret\n` + stamp + `one\n` + stamp + `two\n$`).MatchString(stdout) {
+		t.Errorf("stdout %q: want every line stamped", stdout)
+	}
+	if !regexp.MustCompile(`^` + stamp + `password: \n$`).MatchString(stderr) {
+		t.Errorf("stderr %q: want the prompt stamped", stderr)
+	}
+	if res.Timings.Prompt > time.Second {
+		t.Errorf("the prompt took %v to be answered", res.Timings.Prompt)
+	}
+}
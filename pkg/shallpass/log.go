@@ -0,0 +1,49 @@
+package shallpass
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// nopHandler is the slog.Handler of a Runner without a Logger: it turns
+// every record down before anything is formatted.
+type nopHandler struct{}
+
+func (nopHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (nopHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h nopHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h nopHandler) WithGroup(string) slog.Handler           { return h }
+
+// logger is r.Logger, or one that logs nothing.
+func (r *Runner) logger() *slog.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return slog.New(nopHandler{})
+}
+
+// maxLogLine is how much of a line of output a log record quotes.
+const maxLogLine = 200
+
+// logText is text as the log may show it: with every secret replaced by
+// ***, those of the rules and those read once asked for that were sent so
+// far, and cut short if it is long. The lock must be held.
+func (inj *injector) logText(text string) string {
+	for _, r := range inj.rules {
+		if s := strings.TrimRight(r.Secret, "\r\n"); s != "" && r.isSecret() {
+			text = strings.ReplaceAll(text, s, "***")
+		}
+		if s := bytes.TrimRight(r.SecretBytes, "\r\n"); len(s) > 0 && r.isSecret() {
+			text = string(bytes.ReplaceAll([]byte(text), s, []byte("***")))
+		}
+	}
+	for _, s := range inj.secrets {
+		text = string(bytes.ReplaceAll([]byte(text), s, []byte("***")))
+	}
+	if len(text) > maxLogLine {
+		text = text[:maxLogLine] + "..."
+	}
+	return text
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package shallpass
+
+// lockMemory and unlockMemory do nothing where there is no mlock.
+func lockMemory(b []byte)   {}
+func unlockMemory(b []byte) {}
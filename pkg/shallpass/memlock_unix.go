@@ -0,0 +1,20 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package shallpass
+
+import "golang.org/x/sys/unix"
+
+// lockMemory keeps the pages holding b in RAM, out of swap, until
+// unlockMemory. It is best effort: past RLIMIT_MEMLOCK it fails, and the
+// error is ignored.
+func lockMemory(b []byte) {
+	if len(b) > 0 {
+		unix.Mlock(b)
+	}
+}
+
+func unlockMemory(b []byte) {
+	if len(b) > 0 {
+		unix.Munlock(b)
+	}
+}
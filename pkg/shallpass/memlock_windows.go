@@ -0,0 +1,24 @@
+//go:build windows
+
+package shallpass
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockMemory keeps the pages holding b in RAM, out of the paging file,
+// until unlockMemory. It is best effort: past the working set's minimum
+// size it fails, and the error is ignored.
+func lockMemory(b []byte) {
+	if len(b) > 0 {
+		windows.VirtualLock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	}
+}
+
+func unlockMemory(b []byte) {
+	if len(b) > 0 {
+		windows.VirtualUnlock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	}
+}
@@ -0,0 +1,735 @@
+package shallpass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/plop-systems/shallpass/internal/sshargs"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// nativeTarget is what the native backend makes of ssh arguments: where
+// to connect, as whom, and what to run there.
+type nativeTarget struct {
+	user, host, port string
+	network          string
+	command          string
+	// tty is 1 for -t, -1 for -T and 0 to decide by whether stdin is a
+	// terminal and there is no command, as ssh does.
+	tty            int
+	identities     []string
+	noPubkey       bool
+	knownHosts     []string
+	strict         string
+	connectTimeout time.Duration
+	keepalive      time.Duration
+}
+
+// parseNativeArgs reads the ssh arguments the native backend understands.
+// Options it can't honour are an error rather than silently ignored.
+func parseNativeArgs(args []string) (*nativeTarget, error) {
+	_, rest := sshargs.Split(args)
+	if len(rest) == 0 {
+		return nil, errors.New("no destination in the ssh arguments")
+	}
+	opts := sshargs.Options(args)
+	t := &nativeTarget{network: "tcp", command: strings.Join(sshargs.Command(args), " ")}
+	t.user, t.host, t.port = splitDestination(rest[0])
+
+	for _, o := range opts {
+		switch o.Flag {
+		case 'p':
+			t.port = o.Value
+		case 'l':
+			t.user = o.Value
+		case 'i':
+			t.identities = append(t.identities, o.Value)
+		case '4':
+			t.network = "tcp4"
+		case '6':
+			t.network = "tcp6"
+		case 't':
+			t.tty = 1
+		case 'T':
+			t.tty = -1
+		case 'q', 'v', 'C':
+			// Quiet, verbose and compression make no difference here.
+		case 'o':
+			if err := t.config(o.Value); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("ssh option -%c is not supported by the native backend", o.Flag)
+		}
+	}
+	if t.user == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("no user name: %v", err)
+		}
+		t.user = u.Username
+	}
+	if t.port == "" {
+		t.port = "22"
+	}
+	if len(t.knownHosts) == 0 {
+		if home, err := os.UserHomeDir(); err == nil {
+			t.knownHosts = []string{filepath.Join(home, ".ssh", "known_hosts")}
+		}
+	}
+	return t, nil
+}
+
+// config applies one -o option.
+func (t *nativeTarget) config(option string) error {
+	key, value := sshargs.SplitConfig(option)
+	switch strings.ToLower(key) {
+	case "port":
+		t.port = value
+	case "user":
+		t.user = value
+	case "identityfile":
+		t.identities = append(t.identities, value)
+	case "pubkeyauthentication":
+		t.noPubkey = strings.EqualFold(value, "no")
+	case "userknownhostsfile":
+		t.knownHosts = strings.Fields(value)
+	case "stricthostkeychecking":
+		t.strict = strings.ToLower(value)
+	case "connecttimeout":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid ConnectTimeout %q", value)
+		}
+		t.connectTimeout = time.Duration(n) * time.Second
+	case "serveraliveinterval":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid ServerAliveInterval %q", value)
+		}
+		t.keepalive = time.Duration(n) * time.Second
+	case "serveralivecountmax", "passwordauthentication", "preferredauthentications", "kbdinteractiveauthentication", "batchmode", "loglevel":
+		// Password and keyboard-interactive are always tried, and a dead
+		// server is noticed when a keepalive fails.
+	default:
+		return fmt.Errorf("ssh option -o %s is not supported by the native backend", key)
+	}
+	return nil
+}
+
+// splitDestination takes [user@]host or ssh://[user@]host[:port] apart.
+func splitDestination(dest string) (user, host, port string) {
+	uri := strings.HasPrefix(dest, "ssh://")
+	dest = strings.TrimPrefix(dest, "ssh://")
+	if i := strings.LastIndexByte(dest, '@'); i >= 0 {
+		user, dest = dest[:i], dest[i+1:]
+	}
+	if uri {
+		if i := strings.LastIndexByte(dest, ':'); i >= 0 && !strings.HasSuffix(dest, "]") {
+			dest, port = dest[:i], dest[i+1:]
+		}
+	}
+	return user, strings.Trim(dest, "[]"), port
+}
+
+// nativeUnsupported names the first setting of r the native backend can't
+// honour, or returns "". They all depend on ssh's own terminal or on
+// scanning its output.
+func (r *Runner) nativeUnsupported() string {
+	switch {
+	case r.TTY:
+		return "-tty"
+	case r.Askpass:
+		return "-askpass"
+	case len(r.Triggers) > 0:
+		return "-on"
+	case len(r.Script) > 0:
+		return "-script"
+	case r.OnPrompt != nil:
+		return "OnPrompt"
+	case r.OnOutput != nil:
+		return "OnOutput"
+	case r.NewPassword != "":
+		return "-new-password"
+	case r.FailureMarker != nil:
+		return "-failure-marker"
+	case r.Wake > 0:
+		return "-wake"
+	case r.IdleTimeout > 0:
+		return "-idle-timeout"
+	case r.ScanLimit > 0:
+		return "-scan-limit"
+	case r.TypeDelay > 0:
+		return "-type-delay"
+	case r.EchoCheck || r.FailOnEcho:
+		return "-echo-off-check"
+	case r.BannerTimeout > 0:
+		return "-connect-banner-timeout"
+	case r.KeepStdin:
+		return "ssh -N"
+	case r.Recorder != nil:
+		return "-record"
+	}
+	return ""
+}
+
+// nativeSession is session for the native backend: it connects with the
+// built-in client rather than running ssh. There is no output to scan;
+// the server's password, keyboard-interactive and host key questions go
+// through the rules as prompts, the way Askpass passes ssh's on.
+func (r *Runner) nativeSession(stdin io.Reader, stdout, stderr io.Writer, capture *redactWriter) (res *Result, timedOut bool, err error) {
+	if name := r.nativeUnsupported(); name != "" {
+		return nil, false, &SetupError{ExitUsage, fmt.Errorf("%s can't be used with the native backend", name)}
+	}
+	t, err := parseNativeArgs(r.Args)
+	if err != nil {
+		return nil, false, &SetupError{ExitUsage, err}
+	}
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	times := &timeline{}
+	inj := &injector{
+		rules:         r.Rules,
+		times:         times,
+		keepANSI:      r.KeepANSI,
+		maxSecret:     r.MaxPasswordBytes,
+		stderr:        stderr,
+		forbidPrompt:  r.ForbidPrompt,
+		maxInjections: r.MaxInjections,
+		encoding:      r.ResponseEncoding,
+		onMatch:       r.OnMatch,
+		log:           r.logger(),
+		// There is no stdin of ssh's to close or hand over.
+		closed: true,
+	}
+	if capture != nil {
+		inj.onSecret = capture.AddSecret
+	}
+	for _, rule := range r.Rules {
+		inj.elevation = inj.elevation || rule.elevate
+	}
+
+	// Output goes to the terminal, the transcript, and through -prefix and
+	// -redact-pattern on the way, as it would from ssh.
+	var flush []interface{ Flush() error }
+	var lineMu sync.Mutex
+	counts := &traffic{}
+	output := func(terminal io.Writer, stderr bool) io.Writer {
+		if r.Prefix != "" || r.Timestamps {
+			pw := NewPrefixWriter(terminal, r.Prefix, &lineMu)
+			if r.Timestamps {
+				pw.Timestamp = timestampLayout
+			}
+			flush = append(flush, pw)
+			terminal = pw
+		}
+		outputs := []io.Writer{terminal, times}
+		if r.CountBytes {
+			outputs = append(outputs, counts.writer(stderr))
+		}
+		if capture != nil {
+			outputs = append(outputs, capture)
+		}
+		w := io.MultiWriter(outputs...)
+		if len(r.RedactPatterns) > 0 {
+			pw := &patternWriter{w: w, patterns: r.RedactPatterns}
+			flush = append(flush, pw)
+			return pw
+		}
+		return w
+	}
+	sessionOut := output(stdout, false)
+	sessionErr := sessionOut
+	if !r.MergeStreams {
+		sessionErr = output(stderr, true)
+	}
+	// The outermost writer goes first, so what it held back passes
+	// through the rest.
+	defer func() {
+		for i := len(flush) - 1; i >= 0; i-- {
+			flush[i].Flush()
+		}
+	}()
+
+	var timers []*time.Timer
+	if r.PromptTimeout > 0 {
+		timers = append(timers, time.AfterFunc(r.PromptTimeout, func() { inj.timeout(r.PromptTimeout) }))
+	}
+	defer func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		inj.mu.Lock()
+		defer inj.mu.Unlock()
+		r.cancelled(ctx, inj)
+	})
+	defer stop()
+
+	res = &Result{}
+	finish := func(code int) (*Result, bool, error) {
+		res.Timings = times.timings(time.Now())
+		res.Prompted = inj.prompted()
+		res.PromptMatched = inj.matchedPrompt()
+		res.PromptLine = inj.firstPrompt()
+		res.HostKeyType, res.HostKeyFingerprint = inj.keyType, inj.fingerprint
+		counts.record(res, inj)
+		f := inj.failed()
+		if f == nil {
+			f = r.sshpassFailure(code, inj.sshReason)
+		}
+		if lockedOut(f, code, inj) {
+			fmt.Fprintln(stderr, "shallpass: the server locked us out; not trying again")
+			f, inj.wrong = &failure{code: ExitLockedOut}, nil
+		}
+		if f != nil {
+			code = f.code
+		}
+		res.refused = inj.wrong
+		res.ExitCode = code
+		res.Reason = exitReason(code, f != nil, inj.sshReason)
+		return res, f != nil && (f.code == ExitPromptTimeout || f.code == ExitConnectTimeout), nil
+	}
+
+	connect := r.ConnectTimeout
+	if t.connectTimeout > 0 {
+		connect = t.connectTimeout
+	}
+	authDone, err := r.AuthLimiter.acquire(ctx)
+	if err != nil {
+		return nil, false, limitError(err)
+	}
+	defer authDone()
+	times.start = time.Now()
+	addr := net.JoinHostPort(t.host, t.port)
+	dialer := net.Dialer{Timeout: connect}
+	conn, err := dialer.DialContext(ctx, t.network, addr)
+	if err != nil {
+		if inj.failed() == nil {
+			msg := dialError(t, err)
+			fmt.Fprintln(stderr, msg)
+			inj.sshReason = sshFailure(msg)
+		}
+		return finish(ExitSSHError)
+	}
+	defer conn.Close()
+	inj.mu.Lock()
+	inj.kill = func() { conn.Close() }
+	if inj.failure != nil {
+		inj.kill()
+	}
+	inj.mu.Unlock()
+	// The server has as long again to get through the key exchange.
+	if connect > 0 {
+		conn.SetDeadline(time.Now().Add(connect + connectSlack))
+	}
+
+	config := &ssh.ClientConfig{
+		User:            t.user,
+		Auth:            r.nativeAuth(t, inj, stderr),
+		HostKeyCallback: r.nativeHostKeys(t, inj, stderr),
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	authDone()
+	if err != nil {
+		inj.mu.Lock()
+		inj.lockout = lockoutRE.MatchString(err.Error())
+		inj.mu.Unlock()
+		switch {
+		case inj.failed() != nil:
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			inj.mu.Lock()
+			inj.fail(ExitConnectTimeout, fmt.Sprintf("no answer from %s within %v", addr, connect+connectSlack))
+			inj.mu.Unlock()
+		case strings.Contains(err.Error(), "unable to authenticate"):
+			fmt.Fprintf(stderr, "%s@%s: Permission denied (%s).\n", t.user, t.host, authMethods(err))
+			inj.sshReason = "auth_failed"
+			if inj.lastLogin != nil {
+				fmt.Fprintln(stderr, "shallpass: the server refused the password")
+				inj.mu.Lock()
+				inj.failure = &failure{code: ExitWrongPassword}
+				inj.wrong = inj.lastLogin
+				inj.mu.Unlock()
+			}
+		case errors.Is(err, errNoAnswer):
+			inj.sshReason = "auth_failed"
+		case inj.sshReason == "":
+			fmt.Fprintln(stderr, err)
+		}
+		return finish(ExitSSHError)
+	}
+	conn.SetDeadline(time.Time{})
+	times.mark(&times.reply)
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	inj.mu.Lock()
+	inj.kill = func() { client.Close() }
+	if inj.failure != nil {
+		inj.kill()
+	}
+	inj.mu.Unlock()
+	if t.keepalive > 0 {
+		go nativeKeepalive(client, t.keepalive)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		fmt.Fprintln(stderr, "ssh: failed to open a session:", err)
+		return finish(ExitSSHError)
+	}
+	defer session.Close()
+	session.Stdout, session.Stderr = sessionOut, sessionErr
+
+	local := localTerminal(stdin)
+	if t.tty == 1 || (t.tty == 0 && t.command == "" && local != nil) {
+		if err := requestPTY(session, localTerminal(stdin, stdout)); err != nil {
+			fmt.Fprintln(stderr, "PTY allocation request failed:", err)
+		} else if local != nil {
+			sw := &rawSwitch{f: local, stderr: stderr}
+			sw.raw()
+			defer sw.restore()
+			defer followWindow(session, local)()
+		}
+	}
+	// Wait does not wait for input to run out, which for a terminal it
+	// never would.
+	if stdin != nil {
+		w, err := session.StdinPipe()
+		if err != nil {
+			fmt.Fprintln(stderr, "ssh: failed to open the session's input:", err)
+			return finish(ExitSSHError)
+		}
+		if r.CountBytes {
+			stdin = countingReader{stdin, &counts.in}
+		}
+		go func() {
+			io.Copy(w, stdin)
+			w.Close()
+		}()
+	}
+	if t.command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(t.command)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "ssh: failed to start the remote command:", err)
+		return finish(ExitSSHError)
+	}
+
+	stopRelay := relaySignals(r.Signals, inj, func(sig os.Signal) {
+		if name, ok := sshSignals[sig]; ok {
+			session.Signal(name)
+		}
+	})
+	defer stopRelay()
+
+	var exitErr *ssh.ExitError
+	switch err := session.Wait(); {
+	case err == nil:
+		return finish(0)
+	case errors.As(err, &exitErr):
+		return finish(exitErr.ExitStatus())
+	case inj.failed() == nil:
+		fmt.Fprintln(stderr, "ssh: the session ended without an exit status:", err)
+	}
+	return finish(ExitSSHError)
+}
+
+// nativeAuth is how the native client logs in: with the -i keys, then by
+// answering the server's keyboard-interactive questions or its password
+// request with the rules. A question no rule answers fails that method.
+func (r *Runner) nativeAuth(t *nativeTarget, inj *injector, stderr io.Writer) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if !t.noPubkey && len(t.identities) > 0 {
+		var signers []ssh.Signer
+		for _, path := range t.identities {
+			signer, err := loadIdentity(path, inj)
+			if err != nil {
+				fmt.Fprintf(stderr, "shallpass: warning: not using identity %s: %v\n", path, err)
+				continue
+			}
+			signers = append(signers, signer)
+		}
+		if len(signers) > 0 {
+			methods = append(methods, ssh.PublicKeys(signers...))
+		}
+	}
+	ask := func(prompt string) (string, error) {
+		secret, ok := inj.askpass(prompt)
+		if !ok {
+			if inj.failed() == nil {
+				fmt.Fprintf(stderr, "shallpass: no rule answers %q\n", strings.TrimSpace(prompt))
+			}
+			return "", errNoAnswer
+		}
+		return secret, nil
+	}
+	methods = append(methods,
+		ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			for _, text := range []string{name, instruction} {
+				if text != "" {
+					fmt.Fprintln(stderr, text)
+				}
+			}
+			answers := make([]string, len(questions))
+			for i, q := range questions {
+				a, err := ask(q)
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = a
+			}
+			return answers, nil
+		}),
+		ssh.PasswordCallback(func() (string, error) {
+			return ask(fmt.Sprintf("%s@%s's password: ", t.user, t.host))
+		}),
+	)
+	return methods
+}
+
+// errNoAnswer ends a login whose question no rule answers. It has been
+// reported by then.
+var errNoAnswer = errors.New("no rule answers the server's question")
+
+// loadIdentity reads a private key, as ssh -i would use it. The
+// passphrase of an encrypted key is asked of the rules with ssh's own
+// prompt, so PassphraseRule answers it.
+func loadIdentity(path string, inj *injector) (ssh.Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+	passphrase, ok := inj.askpass(fmt.Sprintf("Enter passphrase for key '%s': ", path))
+	if !ok {
+		return nil, errors.New("the key is encrypted, and no rule answers its passphrase prompt")
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+}
+
+// nativeHostKeys checks the server's key against the known hosts files,
+// as ssh does. An unknown key is asked about with ssh's own question, so
+// -accept-hostkey answers it; a changed one always fails.
+func (r *Runner) nativeHostKeys(t *nativeTarget, inj *injector, stderr io.Writer) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		inj.times.mark(&inj.times.firstOutput)
+		if err := checkKnownHost(t.knownHosts, hostname, remote, key); !errors.Is(err, errUnknownHost) {
+			if err != nil {
+				fmt.Fprintln(stderr, "@@@ WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED! @@@")
+				fmt.Fprintln(stderr, "Host key verification failed.")
+				inj.sshReason = "host_key_changed"
+			}
+			return err
+		}
+
+		keyType, fp := hostKeyType(key.Type()), ssh.FingerprintSHA256(key)
+		inj.mu.Lock()
+		inj.keyType, inj.fingerprint = keyType, fp
+		inj.mu.Unlock()
+		accept := t.strict == "no" || t.strict == "off" || t.strict == "accept-new"
+		if !accept && t.strict != "yes" {
+			fmt.Fprintf(stderr, "The authenticity of host '%s (%s)' can't be established.\n", t.host, remote)
+			fmt.Fprintf(stderr, "%s key fingerprint is %s.\n", keyType, fp)
+			answer, ok := inj.askpass("Are you sure you want to continue connecting (yes/no/[fingerprint])? ")
+			accept = ok && (strings.EqualFold(answer, "yes") || answer == fp)
+		}
+		if !accept {
+			fmt.Fprintln(stderr, "Host key verification failed.")
+			inj.sshReason = "host_key_unknown"
+			return errors.New("host key not trusted")
+		}
+		var err error
+		if len(t.knownHosts) > 0 {
+			err = addKnownHost(t.knownHosts[0], hostname, key)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "shallpass: warning: failed to add the host key to the known hosts:", err)
+		} else {
+			fmt.Fprintf(stderr, "Warning: Permanently added '%s' (%s) to the list of known hosts.\n", t.host, keyType)
+		}
+		return nil
+	}
+}
+
+// errUnknownHost is checkKnownHost's error for a host none of the files
+// has a key for.
+var errUnknownHost = errors.New("unknown host")
+
+// checkKnownHost checks key against those the known hosts files list for
+// hostname. Files that do not exist are skipped.
+func checkKnownHost(paths []string, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	var files []string
+	for _, f := range paths {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return errUnknownHost
+	}
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return err
+	}
+	err = check(hostname, remote, key)
+	var ke *knownhosts.KeyError
+	if errors.As(err, &ke) && len(ke.Want) == 0 {
+		return errUnknownHost
+	}
+	return err
+}
+
+// addKnownHost appends key for hostname to the known hosts file at path.
+func addKnownHost(path, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hostKeyType is the name ssh shows for a key algorithm: "ED25519" for
+// ssh-ed25519 and so on.
+func hostKeyType(algo string) string {
+	switch {
+	case algo == ssh.KeyAlgoED25519:
+		return "ED25519"
+	case algo == ssh.KeyAlgoRSA:
+		return "RSA"
+	case strings.HasPrefix(algo, "ecdsa-"):
+		return "ECDSA"
+	}
+	return strings.ToUpper(algo)
+}
+
+// dialError words a failed connection the way ssh does, so sshFailure
+// knows what went wrong.
+func dialError(t *nativeTarget, err error) string {
+	var dnsErr *net.DNSError
+	reason := err.Error()
+	switch {
+	case errors.As(err, &dnsErr):
+		return fmt.Sprintf("ssh: Could not resolve hostname %s: %s", t.host, dnsErr.Err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		reason = "Connection refused"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT):
+		reason = "Connection timed out"
+	}
+	return fmt.Sprintf("ssh: connect to host %s port %s: %s", t.host, t.port, reason)
+}
+
+// attemptedRE finds the methods in x/crypto's "unable to authenticate,
+// attempted methods [none password], ..." error.
+var attemptedRE = regexp.MustCompile(`attempted methods \[([^\]]*)\]`)
+
+// authMethods lists the methods an authentication error says were tried,
+// the way ssh's "Permission denied (...)" does.
+func authMethods(err error) string {
+	m := attemptedRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return "none"
+	}
+	var methods []string
+	for _, name := range strings.Fields(m[1]) {
+		if name != "none" {
+			methods = append(methods, name)
+		}
+	}
+	return strings.Join(methods, ",")
+}
+
+// requestPTY asks for a terminal of local's size and $TERM, or 80x24 if
+// there is no local terminal.
+func requestPTY(session *ssh.Session, local *os.File) error {
+	rows, cols := 24, 80
+	if local != nil {
+		if ws, ok := terminalSize(local); ok && ws.rows > 0 {
+			rows, cols = int(ws.rows), int(ws.cols)
+		}
+	}
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm"
+	}
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 38400, ssh.TTY_OP_OSPEED: 38400}
+	return session.RequestPty(term, rows, cols, modes)
+}
+
+// followWindow is followSize for the remote terminal of a native session.
+func followWindow(session *ssh.Session, local *os.File) (stop func()) {
+	winch := make(chan os.Signal, 1)
+	if !notifyResize(winch) {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-winch:
+				if ws, ok := terminalSize(local); ok {
+					session.WindowChange(int(ws.rows), int(ws.cols))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(winch)
+		close(done)
+	}
+}
+
+// sshSignals are the signals a native session passes on to the remote
+// command, by their names in the protocol.
+var sshSignals = map[os.Signal]ssh.Signal{
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+}
+
+// nativeKeepalive sends OpenSSH's keepalive request every interval, as
+// ServerAliveInterval does, and drops a connection that stops answering.
+func nativeKeepalive(client *ssh.Client, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			client.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package shallpass
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/plop-systems/shallpass/internal/sshargs"
+)
+
+// DefaultTimeout is how long a Runner from New waits for the password
+// prompt unless WithTimeout says otherwise.
+const DefaultTimeout = 30 * time.Second
+
+// Option adjusts a Runner built on the caller's behalf, by New or
+// Authenticate. Every option applies to both, except that Authenticate's
+// own arguments stand in for WithTarget, WithPassword and WithCommand.
+type Option func(*Runner)
+
+// New returns a Runner configured by opts. Without any it scans both of
+// ssh's streams, runs ssh from PATH and gives up if no prompt appears
+// within DefaultTimeout. WithPassword adds the rule that answers the
+// prompt, "password:" unless WithPromptRegexp names another, after any
+// WithMatchers rules. With WithTarget the ssh arguments are assembled as
+// options, then the host, then the WithCommand command; otherwise they
+// are whatever WithSSHArgs gave. Fields not covered by an option can still
+// be set on the result before it is run. With WithPassword it runs once, as
+// the password is wiped when the run is over; Clone it to run it again.
+func New(opts ...Option) *Runner {
+	r := &Runner{
+		ScanStdout:    true,
+		ScanStderr:    true,
+		PromptTimeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.finish()
+	return r
+}
+
+// finish turns what the options collected into the rules and arguments
+// they stand for. The WithPassword copy becomes the rule's SecretBytes,
+// which the run wipes.
+func (r *Runner) finish() {
+	if r.password != nil {
+		rule := PasswordRule("", promptLanguages[0].prompts)
+		if r.promptRE != nil {
+			rule.Name, rule.Match = r.promptRE.String(), r.promptRE.MatchString
+		}
+		rule.SecretBytes = append(r.password, '\n')
+		lockMemory(rule.SecretBytes)
+		r.Rules = append(r.Rules, rule)
+		r.password = nil
+	}
+	if r.target != "" {
+		r.Args = append(r.Args, "--", r.target)
+		if len(r.command) > 0 {
+			r.Args = append(r.Args, remoteCommand(r.command))
+		}
+	}
+}
+
+// remoteCommand joins words into one command line for the remote shell,
+// each word quoted so that the shell splits it back into the same words.
+func remoteCommand(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = sshargs.Quote(w)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// WithPassword answers the password prompt with password. A newline is
+// added when it is sent. password is copied, so the caller may wipe it as
+// soon as the option has been applied; the copy is never made a string,
+// and is wiped once the Runner has run (see Rule.SecretBytes).
+func WithPassword(password []byte) Option {
+	return func(r *Runner) {
+		// Room for the newline, so the copy is never moved and left behind.
+		r.password = append(make([]byte, 0, len(password)+1), password...)
+	}
+}
+
+// WithPromptRegexp makes WithPassword answer lines matching re rather
+// than ones containing "password:".
+func WithPromptRegexp(re *regexp.Regexp) Option {
+	return func(r *Runner) { r.promptRE = re }
+}
+
+// WithTimeout sets how long to wait for the password prompt before
+// ending the session with ExitPromptTimeout; see Runner.PromptTimeout.
+// A session that gets in without being asked is ended too, so use 0 for
+// hosts that may accept a key.
+func WithTimeout(d time.Duration) Option {
+	return func(r *Runner) { r.PromptTimeout = d }
+}
+
+// WithMatchers adds rules, tried in order before the WithPassword one.
+func WithMatchers(rules ...*Rule) Option {
+	return func(r *Runner) { r.Rules = append(r.Rules, rules...) }
+}
+
+// WithSSHOptions adds ssh options, such as -p 2222 or -o
+// StrictHostKeyChecking=yes, in front of the WithTarget host.
+func WithSSHOptions(opts []string) Option {
+	return WithSSHArgs(opts...)
+}
+
+// WithTarget names the host to connect to, [user@]host or an ssh:// URI.
+// New puts it after every ssh option, behind a "--" so that it is never
+// taken for one.
+func WithTarget(target string) Option {
+	return func(r *Runner) { r.target = target }
+}
+
+// WithCommand sets the remote command to run on the WithTarget host, one
+// word per element. ssh hands the remote shell a single string, so each
+// word is quoted for it and arrives as it is given, spaces and quotes
+// included. Without it ssh starts a login shell.
+func WithCommand(command []string) Option {
+	return func(r *Runner) { r.command = append([]string{}, command...) }
+}
+
+// WithSSHPath runs the given ssh client instead of ssh from PATH.
+func WithSSHPath(path string) Option {
+	return func(r *Runner) { r.SSHPath = path }
+}
+
+// WithSSHArgs adds ssh options, such as -p or -o, in front of the
+// destination.
+func WithSSHArgs(args ...string) Option {
+	return func(r *Runner) { r.Args = append(r.Args, args...) }
+}
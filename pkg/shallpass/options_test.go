@@ -0,0 +1,115 @@
+package shallpass
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestNewDefaults(t *testing.T) {
+	r := New()
+	if !r.ScanStdout || !r.ScanStderr || r.PromptTimeout != DefaultTimeout || r.SSHPath != "" || len(r.Rules) != 0 || len(r.Args) != 0 {
+		t.Errorf("New() = %+v", r)
+	}
+	r = New(WithPassword([]byte("pw")))
+	if len(r.Rules) != 1 || string(r.Rules[0].SecretBytes) != "pw\n" || !r.Rules[0].Match("alice@host's password:") {
+		t.Errorf("the WithPassword rule is %+v", r.Rules)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	matcher := &Rule{Name: "pin", Match: regexp.MustCompile(`PIN:`).MatchString, Secret: "1234\n"}
+	for _, tc := range []struct {
+		name  string
+		opts  []Option
+		check func(*Runner) bool
+	}{
+		{"WithPromptRegexp", []Option{WithPassword([]byte("pw")), WithPromptRegexp(regexp.MustCompile(`Passwort:`))}, func(r *Runner) bool {
+			return len(r.Rules) == 1 && r.Rules[0].Match("Passwort:") && !r.Rules[0].Match("password:")
+		}},
+		{"WithPromptRegexp without a password", []Option{WithPromptRegexp(regexp.MustCompile(`x`))}, func(r *Runner) bool {
+			return len(r.Rules) == 0
+		}},
+		{"WithTimeout", []Option{WithTimeout(time.Second)}, func(r *Runner) bool {
+			return r.PromptTimeout == time.Second
+		}},
+		{"WithMatchers", []Option{WithPassword([]byte("pw")), WithMatchers(matcher)}, func(r *Runner) bool {
+			return len(r.Rules) == 2 && r.Rules[0] == matcher
+		}},
+		{"WithSSHPath", []Option{WithSSHPath("/opt/ssh")}, func(r *Runner) bool {
+			return r.SSHPath == "/opt/ssh"
+		}},
+		{"WithSSHArgs", []Option{WithSSHArgs("-p", "2222"), WithSSHOptions([]string{"-v"})}, func(r *Runner) bool {
+			return reflect.DeepEqual(r.Args, []string{"-p", "2222", "-v"})
+		}},
+		{"WithTarget", []Option{WithTarget("-oProxyCommand=x"), WithSSHArgs("-v")}, func(r *Runner) bool {
+			return reflect.DeepEqual(r.Args, []string{"-v", "--", "-oProxyCommand=x"})
+		}},
+		{"WithCommand", []Option{WithTarget("host"), WithCommand([]string{"ls", "-l", "my file"})}, func(r *Runner) bool {
+			return reflect.DeepEqual(r.Args, []string{"--", "host", "ls -l 'my file'"})
+		}},
+		{"WithCommand without a target", []Option{WithCommand([]string{"ls"})}, func(r *Runner) bool {
+			return len(r.Args) == 0
+		}},
+	} {
+		if r := New(tc.opts...); !tc.check(r) {
+			t.Errorf("%s: New gave %+v", tc.name, r)
+		}
+	}
+}
+
+func TestAuthenticateOptions(t *testing.T) {
+	prompt := func(p string) string {
+		return `printf '` + p + ` ' >&2
+read pw
+[ "$pw" = secret ]`
+	}
+	for _, tc := range []struct {
+		name     string
+		script   string
+		password string
+		opts     []Option
+		want     bool
+		err      error
+	}{
+		{"WithPromptRegexp", prompt("Passwort:"), "secret",
+			[]Option{WithPromptRegexp(regexp.MustCompile(`Passwort:`))}, true, nil},
+		{"WithMatchers before the password", prompt("password:"), "wrong",
+			[]Option{WithMatchers(PasswordRule("secret\n", []string{"password:"}))}, true, nil},
+		{"WithTimeout", "sleep 5", "secret",
+			[]Option{WithTimeout(200 * time.Millisecond)}, false, errNotAsked},
+		{"WithSSHArgs and WithSSHOptions", `[ "$*" = "-p 2222 -v -T -- host true" ] || exit 1
+` + prompt("password:"), "secret",
+			[]Option{WithSSHArgs("-p", "2222"), WithSSHOptions([]string{"-v"})}, true, nil},
+		{"WithPassword gives way to the argument", prompt("password:"), "secret",
+			[]Option{WithPassword([]byte("wrong"))}, true, nil},
+		{"WithTarget gives way to the argument", `[ "$*" = "-T -- host true" ] || exit 1
+` + prompt("password:"), "secret",
+			[]Option{WithTarget("other")}, true, nil},
+	} {
+		opts := append([]Option{WithSSHPath(fakeSSH(t, tc.script))}, tc.opts...)
+		ok, err := Authenticate(context.Background(), "host", []byte(tc.password), opts...)
+		if ok != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%s: Authenticate = %v, %v; want %v, %v", tc.name, ok, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestCommandRunsAsGiven(t *testing.T) {
+	// The fake checks where everything went, then runs the command the
+	// way the remote shell would: from the one string ssh sends.
+	ssh := fakeSSH(t, `[ "$1 $2 $3 $4" = "-p 2222 -- alice@host" ] || { echo "ssh ran with $*"; exit 1; }
+[ $# = 5 ] || { echo "$# arguments"; exit 1; }
+printf 'password: ' >&2
+read pw
+sh -c "$5"`)
+	r := New(WithSSHPath(ssh), WithPassword([]byte("secret")), WithSSHOptions([]string{"-p", "2222"}), WithTarget("alice@host"),
+		WithCommand([]string{"printf", "[%s]", "my file", "it's", "$HOME", "a;b", "*"}))
+	res, stdout, stderr := runFake(t, r)
+	if want := "[my file][it's][$HOME][a;b][*]"; res.ExitCode != 0 || stdout != want {
+		t.Errorf("exit %d, stdout %q, want %q; stderr: %s", res.ExitCode, stdout, want, stderr)
+	}
+}
@@ -0,0 +1,27 @@
+package shallpass
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+)
+
+// PanicReport tells w where a panic happened, by function and line only.
+// The panic value and the argument values of a normal traceback are left
+// out: either could hold a secret. Call it from the deferred function
+// that recovered.
+func PanicReport(w io.Writer) {
+	fmt.Fprintln(w, "shallpass: internal error: panic. This is a bug; please report it with the lines below, which leave out anything that could hold a secret:")
+	pcs := make([]uintptr, 64)
+	// Skip runtime.Callers, PanicReport and the deferred function.
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(w, "    %s (%s:%d)\n", f.Function, filepath.Base(f.File), f.Line)
+		if !more {
+			break
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package shallpass
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPanicLeavesTheSecretOut(t *testing.T) {
+	const secret = "hunter2-do-not-print"
+	// A rule that panics with the secret in the panic value, and in the
+	// arguments of the frames below it.
+	crash := &Rule{Name: "crash", Match: func(line string) bool {
+		panic("matching with " + secret)
+	}}
+	r := New(
+		WithSSHPath(fakeSSH(t, `printf 'password: '; sleep 1`)),
+		WithMatchers(crash),
+		WithPassword([]byte(secret)),
+	)
+	res, _, stderr := runFake(t, r)
+	if res.ExitCode != ExitPanic {
+		t.Errorf("exit %d, want %d", res.ExitCode, ExitPanic)
+	}
+	if !strings.Contains(stderr, "internal error: panic") {
+		t.Errorf("no panic report on stderr: %s", stderr)
+	}
+	if strings.Contains(stderr, secret) {
+		t.Errorf("the secret is on stderr: %s", stderr)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package shallpass
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// signalGroup passes sig to the process group p leads, as under TTY,
+// where ssh has a session of its own.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	if s, ok := sig.(syscall.Signal); ok {
+		return syscall.Kill(-p.Pid, s)
+	}
+	return p.Signal(sig)
+}
+
+// notifyResize relays terminal resizes to ch, and reports whether it can.
+func notifyResize(ch chan<- os.Signal) bool {
+	signal.Notify(ch, syscall.SIGWINCH)
+	return true
+}
+
+// readFD reads file descriptor fd.
+func readFD(fd int, p []byte) (int, error) {
+	return syscall.Read(fd, p)
+}
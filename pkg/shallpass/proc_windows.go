@@ -0,0 +1,39 @@
+//go:build windows
+
+package shallpass
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalGroup passes sig to p. There are no process groups to signal as a
+// whole on Windows, nor signals other than Kill, so Process.Signal says
+// what it can't do.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+// notifyResize reports that terminal resizes can't be followed: a console
+// sends no signal for them.
+func notifyResize(ch chan<- os.Signal) bool { return false }
+
+// readFD reads file descriptor fd. 0, 1 and 2 are the standard handles;
+// any other number is taken as an inherited handle.
+func readFD(fd int, p []byte) (int, error) {
+	h := syscall.Handle(fd)
+	switch fd {
+	case 0:
+		h = syscall.Stdin
+	case 1:
+		h = syscall.Stdout
+	case 2:
+		h = syscall.Stderr
+	}
+	n, err := syscall.Read(h, p)
+	if err == syscall.ERROR_BROKEN_PIPE {
+		// The writing end of a pipe is gone, which is EOF.
+		return 0, nil
+	}
+	return n, err
+}
@@ -0,0 +1,235 @@
+package shallpass
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A PasswordProvider fetches secrets from a store outside shallpass, such
+// as a secrets manager, for ReadSecret. Lookup gets the source without its
+// kind: for "vault:secret/data/db#password", "secret/data/db#password". The
+// error should say what went wrong in the store's own terms, but never
+// contain the secret.
+type PasswordProvider interface {
+	Lookup(ref string) (string, error)
+}
+
+// ProviderFunc is a PasswordProvider made of a function.
+type ProviderFunc func(ref string) (string, error)
+
+func (f ProviderFunc) Lookup(ref string) (string, error) { return f(ref) }
+
+// providers are the PasswordProviders by kind, with the lookups made for
+// this process by source.
+var providers = struct {
+	sync.Mutex
+	byKind map[string]PasswordProvider
+	cache  map[string]*providerLookup
+}{
+	byKind: map[string]PasswordProvider{
+		"vault":  ProviderFunc(vaultSecret),
+		"aws-sm": ProviderFunc(awsSecret),
+		"op":     ProviderFunc(onePasswordSecret),
+	},
+	cache: map[string]*providerLookup{},
+}
+
+// providerLookup is one source's lookup. done is closed once secret and
+// err are set; those asking for the same source meanwhile wait for it.
+type providerLookup struct {
+	done   chan struct{}
+	secret string
+	err    error
+}
+
+// RegisterProvider makes ReadSecret resolve kind:REF sources through p,
+// replacing any provider of that kind. The built-in kinds env, file, fd,
+// pass, keychain and totp can't be replaced.
+func RegisterProvider(kind string, p PasswordProvider) {
+	providers.Lock()
+	defer providers.Unlock()
+	providers.byKind[kind] = p
+}
+
+// providerSecret looks up source through the provider for kind, reporting
+// false if there is none. Each source is fetched once per process, so a
+// hundred hosts sharing a secret make one request for it, while lookups
+// of different sources run side by side. A failed lookup is forgotten, so
+// the next one tries again.
+func providerSecret(kind, ref, source string) (string, bool, error) {
+	providers.Lock()
+	p, ok := providers.byKind[kind]
+	if !ok {
+		providers.Unlock()
+		return "", false, nil
+	}
+	l, ok := providers.cache[source]
+	if ok {
+		providers.Unlock()
+		<-l.done
+		return l.secret, true, l.err
+	}
+	l = &providerLookup{done: make(chan struct{})}
+	providers.cache[source] = l
+	providers.Unlock()
+
+	l.secret, l.err = p.Lookup(ref)
+	switch {
+	case l.err != nil:
+		l.secret, l.err = "", fmt.Errorf("%s: %v", source, l.err)
+	case l.secret == "":
+		l.err = fmt.Errorf("%s: the secret is empty", source)
+	}
+	if l.err != nil {
+		providers.Lock()
+		delete(providers.cache, source)
+		providers.Unlock()
+	}
+	close(l.done)
+	return l.secret, true, l.err
+}
+
+// providerTimeout bounds a single lookup, so a store that is down fails
+// the run instead of hanging it.
+const providerTimeout = 30 * time.Second
+
+// vaultSecret reads field FIELD of the HashiCorp Vault secret at PATH, for
+// ref written PATH#FIELD; FIELD defaults to "password". PATH is the API
+// path, as in "secret/data/hosts/db01" for the KV version 2 engine, whose
+// extra "data" level is looked through. The server is $VAULT_ADDR, the
+// token $VAULT_TOKEN or else ~/.vault-token, and $VAULT_NAMESPACE is
+// passed on if set, as with the vault CLI.
+func vaultSecret(ref string) (string, error) {
+	path, field, _ := strings.Cut(ref, "#")
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "", errors.New("no secret path")
+	}
+	if field == "" {
+		field = "password"
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			data, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(data))
+		}
+	}
+	if token == "" {
+		return "", errors.New("no token: set VAULT_TOKEN or run vault login")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	client := http.Client{Timeout: providerTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Data   map[string]any `json:"data"`
+		Errors []string       `json:"errors"`
+	}
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	switch {
+	case resp.StatusCode != http.StatusOK && len(body.Errors) > 0:
+		return "", fmt.Errorf("%s (%s)", strings.Join(body.Errors, "; "), resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return "", errors.New(resp.Status)
+	case decodeErr != nil:
+		return "", fmt.Errorf("unreadable answer from %s: %v", addr, decodeErr)
+	}
+	data := body.Data
+	if inner, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = inner
+	}
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("the secret has no field %q", field)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %q of the secret is not a string", field)
+	}
+	return s, nil
+}
+
+// awsSecret reads the AWS Secrets Manager secret NAME, or for ref written
+// NAME#KEY the value of KEY in the JSON object it holds, through the aws
+// CLI, so its credentials, profile and region settings apply as they are.
+func awsSecret(ref string) (string, error) {
+	name, key, _ := strings.Cut(ref, "#")
+	if name == "" {
+		return "", errors.New("no secret name")
+	}
+	out, err := runProvider("aws", "secretsmanager", "get-secret-value", "--secret-id", name, "--query", "SecretString", "--output", "text")
+	if err != nil {
+		return "", err
+	}
+	out = strings.TrimRight(out, "\r\n")
+	if key == "" {
+		return out, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(out), &fields); err != nil {
+		return "", fmt.Errorf("the secret is not a JSON object, so it has no key %q", key)
+	}
+	s, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no string key %q", key)
+	}
+	return s, nil
+}
+
+// onePasswordSecret reads a 1Password secret reference, op://VAULT/ITEM/FIELD
+// (ref is what follows "op:"), with the op CLI, signed in as it is.
+func onePasswordSecret(ref string) (string, error) {
+	if !strings.HasPrefix(ref, "//") {
+		return "", errors.New("want op://VAULT/ITEM/FIELD")
+	}
+	out, err := runProvider("op", "read", "--no-newline", "op:"+ref)
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// runProvider runs a secrets manager's CLI and returns what it printed.
+// As with the keychain, only what it says about a failure is reported,
+// never its stdout.
+func runProvider(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,127 @@
+package shallpass
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// registerTestProvider registers p for kind for the length of the test.
+func registerTestProvider(t *testing.T, kind string, p PasswordProvider) {
+	t.Helper()
+	RegisterProvider(kind, p)
+	t.Cleanup(func() {
+		providers.Lock()
+		defer providers.Unlock()
+		delete(providers.byKind, kind)
+		for source := range providers.cache {
+			if strings.HasPrefix(source, kind+":") {
+				delete(providers.cache, source)
+			}
+		}
+	})
+}
+
+func TestSlowProvidersRunSideBySide(t *testing.T) {
+	// Each lookup waits until the other one has started too, which it
+	// never does if the first holds everyone else up.
+	var started sync.WaitGroup
+	started.Add(2)
+	slow := ProviderFunc(func(ref string) (string, error) {
+		started.Done()
+		waited := make(chan struct{})
+		go func() { started.Wait(); close(waited) }()
+		select {
+		case <-waited:
+			return "secret-" + ref, nil
+		case <-time.After(5 * time.Second):
+			return "", errors.New("the other lookup never started")
+		}
+	})
+	registerTestProvider(t, "slow-a", slow)
+	registerTestProvider(t, "slow-b", slow)
+
+	var wg sync.WaitGroup
+	for _, source := range []string{"slow-a:one", "slow-b:two"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ReadSecret(source); err != nil {
+				t.Errorf("%s: %v", source, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProviderLooksUpEachSourceOnce(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	registerTestProvider(t, "once", ProviderFunc(func(ref string) (string, error) {
+		calls.Add(1)
+		<-release
+		return "secret", nil
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if secret, err := ReadSecret("once:db"); err != nil || secret != "secret\n" {
+				t.Errorf("ReadSecret = %q, %v", secret, err)
+			}
+		}()
+	}
+	// Let the callers pile up behind the first lookup before it ends.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d lookups for one source, want 1", n)
+	}
+}
+
+func TestFailedProviderLookupIsRetried(t *testing.T) {
+	fail := true
+	registerTestProvider(t, "flaky", ProviderFunc(func(ref string) (string, error) {
+		if fail {
+			return "", errors.New("store unavailable")
+		}
+		return "secret", nil
+	}))
+	if _, err := ReadSecret("flaky:db"); err == nil || err.Error() != "flaky:db: store unavailable" {
+		t.Errorf("first lookup: %v", err)
+	}
+	fail = false
+	if secret, err := ReadSecret("flaky:db"); err != nil || secret != "secret\n" {
+		t.Errorf("second lookup = %q, %v", secret, err)
+	}
+}
+
+func TestReadSecretThroughAProvider(t *testing.T) {
+	var calls atomic.Int32
+	registerTestProvider(t, "fake", ProviderFunc(func(ref string) (string, error) {
+		calls.Add(1)
+		if ref == "empty" {
+			return "", nil
+		}
+		return "pw-for-" + ref, nil
+	}))
+	for i := 0; i < 2; i++ {
+		if secret, err := ReadSecret("fake:db"); err != nil || secret != "pw-for-db\n" {
+			t.Errorf("ReadSecret = %q, %v", secret, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d lookups, want 1: the second should come from the cache", n)
+	}
+	if _, err := ReadSecret("fake:empty"); err == nil || err.Error() != "fake:empty: the secret is empty" {
+		t.Errorf("empty secret: %v", err)
+	}
+	if _, err := ReadSecret("nosuchkind:db"); err == nil || !strings.Contains(err.Error(), `unknown password source "nosuchkind:db"`) {
+		t.Errorf("unknown kind: %v", err)
+	}
+}
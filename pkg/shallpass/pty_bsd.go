@@ -0,0 +1,148 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package shallpass
+
+import (
+	"os"
+	"syscall"
+
+	creack "github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// ptyProcAttr makes ssh the leader of a session of its own, with the
+// pseudo-terminal that is its stdin as the controlling one.
+func ptyProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true, Setctty: true}
+}
+
+// openPTY allocates a pseudo-terminal and returns both ends: the master we
+// read and write, and the slave ssh gets as its terminal. Every BSD has a
+// way of its own to allocate one (posix_openpt and TIOCPTYGRANT on macOS,
+// PTMGET on OpenBSD, ...), which creack/pty knows. It hands the master
+// over in blocking mode; it is put into non-blocking mode and opened
+// anew, so a blocked read of it can be cut short by closing it, as on
+// Linux.
+func openPTY() (master, slave *os.File, err error) {
+	m, slave, err := creack.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer m.Close()
+	var fd int
+	err = control(m, func(mfd int) (err error) {
+		fd, err = unix.FcntlInt(uintptr(mfd), unix.F_DUPFD_CLOEXEC, 0)
+		return err
+	})
+	if err == nil {
+		if err = unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fd)
+		}
+	}
+	if err != nil {
+		slave.Close()
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fd), m.Name()), slave, nil
+}
+
+// winsize is struct winsize from <sys/ioctl.h>.
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+// terminalSize is the size of the terminal f is, if it is one.
+func terminalSize(f *os.File) (winsize, bool) {
+	var ws *unix.Winsize
+	err := control(f, func(fd int) (err error) {
+		ws, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+		return err
+	})
+	if err != nil || ws.Row == 0 || ws.Col == 0 {
+		return winsize{}, false
+	}
+	return winsize{ws.Row, ws.Col, ws.Xpixel, ws.Ypixel}, true
+}
+
+// setTerminalSize resizes the pseudo-terminal behind master, which sends
+// SIGWINCH to whatever runs on it.
+func setTerminalSize(master *os.File, ws winsize) error {
+	return control(master, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: ws.rows, Col: ws.cols, Xpixel: ws.xpixel, Ypixel: ws.ypixel})
+	})
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	return updateTermios(f, nil) == nil
+}
+
+// setEcho turns the echo of input on the terminal f on or off, and setCRLF
+// the translation of "\n" into "\r\n" on output.
+func setEcho(f *os.File, on bool) error {
+	return updateTermios(f, func(t *unix.Termios) {
+		if on {
+			t.Lflag |= unix.ECHO
+		} else {
+			t.Lflag &^= unix.ECHO
+		}
+	})
+}
+
+func setCRLF(f *os.File, on bool) error {
+	return updateTermios(f, func(t *unix.Termios) {
+		if on {
+			t.Oflag |= unix.ONLCR
+		} else {
+			t.Oflag &^= unix.ONLCR
+		}
+	})
+}
+
+// updateTermios reads the settings of the terminal f, changes them with
+// change and writes them back. A nil change only reads them.
+func updateTermios(f *os.File, change func(*unix.Termios)) error {
+	return control(f, func(fd int) error {
+		t, err := unix.IoctlGetTermios(fd, unix.TIOCGETA)
+		if err != nil || change == nil {
+			return err
+		}
+		change(t)
+		return unix.IoctlSetTermios(fd, unix.TIOCSETA, t)
+	})
+}
+
+// makeRaw switches the terminal f to raw mode, as cfmakeraw(3) does, and
+// returns a function that puts it back the way it was.
+func makeRaw(f *os.File) (restore func() error, err error) {
+	var saved unix.Termios
+	err = updateTermios(f, func(t *unix.Termios) {
+		saved = *t
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		t.Oflag &^= unix.OPOST
+		t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		t.Cflag &^= unix.CSIZE | unix.PARENB
+		t.Cflag |= unix.CS8
+		t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return updateTermios(f, func(t *unix.Termios) { *t = saved })
+	}, nil
+}
+
+// control runs fn with the descriptor of f. It goes through SyscallConn
+// rather than Fd, which would put the master into blocking mode again.
+func control(f *os.File, fn func(fd int) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := conn.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return fnErr
+}
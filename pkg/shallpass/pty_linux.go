@@ -0,0 +1,130 @@
+//go:build linux
+
+package shallpass
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ptyProcAttr makes ssh the leader of a session of its own, with the
+// pseudo-terminal that is its stdin as the controlling one.
+func ptyProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true, Setctty: true}
+}
+
+// openPTY allocates a pseudo-terminal and returns both ends: the master we
+// read and write, and the slave ssh gets as its terminal.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlocking the pseudo-terminal: %v", err)
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("naming the pseudo-terminal: %v", err)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// winsize is struct winsize from <sys/ioctl.h>.
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+// terminalSize is the size of the terminal f is, if it is one.
+func terminalSize(f *os.File) (winsize, bool) {
+	var ws winsize
+	err := ioctl(f, syscall.TIOCGWINSZ, unsafe.Pointer(&ws))
+	return ws, err == nil && ws.rows > 0 && ws.cols > 0
+}
+
+// setTerminalSize resizes the pseudo-terminal behind master, which sends
+// SIGWINCH to whatever runs on it.
+func setTerminalSize(master *os.File, ws winsize) error {
+	return ioctl(master, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	return ioctl(f, syscall.TCGETS, unsafe.Pointer(&t)) == nil
+}
+
+// setEcho turns the echo of input on the terminal f on or off, and setCRLF
+// the translation of "\n" into "\r\n" on output.
+func setEcho(f *os.File, on bool) error {
+	return setFlag(f, func(t *syscall.Termios) *uint32 { return &t.Lflag }, syscall.ECHO, on)
+}
+
+func setCRLF(f *os.File, on bool) error {
+	return setFlag(f, func(t *syscall.Termios) *uint32 { return &t.Oflag }, syscall.ONLCR, on)
+}
+
+func setFlag(f *os.File, field func(*syscall.Termios) *uint32, flag uint32, on bool) error {
+	var t syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	if on {
+		*field(&t) |= flag
+	} else {
+		*field(&t) &^= flag
+	}
+	return ioctl(f, syscall.TCSETS, unsafe.Pointer(&t))
+}
+
+// makeRaw switches the terminal f to raw mode, as cfmakeraw(3) does, and
+// returns a function that puts it back the way it was.
+func makeRaw(f *os.File) (restore func() error, err error) {
+	var saved syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&saved)); err != nil {
+		return nil, err
+	}
+	raw := saved
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := ioctl(f, syscall.TCSETS, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return ioctl(f, syscall.TCSETS, unsafe.Pointer(&saved))
+	}, nil
+}
+
+// ioctl runs the ioctl req on f. It goes through SyscallConn rather than
+// Fd, which would put the master into blocking mode, and a blocked read of
+// it could then no longer be cut short by closing it.
+func ioctl(f *os.File, req uint, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package shallpass
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// errNoPTY is what -tty gets where pseudo-terminals are not supported yet.
+var errNoPTY = errors.New("pseudo-terminals are only supported on Linux, macOS, the BSDs and Windows")
+
+const ptyEOF = ""
+
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+type pty struct{}
+
+func newPTY() (*pty, error) { return nil, errNoPTY }
+
+func (p *pty) Read(b []byte) (int, error)                     { return 0, errNoPTY }
+func (p *pty) Write(b []byte) (int, error)                    { return 0, errNoPTY }
+func (p *pty) Close() error                                   { return errNoPTY }
+func (p *pty) start(ctx context.Context, cmd *exec.Cmd) error { return errNoPTY }
+func (p *pty) wait(cmd *exec.Cmd) error                       { return errNoPTY }
+func (p *pty) setEcho(on bool) error                          { return errNoPTY }
+func (p *pty) setCRLF(on bool) error                          { return errNoPTY }
+func (p *pty) resize(ws winsize) error                        { return errNoPTY }
+
+func terminalSize(f *os.File) (winsize, bool) { return winsize{}, false }
+
+func isTerminal(f *os.File) bool { return false }
+
+func makeRaw(f *os.File) (restore func() error, err error) { return nil, errNoPTY }
@@ -0,0 +1,91 @@
+package shallpass
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTYAnswersTheTerminal(t *testing.T) {
+	if term, err := newPTY(); err != nil {
+		t.Skip("no pseudo-terminals here:", err)
+	} else {
+		term.Close()
+	}
+	// The prompt goes to the terminal only, as ssh's does. Once the
+	// password is in, stdin has nothing more for cat, which ends on the
+	// end-of-file character typed in its place.
+	r := fakeRunner(t, `printf 'password: ' >/dev/tty
+read pw </dev/tty
+echo "got $pw"
+cat
+echo done`)
+	r.TTY = true
+	r.Timeout = 10 * time.Second
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || !res.Prompted {
+		t.Fatalf("exit %d, prompted %v; stderr: %s", res.ExitCode, res.Prompted, stderr)
+	}
+	if want := "password: got secret\ndone\n"; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+}
+
+func TestTTYWithStdinFromAFile(t *testing.T) {
+	if term, err := newPTY(); err != nil {
+		t.Skip("no pseudo-terminals here:", err)
+	} else {
+		term.Close()
+	}
+	// stdin is no terminal, so it is left as it is rather than put into
+	// raw mode, and what it holds still reaches the remote command.
+	in, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	in.WriteString("forwarded\n")
+	in.Seek(0, io.SeekStart)
+	r := fakeRunner(t, `printf 'password: ' >/dev/tty
+read pw </dev/tty
+read line </dev/tty
+echo "got $pw, then $line"`)
+	r.TTY = true
+	r.Timeout = 10 * time.Second
+	var stdout, stderr bytes.Buffer
+	res, err := r.RunWithStdio(in, &stdout, &stderr)
+	if err != nil || res.ExitCode != 0 {
+		t.Fatalf("exit %v, %v; stderr: %s", res, err, stderr.String())
+	}
+	if want := "password: got secret, then forwarded\n"; stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+}
+
+func TestRawSwitchOnAFile(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var stderr bytes.Buffer
+	s := &rawSwitch{f: f, stderr: &stderr}
+	s.raw()
+	if !strings.Contains(stderr.String(), "cannot put the terminal into raw mode") || s.undo != nil {
+		t.Errorf("raw on a file: undo %v, stderr %q", s.undo != nil, stderr.String())
+	}
+	s.restore()
+	s.restore()
+	// Once restored a late raw changes nothing and says nothing.
+	stderr.Reset()
+	s.raw()
+	if stderr.Len() != 0 || s.undo != nil {
+		t.Errorf("raw after restore: undo %v, stderr %q", s.undo != nil, stderr.String())
+	}
+}
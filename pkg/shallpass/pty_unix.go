@@ -0,0 +1,61 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package shallpass
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+// ptyEOF is what a person at the terminal types to end its input.
+const ptyEOF = "\x04"
+
+// pty is the pseudo-terminal of a Runner.TTY session: ssh gets the slave as
+// its stdin, stdout and stderr, and we read and write the master.
+type pty struct {
+	master, slave *os.File
+}
+
+func newPTY() (*pty, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	return &pty{master, slave}, nil
+}
+
+func (p *pty) Read(b []byte) (int, error)  { return p.master.Read(b) }
+func (p *pty) Write(b []byte) (int, error) { return p.master.Write(b) }
+
+// Close closes both ends. Closing the master cuts a read of it short.
+func (p *pty) Close() error {
+	p.slave.Close()
+	return p.master.Close()
+}
+
+// start starts cmd on the terminal, as the leader of a session of its own
+// with the terminal as the controlling one, which is where ssh writes its
+// prompts. exec.CommandContext already ties cmd to ctx.
+func (p *pty) start(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = p.slave, p.slave, p.slave
+	cmd.SysProcAttr = ptyProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// ssh has the terminal now; once it and everything it started have
+	// let go of it, reading the master ends.
+	p.slave.Close()
+	return nil
+}
+
+func (p *pty) wait(cmd *exec.Cmd) error { return cmd.Wait() }
+
+// setEcho turns the echo of what is typed on or off, and setCRLF the
+// translation of "\n" into "\r\n" in what ssh writes.
+func (p *pty) setEcho(on bool) error { return setEcho(p.slave, on) }
+func (p *pty) setCRLF(on bool) error { return setCRLF(p.slave, on) }
+
+// resize gives the terminal the size ws, which sends SIGWINCH to whatever
+// runs on it.
+func (p *pty) resize(ws winsize) error { return setTerminalSize(p.master, ws) }
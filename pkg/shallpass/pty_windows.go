@@ -0,0 +1,214 @@
+//go:build windows
+
+package shallpass
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/term"
+)
+
+// ptyEOF is what a person at a console types to end its input.
+const ptyEOF = "\x1a\r"
+
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+// pty is the pseudoconsole (ConPTY) of a Runner.TTY session. ssh is started
+// attached to it; we type into it through in and read what it shows from
+// out, as VT sequences.
+type pty struct {
+	console windows.Handle
+	in, out *os.File
+	close   sync.Once
+	// stop lets go of the context cmd was started with.
+	stop func() bool
+}
+
+func newPTY() (*pty, error) {
+	// x/sys panics on a function kernel32 doesn't have.
+	if windows.NewLazySystemDLL("kernel32.dll").NewProc("CreatePseudoConsole").Find() != nil {
+		return nil, errors.New("this version of Windows has no pseudoconsoles (ConPTY came with Windows 10 1809)")
+	}
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	p := &pty{in: inW, out: outR, stop: func() bool { return false }}
+	err = windows.CreatePseudoConsole(windows.Coord{X: 80, Y: 24}, windows.Handle(inR.Fd()), windows.Handle(outW.Fd()), 0, &p.console)
+	// The pseudoconsole has copies of its own ends of the pipes.
+	inR.Close()
+	outW.Close()
+	if err != nil {
+		inW.Close()
+		outR.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pty) Read(b []byte) (int, error)  { return p.out.Read(b) }
+func (p *pty) Write(b []byte) (int, error) { return p.in.Write(b) }
+
+// Close closes the pseudoconsole, which ends whatever is still attached to
+// it, and our pipes. Closing out cuts a read of it short.
+func (p *pty) Close() error {
+	p.closeConsole()
+	p.in.Close()
+	return p.out.Close()
+}
+
+func (p *pty) closeConsole() {
+	p.close.Do(func() { windows.ClosePseudoConsole(p.console) })
+}
+
+// start starts cmd attached to the pseudoconsole. os/exec has no way to
+// pass one, so cmd is started with CreateProcess here, and cmd.Process is
+// set the way Start would. cmd.Cancel is called when ctx is done, as it is
+// for a command Start started.
+func (p *pty) start(ctx context.Context, cmd *exec.Cmd) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	app, err := windows.UTF16PtrFromString(cmd.Path)
+	if err != nil {
+		return err
+	}
+	line, err := windows.UTF16PtrFromString(windows.ComposeCommandLine(cmd.Args))
+	if err != nil {
+		return err
+	}
+	var dir *uint16
+	if cmd.Dir != "" {
+		if dir, err = windows.UTF16PtrFromString(cmd.Dir); err != nil {
+			return err
+		}
+	}
+	env, err := envBlock(cmd.Env)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return err
+	}
+	defer attrs.Delete()
+	// The attribute's value is the pseudoconsole handle itself.
+	if err := attrs.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE, *(*unsafe.Pointer)(unsafe.Pointer(&p.console)), unsafe.Sizeof(p.console)); err != nil {
+		return err
+	}
+	si := windows.StartupInfoEx{ProcThreadAttributeList: attrs.List()}
+	si.Cb = uint32(unsafe.Sizeof(si))
+	// Without handles of its own ssh could end up with the ones our stdio
+	// is redirected to instead of the pseudoconsole's.
+	si.Flags = windows.STARTF_USESTDHANDLES
+	si.StdInput, si.StdOutput, si.StdErr = windows.InvalidHandle, windows.InvalidHandle, windows.InvalidHandle
+	var pi windows.ProcessInformation
+	err = windows.CreateProcess(app, line, nil, nil, false, windows.EXTENDED_STARTUPINFO_PRESENT|windows.CREATE_UNICODE_ENVIRONMENT, env, dir, &si.StartupInfo, &pi)
+	if err != nil {
+		return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: err}
+	}
+	defer windows.CloseHandle(pi.Process)
+	windows.CloseHandle(pi.Thread)
+	// Our handle keeps the process ID from being reused while FindProcess
+	// opens one of its own.
+	if cmd.Process, err = os.FindProcess(int(pi.ProcessId)); err != nil {
+		windows.TerminateProcess(pi.Process, 1)
+		return err
+	}
+	p.stop = context.AfterFunc(ctx, func() {
+		if cmd.Cancel != nil {
+			cmd.Cancel()
+		} else {
+			cmd.Process.Kill()
+		}
+	})
+	return nil
+}
+
+// wait waits for cmd to exit, and reports how it did as cmd.Wait would.
+func (p *pty) wait(cmd *exec.Cmd) error {
+	state, err := cmd.Process.Wait()
+	p.stop()
+	if err != nil {
+		return err
+	}
+	cmd.ProcessState = state
+	// Unlike a terminal, the pseudoconsole keeps out open once ssh has
+	// exited; closing it flushes what ssh wrote last and ends reading.
+	p.closeConsole()
+	if !state.Success() {
+		return &exec.ExitError{ProcessState: state}
+	}
+	return nil
+}
+
+// setEcho and setCRLF can't be done from outside: how the pseudoconsole
+// echoes is up to the console mode ssh sets, and its lines always end in
+// "\r\n".
+func (p *pty) setEcho(on bool) error { return errors.ErrUnsupported }
+func (p *pty) setCRLF(on bool) error { return errors.ErrUnsupported }
+
+// resize gives the pseudoconsole the size ws, which reaches ssh as a
+// window buffer size event.
+func (p *pty) resize(ws winsize) error {
+	return windows.ResizePseudoConsole(p.console, windows.Coord{X: int16(ws.cols), Y: int16(ws.rows)})
+}
+
+// envBlock makes the environment block CreateProcess takes of env: each
+// NAME=value ended by a NUL, and one more NUL after the last.
+func envBlock(env []string) (*uint16, error) {
+	var block []uint16
+	for _, kv := range env {
+		s, err := windows.UTF16FromString(kv)
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, s...)
+	}
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+	block = append(block, 0)
+	return &block[0], nil
+}
+
+// terminalSize is the size of the console f is, if it is one.
+func terminalSize(f *os.File) (winsize, bool) {
+	cols, rows, err := term.GetSize(int(f.Fd()))
+	if err != nil || rows <= 0 || cols <= 0 {
+		return winsize{}, false
+	}
+	return winsize{rows: uint16(rows), cols: uint16(cols)}, true
+}
+
+// isTerminal reports whether f is a console.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// makeRaw switches the console f to raw mode, with keys coming in as VT
+// sequences the pseudoconsole understands, and returns a function that
+// puts it back the way it was.
+func makeRaw(f *os.File) (restore func() error, err error) {
+	fd := int(f.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() error { return term.Restore(fd, state) }, nil
+}
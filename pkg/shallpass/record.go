@@ -0,0 +1,73 @@
+package shallpass
+
+import "io"
+
+// A Recorder receives everything that passes through a session as it
+// happens, for Runner.Recorder, with the secrets and RedactPatterns
+// redacted. stream says where p went: "stdin" for what was typed or
+// passed on to ssh, "stdout" and "stderr" for what ssh wrote, or
+// "output" with MergeStreams and "terminal" with TTY, where the two
+// can't be told apart. Record is called from several goroutines at once
+// and must not block for long.
+type Recorder interface {
+	Record(stream string, p []byte)
+}
+
+// recording feeds a session to a Recorder, through a redactWriter per
+// stream that learns every secret as it is sent.
+type recording struct {
+	rec     Recorder
+	secrets [][]byte
+	streams []*redactWriter
+}
+
+// stream returns the writer for the named stream.
+func (rc *recording) stream(name string) *redactWriter {
+	rw := newRedactWriter(recordWriter{rc.rec, name}, rc.secrets)
+	rc.streams = append(rc.streams, rw)
+	return rw
+}
+
+// addSecret redacts secret from every stream from now on.
+func (rc *recording) addSecret(secret []byte) {
+	for _, rw := range rc.streams {
+		rw.AddSecret(secret)
+	}
+}
+
+// flush passes on whatever the streams still hold back. Call it once the
+// session is over.
+func (rc *recording) flush() {
+	for _, rw := range rc.streams {
+		rw.Flush()
+	}
+}
+
+// recordWriter hands every write to a Recorder as one stream.
+type recordWriter struct {
+	rec  Recorder
+	name string
+}
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.rec.Record(w.name, append([]byte(nil), p...))
+	}
+	return len(p), nil
+}
+
+// teeWriteCloser copies to tee whatever w took.
+type teeWriteCloser struct {
+	w   io.WriteCloser
+	tee io.Writer
+}
+
+func (t teeWriteCloser) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		t.tee.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t teeWriteCloser) Close() error { return t.w.Close() }
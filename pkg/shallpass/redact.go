@@ -0,0 +1,140 @@
+package shallpass
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sync"
+)
+
+// redactedMark replaces every secret in redacted output.
+const redactedMark = "***"
+
+// redactWriter copies output to w with every occurrence of the secrets
+// replaced by redactedMark. A secret can be split across two writes, so the
+// end of each write that could be the start of a secret is held back until
+// the next one (or Flush) shows whether it is. It is safe for concurrent use, which
+// lets both of ssh's streams share one transcript.
+type redactWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets [][]byte
+	pending []byte
+}
+
+func newRedactWriter(w io.Writer, secrets [][]byte) *redactWriter {
+	rw := &redactWriter{w: w}
+	for _, s := range secrets {
+		rw.addSecret(s)
+	}
+	return rw
+}
+
+// AddSecret adds a secret that only became known during the session. s is
+// kept as it is, not copied.
+func (rw *redactWriter) AddSecret(s []byte) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.addSecret(s)
+}
+
+func (rw *redactWriter) addSecret(s []byte) {
+	if len(s) == 0 {
+		return
+	}
+	rw.secrets = append(rw.secrets, s)
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	buf := rw.redact(append(rw.pending, p...))
+
+	// Hold back a tail that could be the start of a secret.
+	cut := len(buf) - rw.heldBack(buf)
+	rw.pending = append(rw.pending[:0], buf[cut:]...)
+	if _, err := rw.w.Write(buf[:cut]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out whatever is still held back. Call it once the session
+// is over.
+func (rw *redactWriter) Flush() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	_, err := rw.w.Write(rw.pending)
+	rw.pending = nil
+	return err
+}
+
+// heldBack is the length of the longest end of buf that is the start of a
+// secret.
+func (rw *redactWriter) heldBack(buf []byte) int {
+	n := 0
+	for _, s := range rw.secrets {
+		for k := min(len(s)-1, len(buf)); k > n; k-- {
+			if bytes.HasSuffix(buf, s[:k]) {
+				n = k
+				break
+			}
+		}
+	}
+	return n
+}
+
+func (rw *redactWriter) redact(buf []byte) []byte {
+	for _, s := range rw.secrets {
+		buf = bytes.ReplaceAll(buf, s, []byte(redactedMark))
+	}
+	return buf
+}
+
+// patternWriter copies output to w with whatever matches one of patterns
+// replaced by redactedMark, for -redact-pattern. Matches are found line by
+// line: a line is only written once it is complete, so no match is split
+// across writes, and Flush writes out a last line without a newline.
+// Like PrefixWriter it is meant for one stream.
+type patternWriter struct {
+	w        io.Writer
+	patterns []*regexp.Regexp
+	buf      []byte
+}
+
+func (pw *patternWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	i := bytes.LastIndexByte(pw.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := bytes.SplitAfter(pw.buf[:i+1], []byte("\n"))
+	var out []byte
+	for _, line := range lines {
+		out = append(out, pw.redact(line)...)
+	}
+	pw.buf = append(pw.buf[:0], pw.buf[i+1:]...)
+	if _, err := pw.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out whatever is left. Call it once the session is over.
+func (pw *patternWriter) Flush() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	_, err := pw.w.Write(pw.redact(pw.buf))
+	pw.buf = nil
+	return err
+}
+
+func (pw *patternWriter) redact(line []byte) []byte {
+	for _, re := range pw.patterns {
+		line = re.ReplaceAllLiteral(line, []byte(redactedMark))
+	}
+	return line
+}
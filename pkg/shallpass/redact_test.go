@@ -0,0 +1,50 @@
+package shallpass
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+func TestRedactWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"whole", []string{"pw is hunter2\n"}, "pw is ***\n"},
+		{"split across writes", []string{"pw is hun", "ter2 ok\n"}, "pw is *** ok\n"},
+		{"split byte by byte", []string{"h", "u", "n", "t", "e", "r", "2"}, "***"},
+		// What only looked like the start of a secret comes out in the end.
+		{"a false start", []string{"hunt", "ing\n"}, "hunting\n"},
+		{"held until Flush", []string{"hunter"}, "hunter"},
+		{"both secrets", []string{"hunter2 and s3cr3t"}, "*** and ***"},
+	} {
+		var out bytes.Buffer
+		rw := newRedactWriter(&out, [][]byte{[]byte("hunter2"), nil})
+		rw.AddSecret([]byte("s3cr3t"))
+		for _, w := range tc.writes {
+			if n, err := rw.Write([]byte(w)); n != len(w) || err != nil {
+				t.Fatalf("%s: Write(%q) = %d, %v", tc.name, w, n, err)
+			}
+		}
+		rw.Flush()
+		if out.String() != tc.want {
+			t.Errorf("%s: wrote %q, want %q", tc.name, out.String(), tc.want)
+		}
+	}
+}
+
+func TestPatternWriter(t *testing.T) {
+	var out bytes.Buffer
+	pw := &patternWriter{w: &out, patterns: []*regexp.Regexp{regexp.MustCompile(`token=\S+`)}}
+	pw.Write([]byte("a token=ab"))
+	if out.Len() != 0 {
+		t.Errorf("an incomplete line was written: %q", out.String())
+	}
+	pw.Write([]byte("cd ok\nlast token=x"))
+	pw.Flush()
+	if want := "a *** ok\nlast ***"; out.String() != want {
+		t.Errorf("wrote %q, want %q", out.String(), want)
+	}
+}
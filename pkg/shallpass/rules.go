@@ -0,0 +1,451 @@
+package shallpass
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule pairs a way of recognising a prompt with the secret that answers it.
+// Each rule fires at most once per session.
+type Rule struct {
+	Name   string
+	Match  func(line string) bool
+	Secret string
+
+	// SecretBytes, if set, is sent instead of Secret, and is never made a
+	// string on the way: unlike one it can be kept out of swap and wiped.
+	// The run locks it into memory where the system allows (mlock, or
+	// VirtualLock on Windows), and zeroes and unlocks it once it is over:
+	// the rule answers during that one run, every connection and retry
+	// of it included. Clone gives each copy a buffer of its own. Askpass
+	// and Native hand the secret over as the strings they take.
+	SecretBytes []byte
+
+	// Alternates are more passwords to try, in order, when the server
+	// refuses Secret: each on a new connection, up to Runner.MaxTries
+	// connections in all.
+	Alternates []string
+
+	// Source, if set, supplies the secret instead of Secret. It is read
+	// only when the prompt actually appears, up to the first newline or
+	// EOF, so an expensive or streamed secret is never fetched for a
+	// session that doesn't ask for it. NewChanSource makes one that waits
+	// for the secret to be handed over.
+	Source io.Reader
+
+	// Prelude rules answer the steps that come before the password on
+	// network devices (a username, a "press any key" banner). They are not
+	// secrets, so their echo is expected, and they are retired as soon as
+	// any password has been sent.
+	Prelude bool
+
+	// currentPassword rules answer with the last password sent rather than
+	// Secret; see passwordChangeRules.
+	currentPassword bool
+
+	// followUp rules answer a step that may come after the password, such
+	// as the menu of a push-based second factor. Like Prelude rules their
+	// answer is no secret, but they are not retired by the password.
+	followUp bool
+
+	// pin rules answer a smartcard's PIN prompt, or the passphrase prompt
+	// of an encrypted key. The PIN is as secret as a password, but the
+	// prompt comes from the local token or key, not the host: it neither
+	// counts as the host asking for a password nor is learned as the
+	// host's prompt.
+	pin bool
+
+	// elevate rules answer sudo's password prompt, and only once the
+	// login is over; see authPhase.
+	elevate bool
+
+	// loginPassword rules answer with the password the login took rather
+	// than Secret; see SudoLoginRule.
+	loginPassword bool
+
+	// hostKeys, if set, are the only host key fingerprints the host key
+	// rule says yes to; see TrustedHostKeyRule.
+	hostKeys []string
+
+	// preamble, if set, must have matched a line of the session before
+	// the rule may answer; see RequirePreamble.
+	preamble *regexp.Regexp
+
+	// patterns are the prompts Match looks for one by one, where it is
+	// built from several, so MatchedBy can tell which of them it saw.
+	patterns []pattern
+
+	sent bool
+
+	// wiped is set once the run that had SecretBytes is over.
+	wiped bool
+
+	// tries counts the Alternates used so far; first is Secret as it was
+	// before the first of them.
+	tries int
+	first string
+}
+
+// nextAlternate moves r on to the next of its Alternates after its secret
+// was refused, and reports false if there is none left.
+func (r *Rule) nextAlternate() bool {
+	if r.tries >= len(r.Alternates) {
+		return false
+	}
+	if r.tries == 0 {
+		r.first = r.Secret
+	}
+	r.Secret = r.Alternates[r.tries]
+	r.tries++
+	return true
+}
+
+// rewind puts r back on its first secret.
+func (r *Rule) rewind() {
+	if r.tries > 0 {
+		r.Secret, r.tries = r.first, 0
+	}
+}
+
+// Describe says what kind of rule r is ("password", "prelude",
+// "follow-up" or "sudo") and what it sends, with secrets redacted, as
+// -list-matchers shows it.
+func (r *Rule) Describe() (kind, sends string) {
+	kind, sends = "password", "<redacted>"
+	switch {
+	case r.hostKeys != nil:
+		kind, sends = "prelude", fmt.Sprintf(`"yes\n" for %s, else "no\n"`, strings.Join(r.hostKeys, " or "))
+	case r.Prelude && r.Source != nil:
+		kind, sends = "prelude", "<read when asked>"
+	case r.Prelude:
+		kind, sends = "prelude", strconv.Quote(r.Secret)
+	case r.followUp:
+		kind, sends = "follow-up", strconv.Quote(r.Secret)
+	case r.elevate:
+		kind = "sudo"
+		if r.loginPassword {
+			sends = "<redacted: the login password>"
+		}
+	case r.currentPassword:
+		sends = "<redacted: the current password>"
+	case r.Source != nil:
+		sends = "<redacted: read when asked>"
+	}
+	return kind, sends
+}
+
+// UsernameRule answers a Username:/login: prompt with name.
+func UsernameRule(name string) *Rule {
+	re := regexp.MustCompile(`(?i)(username|login)\s*:\s*$`)
+	return &Rule{
+		Name:    "username",
+		Match:   re.MatchString,
+		Secret:  name + "\n",
+		Prelude: true,
+	}
+}
+
+// PressAnyKeyRule dismisses a legal banner that waits for a keypress.
+func PressAnyKeyRule() *Rule {
+	return &Rule{
+		Name: "press any key",
+		Match: func(line string) bool {
+			return strings.Contains(strings.ToLower(line), "press any key")
+		},
+		Secret:  "\n",
+		Prelude: true,
+	}
+}
+
+// inlineUserRE matches "Password for alice@server:", which some sshd PAM
+// stacks print instead of "alice@server's password:". There is no
+// "password:" in it to find. The line has to start with the prompt, so
+// sudo's "[sudo] password for alice:" and passwd's "Changing password for
+// user alice." are left alone.
+var inlineUserRE = regexp.MustCompile(`(?i)^\s*password for [^\s:]+:\s*$`)
+
+// hostKeyRE matches ssh's confirmation for an unknown host key, in both
+// the old "(yes/no)?" form and the "(yes/no/[fingerprint])?" form of
+// OpenSSH 8.0 and later.
+var hostKeyRE = regexp.MustCompile(`(?i)continue connecting \(yes/no(/\[fingerprint\])?\)\?`)
+
+// HostKeyRule answers the unknown host key question with "yes" when accept
+// is set and "no" otherwise. The full word is sent: newer clients insist
+// on it. It is a prelude rule, as the question comes before the password.
+func HostKeyRule(accept bool) *Rule {
+	answer := "no\n"
+	if accept {
+		answer = "yes\n"
+	}
+	return &Rule{
+		Name:    "host key",
+		Match:   hostKeyRE.MatchString,
+		Secret:  answer,
+		Prelude: true,
+	}
+}
+
+// PasswordRule answers the password read from stdin to the first line that
+// contains any of prompts, compared case-insensitively. With the default
+// -lang en that is the historical check for "password:", plus the
+// inline-username form above.
+func PasswordRule(password string, prompts []string) *Rule {
+	var patterns []pattern
+	for _, p := range prompts {
+		if p == "password:" {
+			patterns = append(patterns, pattern{"password for USER:", inlineUserRE.MatchString})
+		}
+	}
+	for _, p := range prompts {
+		p := p
+		patterns = append(patterns, pattern{p, func(line string) bool {
+			return strings.Contains(strings.ToLower(line), p)
+		}})
+	}
+	return &Rule{
+		Name: strings.Join(prompts, "|"),
+		Match: func(line string) bool {
+			for _, p := range patterns {
+				if p.match(line) {
+					return true
+				}
+			}
+			return false
+		},
+		Secret:   password,
+		patterns: patterns,
+	}
+}
+
+// pattern is one of the prompts a Rule looks for.
+type pattern struct {
+	name  string
+	match func(line string) bool
+}
+
+// MatchedBy names the pattern of r that line matches: which of the -lang
+// prompts or -prompt patterns it was for a password rule, or r.Name for
+// a rule that only has the one.
+func (r *Rule) MatchedBy(line string) string {
+	for _, p := range r.patterns {
+		if p.match(line) {
+			return p.name
+		}
+	}
+	return r.Name
+}
+
+// isSecret reports whether r answers with a secret, which is redacted,
+// counted and guarded against its echo.
+func (r *Rule) isSecret() bool {
+	return !r.Prelude && !r.followUp
+}
+
+// mfaRE matches the method menu of push-based second factors such as Duo:
+// "Passcode or option (1-3): ".
+var mfaRE = regexp.MustCompile(`(?i)passcode or option \(1-\d+\):\s*$`)
+
+// mfaDoneRE matches the line a second factor prints once it has been
+// approved: Duo's "Success. Logging you in...".
+var mfaDoneRE = regexp.MustCompile(`(?i)logging you in`)
+
+// MFARule answers the second-factor menu with choice, typically the
+// number of the push option.
+func MFARule(choice string) *Rule {
+	return &Rule{
+		Name:     "second factor",
+		Match:    mfaRE.MatchString,
+		Secret:   choice + "\n",
+		followUp: true,
+	}
+}
+
+// pinRE matches the prompt ssh prints for a PKCS#11 token or smartcard:
+// "Enter PIN for 'token label': ".
+var pinRE = regexp.MustCompile(`(?i)^\s*enter pin for .*:\s*$`)
+
+// sudoRE matches sudo's own "[sudo] password for alice:" prompt, which
+// the login's prompts do not.
+var sudoRE = regexp.MustCompile(`(?i)\[sudo\] password for [^\s:]+:`)
+
+// SudoRule answers sudo's prompt, or once logged in any prompt the login
+// password would have answered, with secret. Which of the two a prompt
+// belongs to is told by where the session is, not by its wording.
+func SudoRule(secret string, prompts []string) *Rule {
+	r := PasswordRule(secret, prompts)
+	match := r.Match
+	r.Name = "sudo"
+	r.Match = func(line string) bool {
+		return sudoRE.MatchString(line) || match(line)
+	}
+	r.patterns = append([]pattern{{"sudo", sudoRE.MatchString}}, r.patterns...)
+	r.elevate = true
+	return r
+}
+
+// SudoLoginRule is SudoRule for hosts where sudo wants the password the
+// login took, whichever one that was. If the login sent none, say because
+// a key got in, sudo's prompt fails the session: there is nothing to
+// answer it with.
+func SudoLoginRule(prompts []string) *Rule {
+	r := SudoRule("", prompts)
+	r.loginPassword = true
+	return r
+}
+
+// passphraseRE matches the prompt ssh prints for an encrypted private
+// key: "Enter passphrase for key '/home/me/.ssh/id_ed25519': ", or without
+// "key" for keys loaded from elsewhere.
+var passphraseRE = regexp.MustCompile(`(?i)^\s*enter passphrase for (key )?.*:\s*$`)
+
+// PassphraseRule answers the passphrase prompt of an encrypted key with
+// passphrase. Like a PIN it unlocks something local, so it leaves the
+// password rules and -forbid-prompt alone.
+func PassphraseRule(passphrase string) *Rule {
+	return &Rule{
+		Name:   "key passphrase",
+		Match:  passphraseRE.MatchString,
+		Secret: passphrase,
+		pin:    true,
+	}
+}
+
+// PINRule answers the smartcard PIN prompt with pin.
+func PINRule(pin string) *Rule {
+	return &Rule{
+		Name:   "smartcard PIN",
+		Match:  pinRE.MatchString,
+		Secret: pin,
+		pin:    true,
+	}
+}
+
+// RequirePreamble holds rules back until a line matching preamble has been
+// seen, for servers whose banners are full of "password:" but whose real
+// prompt always follows a known line. The preamble line itself is never
+// answered. The preamble arms the rules for one session: every attempt,
+// and every Clone, has to see it again.
+func RequirePreamble(rules []*Rule, preamble *regexp.Regexp) {
+	for _, r := range rules {
+		r.preamble = preamble
+	}
+}
+
+// expiredRE matches the warnings PAM and sshd print when the password has
+// aged out and must be changed before the login can continue.
+var expiredRE = regexp.MustCompile(`(?i)(password (has )?expired|must change your password|required to change your password)`)
+
+// passwordExpired reports whether line announces an expired password.
+func passwordExpired(line string) bool {
+	return expiredRE.MatchString(line)
+}
+
+// PasswordChangeRules are the rules a Runner with NewPassword set puts in
+// front of its own once the server says the password has expired, for
+// listing them. Unlike the Runner's, they do not wait for that.
+func PasswordChangeRules(newPassword string) []*Rule {
+	return passwordChangeRules(newPassword, func() bool { return true })
+}
+
+// passwordChangeRules walk the change dialog that follows an expired
+// password: the current password, then the new one twice. They only fire
+// after expired reports true, so an ordinary "password:" is never answered
+// with the new password. The confirmation rule comes first because its
+// prompt also contains "new password".
+func passwordChangeRules(newPassword string, expired func() bool) []*Rule {
+	gated := func(re *regexp.Regexp) func(string) bool {
+		return func(line string) bool {
+			return expired() && re.MatchString(line)
+		}
+	}
+	return []*Rule{
+		{
+			Name:   "retype new password",
+			Match:  gated(regexp.MustCompile(`(?i)(retype|repeat|confirm|again).*new.*password`)),
+			Secret: newPassword,
+		},
+		{
+			Name:   "new password",
+			Match:  gated(regexp.MustCompile(`(?i)new.*password`)),
+			Secret: newPassword,
+		},
+		{
+			Name:            "current password",
+			Match:           gated(regexp.MustCompile(`(?i)(current|old).*password`)),
+			currentPassword: true,
+		},
+	}
+}
+
+// CaptureSecret is the secret for prompts whose capture group, in
+// CaptureRules, captured Value. The Value "*" stands for any other.
+type CaptureSecret struct {
+	Value, Secret string
+}
+
+// CaptureRules turns a -password-capture pattern and its -password-map into
+// rules: one per value, matching a prompt whose first named group captured
+// exactly that value, and one for "*" matching any other. A session
+// through several hops (alice@jump, then bob@db) thus gets each hop's own
+// password, each at most once.
+func CaptureRules(pattern string, entries []CaptureSecret) ([]*Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	group := -1
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			group = i
+			break
+		}
+	}
+	if group < 0 {
+		return nil, fmt.Errorf("%q has no named group such as (?P<host>...)", pattern)
+	}
+	known := map[string]bool{}
+	for _, e := range entries {
+		known[e.Value] = true
+	}
+	// A prompt is at the end of its line, which may still hold earlier
+	// prompts when they were not followed by a newline.
+	captured := func(line string) (string, bool) {
+		all := re.FindAllStringSubmatch(line, -1)
+		if all == nil {
+			return "", false
+		}
+		return all[len(all)-1][group], true
+	}
+	var rules []*Rule
+	for _, e := range entries {
+		r := &Rule{Name: fmt.Sprintf("%s [%s=%s]", pattern, re.SubexpNames()[group], e.Value), Secret: e.Secret}
+		if e.Value == "*" {
+			r.Match = func(line string) bool {
+				v, ok := captured(line)
+				return ok && !known[v]
+			}
+		} else {
+			r.Match = func(line string) bool {
+				v, ok := captured(line)
+				return ok && v == e.Value
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// hopPromptPattern matches the password prompts ssh itself prints for
+// each hop, "alice@jump's password:" and, at keyboard-interactive logins,
+// "(alice@jump) Password:", capturing the host.
+const hopPromptPattern = `[^\s@(]+@(?P<host>[^\s')]+)(?:'s password:|\) [Pp]assword:)`
+
+// HopRules are CaptureRules for the hops of a -J chain: each entry's Value
+// is a host name as ssh shows it in its prompt, so every hop is answered
+// with its own secret, in whatever order they ask.
+func HopRules(entries []CaptureSecret) ([]*Rule, error) {
+	return CaptureRules(hopPromptPattern, entries)
+}
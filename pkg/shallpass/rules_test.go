@@ -0,0 +1,392 @@
+package shallpass
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequirePreamble(t *testing.T) {
+	rules := []*Rule{PasswordRule("secret\n", []string{"password:"})}
+	RequirePreamble(rules, regexp.MustCompile(`^Authentication required`))
+	inj := testInjector(rules...)
+	for _, tc := range []struct {
+		line string
+		want bool
+	}{
+		{"Banner: no password: here", false},
+		{"Authentication required password:", false},
+		{"password:", true},
+	} {
+		if _, got := inj.answer(tc.line); got != tc.want {
+			t.Errorf("answer(%q) = %v, want %v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestRequirePreambleReconnect(t *testing.T) {
+	// The first connection shows the preamble and then hangs; the second
+	// shows a prompt without one, which must not be answered.
+	count := filepath.Join(t.TempDir(), "count")
+	r := fakeRunner(t, `
+if [ ! -e `+count+` ]; then
+	: > `+count+`
+	echo 'Authentication required'
+	sleep 5
+	exit 0
+fi
+printf 'password: '
+read pw
+echo "got: $pw"
+`)
+	RequirePreamble(r.Rules, regexp.MustCompile(`^Authentication required`))
+	r.PromptTimeout = 300 * time.Millisecond
+	r.ReconnectOnTimeout = 1
+	res, stdout, _ := runFake(t, r)
+	if strings.Contains(stdout, "got: secret") {
+		t.Errorf("the reconnect answered a prompt without its own preamble: %q", stdout)
+	}
+	if _, err := os.Stat(count); err != nil || res.Attempts != 2 {
+		t.Errorf("Attempts = %d, want 2", res.Attempts)
+	}
+	if res.ExitCode != ExitPromptTimeout {
+		t.Errorf("ExitCode = %d, want %d", res.ExitCode, ExitPromptTimeout)
+	}
+}
+
+func TestRequirePreambleClones(t *testing.T) {
+	base := fakeRunner(t, `
+echo 'Authentication required'
+printf 'password: '
+read pw
+echo "got: $pw"
+`)
+	RequirePreamble(base.Rules, regexp.MustCompile(`^Authentication required`))
+
+	first := base.Clone()
+	if _, stdout, _ := runFake(t, first); !strings.Contains(stdout, "got: secret") {
+		t.Fatalf("the prompt after the preamble was not answered: %q", stdout)
+	}
+
+	second := base.Clone()
+	second.SSHPath = fakeSSH(t, `
+printf 'password: '
+read pw
+echo "got: $pw"
+`)
+	second.PromptTimeout = 300 * time.Millisecond
+	res, stdout, _ := runFake(t, second)
+	if strings.Contains(stdout, "got: secret") {
+		t.Errorf("a clone inherited the preamble another one saw: %q", stdout)
+	}
+	if res.ExitCode != ExitPromptTimeout {
+		t.Errorf("ExitCode = %d, want %d", res.ExitCode, ExitPromptTimeout)
+	}
+}
+
+func TestCaptureRules(t *testing.T) {
+	rules, err := CaptureRules(`(?P<user>\w+)@\w+'s password:`, []CaptureSecret{
+		{"alice", "a\n"},
+		{"bob", "b\n"},
+		{"*", "any\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		line string
+		want string // the secret of the rule that matches, or ""
+	}{
+		{"alice@jump's password:", "a\n"},
+		{"bob@db's password:", "b\n"},
+		{"carol@db's password:", "any\n"},
+		// The prompt is the last one on the line.
+		{"alice@jump's password: bob@db's password:", "b\n"},
+		{"Password:", ""},
+	} {
+		got := ""
+		for _, r := range rules {
+			if r.Match(tc.line) {
+				if got != "" {
+					t.Errorf("%q matches more than one rule", tc.line)
+				}
+				got = r.Secret
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%q is answered with %q, want %q", tc.line, got, tc.want)
+		}
+	}
+
+	for _, pattern := range []string{`(\w+)@`, `(`} {
+		if _, err := CaptureRules(pattern, nil); err == nil {
+			t.Errorf("CaptureRules(%q) did not fail", pattern)
+		}
+	}
+}
+
+func TestHopRules(t *testing.T) {
+	rules, err := HopRules([]CaptureSecret{{"jump", "j\n"}, {"db", "d\n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for line, want := range map[string]int{
+		"alice@jump's password:":   0,
+		"(bob@db) Password:":       1,
+		"alice@web's password:":    -1,
+		"Enter passphrase for key": -1,
+	} {
+		got := -1
+		for i, r := range rules {
+			if r.Match(line) {
+				got = i
+			}
+		}
+		if got != want {
+			t.Errorf("%q matches rule %d, want %d", line, got, want)
+		}
+	}
+}
+
+func TestExpiredPasswordDialog(t *testing.T) {
+	r := fakeRunner(t, `printf 'password: ' >&2
+read old
+echo 'WARNING: Your password has expired.' >&2
+echo 'You must change your password now and login again!' >&2
+printf 'Current password: ' >&2
+read cur
+printf 'New password: ' >&2
+read new
+printf 'Retype new password: ' >&2
+read again
+echo "$old|$cur|$new|$again"`)
+	r.NewPassword = "fresh\n"
+	res, stdout, stderr := runFake(t, r)
+	if want := "secret|secret|fresh|fresh\n"; res.ExitCode != 0 || stdout != want {
+		t.Errorf("exit %d, stdout %q, want 0, %q; stderr: %s", res.ExitCode, stdout, want, stderr)
+	}
+
+	// Without a new password to give the session fails at the warning,
+	// and nothing more is typed into the dialog, if ssh even gets that far
+	// before it is stopped.
+	r.NewPassword = ""
+	res, stdout, stderr = runFake(t, r)
+	if res.ExitCode != ExitPasswordExpired || stdout != "" && stdout != "secret|||\n" || !strings.Contains(stderr, "use -new-password") {
+		t.Errorf("without NewPassword: exit %d, stdout %q, stderr %q", res.ExitCode, stdout, stderr)
+	}
+}
+
+func TestNewPasswordOnlyAfterExpiry(t *testing.T) {
+	// Nothing said the password expired, so even a prompt that looks like
+	// the change dialog's gets the login password.
+	for _, prompt := range []string{"password: ", "New password: ", "Retype new password: "} {
+		r := fakeRunner(t, `printf '`+prompt+`' >&2
+read pw
+echo "$pw"`)
+		r.NewPassword = "fresh\n"
+		res, stdout, stderr := runFake(t, r)
+		if res.ExitCode != 0 || stdout != "secret\n" {
+			t.Errorf("%q: exit %d, stdout %q, want the login password; stderr: %s", prompt, res.ExitCode, stdout, stderr)
+		}
+	}
+}
+
+func TestNetworkDeviceLogin(t *testing.T) {
+	// A switch's console: a banner waiting for a key, then its own
+	// username and password prompts, and the CLI prompt once in.
+	r := fakeRunner(t, `echo '*** Authorized access only. Disconnect now otherwise. ***'
+printf 'Press any key to continue'
+read key
+echo
+printf 'User Access Verification\n\nUsername: '
+read user
+printf 'Password: '
+read pw
+echo "key=[$key] user=$user pw=$pw"
+echo 'switch01#'`)
+	r.Rules = append([]*Rule{PressAnyKeyRule(), UsernameRule("admin")}, r.Rules...)
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || res.SecretsSent != 1 {
+		t.Errorf("exit %d with %d secrets sent, want 0 with 1; stderr: %s", res.ExitCode, res.SecretsSent, stderr)
+	}
+	if want := "key=[] user=admin pw=secret\nswitch01#\n"; !strings.HasSuffix(stdout, want) {
+		t.Errorf("stdout = %q, want it to end in %q", stdout, want)
+	}
+}
+
+func TestTwoHopSession(t *testing.T) {
+	// ssh -J alice@jump bob@db: the jump host asks first, then the
+	// destination. The secrets are given the other way round, and each
+	// goes to its own hop once: the repeated jump prompt gets nothing.
+	r := fakeRunner(t, `printf "alice@jump's password: " >&2
+read a
+printf "bob@db's password: " >&2
+read b
+printf "alice@jump's password: " >&2
+read again
+echo "jump=$a db=$b again=[$again]"`)
+	rules, err := HopRules([]CaptureSecret{{"db", "db-pw\n"}, {"jump", "jump-pw\n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Rules = rules
+	r.CaptureOutput = true
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || res.SecretsSent != 2 {
+		t.Errorf("exit %d with %d secrets sent, want 0 with 2; stderr: %s", res.ExitCode, res.SecretsSent, stderr)
+	}
+	if want := "jump=jump-pw db=db-pw again=[]\n"; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+	// The transcript has neither secret.
+	if out := string(res.Output); !strings.Contains(out, "jump=*** db=*** again=[]") || strings.Contains(out, "-pw") {
+		t.Errorf("transcript %q", out)
+	}
+}
+
+func TestInlineUserPrompt(t *testing.T) {
+	all, err := PromptsForLangs("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prompts := range [][]string{{"password:"}, all} {
+		r := PasswordRule("secret\n", prompts)
+		for line, want := range map[string]bool{
+			"Password for alice@server: ":             true,
+			"  password for bob@db01.example.com:":    true,
+			"Password for alice@server: unchanged":    false,
+			"[sudo] password for alice:":              false,
+			"Changing password for user alice.":       false,
+			"echo Password for alice@server: > notes": false,
+		} {
+			if got := r.Match(line); got != want {
+				t.Errorf("%d prompts: Match(%q) = %v, want %v", len(prompts), line, got, want)
+			}
+		}
+		if got := r.MatchedBy("Password for alice@server: "); got != "password for USER:" {
+			t.Errorf("%d prompts: matched by %q", len(prompts), got)
+		}
+
+		runner := fakeRunner(t, "")
+		runner.SSHPath = fixtureSSH(t, "inline-user.sh")
+		runner.Rules = []*Rule{PasswordRule("secret\n", prompts)}
+		res, stdout, stderr := runFake(t, runner)
+		if res.ExitCode != 0 || res.SecretsSent != 1 || !strings.Contains(stdout, "got secret\n") {
+			t.Errorf("%d prompts: exit %d with %d secrets sent, stdout %q; stderr %q", len(prompts), res.ExitCode, res.SecretsSent, stdout, stderr)
+		}
+		if !strings.HasSuffix(stdout, "Password for alice@server: (see above)\n") {
+			t.Errorf("%d prompts: stdout %q lost the session's output", len(prompts), stdout)
+		}
+	}
+}
+
+func TestHostKeyRule(t *testing.T) {
+	const script = `printf '%s' "$QUESTION" >&2
+read answer
+echo "hostkey [$answer]"
+[ "$answer" = yes ] || { echo "Host key verification failed." >&2; exit 255; }
+printf 'password: ' >&2
+read pw
+echo "got $pw"`
+	for _, question := range []string{
+		"Are you sure you want to continue connecting (yes/no)? ",
+		"Are you sure you want to continue connecting (yes/no/[fingerprint])? ",
+	} {
+		for _, accept := range []bool{true, false} {
+			r := fakeRunner(t, "QUESTION='"+question+"'\n"+script)
+			r.Rules = append([]*Rule{HostKeyRule(accept)}, r.Rules...)
+			want, code := "hostkey [yes]\ngot secret\n", 0
+			if !accept {
+				want, code = "hostkey [no]\n", 255
+			}
+			if res, stdout, stderr := runFake(t, r); res.ExitCode != code || stdout != want {
+				t.Errorf("%q, accept %v: exit %d, stdout %q, want %q; stderr: %s", question, accept, res.ExitCode, stdout, want, stderr)
+			}
+		}
+	}
+}
+
+func TestPINRule(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want bool
+	}{
+		{"Enter PIN for 'SSH key': ", true},
+		{"Enter PIN for 'PIV Card Holder pin (PIV_II)': ", true},
+		{"enter pin for token:", true},
+		{"alice@host's password: ", false},
+		{"Please enter PIN for the vault", false},
+	} {
+		if got := PINRule("").Match(tc.line); got != tc.want {
+			t.Errorf("PINRule matches %q: %v, want %v", tc.line, got, tc.want)
+		}
+	}
+
+	// The PIN goes to the token's prompt, the password to the host's.
+	// Like ssh, the fake ends the prompt's line once it has the answer.
+	r := fakeRunner(t, `printf "Enter PIN for 'SSH key': " >&2
+read pin
+echo >&2
+printf "alice@host's password: " >&2
+read pw
+echo "pin $pin, password $pw"`)
+	r.Rules = append([]*Rule{PINRule("1234\n")}, r.Rules...)
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "pin 1234, password secret\n" {
+		t.Errorf("exit %d, stdout %q; stderr: %s", res.ExitCode, stdout, stderr)
+	}
+	// Only the host's prompt counts as the password prompt.
+	if !strings.HasPrefix(res.PromptLine, "alice@host") {
+		t.Errorf("PromptLine %q, want the host's prompt", res.PromptLine)
+	}
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	r := fakeRunner(t, `echo "The authenticity of host 'host (10.0.0.1)' can't be established." >&2
+echo "ED25519 key fingerprint is SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s." >&2
+echo "This key is not known by any other names." >&2
+printf 'Are you sure you want to continue connecting (yes/no/[fingerprint])? ' >&2
+read answer
+printf 'password: ' >&2
+read pw`)
+	r.Rules = append([]*Rule{HostKeyRule(true)}, r.Rules...)
+	res, _, stderr := runFake(t, r)
+	if res.ExitCode != 0 || res.HostKeyType != "ED25519" || res.HostKeyFingerprint != "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s" {
+		t.Errorf("exit %d, host key %q %q; stderr: %s", res.ExitCode, res.HostKeyType, res.HostKeyFingerprint, stderr)
+	}
+}
+
+func TestMFADialog(t *testing.T) {
+	// The password first, then Duo's menu, then the wait for the push.
+	script := func(approval string) string {
+		return `printf 'password: ' >&2
+read pw
+echo "Duo two-factor login for alice" >&2
+echo "" >&2
+echo " 1. Duo Push to XXX-XXX-1234" >&2
+echo " 2. Phone call to XXX-XXX-1234" >&2
+echo " 3. SMS passcodes to XXX-XXX-1234" >&2
+printf 'Passcode or option (1-3): ' >&2
+read choice
+echo "got $pw, option $choice"
+` + approval
+	}
+	for _, tc := range []struct {
+		name, approval string
+		code           int
+	}{
+		{"approved", "sleep 0.2\necho 'Success. Logging you in...' >&2\nsleep 0.5\necho in", 0},
+		{"not approved", "exec sleep 5", ExitMFATimeout},
+	} {
+		r := fakeRunner(t, script(tc.approval))
+		r.Rules = append(r.Rules, MFARule("1"))
+		r.MFAWait = 400 * time.Millisecond
+		res, stdout, stderr := runFake(t, r)
+		if res.ExitCode != tc.code || !strings.HasPrefix(stdout, "got secret, option 1\n") {
+			t.Errorf("%s: exit %d, stdout %q; want exit %d; stderr: %s", tc.name, res.ExitCode, stdout, tc.code, stderr)
+		}
+	}
+}
@@ -0,0 +1,1100 @@
+package shallpass
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plop-systems/shallpass/internal/sshargs"
+)
+
+// Runner runs a single ssh session and answers its prompts. The CLI builds
+// one from its flags; it deliberately knows nothing about flags or exiting
+// so that it can be driven from other programs too.
+type Runner struct {
+	// SSHPath is the ssh client to run. Empty means "ssh" from PATH.
+	SSHPath string
+	// Args are passed to ssh unchanged.
+	Args []string
+	// Dir is ssh's working directory. Empty means ours.
+	Dir string
+	// Native connects with the built-in client (golang.org/x/crypto/ssh)
+	// instead of running SSHPath, for hosts without an OpenSSH client.
+	// Args are read as ssh would read them, and options it can't honour
+	// are a SetupError. The server's password, keyboard-interactive and
+	// host key questions are answered by the Rules like prompts; settings
+	// that depend on scanning ssh's output, such as Triggers, are not
+	// supported.
+	Native bool
+	// Context, if set, kills ssh when it is done. A secret that is being
+	// written when that happens is finished first, so ssh never gets part
+	// of one.
+	Context context.Context
+	// Signals, if set, are passed on to ssh while it runs, so it can end
+	// the session cleanly: to its whole process group under TTY, and to
+	// the remote command with Native. As with Context, a secret being
+	// written is finished first. Ending the session if ssh does not is
+	// up to the caller.
+	Signals <-chan os.Signal
+	// Rules are tried in order against every line of scanned output.
+	Rules []*Rule
+	// Script is a dialog to hold with the session once no Rule has
+	// answered a line, one Step after the other, before any Trigger is
+	// tried.
+	Script []*Step
+	// Triggers answer output for the whole session once no Rule has.
+	// While any of them can still fire, ssh's stdin is kept open.
+	Triggers []*Trigger
+	// ScanStdout and ScanStderr select the streams searched for prompts.
+	ScanStdout, ScanStderr bool
+	// MaxPasswordBytes limits the length of secrets read from a Rule's
+	// Source; a longer one ends the session with ExitUsage. 0 means no
+	// limit.
+	MaxPasswordBytes int
+	// KeepANSI matches prompts against output lines as they are. By
+	// default terminal escape sequences (colours and the like) are stripped
+	// before matching, which does not affect what reaches the terminal.
+	KeepANSI bool
+	// NewPassword, if set, is used to walk the change dialog when the
+	// server reports that the password has expired. Without it an expired
+	// password ends the session with ExitPasswordExpired.
+	NewPassword string
+	// Askpass makes ssh ask us for secrets through SSH_ASKPASS instead of
+	// printing prompts we have to spot in its output. It needs OpenSSH 8.4
+	// or later for SSH_ASKPASS_REQUIRE.
+	Askpass bool
+	// AllowPassthrough runs ssh without prompt detection, with a warning,
+	// if the pipes needed to scan its output can't be created.
+	AllowPassthrough bool
+	// ResponseEncoding says how secrets are written: "raw" (or empty) as
+	// they are, "escape" with Go escapes such as \r and \x1b decoded,
+	// "hex" as hex digits. See decodeSecret.
+	ResponseEncoding string
+	// KeepStdin leaves ssh's stdin open after the secrets have been sent,
+	// rather than giving ssh EOF, when there is nothing to forward. A
+	// session without a remote command (ssh -N) then stays exactly as ssh
+	// would have it until ssh exits by itself.
+	KeepStdin bool
+	// MaxInjections, if set, caps the number of secrets sent in a session.
+	// A prompt beyond it ends the session with ExitTooManyInjections.
+	MaxInjections int
+	// ForbidPrompt ends the session with ExitPromptForbidden as soon as a
+	// password prompt appears, for hosts that must only accept keys. The
+	// rules then only serve to recognise the prompt.
+	ForbidPrompt bool
+	// EchoCheck warns on stderr when a password shows up in ssh's output
+	// shortly after it was sent, which means the prompt left echo on.
+	// FailOnEcho ends the session with ExitPasswordEchoed instead.
+	EchoCheck, FailOnEcho bool
+	// ScanLimit, if set, is how many bytes of output are searched for the
+	// first password prompt. A session that writes more than that without
+	// asking is taken to have got in some other way: from then on its
+	// output is only passed through, Triggers included, which bounds the
+	// work done on chatty sessions that never prompt.
+	ScanLimit int
+	// IdleTimeout, if set, ends a session on which nothing has happened
+	// for this long, ssh writing no output and us typing nothing, with
+	// ExitIdleTimeout: a remote command that hangs halfway. The clock
+	// starts with the first activity, so a connection that never gets
+	// that far is left to BannerTimeout, and it stops while MFAWait runs.
+	IdleTimeout time.Duration
+	// TTY runs ssh on a pseudo-terminal of ours, as its stdin, stdout,
+	// stderr and controlling terminal, instead of on pipes. ssh writes its
+	// own prompts to its terminal rather than to stderr, so without TTY
+	// they go straight to the user's terminal, if there is one, and are
+	// never seen. Everything ssh writes then arrives as one stream, which
+	// is scanned if ScanStdout or ScanStderr is set, and goes to stdout.
+	// When stdin is a terminal it is put into raw mode once it is
+	// forwarded, and the pseudo-terminal follows its size. On Windows it
+	// is a pseudoconsole (ConPTY), whose echo and line ends are ssh's to
+	// set. Other than those and Linux, macOS and the BSDs, no platform
+	// has pseudo-terminals yet.
+	TTY bool
+	// FailureMarker, if set, turns a session that exits 0 into one that
+	// failed with ExitFailureMarker when any line of scanned output
+	// matches it: some ForceCommand wrappers and gateways print
+	// "Authentication failed" and still exit 0.
+	FailureMarker *regexp.Regexp
+	// SSHPassCodes reports ssh's own failures (ExitSSHError) with the code
+	// sshpass gives them where it has one: ExitWrongPassword for a login
+	// the server refused, even with no password sent, and
+	// ExitHostKeyUnknown or ExitHostKeyChanged for a host key ssh would
+	// not accept.
+	SSHPassCodes bool
+	// MaxTries, if more than 1, is how many connections a login may take
+	// while the server refuses its password (ExitWrongPassword): each one
+	// after the first sends the next of the rule's Alternates. It only
+	// applies when stdin is nil, as nothing can be forwarded twice.
+	MaxTries int
+	// RetryBackoff, if set, is how long to wait before connecting again
+	// for MaxTries or ReconnectOnTimeout, doubling with each connection up
+	// to a minute, so a struggling server, or one counting failed logins,
+	// is not hammered. A session the server locked out (ExitLockedOut) is
+	// never tried again.
+	RetryBackoff time.Duration
+	// AuthLimiter, if set, caps how many of the sessions sharing it log
+	// in at the same time.
+	AuthLimiter *AuthLimiter
+	// TypeDelay, if set, writes secrets and trigger responses a byte at a
+	// time with this pause in between, for serial-console bridges that
+	// drop input arriving faster than a person types. A cancelled session
+	// still never gets part of a secret: it ends once the secret is
+	// typed, which can take up to TypeDelay per byte.
+	TypeDelay time.Duration
+	// PromptGrace ignores prompts in scanned output for this long after
+	// ssh starts, for servers that replay a stale prompt on connect.
+	// Prompts passed through Askpass come from ssh itself and are always
+	// answered.
+	PromptGrace time.Duration
+	// PromptTimeout, if set, ends a session that has not been asked for a
+	// password this long after ssh started, with ExitPromptTimeout. Only
+	// use it when a prompt is expected: a session that got in another way
+	// is ended too.
+	PromptTimeout time.Duration
+	// ConnectTimeout gives up on a session where ssh has written nothing
+	// at all this long after it started, with ExitConnectTimeout. With
+	// PromptTimeout it only applies if it is the shorter of the two. It
+	// should match ssh's own ConnectTimeout; a little slack is added for
+	// the banner.
+	ConnectTimeout time.Duration
+	// Timeout, if set, is a deadline for the whole run, reconnects
+	// included: once it passes, ssh is killed the way a cancelled Context
+	// kills it, and the run ends with ExitTimeout.
+	Timeout time.Duration
+	// BannerTimeout, if set, ends a session where ssh has written nothing
+	// at all this long after it started. Unlike PromptTimeout it points at
+	// the network rather than the login, and it fails like a connection
+	// error in ssh itself, with ExitSSHError.
+	BannerTimeout time.Duration
+	// RetryWithoutPTY runs ssh once more with -T when the server refused
+	// the terminal asked for with -t and the session then failed. It only
+	// applies when there is no stdin to forward, as that cannot be
+	// replayed.
+	RetryWithoutPTY bool
+	// MFAWait, if set, is how long a second factor may take to be approved
+	// after its menu was answered (see MFARule), say while a push waits
+	// on a phone. A session still not in by then ends with
+	// ExitMFATimeout.
+	MFAWait time.Duration
+	// Wake, if set, sends a newline this long after ssh started, for
+	// consoles and appliances that only show their prompt once a key is
+	// pressed. With WakeRepeat it is sent up to that many more times, a
+	// Wake apart. Nothing is sent once any rule has answered.
+	Wake       time.Duration
+	WakeRepeat int
+	// ReconnectOnTimeout is how many times to start ssh again after a
+	// prompt timeout before giving up. A first connection to a host that is
+	// still booting often gets as far as the banner and then stalls.
+	ReconnectOnTimeout int
+
+	// Prefix, if set, is put in front of every line ssh writes to the
+	// terminal. Lines are written whole, so sessions sharing a terminal
+	// don't tear each other's output.
+	Prefix string
+	// Binary keeps ssh's stdout byte-for-byte: Prefix and Timestamps are
+	// not applied to it, and it is no longer scanned once the password has
+	// been sent. Use it when the remote command writes binary data.
+	Binary bool
+	// MergeStreams sends ssh's stderr wherever its stdout goes, through a
+	// single scanner, as 2>&1 would. A prompt is then caught whichever
+	// stream it was written to, even one split across both, but the two
+	// can no longer be told apart. Binary does not apply.
+	MergeStreams bool
+	// RedactPatterns replaces whatever matches one of them with *** in
+	// what ssh writes to the terminal and to Capture, for secrets
+	// other than the password, such as tokens the remote command prints.
+	// Output then reaches the terminal a line at a time. Prompt detection
+	// sees it unredacted. Binary stdout is left alone.
+	RedactPatterns []*regexp.Regexp
+	// Timestamps starts every line ssh writes to the terminal with the time
+	// it was written. Prompt detection sees the lines without it.
+	Timestamps bool
+	// CountBytes fills in the byte counts of the Result. A stream that
+	// would be handed to ssh as it is then goes through a pipe of ours,
+	// so ssh no longer sees a terminal there.
+	CountBytes bool
+
+	// Logger, if set, is told what each session does: ssh starting and
+	// exiting, every line scanned and the rule that answered it, triggers
+	// and script steps firing, and why a session was abandoned. Secrets
+	// that were sent are replaced by *** in what it gets.
+	Logger *slog.Logger
+
+	// OnMatch, if set, is called with each rule as it answers line, before
+	// its secret is read. Rule.MatchedBy says which of its patterns that
+	// was. It is called with the session's lock held and must not block.
+	OnMatch func(rule *Rule, line string)
+
+	// OnSuccess and OnFailure, if set, are called once when the session is
+	// over: OnSuccess if ssh exited 0, OnFailure with the exit code (or
+	// the code of the setup error) otherwise.
+	OnSuccess func()
+	OnFailure func(code int)
+	// OnExit, if set, is called once when the session is over, after
+	// OnSuccess or OnFailure, with the code it ended with, 0 included.
+	OnExit func(code int)
+
+	// OnOutput, if set, is called with every chunk ssh writes to a scanned
+	// stream (see PromptMatch.Stream) as it was written, before it is
+	// scanned: nothing in it is redacted, secrets echoed back included.
+	// It is called from the goroutine reading the stream, and must neither
+	// block nor keep chunk.
+	OnOutput func(stream string, chunk []byte)
+	// OnPrompt, if set, is offered every line of scanned output that no
+	// Rule answered, before the Script and the Triggers, complete or not,
+	// as prompts seldom end in a newline. A non-nil response is written to
+	// ssh's stdin as it is, and treated as a secret: it is redacted, and
+	// its echo is not taken for a prompt. An error ends the session with
+	// ExitReadPassword. It is called with the session's lock held, so it
+	// may take its time, fetching a one-time code say, while the session
+	// waits for it. Like a Trigger, it keeps ssh's stdin open until the
+	// session ends. The native backend does not support it.
+	OnPrompt func(m PromptMatch) ([]byte, error)
+
+	// Capture, if set, receives a copy of everything ssh writes to stdout
+	// and stderr, with the secrets redacted. It does not replace the
+	// terminal output.
+	Capture io.Writer
+	// CaptureOutput keeps the same redacted transcript in Result.Output.
+	CaptureOutput bool
+	// Recorder, if set, gets the session stream by stream, input
+	// included, with the secrets redacted; see Recorder.
+	Recorder Recorder
+
+	// password and promptRE are set by WithPassword and WithPromptRegexp
+	// for New, which turns them into a Rule; target and command are set by
+	// WithTarget and WithCommand, which New adds to Args.
+	password []byte
+	promptRE *regexp.Regexp
+	target   string
+	command  []string
+}
+
+// Result describes a finished session.
+type Result struct {
+	// ExitCode is ssh's exit status, or ours if we ended the session.
+	ExitCode int
+	// Prompted is true if a password prompt was matched and answered.
+	Prompted bool
+	// PromptLine is the prompt that got the first password, as matched.
+	PromptLine string
+	// PromptMatched is true if a password prompt was recognised, whether
+	// or not it could be answered.
+	PromptMatched bool
+	// Output is the redacted transcript, if Runner.CaptureOutput was set.
+	Output []byte
+	// Timings breaks the session down into connect, prompt and auth. With
+	// reconnects they describe the last attempt.
+	Timings Timings
+	// Attempts is how many times ssh was started.
+	Attempts int
+	// PTYRefused is true if the server refused the terminal -t asked for.
+	PTYRefused bool
+	// HostKeyType and HostKeyFingerprint describe the unknown host key ssh
+	// asked about, e.g. "ED25519" and "SHA256:...". They are empty if ssh
+	// already knew the host.
+	HostKeyType, HostKeyFingerprint string
+	// BytesIn is how much of stdin was passed on to ssh, and BytesOut and
+	// BytesErr how much ssh wrote to stdout and stderr; with MergeStreams
+	// or TTY it all counts as stdout. They are only counted with
+	// Runner.CountBytes, and add up every attempt.
+	BytesIn, BytesOut, BytesErr int64
+	// SecretsSent is how many passwords, PINs and other secrets were
+	// typed, over every attempt.
+	SecretsSent int
+	// Reason names ExitCode in words that stay stable across releases:
+	// "ok", "auth_failed", "prompt_timeout", "remote_command_failed" and
+	// so on. See exitReasons.
+	Reason string
+
+	// refused is the rule whose password the server refused, which
+	// MaxTries may try again with the next of its Alternates.
+	refused *Rule
+}
+
+// SetupError is a failure inside the wrapper itself, before or while
+// starting ssh. Code is the exit code for the step that failed, such as
+// ExitStdinPipe or ExitNotFound.
+type SetupError struct {
+	Code int
+	Err  error
+}
+
+func (e *SetupError) Error() string { return e.Err.Error() }
+
+func (e *SetupError) Unwrap() error { return e.Err }
+
+// ExitCodeOf is the exit code for an error from a Runner: the code of a
+// SetupError, and ExitFailure for anything else.
+func ExitCodeOf(err error) int {
+	var se *SetupError
+	if errors.As(err, &se) {
+		return se.Code
+	}
+	return ExitFailure
+}
+
+// Run starts ssh, feeds it the secrets as its prompts appear, waits for it
+// to finish, and returns the code to exit with: ssh's status, or ours if
+// we ended the session. An error means the session could not be set up,
+// and comes with the code for that (see ExitCodeOf). ssh's output goes to
+// our stdout and stderr, and ssh gets EOF on its stdin once the secrets
+// are sent. ctx, if not nil, stands in for the Runner's Context.
+func (r *Runner) Run(ctx context.Context) (int, error) {
+	if ctx != nil {
+		defer func(saved context.Context) { r.Context = saved }(r.Context)
+		r.Context = ctx
+	}
+	res, err := r.RunWithStdio(nil, os.Stdout, os.Stderr)
+	if err != nil {
+		return ExitCodeOf(err), err
+	}
+	return res.ExitCode, nil
+}
+
+// RunWithStdio is Run with explicit streams, reporting everything about
+// the session in its Result. ssh's output, and our own warnings, go to
+// stdout and stderr. Once every secret has been sent, stdin (if not nil) is
+// copied to ssh for the remote command to read; otherwise ssh gets EOF at
+// that point.
+func (r *Runner) RunWithStdio(stdin io.Reader, stdout, stderr io.Writer) (res *Result, err error) {
+	defer lockSecrets(r.Rules)()
+	// A bug must not print a secret on its way out.
+	defer func() {
+		if recover() != nil {
+			PanicReport(stderr)
+			res, err = nil, &SetupError{ExitPanic, errors.New("internal error: panic")}
+		}
+	}()
+	res, err = r.run(stdin, stdout, stderr)
+	switch {
+	case err != nil && r.OnFailure != nil:
+		r.OnFailure(ExitCodeOf(err))
+	case err == nil && res.ExitCode == 0 && r.OnSuccess != nil:
+		r.OnSuccess()
+	case err == nil && res.ExitCode != 0 && r.OnFailure != nil:
+		r.OnFailure(res.ExitCode)
+	}
+	if r.OnExit != nil {
+		code := ExitCodeOf(err)
+		if err == nil {
+			code = res.ExitCode
+		}
+		r.OnExit(code)
+	}
+	return res, err
+}
+
+// run is RunWithStdio without the hooks.
+func (r *Runner) run(stdin io.Reader, stdout, stderr io.Writer) (*Result, error) {
+	// Our messages and ssh's stderr meet in stderr, possibly together with
+	// stdout. Files take care of themselves; anything else gets a lock.
+	if _, ok := stderr.(*os.File); !ok {
+		locked := &lockedWriter{w: stderr}
+		if stdout == stderr {
+			stdout = locked
+		}
+		stderr = locked
+	}
+	// Anyone on the machine can read ssh's arguments in the process list.
+	if argsHoldSecret(r.Args, r.Rules) {
+		fmt.Fprintln(stderr, "shallpass: warning: a password is in ssh's arguments too, where other users can read it in the process list")
+	}
+
+	// The transcript, if any, is shared by both streams and every attempt,
+	// and redacted as it is written.
+	var transcript bytes.Buffer
+	var capture *redactWriter
+	if r.Capture != nil || r.CaptureOutput {
+		var sinks []io.Writer
+		if r.Capture != nil {
+			sinks = append(sinks, r.Capture)
+		}
+		if r.CaptureOutput {
+			sinks = append(sinks, &transcript)
+		}
+		capture = newRedactWriter(io.MultiWriter(sinks...), secretBytes(r.Rules))
+	}
+
+	// A prompt timeout means nothing was sent, not even a lazily read
+	// secret, so the next attempt can start over with the same rules.
+	// Secrets read lazily are kept once read, so a retry without a
+	// terminal can send them again. run is r, or a copy with the Timeout's
+	// Context or with -T added.
+	r.reset()
+	for _, rule := range r.Rules {
+		rule.rewind()
+	}
+	run, retried, tries := r, false, 1
+	var total Result
+	if r.Timeout > 0 {
+		parent := r.Context
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithTimeoutCause(parent, r.Timeout, errTimeout)
+		defer cancel()
+		deadline := *r
+		deadline.Context = ctx
+		run = &deadline
+	}
+	for attempt := 1; ; attempt++ {
+		session := run.session
+		if r.Native {
+			session = run.nativeSession
+		}
+		res, timedOut, err := session(stdin, stdout, stderr, capture)
+		if err != nil {
+			return nil, err
+		}
+		total.BytesIn += res.BytesIn
+		total.BytesOut += res.BytesOut
+		total.BytesErr += res.BytesErr
+		total.SecretsSent += res.SecretsSent
+		retry := res.PTYRefused && res.ExitCode != 0 && r.RetryWithoutPTY && !retried && stdin == nil
+		// ssh would ask again itself, but on the next connection the new
+		// password is sent to a fresh prompt, the way it was found.
+		another := res.refused != nil && tries < r.MaxTries && stdin == nil && res.refused.nextAlternate()
+		if (timedOut && attempt <= r.ReconnectOnTimeout) || retry || another {
+			switch {
+			case another:
+				tries++
+				fmt.Fprintf(stderr, "shallpass: trying the next password (%d of %d)\n", tries, r.MaxTries)
+			case retry:
+				fmt.Fprintln(stderr, "shallpass: retrying without a terminal (-T)")
+				noPTY := *run
+				noPTY.Args = sshargs.Insert(r.Args, []string{"-T"})
+				run, retried = &noPTY, true
+			default:
+				fmt.Fprintf(stderr, "shallpass: reconnecting (%d of %d)\n", attempt, r.ReconnectOnTimeout)
+			}
+			// Interrupted while waiting, the session stands as it ended.
+			if run.backOff(attempt) {
+				r.reset()
+				continue
+			}
+		}
+		res.Attempts = attempt
+		res.BytesIn, res.BytesOut, res.BytesErr = total.BytesIn, total.BytesOut, total.BytesErr
+		res.SecretsSent = total.SecretsSent
+		if capture != nil {
+			capture.Flush()
+			res.Output = transcript.Bytes()
+		}
+		return res, nil
+	}
+}
+
+// session runs ssh once. timedOut reports that it was ended by
+// PromptTimeout.
+func (r *Runner) session(stdin io.Reader, stdout, stderr io.Writer, capture *redactWriter) (res *Result, timedOut bool, err error) {
+	// Prepare the ssh command, passing through the arguments.
+	sshPath := r.SSHPath
+	if sshPath == "" {
+		sshPath = "ssh"
+	}
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cmd := exec.CommandContext(ctx, sshPath, r.Args...)
+	cmd.Dir = r.Dir
+	cmd.Env = Environ()
+	// Once ssh has exited, don't wait forever for output from children it
+	// left behind (a ProxyCommand, say) that still hold its pipes.
+	cmd.WaitDelay = 2 * time.Second
+
+	authDone, err := r.AuthLimiter.acquire(ctx)
+	if err != nil {
+		return nil, false, limitError(err)
+	}
+	defer authDone()
+
+	// We need to control ssh's stdin to send the password, so we get a
+	// pipe, or with TTY a terminal that is ssh's stdin and the rest.
+	var stdinPipe io.WriteCloser
+	var term *pty
+	if r.TTY {
+		term, err = newPTY()
+		if err != nil {
+			return nil, false, &SetupError{ExitStdinPipe, fmt.Errorf("failed to allocate a pseudo-terminal: %v%s", err, pipeHint(err))}
+		}
+		defer term.Close()
+		stdinPipe = ptyInput{term}
+	} else {
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			return nil, false, &SetupError{ExitStdinPipe, fmt.Errorf("failed to create stdin pipe: %v%s", err, pipeHint(err))}
+		}
+	}
+	// What we type into ssh is recorded as it goes in, so a password
+	// shows as *** where it was sent.
+	var rec *recording
+	if r.Recorder != nil {
+		rec = &recording{rec: r.Recorder, secrets: secretBytes(r.Rules)}
+		stdinPipe = teeWriteCloser{stdinPipe, rec.stream("stdin")}
+	}
+	times := &timeline{}
+	counts := &traffic{}
+	forward := stdin
+	if stdin != nil && r.CountBytes {
+		forward = countingReader{stdin, &counts.in}
+	}
+	inj := &injector{
+		stdin:         stdinPipe,
+		rules:         r.Rules,
+		times:         times,
+		keepANSI:      r.KeepANSI,
+		maxSecret:     r.MaxPasswordBytes,
+		forward:       forward,
+		stderr:        stderr,
+		forbidPrompt:  r.ForbidPrompt,
+		grace:         r.PromptGrace,
+		maxInjections: r.MaxInjections,
+		keepStdin:     r.KeepStdin,
+		encoding:      r.ResponseEncoding,
+		triggers:      r.Triggers,
+		script:        r.Script,
+		mfaWait:       r.MFAWait,
+		echoCheck:     r.EchoCheck,
+		failOnEcho:    r.FailOnEcho,
+		typeDelay:     r.TypeDelay,
+		scanLimit:     r.ScanLimit,
+		idle:          r.IdleTimeout,
+		failureMarker: r.FailureMarker,
+		log:           r.logger(),
+	}
+	for _, rule := range r.Rules {
+		inj.elevation = inj.elevation || rule.elevate
+	}
+	if r.TTY {
+		// A terminal echoes what is typed and ends lines with "\r\n". That
+		// is only wanted where it ends up on one of ours: input from a
+		// pipe would otherwise show up in the output, and output going to
+		// a file would get carriage returns.
+		term.setEcho(localTerminal(stdin) != nil)
+		term.setCRLF(localTerminal(stdout) != nil)
+		if local := localTerminal(stdin, stdout, stderr); local != nil {
+			defer followSize(term, local)()
+		}
+		if f, ok := stdin.(*os.File); ok && isTerminal(f) {
+			t := &rawSwitch{f: f, stderr: stderr}
+			inj.onForward = t.raw
+			defer t.restore()
+		}
+	}
+	if r.NewPassword != "" {
+		inj.changePassword = true
+		inj.rules = append(passwordChangeRules(r.NewPassword, inj.isExpired), inj.rules...)
+	}
+
+	if r.Askpass {
+		srv, env, err := startAskpass(inj)
+		if err != nil {
+			return nil, false, &SetupError{ExitAskpass, fmt.Errorf("failed to set up SSH_ASKPASS: %v", err)}
+		}
+		defer srv.Close()
+		cmd.Env = append(cmd.Env, env...)
+	}
+
+	if capture != nil || rec != nil {
+		inj.onSecret = func(secret []byte) {
+			if capture != nil {
+				capture.AddSecret(secret)
+			}
+			if rec != nil {
+				rec.addSecret(secret)
+			}
+		}
+	}
+	inj.onMatch = r.OnMatch
+	inj.onPrompt, inj.onOutput = r.OnPrompt, r.OnOutput
+	inj.authDone = authDone
+
+	// Each stream goes straight to the user's terminal, through a
+	// PrefixWriter if lines are to be prefixed or timestamped. A stream we scan is also
+	// teed into a pipe our scanner goroutine reads, and the transcript gets
+	// a copy of both.
+	var scanned, teed []*os.File
+	var scannedNames []string
+	defer func() {
+		for _, f := range append(scanned, teed...) {
+			f.Close()
+		}
+	}()
+	var prefixed []*PrefixWriter
+	var patterned []*patternWriter
+	var lineMu sync.Mutex
+	type stream struct {
+		name     string
+		enabled  bool
+		dst      *io.Writer
+		terminal io.Writer
+		binary   bool
+	}
+	streams := []stream{
+		{"stdout", r.ScanStdout, &cmd.Stdout, stdout, r.Binary},
+		{"stderr", r.ScanStderr, &cmd.Stderr, stderr, false},
+	}
+	if r.MergeStreams {
+		// One writer for both: exec then never has two writes to it in
+		// flight, so a prompt split across the streams stays in order.
+		streams = []stream{{"output", r.ScanStdout || r.ScanStderr, &cmd.Stdout, stdout, false}}
+	}
+	// Under TTY ssh writes to the terminal, and we copy what comes out of
+	// it: one stream, as a terminal shows it.
+	var ptyOut io.Writer
+	if r.TTY {
+		streams = []stream{{"terminal", r.ScanStdout || r.ScanStderr, &ptyOut, stdout, false}}
+	}
+	for _, s := range streams {
+		if (r.Prefix != "" || r.Timestamps) && !s.binary {
+			pw := NewPrefixWriter(s.terminal, r.Prefix, &lineMu)
+			if r.Timestamps {
+				pw.Timestamp = timestampLayout
+			}
+			prefixed = append(prefixed, pw)
+			s.terminal = pw
+		}
+		// Extra redaction sits in front of the prefix, so patterns see
+		// what ssh wrote, and runs per stream for the transcript too.
+		if len(r.RedactPatterns) > 0 && !s.binary {
+			pw := &patternWriter{w: s.terminal, patterns: r.RedactPatterns}
+			patterned = append(patterned, pw)
+			s.terminal = pw
+		}
+		outputs := []io.Writer{s.terminal}
+		if r.CountBytes {
+			outputs = append(outputs, counts.writer(s.name == "stderr"))
+		}
+		if rec != nil {
+			var w io.Writer = rec.stream(s.name)
+			if len(r.RedactPatterns) > 0 {
+				pw := &patternWriter{w: w, patterns: r.RedactPatterns}
+				patterned = append(patterned, pw)
+				w = pw
+			}
+			outputs = append(outputs, w)
+		}
+		if capture != nil && len(r.RedactPatterns) > 0 && !s.binary {
+			pw := &patternWriter{w: capture, patterns: r.RedactPatterns}
+			patterned = append(patterned, pw)
+			outputs = append(outputs, pw)
+		} else if capture != nil {
+			outputs = append(outputs, capture)
+		}
+		scannedBefore := len(scanned)
+		if s.enabled {
+			pr, pw, err := newPipe()
+			switch {
+			case err == nil && s.binary:
+				// Scan only until the password is out; the rest is the
+				// remote command's data.
+				cw := &cutoffWriter{w: pw}
+				inj.onPassword = cw.cut
+				outputs = append(outputs, cw, times)
+				scanned, teed = append(scanned, pr), append(teed, pw)
+				scannedNames = append(scannedNames, s.name)
+			case err == nil:
+				outputs = append(outputs, pw, times)
+				scanned, teed = append(scanned, pr), append(teed, pw)
+				scannedNames = append(scannedNames, s.name)
+			case !r.AllowPassthrough:
+				// ssh is never started, so its stdin is not closed for us.
+				stdinPipe.Close()
+				return nil, false, &SetupError{ExitOutputPipe, fmt.Errorf("failed to create %s pipe: %v%s", s.name, err, pipeHint(err))}
+			default:
+				// The stream still reaches the terminal, we just can't
+				// look for prompts in it.
+				fmt.Fprintf(stderr, "shallpass: warning: cannot scan %s for prompts, passing it through: %v%s\n", s.name, err, pipeHint(err))
+			}
+		}
+		if r.IdleTimeout > 0 && len(scanned) == scannedBefore {
+			outputs = append(outputs, activityWriter{times})
+		}
+		if len(outputs) == 1 {
+			*s.dst = s.terminal
+		} else {
+			*s.dst = io.MultiWriter(outputs...)
+		}
+	}
+	if r.MergeStreams && !r.TTY {
+		cmd.Stderr = cmd.Stdout
+	}
+	if len(scanned) == 0 && (r.ScanStdout || r.ScanStderr) {
+		fmt.Fprintln(stderr, "shallpass: warning: no prompt detection; the password will not be sent")
+	}
+
+	// A cancelled session is only ended between writes, never in the
+	// middle of a secret.
+	cmd.Cancel = func() error {
+		inj.mu.Lock()
+		defer inj.mu.Unlock()
+		r.cancelled(ctx, inj)
+		return nil
+	}
+
+	// One scanner per teed stream. They share the injector, so a prompt that
+	// shows up on both streams is still only answered once. They are
+	// reading before ssh starts: a prompt from a reused connection can
+	// arrive before Start returns.
+	var scanners sync.WaitGroup
+	for i, pr := range scanned {
+		scanners.Add(1)
+		go func() {
+			defer scanners.Done()
+			// A panic here would take the whole process down with a
+			// traceback; end the session without one instead, and keep
+			// the pipe drained until ssh is gone.
+			defer func() {
+				if recover() != nil {
+					PanicReport(stderr)
+					inj.crashed()
+					io.Copy(io.Discard, pr)
+				}
+			}()
+			scanStream(pr, scannedNames[i], inj)
+		}()
+	}
+
+	// Start the ssh command in the background. The clock starts first for
+	// the same reason.
+	times.start = time.Now()
+	inj.log.Info("starting ssh", "path", sshPath, "args", r.Args, "tty", r.TTY, "askpass", r.Askpass, "scanned", scannedNames)
+	start, wait := cmd.Start, cmd.Wait
+	if r.TTY {
+		start = func() error { return term.start(ctx, cmd) }
+		wait = func() error { return term.wait(cmd) }
+	}
+	if err := start(); err != nil {
+		inj.log.Error("ssh did not start", "error", err)
+		for _, pw := range teed {
+			pw.Close()
+		}
+		scanners.Wait()
+		return nil, false, startError(sshPath, err)
+	}
+	copied := make(chan struct{})
+	if r.TTY {
+		go func() {
+			defer close(copied)
+			io.Copy(ptyOut, term)
+		}()
+	} else {
+		close(copied)
+	}
+	// The scanners may already have given up on the session before there
+	// was a process to kill.
+	inj.mu.Lock()
+	inj.kill = func() { cmd.Process.Kill() }
+	if inj.failure != nil {
+		inj.kill()
+	}
+	inj.mu.Unlock()
+
+	if r.ForbidPrompt {
+		// We will never type a password, so unless there is a PIN to send
+		// the remote command can have stdin straight away.
+		inj.mu.Lock()
+		inj.closeIfDone()
+		inj.mu.Unlock()
+	}
+	var timers []*time.Timer
+	if r.PromptTimeout > 0 {
+		timers = append(timers, time.AfterFunc(r.PromptTimeout, func() { inj.timeout(r.PromptTimeout) }))
+	}
+	if connect := r.ConnectTimeout + connectSlack; r.ConnectTimeout > 0 && (r.PromptTimeout == 0 || connect < r.PromptTimeout) {
+		timers = append(timers, time.AfterFunc(connect, func() { inj.silent(connect, ExitConnectTimeout) }))
+	}
+	if r.BannerTimeout > 0 {
+		timers = append(timers, time.AfterFunc(r.BannerTimeout, func() { inj.silent(r.BannerTimeout, ExitSSHError) }))
+	}
+	for i := 1; r.Wake > 0 && i <= 1+r.WakeRepeat; i++ {
+		timers = append(timers, time.AfterFunc(time.Duration(i)*r.Wake, inj.wake))
+	}
+	if r.IdleTimeout > 0 {
+		inj.mu.Lock()
+		inj.idleTimer = time.AfterFunc(r.IdleTimeout, inj.idleCheck)
+		inj.mu.Unlock()
+	}
+	inj.mu.Lock()
+	inj.startStep()
+	inj.mu.Unlock()
+
+	stopRelay := relaySignals(r.Signals, inj, func(sig os.Signal) {
+		if r.TTY {
+			// ssh leads a process group of its own on the terminal.
+			signalGroup(cmd.Process, sig)
+			return
+		}
+		cmd.Process.Signal(sig)
+	})
+
+	// Wait for the ssh command to complete. If we ended the session
+	// ourselves, our reason beats ssh's status.
+	waitErr := wait()
+	stopRelay()
+	for _, t := range timers {
+		t.Stop()
+	}
+	inj.stopMFA()
+	inj.stopIdle()
+	inj.stopScript()
+	if errors.Is(waitErr, exec.ErrWaitDelay) {
+		// ssh itself exited cleanly; only the leftover pipes were cut.
+		waitErr = nil
+	}
+	// What ssh wrote to its terminal last may still be on its way out.
+	// Children it left behind can hold the terminal open too, and get the
+	// same WaitDelay they would get on pipes.
+	select {
+	case <-copied:
+	case <-time.After(cmd.WaitDelay):
+		term.Close()
+		<-copied
+	}
+	// Nothing writes to the tees any more: Wait returns only once ssh's
+	// stdout and stderr have both been copied out in full. Closing the
+	// tees ends the scanners of both streams, which must be done before
+	// the session's state is read.
+	for _, pw := range teed {
+		pw.Close()
+	}
+	scanners.Wait()
+	res = &Result{ExitCode: exitStatus(waitErr)}
+	var exitErr *exec.ExitError
+	internal := waitErr != nil && !errors.As(waitErr, &exitErr)
+	if internal {
+		fmt.Fprintln(stderr, "shallpass: internal error while ssh was running:", waitErr)
+	}
+	res.Timings = times.timings(time.Now())
+	res.Prompted = inj.prompted()
+	res.PromptMatched = inj.matchedPrompt()
+	res.PromptLine = inj.firstPrompt()
+	res.PTYRefused = inj.ptyRefused
+	res.HostKeyType, res.HostKeyFingerprint = inj.keyType, inj.fingerprint
+	counts.record(res, inj)
+	for _, pw := range patterned {
+		pw.Flush()
+	}
+	if rec != nil {
+		rec.flush()
+	}
+	for _, pw := range prefixed {
+		pw.Flush()
+	}
+	f := inj.failed()
+	// A failure marker only speaks for sessions that claim to be fine.
+	marked := f == nil && res.ExitCode == 0 && inj.markerSeen
+	// ssh giving up on authentication after we sent a password means
+	// the server did not take it.
+	if f == nil && res.ExitCode == ExitSSHError && inj.sshReason == "auth_failed" && inj.lastLogin != nil {
+		fmt.Fprintln(stderr, "shallpass: the server refused the password")
+		f = &failure{code: ExitWrongPassword}
+		inj.wrong = inj.lastLogin
+	}
+	if f == nil {
+		f = r.sshpassFailure(res.ExitCode, inj.sshReason)
+	}
+	if lockedOut(f, res.ExitCode, inj) {
+		fmt.Fprintln(stderr, "shallpass: the server locked us out; not trying again")
+		f, inj.wrong = &failure{code: ExitLockedOut}, nil
+	}
+	res.refused = inj.wrong
+	// Like the marker, an unfinished script only speaks for sessions that
+	// claim to be fine.
+	if f == nil && res.ExitCode == 0 {
+		f = inj.scriptUnfinished()
+	}
+	if f != nil {
+		res.ExitCode = f.code
+		timedOut = f.code == ExitPromptTimeout || f.code == ExitConnectTimeout
+	} else if marked {
+		fmt.Fprintln(stderr, "shallpass: ssh exited 0, but its output matched the failure marker")
+		res.ExitCode = ExitFailureMarker
+	} else if res.ExitCode != 0 {
+		if msg := inj.earlyEOF(); msg != "" {
+			fmt.Fprintln(stderr, "shallpass:", msg)
+		}
+	}
+	res.Reason = exitReason(res.ExitCode, f != nil || internal || marked, inj.sshReason)
+	inj.log.Info("ssh exited", "status", exitStatus(waitErr), "exit_code", res.ExitCode, "reason", res.Reason, "prompted", res.Prompted)
+	return res, timedOut, nil
+}
+
+// cancelled ends the session because ctx is done: with ExitTimeout if it
+// was the Timeout that ran out. The lock must be held.
+func (r *Runner) cancelled(ctx context.Context, inj *injector) {
+	switch {
+	case inj.failure != nil:
+	case errors.Is(context.Cause(ctx), errTimeout):
+		inj.fail(ExitTimeout, fmt.Sprintf("the run took longer than %v", r.Timeout))
+	default:
+		inj.fail(ExitInterrupted, "interrupted")
+	}
+}
+
+// relaySignals hands each signal from signals to send, with the lock held,
+// until the returned function is called.
+func relaySignals(signals <-chan os.Signal, inj *injector, send func(os.Signal)) (stop func()) {
+	if signals == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				inj.mu.Lock()
+				send(sig)
+				inj.mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// errTimeout is the cause of a Context that ended because the Runner's
+// Timeout passed.
+var errTimeout = errors.New("timeout")
+
+// newPipe makes the pipes scanned output is teed into. Tests replace it
+// to see what a session does when it fails.
+var newPipe = os.Pipe
+
+// connectSlack is added to ConnectTimeout before we call a silent ssh
+// stuck: ssh's timeout covers the TCP connect, not the banner after it.
+const connectSlack = 2 * time.Second
+
+// reset makes every rule and trigger ready to fire again, for the next
+// attempt or for running r once more (as -batch does).
+func (r *Runner) reset() {
+	for _, rule := range r.Rules {
+		rule.sent = false
+	}
+	for _, t := range r.Triggers {
+		t.fired, t.hold = 0, false
+	}
+}
+
+// Clone returns a copy of r with copies of its Rules and Triggers, in the
+// same order, so that copies can run sessions side by side: what a rule or
+// trigger remembers about a session is its own, SecretBytes included, as
+// each run wipes its own. Everything else, Sources and callbacks included,
+// is shared.
+func (r *Runner) Clone() *Runner {
+	c := *r
+	c.Rules = make([]*Rule, len(r.Rules))
+	for i, rule := range r.Rules {
+		copied := *rule
+		if rule.SecretBytes != nil {
+			copied.SecretBytes = append([]byte{}, rule.SecretBytes...)
+			lockMemory(copied.SecretBytes)
+		}
+		c.Rules[i] = &copied
+	}
+	c.Triggers = make([]*Trigger, len(r.Triggers))
+	for i, t := range r.Triggers {
+		copied := *t
+		c.Triggers[i] = &copied
+	}
+	c.reset()
+	return &c
+}
+
+// startError explains why ssh could not be started. A missing or
+// non-executable client gets the shell's "command not found" (127) and
+// "not executable" (126) codes and a hint, since it is nearly always a setup
+// problem on the calling machine.
+func startError(sshPath string, err error) error {
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		where := "in PATH"
+		if strings.ContainsRune(sshPath, os.PathSeparator) {
+			where = "at " + sshPath
+		}
+		return &SetupError{ExitNotFound, fmt.Errorf("%s not found %s; install an ssh client or set -ssh-bin", filepath.Base(sshPath), where)}
+	case errors.Is(err, fs.ErrPermission):
+		return &SetupError{ExitNotExecutable, fmt.Errorf("%s is not executable; check its permissions or set -ssh-bin", sshPath)}
+	}
+	return &SetupError{ExitStart, fmt.Errorf("failed to start ssh command: %v", err)}
+}
+
+// Secrets lists the secrets that must never appear in a transcript: the
+// rule responses, without the newline that ends them. SecretBytes are left
+// out, as they would have to be copied into strings; the Runner redacts
+// them all the same.
+func Secrets(rules []*Rule) []string {
+	var secrets []string
+	for _, r := range rules {
+		if r.isSecret() {
+			secrets = append(secrets, strings.TrimRight(r.Secret, "\r\n"))
+			if r.tries > 0 {
+				secrets = append(secrets, strings.TrimRight(r.first, "\r\n"))
+			}
+			for _, alt := range r.Alternates {
+				secrets = append(secrets, strings.TrimRight(alt, "\r\n"))
+			}
+		}
+	}
+	return secrets
+}
+
+// secretBytes is Secrets for the redactWriters, with SecretBytes as they
+// are rather than copied into strings.
+func secretBytes(rules []*Rule) [][]byte {
+	var secrets [][]byte
+	for _, s := range Secrets(rules) {
+		secrets = append(secrets, []byte(s))
+	}
+	for _, r := range rules {
+		if r.isSecret() && r.SecretBytes != nil {
+			secrets = append(secrets, bytes.TrimRight(r.SecretBytes, "\r\n"))
+		}
+	}
+	return secrets
+}
+
+// argsHoldSecret reports whether one of args contains a secret of rules.
+func argsHoldSecret(args []string, rules []*Rule) bool {
+	for _, arg := range args {
+		for _, s := range secretBytes(rules) {
+			if len(s) > 0 && bytes.Contains([]byte(arg), s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lockSecrets locks the SecretBytes of rules into memory for the length
+// of a run, and returns the function that ends it by wiping them.
+func lockSecrets(rules []*Rule) (wipe func()) {
+	var locked []*Rule
+	for _, r := range rules {
+		if r.SecretBytes != nil && !r.wiped {
+			lockMemory(r.SecretBytes)
+			locked = append(locked, r)
+		}
+	}
+	return func() {
+		for _, r := range locked {
+			clear(r.SecretBytes)
+			unlockMemory(r.SecretBytes)
+			r.wiped = true
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package shallpass
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestArgumentsReachSSHInOrder(t *testing.T) {
+	r := fakeRunner(t, `for a in "$@"; do printf '[%s]' "$a"; done`)
+	r.Args = []string{"--", "host", "-t", "tmux attach"}
+	_, stdout, _ := runFake(t, r)
+	if want := "[--][host][-t][tmux attach]"; stdout != want {
+		t.Errorf("ssh got %s, want %s", stdout, want)
+	}
+}
+
+func TestPromptSource(t *testing.T) {
+	// ssh prompts on one stream, or on both at once as some servers do;
+	// a prompt on a stream that isn't scanned is never answered.
+	prompts := map[string]string{
+		"stdout": `printf 'password: '`,
+		"stderr": `printf 'password: ' >&2`,
+		"both":   `printf 'password: '; printf 'password: ' >&2`,
+	}
+	for _, tc := range []struct {
+		mode           string
+		stdout, stderr bool
+		answers        map[string]bool
+	}{
+		{"stdout", true, false, map[string]bool{"stdout": true, "stderr": false, "both": true}},
+		{"stderr", false, true, map[string]bool{"stdout": false, "stderr": true, "both": true}},
+		{"both", true, true, map[string]bool{"stdout": true, "stderr": true, "both": true}},
+	} {
+		for on, answered := range tc.answers {
+			r := fakeRunner(t, prompts[on]+`
+read pw
+echo "got $pw"`)
+			r.ScanStdout, r.ScanStderr = tc.stdout, tc.stderr
+			r.PromptTimeout = 300 * time.Millisecond
+			res, stdout, stderr := runFake(t, r)
+			switch {
+			case !answered && res.ExitCode != ExitPromptTimeout:
+				t.Errorf("-prompt-source %s, prompt on %s: exit %d, want the prompt timeout", tc.mode, on, res.ExitCode)
+			case answered && (res.ExitCode != 0 || res.SecretsSent != 1 || !strings.Contains(stdout, "got secret")):
+				t.Errorf("-prompt-source %s, prompt on %s: exit %d with %d secrets sent, stdout %q; stderr: %s", tc.mode, on, res.ExitCode, res.SecretsSent, stdout, stderr)
+			}
+		}
+	}
+}
+
+func TestSecretBytesAreWipedAfterTheRun(t *testing.T) {
+	secret := []byte("hunter2\n")
+	r := fakeRunner(t, `printf 'password: '
+read pw
+echo "got $pw"`)
+	r.Rules = []*Rule{{Name: "password", Match: func(line string) bool { return strings.Contains(line, "password:") }, SecretBytes: secret}}
+	r.CaptureOutput = true
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "password: got hunter2\n" {
+		t.Fatalf("exit %d, stdout %q; stderr: %s", res.ExitCode, stdout, stderr)
+	}
+	if want := "password: got ***\n"; string(res.Output) != want {
+		t.Errorf("transcript %q, want %q", res.Output, want)
+	}
+	if string(secret) != "\x00\x00\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("the secret is %q after the run", secret)
+	}
+	// What is left is never sent.
+	res, stdout, _ = runFake(t, r)
+	if res.ExitCode != ExitReadPassword || strings.Contains(stdout, "got") {
+		t.Errorf("a second run: exit %d, stdout %q", res.ExitCode, stdout)
+	}
+}
+
+func TestWithPasswordIsWipedAfterTheRun(t *testing.T) {
+	r := New(WithSSHPath(fakeSSH(t, `printf 'password: '; read pw; echo "got $pw"`)), WithPassword([]byte("hunter2")))
+	sent := r.Rules[0].SecretBytes
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "password: got hunter2\n" {
+		t.Fatalf("exit %d, stdout %q; stderr: %s", res.ExitCode, stdout, stderr)
+	}
+	if len(sent) != len("hunter2\n") || strings.Trim(string(sent), "\x00") != "" {
+		t.Errorf("the password is %q after the run", sent)
+	}
+}
+
+func TestCloneHasSecretBytesOfItsOwn(t *testing.T) {
+	r := fakeRunner(t, `printf 'password: '; read pw`)
+	r.Rules[0].SecretBytes = []byte("hunter2\n")
+	c := r.Clone()
+	if res, _, stderr := runFake(t, c); res.ExitCode != 0 {
+		t.Fatalf("exit %d; stderr: %s", res.ExitCode, stderr)
+	}
+	if string(r.Rules[0].SecretBytes) != "hunter2\n" {
+		t.Errorf("running the copy left the original with %q", r.Rules[0].SecretBytes)
+	}
+}
+
+func TestSecretInArgumentsIsWarnedAbout(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		warn bool
+	}{
+		{[]string{"--", "host", "echo hunter2"}, true},
+		{[]string{"--", "host", "uptime"}, false},
+	} {
+		r := New(WithSSHPath(fakeSSH(t, `printf 'password: '; read pw`)), WithPassword([]byte("hunter2")), WithSSHArgs(tc.args...))
+		_, _, stderr := runFake(t, r)
+		if got := strings.Contains(stderr, "process list"); got != tc.warn {
+			t.Errorf("ssh %q: warned %v, want %v; stderr: %s", tc.args, got, tc.warn, stderr)
+		}
+	}
+}
+
+// failingPipes makes newPipe succeed ok times and then fail as if out of
+// file descriptors, until the test ends. It returns the pipes it made.
+func failingPipes(t *testing.T, ok int) *[]*os.File {
+	var made []*os.File
+	saved := newPipe
+	t.Cleanup(func() { newPipe = saved })
+	newPipe = func() (*os.File, *os.File, error) {
+		if len(made)/2 >= ok {
+			return nil, nil, &os.SyscallError{Syscall: "pipe2", Err: syscall.EMFILE}
+		}
+		r, w, err := saved()
+		made = append(made, r, w)
+		return r, w, err
+	}
+	return &made
+}
+
+func TestPipeFailure(t *testing.T) {
+	ran := filepath.Join(t.TempDir(), "ran")
+	r := fakeRunner(t, fmt.Sprintf("touch '%s'", ran))
+	made := failingPipes(t, 1)
+	var stderr bytes.Buffer
+	_, err := r.RunWithStdio(nil, &bytes.Buffer{}, &stderr)
+	if code := ExitCodeOf(err); code != ExitOutputPipe || !strings.Contains(err.Error(), "out of file descriptors") {
+		t.Fatalf("exit %d: %v", code, err)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("ssh was started")
+	}
+	if len(*made) != 2 {
+		t.Fatalf("%d pipe ends made, want the 2 of stdout's", len(*made))
+	}
+	for _, f := range *made {
+		if err := f.Close(); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("a pipe end was left open")
+		}
+	}
+}
+
+func TestPipeFailurePassthrough(t *testing.T) {
+	r := fakeRunner(t, `echo hi; echo ho >&2`)
+	r.AllowPassthrough = true
+	failingPipes(t, 0)
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "hi\n" || !strings.Contains(stderr, "ho\n") {
+		t.Errorf("exit %d, stdout %q, stderr %q", res.ExitCode, stdout, stderr)
+	}
+	if !strings.Contains(stderr, "cannot scan stdout") || !strings.Contains(stderr, "no prompt detection") {
+		t.Errorf("no warning on stderr: %s", stderr)
+	}
+}
+
+func TestTrailingStderrIsScannedAndWritten(t *testing.T) {
+	// A burst on stderr, ending in a prompt, from an ssh that exits at
+	// once: Wait must not return before every byte is through the tee.
+	r := fakeRunner(t, `i=0
+while [ $i -lt 4000 ]; do echo "debug1: line $i of noise" >&2; i=$((i+1)); done
+printf 'password: ' >&2`)
+	r.ScanStdout = false
+	var scanned int
+	r.OnOutput = func(stream string, chunk []byte) {
+		if stream == "stderr" {
+			scanned += len(chunk)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		res, _, stderr := runFake(t, r)
+		if !strings.HasSuffix(stderr, "debug1: line 3999 of noise\npassword: ") || strings.Count(stderr, "\n") != 4000 {
+			t.Fatalf("stderr lost bytes: %d lines, ends %q", strings.Count(stderr, "\n"), stderr[max(0, len(stderr)-40):])
+		}
+		if !res.PromptMatched || scanned < len(stderr) {
+			t.Fatalf("the prompt at the end was not scanned: matched %v, %d of %d bytes seen", res.PromptMatched, scanned, len(stderr))
+		}
+		scanned = 0
+	}
+}
+
+func TestMissingSSH(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "no", "ssh")
+	notExecutable := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path, want string
+		code       int
+	}{
+		{missing, "ssh not found at " + missing + "; install an ssh client or set -ssh-bin", ExitNotFound},
+		{"shallpass-no-such-ssh", "shallpass-no-such-ssh not found in PATH; install an ssh client or set -ssh-bin", ExitNotFound},
+		{notExecutable, notExecutable + " is not executable; check its permissions or set -ssh-bin", ExitNotExecutable},
+	} {
+		if tc.code == ExitNotExecutable && runtime.GOOS == "windows" {
+			continue
+		}
+		code, err := New(WithSSHPath(tc.path), WithPassword([]byte("secret")), WithTarget("host")).Run(context.Background())
+		var setup *SetupError
+		if code != tc.code || !errors.As(err, &setup) || setup.Code != tc.code || err.Error() != tc.want {
+			t.Errorf("%s: exit %d, %v; want %d, %q", tc.path, code, err, tc.code, tc.want)
+		}
+	}
+}
+
+func TestBinaryOutputIsKeptByteForByte(t *testing.T) {
+	// Every byte value, line ends of every kind, escapes, a prompt-like
+	// line and a line too long to scan, with no newline at the end.
+	var data []byte
+	for i := 0; i < 256; i++ {
+		data = append(data, byte(i))
+	}
+	data = append(data, "\r\n\x1b[31mpassword: \x00\xff\xfe\r"...)
+	data = append(data, bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 40000)...)
+	image := filepath.Join(t.TempDir(), "image.png")
+	if err := os.WriteFile(image, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(data)
+	for _, tc := range []struct {
+		name       string
+		binary     bool
+		timestamps bool
+		same       bool
+	}{
+		{"binary", true, false, true},
+		{"binary with timestamps", true, true, true},
+		// The check can tell: line processing changes the bytes.
+		{"timestamps", false, true, false},
+	} {
+		r := fakeRunner(t, `printf 'password: ' >&2
+read pw
+cat '`+image+`'`)
+		r.Binary, r.Timestamps = tc.binary, tc.timestamps
+		res, stdout, stderr := runFake(t, r)
+		if res.ExitCode != 0 || !res.Prompted {
+			t.Errorf("%s: exit %d, prompted %v; stderr %q", tc.name, res.ExitCode, res.Prompted, stderr)
+			continue
+		}
+		if got := sha256.Sum256([]byte(stdout)); (got == want) != tc.same {
+			t.Errorf("%s: %d bytes with checksum %x, sent %d with %x; want them the same: %v", tc.name, len(stdout), got, len(data), want, tc.same)
+		}
+	}
+}
+
+func TestRunWithInMemoryStdio(t *testing.T) {
+	// No file or terminal anywhere: stdin is a buffer handed on once the
+	// password is in, and both outputs land in buffers of their own.
+	r := fakeRunner(t, `printf 'password: ' >&2
+read pw
+while read line; do echo "got $line"; done
+echo "done, after $pw" >&2`)
+	r.CountBytes = true
+	stdin := bytes.NewBufferString("first\nsecond\n")
+	var stdout, stderr bytes.Buffer
+	res, err := r.RunWithStdio(stdin, &stdout, &stderr)
+	if err != nil || res.ExitCode != 0 {
+		t.Fatalf("%v, %v; stderr %q", res, err, stderr.String())
+	}
+	if want := "got first\ngot second\n"; stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+	if want := "password: done, after secret\n"; stderr.String() != want {
+		t.Errorf("stderr = %q, want %q", stderr.String(), want)
+	}
+	if stdin.Len() != 0 || res.BytesIn != 13 || res.BytesOut != int64(stdout.Len()) {
+		t.Errorf("%d bytes of stdin left; counted %d in and %d out", stdin.Len(), res.BytesIn, res.BytesOut)
+	}
+}
+
+func TestReconnectOnTimeout(t *testing.T) {
+	// The first connection hangs without a prompt, as against an sshd that
+	// is still starting; the second asks for the password.
+	count := filepath.Join(t.TempDir(), "count")
+	r := fakeRunner(t, `echo x >> '`+count+`'
+if [ "$(wc -l < '`+count+`')" -lt 2 ]; then exec sleep 5; fi
+printf 'password: ' >&2
+read pw
+echo "got $pw"`)
+	r.PromptTimeout = 200 * time.Millisecond
+	r.ReconnectOnTimeout = 2
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "got secret\n" || res.Attempts != 2 {
+		t.Errorf("exit %d after %d attempts, stdout %q; stderr: %s", res.ExitCode, res.Attempts, stdout, stderr)
+	}
+	if !strings.Contains(stderr, "reconnecting (1 of 2)") {
+		t.Errorf("stderr %q doesn't mention the reconnect", stderr)
+	}
+
+	// A host that never prompts is given up on after the last reconnect.
+	r = fakeRunner(t, `exec sleep 5`)
+	r.PromptTimeout = 100 * time.Millisecond
+	r.ReconnectOnTimeout = 2
+	if res, _, stderr := runFake(t, r); res.ExitCode != ExitPromptTimeout || res.Attempts != 3 {
+		t.Errorf("exit %d after %d attempts, want %d after 3; stderr: %s", res.ExitCode, res.Attempts, ExitPromptTimeout, stderr)
+	}
+}
+
+func TestFastFailureDoesNotHang(t *testing.T) {
+	// ssh gives up before anything could match, as on a refused
+	// connection; the run must end with it, every time.
+	r := fakeRunner(t, `echo "ssh: connect to host h port 22: Connection refused" >&2
+exit 255`)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		var stderr bytes.Buffer
+		var res *Result
+		var err error
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			res, err = r.RunWithStdio(nil, io.Discard, &stderr)
+		}()
+		select {
+		case <-done:
+			if err != nil {
+				t.Fatalf("run %d: %v", i, err)
+			}
+			if res.ExitCode != 255 || !strings.Contains(stderr.String(), "Connection refused") {
+				t.Errorf("run %d: exit %d, stderr %q", i, res.ExitCode, stderr.String())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("run %d hung after ssh exited", i)
+		}
+	}
+	// Leave the runtime a moment to retire the last run's goroutines.
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running, %d before", n, before)
+	}
+}
+
+func TestKeepStdinForAForward(t *testing.T) {
+	// Like ssh -N, the fake carries on after the password with nothing to
+	// run, and checks whether its stdin is still open by then.
+	script := `printf 'password: ' >&2
+read pw
+echo "got $pw"
+exec 3<&0
+read rest <&3 &
+sleep 0.3
+if kill $! 2>/dev/null; then echo "stdin open"; else echo "stdin closed"; fi`
+	for _, keep := range []bool{true, false} {
+		r := fakeRunner(t, script)
+		r.KeepStdin = keep
+		want := "got secret\nstdin closed\n"
+		if keep {
+			want = "got secret\nstdin open\n"
+		}
+		if res, stdout, stderr := runFake(t, r); res.ExitCode != 0 || stdout != want {
+			t.Errorf("KeepStdin %v: exit %d, stdout %q, want %q; stderr: %s", keep, res.ExitCode, stdout, want, stderr)
+		}
+	}
+}
+
+func TestPromptAsTheFirstByte(t *testing.T) {
+	// The prompt is out the moment ssh starts, as over a reused
+	// connection; it is caught every time.
+	r := fakeRunner(t, `printf 'password: ' >&2
+read pw
+echo "got $pw"`)
+	for i := 0; i < 50; i++ {
+		res, stdout, stderr := runFake(t, r)
+		if res.ExitCode != 0 || stdout != "got secret\n" || !res.Prompted {
+			t.Fatalf("run %d: exit %d, stdout %q; stderr: %s", i, res.ExitCode, stdout, stderr)
+		}
+	}
+}
+
+func TestBannerAndPromptTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		script string
+		code   int
+		msg    string
+	}{
+		// Not a byte from ssh: the network.
+		{"silent", "exec sleep 5", ExitSSHError, "no output from ssh within 200ms"},
+		// The server talks but never asks: the login.
+		{"no prompt", "echo 'Welcome to host' >&2\nexec sleep 5", ExitPromptTimeout, "no password prompt within 400ms"},
+	} {
+		r := fakeRunner(t, tc.script)
+		r.BannerTimeout = 200 * time.Millisecond
+		r.PromptTimeout = 400 * time.Millisecond
+		if res, _, stderr := runFake(t, r); res.ExitCode != tc.code || !strings.Contains(stderr, tc.msg) {
+			t.Errorf("%s: exit %d, stderr %q; want exit %d and %q", tc.name, res.ExitCode, stderr, tc.code, tc.msg)
+		}
+	}
+}
+
+func TestRetryWithoutPTY(t *testing.T) {
+	// A restricted server turns down -t, and the command fails without a
+	// terminal; with -T it runs as it should.
+	const script = `printf 'password: ' >&2
+read pw
+case " $* " in
+*" -T "*) echo "ran with $*" ;;
+*) echo "PTY allocation request failed on channel 0" >&2; exit 1 ;;
+esac`
+	r := fakeRunner(t, script)
+	r.Args = []string{"-t", "host"}
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 1 || !res.PTYRefused || !strings.Contains(stderr, "shallpass: note: the server refused a terminal") {
+		t.Errorf("without the retry: exit %d, PTYRefused %v, stderr %q", res.ExitCode, res.PTYRefused, stderr)
+	}
+
+	r = fakeRunner(t, script)
+	r.Args = []string{"-t", "host"}
+	r.RetryWithoutPTY = true
+	res, stdout, stderr = runFake(t, r)
+	if res.ExitCode != 0 || res.Attempts != 2 || !strings.HasPrefix(stdout, "ran with ") || !strings.Contains(stderr, "retrying without a terminal (-T)") {
+		t.Errorf("with the retry: exit %d after %d attempts, stdout %q; stderr: %s", res.ExitCode, res.Attempts, stdout, stderr)
+	}
+
+	// Only the warning itself counts.
+	r = fakeRunner(t, `echo "echo PTY allocation request failed"`)
+	if res, _, stderr := runFake(t, r); res.PTYRefused || strings.Contains(stderr, "refused a terminal") {
+		t.Errorf("a line like the warning was taken for it: stderr %q", stderr)
+	}
+}
+
+func TestMergeStreams(t *testing.T) {
+	// Only stdout is scanned, yet the prompt on stderr is caught, and
+	// everything comes out on stdout in the order it was written.
+	r := fakeRunner(t, `echo "banner" >&2
+echo "motd"
+printf 'password: ' >&2
+read pw
+echo "got $pw"
+echo "warning" >&2`)
+	r.ScanStdout, r.ScanStderr = true, false
+	r.MergeStreams = true
+	res, stdout, stderr := runFake(t, r)
+	if want := "banner\nmotd\npassword: got secret\nwarning\n"; res.ExitCode != 0 || stdout != want || stderr != "" {
+		t.Errorf("exit %d, stdout %q, stderr %q; want stdout %q", res.ExitCode, stdout, stderr, want)
+	}
+}
+
+func TestWake(t *testing.T) {
+	// A console that takes its time: everything that reaches it is
+	// shown once the password is in.
+	const script = `sleep 0.5
+printf 'password: ' >&2
+od -An -tx1 | tr -d ' \n'`
+	const secret = "7365637265740a"
+	for _, tc := range []struct {
+		name       string
+		wake       time.Duration
+		wakeRepeat int
+		want       string
+	}{
+		{"no wake", 0, 0, secret},
+		{"once", 100 * time.Millisecond, 0, "0a" + secret},
+		{"repeated", 100 * time.Millisecond, 2, "0a0a0a" + secret},
+	} {
+		r := fakeRunner(t, script)
+		r.Wake, r.WakeRepeat = tc.wake, tc.wakeRepeat
+		if res, stdout, stderr := runFake(t, r); res.ExitCode != 0 || stdout != tc.want {
+			t.Errorf("%s: exit %d, ssh read %s, want %s; stderr: %s", tc.name, res.ExitCode, stdout, tc.want, stderr)
+		}
+	}
+}
+
+// failingWriter fails every write, like a stdout whose reader went away.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestInternalErrorIsNotSSHs(t *testing.T) {
+	// ssh runs and exits 0, but its output can't be written out: that is
+	// our failure, and says so, rather than passing for ssh's.
+	r := fakeRunner(t, `printf 'password: ' >&2
+read pw
+echo "some output"`)
+	var stderr bytes.Buffer
+	res, err := r.RunWithStdio(nil, failingWriter{}, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != ExitInternal || res.Reason != "internal_error" || !strings.Contains(stderr.String(), "shallpass: internal error while ssh was running: ") || !strings.Contains(stderr.String(), "disk full") {
+		t.Errorf("exit %d, reason %q, stderr %q; want exit %d and the error", res.ExitCode, res.Reason, stderr.String(), ExitInternal)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name, command string
+		code          int
+	}{
+		// Output keeps coming, more slowly than the timeout in all.
+		{"busy", "for i in 1 2 3 4 5 6; do sleep 0.1; echo $i; done", 0},
+		// The remote command hangs halfway.
+		{"hung", "echo 1; echo 2; exec sleep 5", ExitIdleTimeout},
+	} {
+		r := fakeRunner(t, "printf 'password: ' >&2\nread pw\n"+tc.command)
+		r.IdleTimeout = 300 * time.Millisecond
+		start := time.Now()
+		res, stdout, stderr := runFake(t, r)
+		if res.ExitCode != tc.code || !strings.HasPrefix(stdout, "1\n2\n") {
+			t.Errorf("%s: exit %d, stdout %q; want exit %d; stderr: %s", tc.name, res.ExitCode, stdout, tc.code, stderr)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: the session took %v", tc.name, d)
+		}
+	}
+}
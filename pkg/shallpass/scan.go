@@ -0,0 +1,957 @@
+package shallpass
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// injector owns ssh's standard input. Several scanners (one per output
+// stream) may spot the same prompt; the mutex makes sure each rule's secret
+// is written at most once, whichever stream saw it first.
+type injector struct {
+	mu     sync.Mutex
+	stdin  io.WriteCloser
+	rules  []*Rule
+	guard  echoGuard
+	closed bool
+
+	// keepANSI matches lines with their escape sequences intact instead
+	// of stripping them first.
+	keepANSI bool
+
+	// maxSecret limits the length of secrets read lazily; 0 means no
+	// limit.
+	maxSecret int
+
+	// lastSecret is the last password we sent, which is what a password
+	// change dialog asks for as the current password.
+	lastSecret []byte
+
+	// loginSecret is the last password sent to the login, as opposed to a
+	// PIN or sudo, which is what SudoLoginRule answers with.
+	loginSecret []byte
+
+	// promptLine is the line that got the first password.
+	promptLine string
+
+	// armed holds the RequirePreamble preambles seen in this session.
+	armed map[*regexp.Regexp]bool
+
+	// unsent is set when writing a secret to ssh failed, which means ssh
+	// was already gone.
+	unsent bool
+
+	// matched is set once a password prompt is recognised, even if its
+	// secret then could not be sent.
+	matched bool
+
+	// maxInjections caps how many secrets are sent in all, and injections
+	// counts them; 0 means no cap.
+	maxInjections, injections int
+
+	// encoding is the -response-encoding of passwords; empty means raw.
+	encoding string
+
+	// grace is how long after ssh started prompts are ignored, because
+	// what shows up that early is a stale echo rather than a challenge.
+	grace time.Duration
+
+	// forbidPrompt treats any password prompt as a failure rather than
+	// answering it.
+	forbidPrompt bool
+
+	// echoCheck warns when a password comes back in the output, and
+	// failOnEcho ends the session instead. echoed is set once it has.
+	echoCheck, failOnEcho, echoed bool
+
+	// sshReason is what the first of ssh's error messages says went
+	// wrong; see sshFailure.
+	sshReason string
+
+	// keyType and fingerprint are the unknown host key ssh showed before
+	// asking whether to trust it.
+	keyType, fingerprint string
+
+	// mfaWait is how long a second factor may take to be approved once
+	// its menu has been answered; mfaTimer enforces it.
+	mfaWait  time.Duration
+	mfaTimer *time.Timer
+
+	// idle is how long the session may go without activity once it has
+	// started talking; idleTimer is the watchdog. See idleCheck.
+	idle      time.Duration
+	idleTimer *time.Timer
+
+	// scanLimit, if set, is how many bytes of output are searched for the
+	// first password prompt; scannedBytes counts them. scanStopped is set
+	// once the limit is passed and the rest is only passed through.
+	scanLimit    int
+	scannedBytes int
+	scanStopped  bool
+
+	// typeDelay, if set, is the pause between the bytes of everything we
+	// type into ssh; see write.
+	typeDelay time.Duration
+
+	// phase is how far the login has got. It is only tracked when
+	// elevation is set, that is when a rule answers sudo. loginSent is set
+	// while a login password is out and has not been refused.
+	phase     authPhase
+	elevation bool
+	loginSent bool
+
+	// failureMarker, if set, is output that means the session failed
+	// whatever ssh's status; markerSeen is set once a line matched it.
+	failureMarker *regexp.Regexp
+	markerSeen    bool
+
+	// loginCheck is the login rule whose password was just sent, until
+	// the first line after it that is no refusal; refused is set if a
+	// refusal came first. The same prompt then means the password was
+	// wrong. lastLogin is the login rule answered last, and wrong the one
+	// found to be wrong.
+	loginCheck, lastLogin, wrong *Rule
+	refused                      bool
+
+	// ptyRefused is set once ssh reports that the server would not
+	// allocate the terminal -t asked for.
+	ptyRefused bool
+
+	// changePassword is set when the password change rules are in place.
+	// Without them an expired password ends the session.
+	changePassword bool
+	expired        bool
+
+	// onSecret is told about every secret as it is sent, so secrets that
+	// were read lazily can still be redacted.
+	onSecret func(secret []byte)
+
+	// onMatch is Runner.OnMatch.
+	onMatch func(r *Rule, line string)
+	// onPrompt and onOutput are Runner.OnPrompt and Runner.OnOutput.
+	// promptHold is set while the unfinished line onPrompt answered is
+	// still growing.
+	onPrompt   func(m PromptMatch) ([]byte, error)
+	onOutput   func(stream string, chunk []byte)
+	promptHold bool
+
+	// authDone hands back the AuthLimiter slot, once the server replied
+	// to the password. lockout is set once the server said it won't take
+	// any more logins.
+	authDone func()
+	lockout  bool
+
+	// onPassword, if set, is called after each password is chosen. It
+	// runs with the lock held and must not block.
+	onPassword func()
+
+	// times records when the prompt was answered and when the server
+	// replied.
+	times *timeline
+
+	// forward, if set, is copied to ssh's stdin once the secrets are all
+	// sent, instead of closing it.
+	forward io.Reader
+
+	// forwarded says forward has run dry. stdin is closed then, or once
+	// the triggers and the script are done if they are not yet.
+	forwarded bool
+
+	// onForward, if set, is called just before forward starts being
+	// copied.
+	onForward func()
+
+	// keepStdin leaves ssh's stdin open once the secrets are all sent.
+	keepStdin bool
+
+	// triggers answer output for the rest of the session; stdin stays
+	// open while they may still fire.
+	triggers []*Trigger
+
+	// script is Runner.Script and step the index of the step waiting for
+	// its output, whose timeout stepTimer is. stepHold is set while the
+	// unfinished line the last step matched is still growing. tail and
+	// tailPartial are the end of the output, for a step that fails.
+	script            []*Step
+	step              int
+	stepTimer         *time.Timer
+	stepHold          bool
+	tail, tailPartial string
+
+	// stderr receives our own messages.
+	stderr io.Writer
+
+	// log is Runner.Logger, or a logger that drops everything; secrets
+	// are the secrets sent so far, which it never gets to see.
+	log     *slog.Logger
+	secrets [][]byte
+
+	// kill stops ssh when the session has to be abandoned; failure then
+	// records why.
+	kill    func()
+	failure *failure
+}
+
+// authPhase is where a session is on its way in. Before the login is over
+// a password prompt is the login's; after it, the same prompt comes from
+// sudo in the remote command.
+type authPhase int
+
+const (
+	preLogin authPhase = iota
+	loggedIn
+	elevated
+)
+
+// loginMarkerRE matches what servers print once a login is over.
+var loginMarkerRE = regexp.MustCompile(`^(Last login:|Welcome to )`)
+
+// loginRefusedRE matches a server turning a login password down, after
+// which the next prompt is the login's again.
+var loginRefusedRE = regexp.MustCompile(`(?i)permission denied|try again|authentication failed|access denied|login incorrect`)
+
+// advancePhase moves the session to loggedIn on output showing the login
+// is over: a marker such as "Last login:", or the first output after the
+// login password that is no refusal, which comes from the remote command
+// (a prompt waiting without a newline, sudo's included, or a complete
+// line). The lock must be held.
+func (inj *injector) advancePhase(line string, partial bool) {
+	text := strings.TrimSpace(line)
+	if inj.phase != preLogin || inj.expired || text == "" {
+		return
+	}
+	if !loginMarkerRE.MatchString(text) {
+		if loginRefusedRE.MatchString(text) || sshFailure(text) != "" {
+			inj.loginSent = false
+			return
+		}
+		if !inj.loginSent || partial && !inj.isPrompt(line) {
+			return
+		}
+	}
+	inj.phase = loggedIn
+	// A login that did not need its password will not ask for it now.
+	for _, r := range inj.rules {
+		if r.isSecret() && !r.pin && !r.elevate {
+			r.sent = true
+		}
+	}
+}
+
+// checkLogin watches the output right after a login password: a refusal
+// ("Permission denied, please try again.") followed by the same prompt
+// means the password was wrong, and ends the session rather than leave
+// ssh waiting for another. Any other complete line means the password got
+// past that point. The lock must be held.
+func (inj *injector) checkLogin(line string, partial bool) {
+	// An expired password is refused on purpose, and asked for again as
+	// the current one.
+	if inj.expired {
+		inj.loginCheck = nil
+		return
+	}
+	text := strings.TrimSpace(line)
+	switch {
+	case text == "":
+	case loginRefusedRE.MatchString(text):
+		inj.refused = true
+	case inj.refused && inj.loginCheck.Match(line):
+		inj.wrong = inj.loginCheck
+		inj.fail(ExitWrongPassword, "the server refused the password and asked for it again")
+	case !partial:
+		inj.loginCheck, inj.refused = nil, false
+	}
+}
+
+// isPrompt reports whether a rule that has not fired yet matches line.
+// The lock must be held.
+func (inj *injector) isPrompt(line string) bool {
+	for _, r := range inj.rules {
+		if !r.sent && r.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// failure is a reason we ended the session ourselves.
+type failure struct {
+	code int
+	msg  string
+}
+
+// handle checks line, from stream, against the rules in order and answers
+// the first one that matches and has not fired yet, or failing that asks
+// OnPrompt, runs the script or fires a trigger. partial says the line has
+// no newline yet. Once every password rule has been answered ssh's stdin
+// is closed, unless the triggers or OnPrompt still need it.
+func (inj *injector) handle(stream, line string, partial bool) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	if inj.failure != nil {
+		return
+	}
+
+	// Only the copy we match against is stripped; the terminal still gets
+	// the colours.
+	if !inj.keepANSI {
+		line = stripANSI(line)
+	}
+
+	if inj.sshReason == "" {
+		inj.sshReason = sshFailure(line)
+	}
+	if !inj.lockout && lockoutRE.MatchString(line) {
+		inj.lockout = true
+		inj.log.Warn("the server is locking us out", "line", inj.logText(strings.TrimSpace(line)))
+	}
+	if m := fingerprintRE.FindStringSubmatch(line); m != nil && inj.fingerprint == "" {
+		inj.keyType, inj.fingerprint = m[1], m[2]
+	}
+	if inj.mfaTimer != nil && mfaDoneRE.MatchString(line) {
+		inj.mfaTimer.Stop()
+		inj.mfaTimer = nil
+	}
+	if !inj.ptyRefused && ptyRefusedRE.MatchString(line) {
+		inj.ptyRefused = true
+		fmt.Fprintln(inj.stderr, "shallpass: note: the server refused a terminal, so the remote command runs without one; programs that only prompt on a terminal (sudo, passwd) will not ask")
+	}
+
+	if inj.failureMarker != nil && !inj.markerSeen && inj.failureMarker.MatchString(line) {
+		inj.markerSeen = true
+	}
+
+	// A line that merely echoes what we just typed is never a prompt,
+	// even when the password itself contains "password:".
+	if inj.guard.suppresses(line, time.Now()) {
+		inj.log.Debug("echo of what was sent, not a prompt")
+		if (inj.echoCheck || inj.failOnEcho) && !inj.echoed {
+			inj.reportEcho()
+		}
+		return
+	}
+	if len(inj.script) > 0 {
+		inj.noteTail(line, partial)
+	}
+	if inj.log.Enabled(context.Background(), slog.LevelDebug) {
+		inj.log.Debug("output", "line", inj.logText(line), "partial", partial)
+	}
+
+	// An expired password is followed by "Current password:" and
+	// "New password:" prompts. Unless we were told how to change it, stop
+	// rather than send the old password into the change dialog.
+	if passwordExpired(line) {
+		inj.expired = true
+		if !inj.changePassword {
+			inj.fail(ExitPasswordExpired, "the password has expired; use -new-password to change it")
+			return
+		}
+	}
+
+	if inj.elevation {
+		inj.advancePhase(line, partial)
+	}
+	if inj.loginCheck != nil {
+		if inj.checkLogin(line, partial); inj.failure != nil {
+			return
+		}
+	}
+
+	// The first line after a password is the server's reply to it.
+	if len(inj.lastSecret) > 0 {
+		inj.times.mark(&inj.times.reply)
+		if inj.authDone != nil {
+			inj.authDone()
+		}
+	}
+
+	if inj.grace > 0 && time.Since(inj.times.start) < inj.grace {
+		return
+	}
+
+	// With -forbid-prompt stdin is released from the start, but prompts
+	// still have to be spotted. Triggers carry on after the login.
+	if !inj.closed || inj.forbidPrompt {
+		if secret, ok := inj.answer(line); ok {
+			if err := inj.write(secret); err != nil {
+				inj.unsent = true
+			}
+			// The echo can only come once the last byte is typed.
+			if inj.typeDelay > 0 && bytes.Equal(inj.guard.sent, bytes.TrimRight(secret, "\r\n")) {
+				inj.guard.arm(secret, time.Now())
+			}
+			inj.closeIfDone()
+			return
+		}
+		inj.closeIfDone()
+	}
+	if inj.failure != nil || inj.askHook(stream, line, partial) {
+		return
+	}
+	if inj.failure == nil && !inj.runStep(line, partial) {
+		inj.fireTrigger(line, partial)
+	}
+}
+
+// write types s into ssh's stdin: all at once, or a byte at a time
+// typeDelay apart for consoles that drop input arriving too fast. The lock
+// must be held, and stays held while typing, so a cancelled session still
+// never gets half a secret; it just ends once the last byte is out.
+func (inj *injector) write(s []byte) error {
+	inj.times.touch()
+	if inj.typeDelay <= 0 {
+		_, err := inj.stdin.Write(s)
+		return err
+	}
+	for i := 0; i < len(s); i++ {
+		if i > 0 {
+			time.Sleep(inj.typeDelay)
+		}
+		if _, err := inj.stdin.Write(s[i : i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pastScanLimit counts n more bytes of output towards the scanLimit and
+// reports whether prompts are no longer looked for. Only output before
+// the first password counts. Once past the limit the session is taken to
+// have got in without one, say with a key: the triggers are dropped and
+// stdin is released as if the login were done.
+func (inj *injector) pastScanLimit(n int) bool {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	if inj.scanStopped {
+		return true
+	}
+	if inj.scanLimit <= 0 || len(inj.lastSecret) > 0 || inj.failure != nil {
+		return false
+	}
+	inj.scannedBytes += n
+	if inj.scannedBytes <= inj.scanLimit {
+		return false
+	}
+	inj.scanStopped = true
+	inj.log.Info("scan limit reached", "bytes", inj.scannedBytes)
+	fmt.Fprintf(inj.stderr, "shallpass: note: no password prompt in the first %d bytes of output, no longer looking for one\n", inj.scanLimit)
+	inj.triggers, inj.onPrompt = nil, nil
+	if !inj.closed {
+		inj.release()
+	}
+	return true
+}
+
+// askpass answers a prompt that ssh passed to its SSH_ASKPASS program
+// rather than printing it. The rules are the same; only the delivery of
+// the secret differs.
+func (inj *injector) askpass(prompt string) (string, bool) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	if inj.failure != nil {
+		return "", false
+	}
+	if !inj.keepANSI {
+		prompt = stripANSI(prompt)
+	}
+	secret, ok := inj.answer(prompt)
+	inj.closeIfDone()
+	return string(bytes.TrimRight(secret, "\r\n")), ok
+}
+
+// answer finds the first rule that matches line and has not fired yet,
+// marks it as fired and returns the secret to send. The lock must be held.
+func (inj *injector) answer(line string) ([]byte, bool) {
+	// A preamble arms its rules for the lines after it, not for itself.
+	defer inj.armPreambles(line)
+	for _, r := range inj.rules {
+		if r.sent || r.preamble != nil && !inj.armed[r.preamble] || !r.Match(line) {
+			continue
+		}
+		// The login's password rules only answer before the login is
+		// over and sudo's only after; the dialog for an expired password
+		// belongs to the login.
+		if inj.elevation && r.isSecret() && !r.pin && !inj.expired && r.elevate != (inj.phase != preLogin) {
+			continue
+		}
+		if inj.onMatch != nil {
+			inj.onMatch(r, line)
+		}
+		kind, _ := r.Describe()
+		inj.log.Info("rule answers", "rule", kind, "name", r.Name, "pattern", r.MatchedBy(line), "line", inj.logText(strings.TrimSpace(line)))
+		if r.isSecret() && !r.pin && !r.elevate {
+			inj.matched = true
+			if inj.forbidPrompt {
+				inj.fail(ExitPromptForbidden, fmt.Sprintf("password prompt %q, but this host should only accept keys (-forbid-prompt)", line))
+				return nil, false
+			}
+		}
+		if r.isSecret() && inj.maxInjections > 0 && inj.injections >= inj.maxInjections {
+			inj.fail(ExitTooManyInjections, fmt.Sprintf("not sending a secret to %q: already sent %d (-max-injections)", line, inj.injections))
+			return nil, false
+		}
+		secret, err := inj.secretFor(r, line)
+		if err != nil {
+			code := ExitReadPassword
+			switch {
+			case errors.Is(err, ErrSecretTooLong):
+				code = ExitUsage
+			case errors.Is(err, errApprovalDenied):
+				code = ExitApprovalDenied
+			}
+			inj.fail(code, fmt.Sprintf("failed to read the secret for %q: %v", r.Name, err))
+			return nil, false
+		}
+		// Register the secret for redaction before it is sent, so not even
+		// an immediate echo gets through.
+		if r.isSecret() {
+			if s := bytes.TrimRight(secret, "\r\n"); len(s) > 0 {
+				inj.secrets = append(inj.secrets, s)
+			}
+		}
+		if r.isSecret() && inj.onSecret != nil {
+			inj.onSecret(bytes.TrimRight(secret, "\r\n"))
+		}
+		r.sent = true
+		if r.followUp && inj.mfaWait > 0 {
+			inj.mfaTimer = time.AfterFunc(inj.mfaWait, inj.mfaTimeout)
+		}
+		if r.isSecret() {
+			inj.injections++
+			inj.guard.arm(secret, time.Now())
+			inj.times.mark(&inj.times.prompt)
+			if inj.promptLine == "" && !r.pin && !r.elevate {
+				inj.promptLine = line
+			}
+			if !r.pin && !r.elevate && !r.currentPassword && !inj.expired {
+				inj.loginCheck, inj.lastLogin, inj.refused = r, r, false
+			}
+			switch {
+			case r.elevate:
+				inj.phase = elevated
+			case !r.pin && inj.phase == preLogin:
+				inj.loginSent = true
+			}
+			inj.lastSecret = secret
+			if !r.pin && !r.elevate {
+				inj.loginSecret = secret
+			}
+			inj.retirePrelude()
+			if inj.onPassword != nil {
+				inj.onPassword()
+			}
+		}
+		return secret, true
+	}
+	return nil, false
+}
+
+// armPreambles marks the preambles of the rules that line matches as seen.
+// The lock must be held.
+func (inj *injector) armPreambles(line string) {
+	for _, r := range inj.rules {
+		if p := r.preamble; p != nil && !inj.armed[p] && p.MatchString(line) {
+			if inj.armed == nil {
+				inj.armed = map[*regexp.Regexp]bool{}
+			}
+			inj.armed[p] = true
+		}
+	}
+}
+
+// closeIfDone closes ssh's stdin once every password rule has been
+// answered, or hands it over to the forwarded input. The lock must be held.
+func (inj *injector) closeIfDone() {
+	if inj.closed {
+		return
+	}
+	for _, r := range inj.rules {
+		// With -forbid-prompt only a PIN or sudo's password is ever sent.
+		if !r.sent && !r.Prelude && (r.pin || r.elevate || !inj.forbidPrompt) {
+			return
+		}
+	}
+	inj.release()
+}
+
+// release closes ssh's stdin, or hands it over to the forwarded input. The
+// lock must be held.
+func (inj *injector) release() {
+	if inj.forward != nil {
+		onForward := inj.onForward
+		go func() {
+			if onForward != nil {
+				onForward()
+			}
+			io.Copy(inj.stdin, inj.forward)
+			inj.mu.Lock()
+			inj.forwarded = true
+			inj.closeIfIdle()
+			inj.mu.Unlock()
+		}()
+	} else if !inj.keepStdin && inj.triggersDone() {
+		inj.stdin.Close()
+	}
+	inj.closed = true
+}
+
+// closeIfIdle closes ssh's stdin once the login is over and nothing else
+// needs it: forwarded input, if any, has run dry and no trigger or script
+// step is left. The lock must be held.
+func (inj *injector) closeIfIdle() {
+	if inj.closed && inj.triggersDone() && (inj.forwarded || inj.forward == nil && !inj.keepStdin) {
+		inj.stdin.Close()
+	}
+}
+
+// secretFor returns what to send for r. A rule with a Source reads it now,
+// the first time its prompt appears; one with SecretBytes sends them as
+// they are, without a copy. Passwords are decoded on the way out.
+func (inj *injector) secretFor(r *Rule, prompt string) ([]byte, error) {
+	if r.currentPassword {
+		return inj.lastSecret, nil
+	}
+	if r.loginPassword {
+		if len(inj.loginSecret) == 0 {
+			return nil, errors.New("no password was sent to log in, so there is none to reuse")
+		}
+		return inj.loginSecret, nil
+	}
+	if r.hostKeys != nil {
+		return []byte(inj.hostKeyAnswer(r.hostKeys)), nil
+	}
+	if r.SecretBytes != nil && r.tries == 0 {
+		if r.wiped {
+			return nil, errors.New("its SecretBytes were wiped when an earlier run ended")
+		}
+		if !r.isSecret() || inj.encoding == "" {
+			return r.SecretBytes, nil
+		}
+		decoded, err := decodeSecret(string(r.SecretBytes), inj.encoding)
+		return []byte(decoded), err
+	}
+	if r.Source != nil {
+		// Some sources, such as an approval service, want to know what
+		// they are answering.
+		if p, ok := r.Source.(interface{ prompted(string) }); ok {
+			p.prompted(prompt)
+		}
+		line, err := ReadLine(r.Source, inj.maxSecret)
+		if err != nil {
+			return nil, err
+		}
+		// A one-time code is read afresh every time it is asked for.
+		if _, ok := r.Source.(*totpSource); ok {
+			return []byte(line + "\n"), nil
+		}
+		r.Secret, r.Source = line+"\n", nil
+	}
+	if !r.isSecret() || inj.encoding == "" {
+		return []byte(r.Secret), nil
+	}
+	decoded, err := decodeSecret(r.Secret, inj.encoding)
+	return []byte(decoded), err
+}
+
+// prompted reports whether any password has been sent.
+func (inj *injector) prompted() bool {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return len(inj.lastSecret) > 0 && !inj.unsent
+}
+
+// firstPrompt returns the line that got the first password, if any.
+func (inj *injector) firstPrompt() string {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.promptLine
+}
+
+// matchedPrompt reports whether a password prompt was recognised.
+func (inj *injector) matchedPrompt() bool {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.matched
+}
+
+// isExpired reports whether the server said the password has expired. It
+// is only called from rule matchers, with the lock held.
+func (inj *injector) isExpired() bool {
+	return inj.expired
+}
+
+// fail abandons the session with the given exit code. The lock must be
+// held.
+func (inj *injector) fail(code int, msg string) {
+	inj.log.Warn("abandoning the session", "exit_code", code, "reason", exitReason(code, true, ""), "message", inj.logText(msg))
+	inj.failure = &failure{code: code, msg: msg}
+	fmt.Fprintln(inj.stderr, "shallpass:", msg)
+	if inj.kill != nil {
+		inj.kill()
+	}
+}
+
+// reportEcho deals with a password that the server echoed back: the
+// prompt did not turn echo off. The lock must be held.
+func (inj *injector) reportEcho() {
+	inj.echoed = true
+	const msg = "the password was echoed back, so the prompt did not turn echo off and it may be visible or logged"
+	if inj.failOnEcho {
+		inj.fail(ExitPasswordEchoed, msg+" (-fail-on-echo)")
+		return
+	}
+	fmt.Fprintln(inj.stderr, "shallpass: warning:", msg)
+}
+
+// wake sends a newline to a server that may be waiting for a keypress
+// before it prompts, unless something has been answered already. Like
+// timeout it runs from a timer.
+func (inj *injector) wake() {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.failure != nil || inj.closed {
+		return
+	}
+	for _, r := range inj.rules {
+		if r.sent {
+			return
+		}
+	}
+	io.WriteString(inj.stdin, "\n")
+}
+
+// mfaTimeout ends a session whose second factor was not approved in
+// time. Like timeout it runs from a timer.
+func (inj *injector) mfaTimeout() {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.failure == nil && inj.mfaTimer != nil {
+		inj.fail(ExitMFATimeout, fmt.Sprintf("the second factor was not approved within %v", inj.mfaWait))
+	}
+}
+
+// stopMFA stops the second-factor timer once the session is over.
+func (inj *injector) stopMFA() {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.mfaTimer != nil {
+		inj.mfaTimer.Stop()
+	}
+}
+
+// idleCheck ends the session with ExitIdleTimeout once nothing has
+// happened on it for idle, and otherwise checks again when that could
+// first be the case. The clock only runs once there has been some
+// activity, since silence before that is the banner timeout's business,
+// and not while a second factor waits for approval.
+func (inj *injector) idleCheck() {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.failure != nil || inj.idleTimer == nil {
+		return
+	}
+	wait := inj.idle
+	if active := inj.times.at(&inj.times.active); !active.IsZero() && inj.mfaTimer == nil {
+		since := time.Since(active)
+		if since >= inj.idle {
+			inj.fail(ExitIdleTimeout, fmt.Sprintf("nothing happened on the session for %v (-idle-timeout)", inj.idle))
+			return
+		}
+		wait = inj.idle - since
+	}
+	inj.idleTimer.Reset(wait)
+}
+
+// crashed ends the session after a scanner recovered from a panic.
+func (inj *injector) crashed() {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.failure == nil {
+		inj.fail(ExitPanic, "internal error: panic while scanning ssh's output")
+	}
+}
+
+// stopIdle stops the watchdog for good.
+func (inj *injector) stopIdle() {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.idleTimer != nil {
+		inj.idleTimer.Stop()
+		inj.idleTimer = nil
+	}
+}
+
+// timeout ends the session if no password has been asked for within
+// after. It runs from a timer, so it takes the lock itself.
+func (inj *injector) timeout(after time.Duration) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.failure == nil && len(inj.lastSecret) == 0 {
+		inj.fail(ExitPromptTimeout, fmt.Sprintf("no password prompt within %v", after))
+	}
+}
+
+// silent ends the session with code if ssh has not written a thing within
+// after, which means it never got as far as talking to the server. Like
+// timeout it runs from a timer.
+func (inj *injector) silent(after time.Duration, code int) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.failure == nil && len(inj.lastSecret) == 0 && !inj.times.sawOutput() {
+		inj.fail(code, fmt.Sprintf("no output from ssh within %v", after))
+	}
+}
+
+// earlyEOF explains a failed session whose connection went away around
+// the prompt, which looks much like a wrong password from the outside. It
+// returns "" when nothing of the sort happened.
+func (inj *injector) earlyEOF() string {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	switch {
+	case inj.failure != nil:
+		return ""
+	case inj.matched && (len(inj.lastSecret) == 0 || inj.unsent):
+		return "the connection closed after the password prompt, before the password was sent"
+	case inj.unsent:
+		return "the connection closed before the password could be sent"
+	case len(inj.lastSecret) > 0 && inj.times.at(&inj.times.reply).IsZero():
+		return "the connection closed right after the password was sent, before the server replied; this is more likely a network problem than a wrong password"
+	}
+	return ""
+}
+
+// failed returns the failure that ended the session, if any.
+func (inj *injector) failed() *failure {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.failure
+}
+
+// retirePrelude stops the username and banner responders from firing once
+// we are past the login sequence, so later output such as "Last login:"
+// is not answered.
+func (inj *injector) retirePrelude() {
+	for _, r := range inj.rules {
+		if r.Prelude {
+			r.sent = true
+		}
+	}
+}
+
+// maxScanLine is the longest line we keep looking at. Anything longer is
+// not a prompt; it is dropped from the matcher and scanning carries on
+// with the next line, or from the last carriage return of the line, as
+// that is where a terminal would start it over.
+const maxScanLine = 64 * 1024
+
+// scanStream reads one of ssh's output streams looking for prompts. Every
+// complete line is checked, and so is the unfinished line at the end of
+// each read: prompts, nested ones from the remote command in particular
+// ("Enter password: " from mysql -p), don't end in a newline. It keeps
+// reading until the stream ends so the tee that feeds it never blocks the
+// output the user sees.
+func scanStream(r io.Reader, stream string, inj *injector) {
+	var line []byte
+	var total int64
+	defer func() { inj.log.Debug("stream ended", "stream", stream, "bytes", total) }()
+	long := false // the current line went past maxScanLine
+	add := func(data []byte) {
+		if !long && len(line)+len(data) <= maxScanLine {
+			line = append(line, data...)
+			return
+		}
+		// A progress meter redraws its line with \r for as long as it
+		// runs, and a prompt may follow it without a newline in between.
+		if i := bytes.LastIndexByte(data, '\r'); i >= 0 {
+			if len(data)-i-1 <= maxScanLine {
+				line, long = append(line[:0], data[i+1:]...), false
+				return
+			}
+		} else if i := bytes.LastIndexByte(line, '\r'); !long && i >= 0 && len(line)-i-1+len(data) <= maxScanLine {
+			line = append(append(line[:0], line[i+1:]...), data...)
+			return
+		}
+		line, long = line[:0], true
+	}
+	chunk := make([]byte, 4096)
+	for {
+		n, err := r.Read(chunk)
+		total += int64(n)
+		if n > 0 && inj.onOutput != nil {
+			inj.onOutput(stream, chunk[:n])
+		}
+		if n > 0 && inj.pastScanLimit(n) {
+			// Keep the pipe drained so the terminal still gets it all.
+			inj.drain(r, stream)
+			return
+		}
+		data := chunk[:n]
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			add(data[:i])
+			if !long {
+				inj.handle(stream, strings.TrimSuffix(string(line), "\r"), false)
+			}
+			line, long, data = line[:0], false, data[i+1:]
+		}
+		if len(data) > 0 {
+			add(data)
+			if !long {
+				inj.handle(stream, string(line), true)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// fingerprintRE matches the line ssh prints about an unknown host key
+// before asking whether to trust it: "ED25519 key fingerprint is
+// SHA256:...".
+var fingerprintRE = regexp.MustCompile(`(\S+) key fingerprint is (\S+?)\.?\s*$`)
+
+// ptyRefusedRE matches ssh's warning when the server turns down -t, as
+// restricted accounts and forced commands often do.
+var ptyRefusedRE = regexp.MustCompile(`PTY allocation request failed on channel \d+`)
+
+// echoWindow is how long after an injection we treat lines containing the
+// injected text as our own echo rather than new output from the server.
+const echoWindow = 2 * time.Second
+
+// echoGuard remembers the last secret written into ssh's stdin so the scanner
+// does not mistake its echo for a fresh prompt and answer itself in a loop.
+type echoGuard struct {
+	sent  []byte
+	until time.Time
+}
+
+// arm records an injection made at now.
+func (g *echoGuard) arm(sent []byte, now time.Time) {
+	g.sent = bytes.TrimRight(sent, "\r\n")
+	g.until = now.Add(echoWindow)
+}
+
+// suppresses reports whether line should be skipped by the prompt matcher
+// because it is (or contains) the echo of our last injection.
+func (g *echoGuard) suppresses(line string, now time.Time) bool {
+	if len(g.sent) == 0 || now.After(g.until) {
+		return false
+	}
+	return bytes.Contains([]byte(line), g.sent)
+}
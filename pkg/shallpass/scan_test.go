@@ -0,0 +1,231 @@
+package shallpass
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEchoGuard(t *testing.T) {
+	now := time.Now()
+	armed := func() *echoGuard {
+		g := &echoGuard{}
+		g.arm([]byte("hunter2 password:\n"), now)
+		return g
+	}
+	for _, tc := range []struct {
+		name  string
+		guard *echoGuard
+		line  string
+		at    time.Time
+		want  bool
+	}{
+		{"the echo itself", armed(), "hunter2 password:", now, true},
+		{"the echo within a line", armed(), "> hunter2 password: <", now.Add(time.Second), true},
+		{"a real prompt", armed(), "password:", now, false},
+		{"after the window", armed(), "hunter2 password:", now.Add(echoWindow + time.Millisecond), false},
+		{"nothing sent", &echoGuard{}, "hunter2 password:", now, false},
+	} {
+		if got := tc.guard.suppresses(tc.line, tc.at); got != tc.want {
+			t.Errorf("%s: suppresses(%q) = %v, want %v", tc.name, tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestPasswordContainingThePrompt(t *testing.T) {
+	// The server echoes the password back, and it contains the prompt.
+	// A second rule for that prompt, a later hop's say, is still waiting:
+	// only the guard keeps it from answering the echo.
+	r := fakeRunner(t, `printf 'password: '
+read pw
+echo "$pw"
+sleep 1`)
+	r.Rules = []*Rule{
+		PasswordRule("my password: is long\n", []string{"password:"}),
+		PasswordRule("other\n", []string{"password:"}),
+	}
+	res, _, stderr := runFake(t, r)
+	if res.ExitCode != 0 || res.SecretsSent != 1 {
+		t.Errorf("exit %d with %d secrets sent, want 0 with 1; stderr: %s", res.ExitCode, res.SecretsSent, stderr)
+	}
+}
+
+func TestPromptsKeyedToTheirSecrets(t *testing.T) {
+	// As -password-for builds them: the prompts come in another order
+	// than the rules, and the bastion line matches the login rule too,
+	// where the first rule given wins. Once each rule has answered, stdin
+	// is closed, so the bastion's second prompt gets nothing.
+	r := fakeRunner(t, `printf '[sudo] password for deploy: '
+read a
+printf 'deploy@bastion password: '
+read b
+printf 'deploy@web1 password: '
+read c
+printf 'deploy@bastion password: '
+read d
+echo "$a|$b|$c|$d"`)
+	keyed := func(pattern, secret string) *Rule {
+		return &Rule{Name: pattern, Match: regexp.MustCompile(pattern).MatchString, Secret: secret}
+	}
+	r.Rules = []*Rule{
+		keyed(`bastion`, "bastion-pw\n"),
+		keyed(`password: ?$`, "login-pw\n"),
+		keyed(`\[sudo\]`, "sudo-pw\n"),
+	}
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || res.SecretsSent != 3 {
+		t.Errorf("exit %d with %d secrets sent, want 0 with 3; stderr: %s", res.ExitCode, res.SecretsSent, stderr)
+	}
+	if want := "sudo-pw|bastion-pw|login-pw|\n"; !strings.HasSuffix(stdout, want) {
+		t.Errorf("stdout = %q, want it to end in %q", stdout, want)
+	}
+}
+
+// BenchmarkScanStream measures the per-byte cost of scanning output for
+// prompts, which is what -prompt-source stderr saves on stdout.
+func BenchmarkScanStream(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		line string
+	}{
+		{"short lines", "drwxr-xr-x  2 alice staff  64 Oct 14 02:52 src\n"},
+		{"long lines", strings.Repeat("x", 8192) + "\n"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			out := bytes.Repeat([]byte(bc.line), (1<<20)/len(bc.line))
+			b.SetBytes(int64(len(out)))
+			for i := 0; i < b.N; i++ {
+				inj := testInjector(PasswordRule("secret\n", []string{"password:"}))
+				scanStream(bytes.NewReader(out), "stdout", inj)
+			}
+		})
+	}
+}
+
+func TestPromptGrace(t *testing.T) {
+	// The server replays the last session's prompt on connect, then asks
+	// for real once the grace period is over.
+	r := fakeRunner(t, `echo "stale password:" >&2
+sleep 0.4
+printf "alice@host's password: " >&2
+read pw
+echo "got $pw"`)
+	r.PromptGrace = 200 * time.Millisecond
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "got secret\n" || res.SecretsSent != 1 {
+		t.Fatalf("exit %d, %d secrets sent, stdout %q; stderr: %s", res.ExitCode, res.SecretsSent, stdout, stderr)
+	}
+	if !strings.HasPrefix(res.PromptLine, "alice@host") {
+		t.Errorf("answered %q, want the prompt after the grace period", res.PromptLine)
+	}
+	// Without the grace period the stale prompt gets the password.
+	r.PromptGrace = 0
+	if res, _, _ := runFake(t, r); res.PromptLine != "stale password:" {
+		t.Errorf("without -prompt-grace answered %q, want the stale prompt", res.PromptLine)
+	}
+}
+
+func TestMaxInjections(t *testing.T) {
+	// A server stuck asking again and again, with a rule ready for every
+	// time, gets the secret no more often than the cap allows.
+	r := fakeRunner(t, `for i in 1 2 3 4 5; do
+	printf 'password: ' >&2
+	read pw || exit 1
+	echo "got $pw"
+done`)
+	for i := 0; i < 4; i++ {
+		r.Rules = append(r.Rules, PasswordRule("secret\n", []string{"password:"}))
+	}
+	r.MaxInjections = 2
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != ExitTooManyInjections || res.SecretsSent != 2 || stdout != "got secret\ngot secret\n" {
+		t.Errorf("exit %d, %d secrets sent, stdout %q; stderr: %s", res.ExitCode, res.SecretsSent, stdout, stderr)
+	}
+}
+
+func TestConnectionClosedAtThePrompt(t *testing.T) {
+	// The server hangs up right after asking: whether or not the password
+	// got out first, it must not pass for a wrong password.
+	r := fakeRunner(t, `printf 'password: ' >&2
+exit 255`)
+	res, _, stderr := runFake(t, r)
+	if res.ExitCode != 255 || !strings.Contains(stderr, "shallpass: the connection closed") {
+		t.Errorf("exit %d, stderr %q; want a diagnostic about the closed connection", res.ExitCode, stderr)
+	}
+
+	// A refused password is told apart from it.
+	r = fakeRunner(t, `printf 'password: ' >&2
+read pw
+echo "Permission denied (publickey,password)." >&2
+exit 255`)
+	if res, _, stderr := runFake(t, r); res.ExitCode != ExitWrongPassword || strings.Contains(stderr, "connection closed") {
+		t.Errorf("refused password: exit %d, stderr %q", res.ExitCode, stderr)
+	}
+}
+
+func TestEchoCheck(t *testing.T) {
+	const echoed = `printf 'password: ' >&2
+read pw
+echo "$pw"
+echo "welcome"`
+	const quiet = `printf 'password: ' >&2
+read pw
+echo
+echo "welcome"`
+	const warning = "the password was echoed back"
+	for _, tc := range []struct {
+		name       string
+		script     string
+		failOnEcho bool
+		code       int
+		warns      bool
+	}{
+		{"echoed", echoed, false, 0, true},
+		{"echoed, failing", echoed, true, ExitPasswordEchoed, true},
+		{"echo off", quiet, false, 0, false},
+		{"echo off, failing", quiet, true, 0, false},
+	} {
+		r := fakeRunner(t, tc.script)
+		r.EchoCheck, r.FailOnEcho = true, tc.failOnEcho
+		res, _, stderr := runFake(t, r)
+		if res.ExitCode != tc.code || strings.Contains(stderr, warning) != tc.warns {
+			t.Errorf("%s: exit %d, stderr %q; want exit %d, warning %v", tc.name, res.ExitCode, stderr, tc.code, tc.warns)
+		}
+	}
+}
+
+func TestScanLimit(t *testing.T) {
+	// A chatty session that got in with a key: past the limit its output
+	// is only passed through, a prompt at the end included.
+	const script = `i=0
+while [ $i -lt 100 ]; do echo "line $i of the build log, padded out to be long enough"; i=$((i+1)); done
+printf 'password: '
+read pw
+echo "[$pw]"`
+	var want strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&want, "line %d of the build log, padded out to be long enough\n", i)
+	}
+	want.WriteString("password: ")
+	for _, tc := range []struct {
+		limit int
+		reply string
+	}{
+		{1000, "[]\n"},
+		{0, "[secret]\n"},
+	} {
+		r := fakeRunner(t, script)
+		r.ScanStderr = false
+		r.ScanLimit = tc.limit
+		res, stdout, stderr := runFake(t, r)
+		if res.ExitCode != 0 || stdout != want.String()+tc.reply {
+			t.Errorf("limit %d: exit %d, output ending %q, want %q; stderr: %s", tc.limit, res.ExitCode, stdout[max(0, len(stdout)-30):], tc.reply, stderr)
+		}
+		if res.Prompted != (tc.limit == 0) {
+			t.Errorf("limit %d: prompted %v", tc.limit, res.Prompted)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package shallpass
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Step is one expect/send pair of a Runner's Script. Unlike a Trigger it
+// fires exactly once, and only once the steps before it have: the Script
+// drives the session through a fixed dialog, such as an installer's
+// questions, and fails it if the dialog goes another way.
+type Step struct {
+	Name     string
+	Match    func(line string) bool
+	Response string
+	// Timeout is how long the step waits for its output, from the moment
+	// the step before it matched or, for the first, the session started.
+	Timeout time.Duration
+}
+
+// scriptTailBytes is how much of the latest output a failed step reports,
+// enough for the question the script did not expect.
+const scriptTailBytes = 512
+
+// startStep arms the timeout of the current step, if there is one left.
+// The lock must be held.
+func (inj *injector) startStep() {
+	if inj.step >= len(inj.script) {
+		return
+	}
+	s, n := inj.script[inj.step], inj.step
+	if s.Timeout > 0 {
+		inj.stepTimer = time.AfterFunc(s.Timeout, func() { inj.stepTimeout(n) })
+	}
+}
+
+// runStep answers line if it is what the current step expects, and moves
+// on to the next. It reports whether it did. partial says line has no
+// newline yet. The lock must be held.
+func (inj *injector) runStep(line string, partial bool) bool {
+	if inj.stepHold {
+		inj.stepHold = partial
+		return false
+	}
+	if inj.step >= len(inj.script) || !inj.script[inj.step].Match(line) {
+		return false
+	}
+	s := inj.script[inj.step]
+	response, ok := inj.decodeResponse(s.Name, s.Response)
+	if !ok {
+		return true
+	}
+	if inj.stepTimer != nil {
+		inj.stepTimer.Stop()
+		inj.stepTimer = nil
+	}
+	inj.log.Info("script step matched", "step", inj.step+1, "name", s.Name)
+	inj.step++
+	// The rest of the line the step matched is not the next step's.
+	inj.stepHold = partial
+	if response != "" {
+		inj.write([]byte(response))
+	}
+	inj.startStep()
+	inj.closeIfIdle()
+	return true
+}
+
+// stepTimeout ends a session whose step n saw nothing it expected in time.
+// Like timeout it runs from a timer.
+func (inj *injector) stepTimeout(n int) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.failure == nil && inj.step == n {
+		s := inj.script[n]
+		inj.fail(ExitScript, fmt.Sprintf("script step %d (%s) saw nothing it expects within %v%s", n+1, s.Name, s.Timeout, inj.outputTail()))
+	}
+}
+
+// stopScript stops the timeout of the current step once the session is
+// over.
+func (inj *injector) stopScript() {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.stepTimer != nil {
+		inj.stepTimer.Stop()
+		inj.stepTimer = nil
+	}
+}
+
+// scriptUnfinished is the failure of a session that ended fine but before
+// its Script did, or nil. The lock must not be held.
+func (inj *injector) scriptUnfinished() *failure {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.step >= len(inj.script) {
+		return nil
+	}
+	msg := fmt.Sprintf("the session ended before script step %d (%s)%s", inj.step+1, inj.script[inj.step].Name, inj.outputTail())
+	fmt.Fprintln(inj.stderr, "shallpass:", msg)
+	return &failure{code: ExitScript, msg: msg}
+}
+
+// noteTail keeps the end of the output for a failed step to show. partial
+// says line has no newline yet, and is replaced by the next call. The lock
+// must be held.
+func (inj *injector) noteTail(line string, partial bool) {
+	tail := inj.tail + line
+	if !partial {
+		tail += "\n"
+	}
+	if len(tail) > scriptTailBytes {
+		tail = tail[len(tail)-scriptTailBytes:]
+	}
+	if partial {
+		inj.tailPartial = tail
+		return
+	}
+	inj.tail, inj.tailPartial = tail, ""
+}
+
+// outputTail is the end of the output, indented under the message it
+// explains, or "" if there was none. The lock must be held.
+func (inj *injector) outputTail() string {
+	tail := inj.tail
+	if inj.tailPartial != "" {
+		tail = inj.tailPartial
+	}
+	tail = strings.TrimRight(tail, "\r\n")
+	if tail == "" {
+		return "; there was no output"
+	}
+	return "; the output ended with:\n  " + strings.ReplaceAll(tail, "\n", "\n  ")
+}
+
+// Describe is what s sends, and how long it waits for its output.
+func (s *Step) Describe() string {
+	sends := strconv.Quote(s.Response)
+	if s.Timeout > 0 {
+		sends += fmt.Sprintf(" (within %v)", s.Timeout)
+	}
+	return sends
+}
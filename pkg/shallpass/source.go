@@ -0,0 +1,303 @@
+package shallpass
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadSecret resolves a password source:
+//
+//	env:NAME   the value of environment variable NAME
+//	file:PATH  the first line of the file at PATH
+//	fd:N       the first line read from file descriptor N
+//	pass:TEXT  TEXT itself
+//	keychain:SERVICE[/ACCOUNT]
+//	           the secret stored in the OS keychain; see keychainSecret
+//	totp:KEY   the current one-time code for the base32 KEY; see totpKey
+//	vault:PATH[#FIELD]
+//	           a field of a HashiCorp Vault secret; see vaultSecret
+//	aws-sm:NAME[#KEY]
+//	           an AWS Secrets Manager secret; see awsSecret
+//	op://VAULT/ITEM/FIELD
+//	           a 1Password secret reference, read with the op CLI
+//
+// and any other kind given to RegisterProvider.
+//
+// The secret is returned with a single trailing newline, which is what ends
+// the line at the prompt. A variable read by env: is left out of Environ
+// from then on.
+func ReadSecret(source string) (string, error) {
+	kind, arg, _ := strings.Cut(source, ":")
+	var secret string
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		secretEnv.Lock()
+		secretEnv.names[arg] = true
+		secretEnv.Unlock()
+		secret = v
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return "", err
+		}
+		secret, _, _ = strings.Cut(string(data), "\n")
+	case "fd":
+		fd, err := strconv.Atoi(arg)
+		if err != nil || fd < 0 {
+			return "", fmt.Errorf("invalid file descriptor %q", arg)
+		}
+		secret, err = ReadLine(fdReader(fd), 0)
+		if err != nil {
+			return "", fmt.Errorf("fd:%d: %v", fd, err)
+		}
+	case "pass":
+		secret = arg
+	case "keychain":
+		v, err := keychainSecret(arg)
+		if err != nil {
+			return "", err
+		}
+		secret = v
+	case "totp":
+		key, err := totpKey(arg)
+		if err != nil {
+			return "", err
+		}
+		secret = totpCode(key, time.Now())
+	default:
+		v, ok, err := providerSecret(kind, arg, source)
+		switch {
+		case err != nil:
+			return "", err
+		case !ok:
+			return "", fmt.Errorf("unknown password source %q (want env:, file:, fd:, pass:, keychain:, totp:, vault:, aws-sm: or op:)", source)
+		}
+		secret = v
+	}
+	return strings.TrimRight(secret, "\r\n") + "\n", nil
+}
+
+// secretEnv are the environment variables a secret was read from.
+var secretEnv = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// Environ is os.Environ without the variables that hold secrets, for the
+// programs shallpass starts: ssh, which would otherwise pass them on with
+// SendEnv, and whatever ssh starts in turn, ProxyCommands included.
+func Environ() []string {
+	secretEnv.Lock()
+	defer secretEnv.Unlock()
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !secretEnv.names[name] {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// fdReader reads an inherited file descriptor directly. Unlike
+// os.NewFile it never closes it, so fd:0 leaves stdin usable, and
+// ReadLine leaves whatever follows the line for the next reader.
+type fdReader int
+
+func (fd fdReader) Read(p []byte) (int, error) {
+	n, err := readFD(int(fd), p)
+	switch {
+	case err != nil:
+		return 0, err
+	case n == 0:
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// ErrSecretTooLong is returned for a secret longer than the configured
+// maximum, which nearly always means the wrong thing was piped in.
+var ErrSecretTooLong = errors.New("secret is longer than -max-password-bytes")
+
+// CheckSecretSize fails if secret, without its line ending, is longer than
+// max bytes. A max of 0 disables the check.
+func CheckSecretSize(secret string, max int) error {
+	if max > 0 && len(strings.TrimRight(secret, "\r\n")) > max {
+		return fmt.Errorf("%w (%d bytes)", ErrSecretTooLong, max)
+	}
+	return nil
+}
+
+// ReadLine reads r up to and including the first newline, or to EOF, and
+// returns the line without its line ending. It reads one byte at a time so
+// nothing after the newline is consumed, and gives up with
+// ErrSecretTooLong once the line exceeds max bytes (0 means no limit).
+func ReadLine(r io.Reader, max int) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+			if max > 0 && len(line) > max+1 {
+				return "", fmt.Errorf("%w (%d bytes)", ErrSecretTooLong, max)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	secret := strings.TrimRight(string(line), "\r")
+	return secret, CheckSecretSize(secret, max)
+}
+
+// SocketSource is a Rule.Source that fetches the secret from a local
+// secret broker listening on a Unix socket. Nothing is dialled until the
+// prompt appears; then one line is read and the connection is closed.
+type SocketSource struct {
+	Path string
+	line io.Reader
+}
+
+// socketDialTimeout bounds how long we wait for the broker to accept.
+const socketDialTimeout = 5 * time.Second
+
+func (s *SocketSource) Read(p []byte) (int, error) {
+	if s.line == nil {
+		conn, err := net.DialTimeout("unix", s.Path, socketDialTimeout)
+		if err != nil {
+			return 0, fmt.Errorf("password socket: %w", err)
+		}
+		line, err := ReadLine(conn, 0)
+		conn.Close()
+		if err != nil {
+			return 0, fmt.Errorf("password socket %s: %w", s.Path, err)
+		}
+		s.line = strings.NewReader(line + "\n")
+	}
+	return s.line.Read(p)
+}
+
+// errNoSecret is returned by a channel source that got nothing in time.
+var errNoSecret = errors.New("no secret delivered")
+
+// chanSource is the Rule.Source returned by NewChanSource.
+type chanSource struct {
+	ch      <-chan []byte
+	timeout time.Duration
+	secret  io.Reader
+}
+
+// NewChanSource returns a Rule.Source that waits for the secret on ch, for
+// flows where something outside the session releases it just in time, for
+// instance after an out-of-band approval. The wait starts when the prompt
+// appears and lasts at most timeout (0 waits forever); if it runs out, or
+// ch is closed first, the session ends with ExitReadPassword. Other
+// prompts are not handled while the source waits.
+func NewChanSource(ch <-chan []byte, timeout time.Duration) io.Reader {
+	return &chanSource{ch: ch, timeout: timeout}
+}
+
+func (s *chanSource) Read(p []byte) (int, error) {
+	if s.secret == nil {
+		var expired <-chan time.Time
+		if s.timeout > 0 {
+			timer := time.NewTimer(s.timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case secret, ok := <-s.ch:
+			if !ok {
+				return 0, fmt.Errorf("%w: channel closed", errNoSecret)
+			}
+			s.secret = bytes.NewReader(secret)
+		case <-expired:
+			return 0, fmt.Errorf("%w within %v", errNoSecret, s.timeout)
+		}
+	}
+	return s.secret.Read(p)
+}
+
+// CheckEncoding fails unless encoding is one Runner.ResponseEncoding
+// knows.
+func CheckEncoding(encoding string) error {
+	_, err := decodeSecret("", encoding)
+	return err
+}
+
+// decodeSecret applies -response-encoding to a secret as read from its
+// source: "raw" leaves it alone, "escape" decodes Go string escapes
+// (\r, \x1b, \u00e9, ...) and "hex" decodes hex digits. A decoded secret
+// is sent exactly as it comes out, except that a newline is added unless it
+// already ends in "\r" or "\n".
+func decodeSecret(secret, encoding string) (string, error) {
+	if encoding == "raw" {
+		return secret, nil
+	}
+	decoded, err := decodeText(strings.TrimRight(secret, "\r\n"), encoding)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(decoded, "\r") && !strings.HasSuffix(decoded, "\n") {
+		decoded += "\n"
+	}
+	return decoded, nil
+}
+
+// decodeText is decodeSecret without the line ending rules.
+func decodeText(text, encoding string) (string, error) {
+	var decoded string
+	switch encoding {
+	case "raw":
+		return text, nil
+	case "escape":
+		var b strings.Builder
+		for text != "" {
+			if text[0] == '"' {
+				b.WriteByte('"')
+				text = text[1:]
+				continue
+			}
+			r, multibyte, tail, err := strconv.UnquoteChar(text, '"')
+			if err != nil {
+				return "", fmt.Errorf("invalid escape sequence in secret")
+			}
+			if multibyte {
+				b.WriteRune(r)
+			} else {
+				b.WriteByte(byte(r))
+			}
+			text = tail
+		}
+		decoded = b.String()
+	case "hex":
+		b, err := hex.DecodeString(text)
+		if err != nil {
+			return "", fmt.Errorf("invalid hex in secret")
+		}
+		decoded = string(b)
+	default:
+		return "", fmt.Errorf("unknown encoding %q (want raw, escape or hex)", encoding)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,207 @@
+package shallpass
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDecodeSecret(t *testing.T) {
+	for _, tc := range []struct {
+		secret, encoding string
+		want             string
+		fails            bool
+	}{
+		{"hunter2\n", "raw", "hunter2\n", false},
+		{"no newline", "raw", "no newline", false},
+		{`a\tb`, "escape", "a\tb\n", false},
+		{`\x1b[A\r`, "escape", "\x1b[A\r", false},
+		{`café` + "\n", "escape", "café\n", false},
+		{`say "hi"`, "escape", "say \"hi\"\n", false},
+		{`bad\q`, "escape", "", true},
+		{"68756e746572320a", "hex", "hunter2\n", false},
+		{"6869", "hex", "hi\n", false},
+		{"6g", "hex", "", true},
+		{"x", "base64", "", true},
+	} {
+		got, err := decodeSecret(tc.secret, tc.encoding)
+		if (err != nil) != tc.fails || got != tc.want {
+			t.Errorf("decodeSecret(%q, %s) = %q, %v; want %q, failing %v", tc.secret, tc.encoding, got, err, tc.want, tc.fails)
+		}
+	}
+}
+
+func TestCheckEncoding(t *testing.T) {
+	for _, encoding := range []string{"raw", "escape", "hex"} {
+		if err := CheckEncoding(encoding); err != nil {
+			t.Errorf("CheckEncoding(%s): %v", encoding, err)
+		}
+	}
+	if CheckEncoding("utf-7") == nil {
+		t.Error("CheckEncoding(utf-7) did not fail")
+	}
+}
+
+// passwordBroker listens on a Unix socket in a fresh directory and gives
+// secret to everyone who connects, counting them.
+func passwordBroker(t *testing.T, secret string) (path string, dials *atomic.Int32) {
+	t.Helper()
+	// Socket paths are short on some systems; t.TempDir can be long.
+	dir, err := os.MkdirTemp("", "shallpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path = filepath.Join(dir, "broker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("no Unix sockets here:", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	dials = &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			dials.Add(1)
+			io.WriteString(conn, secret+"\n")
+			conn.Close()
+		}
+	}()
+	return path, dials
+}
+
+func TestSocketSource(t *testing.T) {
+	path, dials := passwordBroker(t, "from-the-broker")
+	r := fakeRunner(t, `printf 'password: ' >&2
+read pw
+echo "got $pw"`)
+	r.Rules[0].Secret, r.Rules[0].Source = "", &SocketSource{Path: path}
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "got from-the-broker\n" {
+		t.Errorf("exit %d, stdout %q; stderr %s", res.ExitCode, stdout, stderr)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("the broker was dialled %d times, want once", n)
+	}
+
+	// Without a prompt the broker is never asked.
+	r = fakeRunner(t, `echo "in with a key"`)
+	r.Rules[0].Secret, r.Rules[0].Source = "", &SocketSource{Path: path}
+	if res, _, stderr := runFake(t, r); res.ExitCode != 0 || dials.Load() != 1 {
+		t.Errorf("without a prompt: exit %d, %d dials; stderr %s", res.ExitCode, dials.Load(), stderr)
+	}
+}
+
+func TestSocketSourceUnreachable(t *testing.T) {
+	r := fakeRunner(t, `printf 'password: ' >&2
+read pw
+echo "got $pw"
+sleep 5`)
+	missing := filepath.Join(t.TempDir(), "broker.sock")
+	r.Rules[0].Secret, r.Rules[0].Source = "", &SocketSource{Path: missing}
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != ExitReadPassword || stdout != "" || !strings.Contains(stderr, "password socket") {
+		t.Errorf("exit %d, stdout %q, stderr %q; want %d and the socket named", res.ExitCode, stdout, stderr, ExitReadPassword)
+	}
+}
+
+// readCounter counts the reads made of it.
+type readCounter struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func TestReaderSourceIsReadLazily(t *testing.T) {
+	// Never asked for, the secret is never read.
+	src := &readCounter{r: strings.NewReader("streamed\nleft for later\n")}
+	r := fakeRunner(t, `echo "in with a key"`)
+	r.Rules[0].Secret, r.Rules[0].Source = "", src
+	if res, _, stderr := runFake(t, r); res.ExitCode != 0 || src.reads != 0 {
+		t.Errorf("without a prompt: exit %d, %d reads; stderr %s", res.ExitCode, src.reads, stderr)
+	}
+
+	// Asked for, it is read up to the newline only, once.
+	r = fakeRunner(t, `printf 'password: ' >&2
+read pw
+echo "got $pw"`)
+	r.Rules[0].Secret, r.Rules[0].Source = "", src
+	res, stdout, stderr := runFake(t, r)
+	if res.ExitCode != 0 || stdout != "got streamed\n" || src.reads == 0 {
+		t.Errorf("with a prompt: exit %d, stdout %q, %d reads; stderr %s", res.ExitCode, stdout, src.reads, stderr)
+	}
+	if rest, _ := io.ReadAll(src.r); string(rest) != "left for later\n" {
+		t.Errorf("the source was read past the secret: %q left", rest)
+	}
+}
+
+func TestChanSource(t *testing.T) {
+	const script = `printf 'password: ' >&2
+read pw
+echo "got $pw"`
+	chanRunner := func(ch <-chan []byte, timeout time.Duration) *Runner {
+		r := fakeRunner(t, script)
+		r.Rules[0].Source = NewChanSource(ch, timeout)
+		return r
+	}
+
+	// The approval comes in while the prompt waits.
+	ch := make(chan []byte)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ch <- []byte("approved\n")
+	}()
+	if res, stdout, stderr := runFake(t, chanRunner(ch, 5*time.Second)); res.ExitCode != 0 || stdout != "got approved\n" {
+		t.Errorf("delivered: exit %d, stdout %q; stderr: %s", res.ExitCode, stdout, stderr)
+	}
+
+	// No approval in time, or none at all.
+	closed := make(chan []byte)
+	close(closed)
+	for _, tc := range []struct {
+		name string
+		ch   <-chan []byte
+		want string
+	}{
+		{"timeout", make(chan []byte), "no secret delivered within 100ms"},
+		{"closed", closed, "no secret delivered: channel closed"},
+	} {
+		start := time.Now()
+		res, stdout, stderr := runFake(t, chanRunner(tc.ch, 100*time.Millisecond))
+		if res.ExitCode != ExitReadPassword || stdout != "" || !strings.Contains(stderr, tc.want) {
+			t.Errorf("%s: exit %d, stdout %q, stderr %q; want exit %d and %q", tc.name, res.ExitCode, stdout, stderr, ExitReadPassword, tc.want)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: the session ran on for %v", tc.name, d)
+		}
+	}
+}
+
+func TestResponseEncodingSendsTheBytes(t *testing.T) {
+	// A menu-driven appliance: a key sequence to pick the menu entry,
+	// then the password ending in a bare carriage return.
+	r := fakeRunner(t, `echo "Select an option:"
+sleep 0.2
+printf 'password: ' >&2
+od -An -tx1 | tr -d ' \n'`)
+	r.Rules[0].Secret = `pw\r`
+	r.Triggers = []*Trigger{triggerOn("Select an option:", `\x1b[B\r\n`, 1)}
+	r.ResponseEncoding = "escape"
+	res, stdout, stderr := runFake(t, r)
+	// ESC [ B CR LF, then p w CR.
+	if want := "Select an option:\n1b5b420d0a70770d"; res.ExitCode != 0 || stdout != want {
+		t.Errorf("exit %d, stdout %q, want %q; stderr: %s", res.ExitCode, stdout, want, stderr)
+	}
+}
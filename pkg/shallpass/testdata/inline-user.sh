@@ -0,0 +1,10 @@
+# A PAM stack that names the user in its prompt instead of writing
+# "alice@server's password:", then a session whose output names the user
+# the same way, which must not be taken for the prompt again.
+printf 'Password for alice@server: ' >&2
+read pw
+echo 'Last login: Tue Oct 13 17:02:11 2026 from 10.0.0.5'
+echo "got $pw"
+echo 'Password for alice@server: unchanged since 2026-01-04'
+printf 'Password for alice@server:'
+echo ' (see above)'
@@ -0,0 +1,99 @@
+package shallpass
+
+import (
+	"sync"
+	"time"
+)
+
+// Timings says how long the phases of a session took, each measured from
+// the moment ssh was started. A zero value means the phase never happened.
+type Timings struct {
+	// FirstOutput is when ssh first wrote to a scanned stream.
+	FirstOutput time.Duration
+	// Prompt is when the first password prompt was matched and answered.
+	Prompt time.Duration
+	// Auth is how long after the answer the next line of output arrived,
+	// which is roughly how long the server took to check the password.
+	Auth time.Duration
+	// Total is the whole session, until ssh exited.
+	Total time.Duration
+}
+
+// timeline collects the timestamps behind Timings. Scanned streams write
+// into it to mark the first output; the injector marks the rest.
+type timeline struct {
+	mu                                sync.Mutex
+	start, firstOutput, prompt, reply time.Time
+	// active is the last time anything happened on the session: output
+	// from ssh, or input we typed. See touch.
+	active time.Time
+}
+
+// Write marks the first output; the bytes themselves are ignored.
+func (t *timeline) Write(p []byte) (int, error) {
+	t.mark(&t.firstOutput)
+	t.touch()
+	return len(p), nil
+}
+
+// touch records activity now, for the idle watchdog.
+func (t *timeline) touch() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active = time.Now()
+}
+
+// activityWriter touches t on every write, for the streams that are not
+// scanned and so never reach t.Write.
+type activityWriter struct{ t *timeline }
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	w.t.touch()
+	return len(p), nil
+}
+
+// mark sets *at to now unless it is already set.
+func (t *timeline) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+// timings converts the timestamps into durations, with end as the end of
+// the session.
+func (t *timeline) timings(end time.Time) Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	since := func(at time.Time) time.Duration {
+		if at.IsZero() {
+			return 0
+		}
+		return at.Sub(t.start)
+	}
+	tm := Timings{
+		FirstOutput: since(t.firstOutput),
+		Prompt:      since(t.prompt),
+		Total:       end.Sub(t.start),
+	}
+	if !t.prompt.IsZero() && !t.reply.IsZero() {
+		tm.Auth = t.reply.Sub(t.prompt)
+	}
+	return tm
+}
+
+// sawOutput reports whether ssh has written anything to a scanned stream.
+func (t *timeline) sawOutput() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.firstOutput.IsZero()
+}
+
+// at reads one of the timestamps.
+func (t *timeline) at(ts *time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *ts
+}
@@ -0,0 +1,33 @@
+package shallpass
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	r := fakeRunner(t, `echo 'Connected.' >&2
+sleep 0.2
+printf 'password: ' >&2
+read pw
+sleep 0.2
+echo 'Welcome'
+sleep 0.1`)
+	res, _, stderr := runFake(t, r)
+	if res.ExitCode != 0 {
+		t.Fatalf("exit %d; stderr: %s", res.ExitCode, stderr)
+	}
+	tm := res.Timings
+	// Each phase follows the one before, and the sleeps show in between.
+	if tm.FirstOutput <= 0 || tm.Prompt < tm.FirstOutput+150*time.Millisecond ||
+		tm.Auth < 150*time.Millisecond || tm.Total < tm.Prompt+tm.Auth {
+		t.Errorf("timings out of order: %+v", tm)
+	}
+
+	// Without a prompt there is nothing to time but the output.
+	r = fakeRunner(t, `echo 'in with a key'`)
+	res, _, _ = runFake(t, r)
+	if tm := res.Timings; tm.FirstOutput <= 0 || tm.Prompt != 0 || tm.Auth != 0 || tm.Total < tm.FirstOutput {
+		t.Errorf("without a prompt: %+v", tm)
+	}
+}
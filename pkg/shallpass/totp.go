@@ -0,0 +1,76 @@
+package shallpass
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// totpStep is the time step nearly every authenticator app uses, and the
+// default of RFC 6238. Their codes have six digits.
+const totpStep = 30 * time.Second
+
+// totpKey decodes the base32 secret an authenticator is set up with. It is
+// usually shown in groups, in either case and without padding, so all of
+// that is accepted. The secret may also be given as another source, e.g.
+// totp:env:NAME, to keep it off the command line.
+func totpKey(secret string) ([]byte, error) {
+	if strings.Contains(secret, ":") {
+		s, err := ReadSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+		secret = s
+	}
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid TOTP secret: want the base32 key the authenticator was set up with")
+	}
+	return key, nil
+}
+
+// totpCode is the RFC 6238 code for key at t.
+func totpCode(key []byte, t time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(totpStep/time.Second)))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// NewTOTPSource returns a Rule.Source answering with the current one-time
+// code for the base32 key an authenticator app would be set up with;
+// totpKey says which forms it takes.
+func NewTOTPSource(key string) (io.Reader, error) {
+	k, err := totpKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &totpSource{key: k}, nil
+}
+
+// totpSource is the Source of a rule answering with a one-time code. Each
+// line read from it is the code for the moment it is read, so a prompt on
+// a later attempt, or in a later session, is answered with a current one.
+type totpSource struct {
+	key []byte
+	buf []byte
+}
+
+func (s *totpSource) Read(p []byte) (int, error) {
+	if len(s.buf) == 0 {
+		s.buf = []byte(totpCode(s.key, time.Now()) + "\n")
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,90 @@
+package shallpass
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Trigger answers remote output for the whole session, long after the
+// login: a confirmation, a menu choice. Unlike a Rule it may fire again
+// and again, up to Max times (0 means no limit). Triggers are only tried
+// on lines no Rule has answered.
+type Trigger struct {
+	Name     string
+	Match    func(line string) bool
+	Response string
+	Max      int
+
+	fired int
+	// hold is set while the unfinished line a trigger fired on is still
+	// growing, so the same line doesn't fire it twice.
+	hold bool
+}
+
+// fireTrigger sends the response of the first trigger that matches line.
+// partial says line has no newline yet. The lock must be held.
+func (inj *injector) fireTrigger(line string, partial bool) {
+	for _, t := range inj.triggers {
+		if t.hold {
+			t.hold = partial
+			continue
+		}
+		if (t.Max > 0 && t.fired >= t.Max) || !t.Match(line) {
+			continue
+		}
+		response, ok := inj.decodeResponse(t.Name, t.Response)
+		if !ok {
+			return
+		}
+		t.fired++
+		t.hold = partial
+		inj.log.Info("trigger fires", "name", t.Name, "fired", t.fired)
+		inj.write([]byte(response))
+		// Before the login is over stdin still has secrets to carry;
+		// closeIfDone closes it then.
+		inj.closeIfIdle()
+		return
+	}
+}
+
+// decodeResponse applies the ResponseEncoding to the response of the
+// trigger or step called name. Only the text is decoded; the line ending
+// is the response's own. It fails the session if the text does not
+// decode. The lock must be held.
+func (inj *injector) decodeResponse(name, response string) (string, bool) {
+	if inj.encoding == "" {
+		return response, true
+	}
+	text := strings.TrimRight(response, "\r\n")
+	decoded, err := decodeText(text, inj.encoding)
+	if err != nil {
+		inj.fail(ExitUsage, fmt.Sprintf("response for %q: %v", name, err))
+		return "", false
+	}
+	return decoded + response[len(text):], true
+}
+
+// triggersDone reports whether every trigger has used up its fires and
+// the script is over, so stdin no longer needs to stay open for them. The
+// lock must be held.
+func (inj *injector) triggersDone() bool {
+	if inj.step < len(inj.script) || inj.onPrompt != nil {
+		return false
+	}
+	for _, t := range inj.triggers {
+		if t.Max == 0 || t.fired < t.Max {
+			return false
+		}
+	}
+	return true
+}
+
+// Describe is what t sends, and how often it may.
+func (t *Trigger) Describe() string {
+	sends := strconv.Quote(t.Response)
+	if t.Max > 0 {
+		sends += fmt.Sprintf(" (max %d)", t.Max)
+	}
+	return sends
+}
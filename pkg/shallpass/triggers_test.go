@@ -0,0 +1,61 @@
+package shallpass
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTriggerBeforePasswordKeepsStdinOpen(t *testing.T) {
+	r := fakeRunner(t, `
+printf 'Continue? [y/N] '
+read answer
+echo "answer: $answer"
+printf 'password: '
+if read pw; then echo "got: $pw"; else echo "stdin closed"; fi
+`)
+	r.Triggers = []*Trigger{triggerOn("Continue?", "y\n", 1)}
+	res, stdout, _ := runFake(t, r)
+	if !strings.Contains(stdout, "answer: y") {
+		t.Errorf("the trigger was not answered: %q", stdout)
+	}
+	if !strings.Contains(stdout, "got: secret") {
+		t.Errorf("the password did not arrive after the trigger fired: %q", stdout)
+	}
+	if res.ExitCode != 0 || !res.Prompted {
+		t.Errorf("ExitCode = %d, Prompted = %v; want 0, true", res.ExitCode, res.Prompted)
+	}
+}
+
+func TestTriggerAfterPasswordClosesStdin(t *testing.T) {
+	r := fakeRunner(t, `
+printf 'password: '
+read pw
+printf 'Continue? [y/N] '
+read answer
+echo "answer: $answer"
+if read more; then echo "stdin open"; else echo "stdin closed"; fi
+`)
+	r.Triggers = []*Trigger{triggerOn("Continue?", "y\n", 1)}
+	_, stdout, _ := runFake(t, r)
+	if !strings.Contains(stdout, "answer: y") || !strings.Contains(stdout, "stdin closed") {
+		t.Errorf("stdin was not closed once the last trigger fired: %q", stdout)
+	}
+}
+
+func TestTriggersDone(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		triggers []*Trigger
+		want     bool
+	}{
+		{"none", nil, true},
+		{"unlimited", []*Trigger{{Max: 0}}, false},
+		{"left", []*Trigger{{Max: 2, fired: 1}}, false},
+		{"used up", []*Trigger{{Max: 2, fired: 2}, {Max: 1, fired: 1}}, true},
+	} {
+		inj := &injector{triggers: tc.triggers}
+		if got := inj.triggersDone(); got != tc.want {
+			t.Errorf("%s: triggersDone() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package shallpass
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// ptyInput is ssh's stdin under Runner.TTY: the pseudo-terminal. Closing
+// that would hang the terminal up on ssh, so Close types the end-of-file
+// character instead, as a person at the terminal would.
+type ptyInput struct {
+	term *pty
+}
+
+func (p ptyInput) Write(b []byte) (int, error) { return p.term.Write(b) }
+
+func (p ptyInput) Close() error {
+	_, err := io.WriteString(p.term, ptyEOF)
+	return err
+}
+
+// localTerminal is the first of our streams that is a terminal, whose size
+// the pseudo-terminal should have, or nil.
+func localTerminal(streams ...any) *os.File {
+	for _, s := range streams {
+		if f, ok := s.(*os.File); ok && isTerminal(f) {
+			return f
+		}
+	}
+	return nil
+}
+
+// followSize gives the pseudo-terminal term the size of local,
+// now and whenever local is resized, so full-screen programs on the other
+// end draw to the right size. The returned function stops following.
+func followSize(term *pty, local *os.File) (stop func()) {
+	resize := func() {
+		if ws, ok := terminalSize(local); ok {
+			term.resize(ws)
+		}
+	}
+	resize()
+	winch := make(chan os.Signal, 1)
+	if !notifyResize(winch) {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-winch:
+				resize()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(winch)
+		close(done)
+	}
+}
+
+// rawSwitch puts our terminal into raw mode once its keys are forwarded to
+// ssh, so they reach the pseudo-terminal, and the remote end, one at a time
+// and uninterpreted: Ctrl-C included. Until then the terminal is left
+// alone, and Ctrl-C still interrupts us while the login is going on.
+type rawSwitch struct {
+	mu      sync.Mutex
+	f       *os.File
+	stderr  io.Writer
+	undo    func() error
+	stopped bool
+}
+
+// raw switches the terminal to raw mode. If it can't, the session carries
+// on with the terminal as it is, keys then arriving a line at a time.
+func (t *rawSwitch) raw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || t.undo != nil {
+		return
+	}
+	undo, err := makeRaw(t.f)
+	if err != nil {
+		fmt.Fprintln(t.stderr, "shallpass: warning: cannot put the terminal into raw mode, so input is passed on a line at a time:", err)
+		return
+	}
+	t.undo = undo
+}
+
+// restore puts the terminal back as it was, and keeps a late raw from
+// changing it again. It is safe to call more than once.
+func (t *rawSwitch) restore() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.undo != nil {
+		t.undo()
+		t.undo = nil
+	}
+}
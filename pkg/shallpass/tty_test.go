@@ -0,0 +1,61 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package shallpass
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFollowSize(t *testing.T) {
+	// local stands in for our terminal: the slave of a pseudo-terminal
+	// whose size we set through its master.
+	local, err := newPTY()
+	if err != nil {
+		t.Skip("no pseudo-terminals here:", err)
+	}
+	defer local.Close()
+	term, err := newPTY()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+	sizeOf := func() winsize {
+		ws, _ := terminalSize(term.slave)
+		return ws
+	}
+
+	first := winsize{rows: 40, cols: 100}
+	local.resize(first)
+	var once sync.Once
+	follow := followSize(term, local.slave)
+	stop := func() { once.Do(follow) }
+	defer stop()
+	if got := sizeOf(); got != first {
+		t.Fatalf("the pseudo-terminal is %+v, want %+v", got, first)
+	}
+
+	// A resize of our terminal comes with SIGWINCH.
+	resized := winsize{rows: 50, cols: 132}
+	local.resize(resized)
+	syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	deadline := time.Now().Add(5 * time.Second)
+	for sizeOf() != resized {
+		if time.Now().After(deadline) {
+			t.Fatalf("the pseudo-terminal is %+v after the resize, want %+v", sizeOf(), resized)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once stopped, it no longer follows.
+	stop()
+	local.resize(first)
+	syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	time.Sleep(100 * time.Millisecond)
+	if got := sizeOf(); got != resized {
+		t.Errorf("the pseudo-terminal is %+v after stop, want %+v", got, resized)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// profileSetting is one "key = value" line of a profile. Keys are our flag
+// names; an array value sets a repeatable flag several times. The
+// ssh-args key holds arguments for ssh instead.
+type profileSetting struct {
+	key    string
+	values []string
+}
+
+// profilesPath is where -profile looks for profiles.
+func profilesPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shallpass", "profiles.toml"), nil
+}
+
+// profileTable is one [name] table of a profiles file, or one section of
+// a host config file.
+type profileTable struct {
+	name     string
+	settings []profileSetting
+}
+
+// loadProfile reads the [name] table of a profiles file. The file is a
+// small subset of TOML: tables, comments, and keys set to a string, a
+// bare word such as a number or boolean, or an array of strings:
+//
+//	[db]
+//	lang = "en,de"
+//	prompt-timeout = "30s"
+//	password-for = ["bastion=env:BASTION_PW", "(?i)password:=file:/run/db"]
+//	ssh-args = ["-J", "bastion"]
+func loadProfile(path, name string) ([]profileSetting, error) {
+	tables, err := readTables(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings []profileSetting
+	found := false
+	for _, t := range tables {
+		if t.name == name {
+			settings, found = append(settings, t.settings...), true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no profile %q in %s", name, path)
+	}
+	return settings, nil
+}
+
+// readTables reads every table of a file in the profiles format, in
+// order. Settings before the first table belong to none and are skipped.
+func readTables(path string) ([]profileTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tables []profileTable
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			table := strings.TrimSpace(strings.Trim(line, "[]"))
+			tables = append(tables, profileTable{name: unquoteProfile(table)})
+			continue
+		}
+		if len(tables) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: want key = value", path, n)
+		}
+		values, err := profileValues(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		t := &tables[len(tables)-1]
+		t.settings = append(t.settings, profileSetting{key: unquoteProfile(strings.TrimSpace(key)), values: values})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// profileValues parses the right-hand side of a setting.
+func profileValues(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		return []string{unquoteProfile(value)}, nil
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("unterminated array")
+	}
+	var values []string
+	rest := strings.TrimSpace(value[1 : len(value)-1])
+	for rest != "" {
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, fmt.Errorf("array elements must be quoted strings")
+		}
+		values = append(values, unquoteProfile(quoted))
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest[len(quoted):]), ","))
+	}
+	return values, nil
+}
+
+// unquoteProfile strips TOML quotes: "basic" strings have their escapes
+// decoded, 'literal' ones are taken as they are, and bare words (numbers,
+// booleans, simple keys) pass through.
+func unquoteProfile(s string) string {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// applyProfile sets every flag the profile names that was not given on the
+// command line, so explicit flags always win, and returns the profile's
+// ssh arguments.
+func applyProfile(settings []profileSetting) ([]string, error) {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var sshArgs []string
+	for _, s := range settings {
+		switch {
+		case s.key == "ssh-args":
+			sshArgs = append(sshArgs, s.values...)
+			continue
+		case s.key == "profile" || s.key == "host-config" || flag.Lookup(s.key) == nil:
+			return nil, fmt.Errorf("unknown setting %q", s.key)
+		case explicit[s.key]:
+			continue
+		}
+		for _, v := range s.values {
+			if err := flag.Set(s.key, v); err != nil {
+				return nil, fmt.Errorf("%s: %v", s.key, err)
+			}
+		}
+	}
+	return sshArgs, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testProfiles = `# Shared settings for the fleet.
+[db]
+lang = "en,de"
+prompt-timeout = '30s'
+port = 2222
+ssh-args = ["-J", "bastion", "-o", "User=deploy"]
+
+[web]
+port = 8022
+
+[db]
+password-for = ["bastion=env:BASTION_PW", "(?i)password:=file:/run/db"]
+`
+
+// writeProfiles puts profiles where -profile looks for them, in a
+// configuration directory of the test's own.
+func writeProfiles(t *testing.T, profiles string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	path, err := profilesPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(profiles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.toml")
+	if err := os.WriteFile(path, []byte(testProfiles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadProfile(path, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both [db] tables, in order.
+	want := []profileSetting{
+		{"lang", []string{"en,de"}},
+		{"prompt-timeout", []string{"30s"}},
+		{"port", []string{"2222"}},
+		{"ssh-args", []string{"-J", "bastion", "-o", "User=deploy"}},
+		{"password-for", []string{"bastion=env:BASTION_PW", "(?i)password:=file:/run/db"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadProfile = %q, want %q", got, want)
+	}
+	if _, err := loadProfile(path, "mail"); err == nil {
+		t.Error("loadProfile found a profile that isn't there")
+	}
+	for _, bad := range []string{
+		"[x]\nport\n",
+		"[x]\nssh-args = [\"-v\"\n",
+		"[x]\nssh-args = [-v]\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadProfile(path, "x"); err == nil {
+			t.Errorf("loadProfile took %q", bad)
+		}
+	}
+}
+
+func TestProfileAppliesUnderFlags(t *testing.T) {
+	writeProfiles(t, `[db]
+password = "env:PW"
+port = 2222
+ssh-args = ["-o", "User=deploy"]
+
+[typo]
+prot = 22
+`)
+	fake := fakeSSH(t, `for a in "$@"; do printf '[%s]' "$a"; done
+printf 'password: ' >&2
+read pw
+printf '[%s]' "$pw"`)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "[-p][2222][-o][User=deploy][db1][secret]"},
+		// The command line wins over the profile.
+		{[]string{"-port", "2200"}, "[-p][2200][-o][User=deploy][db1][secret]"},
+		{[]string{"-password", "env:OTHER"}, "[-p][2222][-o][User=deploy][db1][other]"},
+	} {
+		args := append(append([]string{"-profile", "db", "-host-config", "none", "-ssh-bin", fake}, tc.args...), "--", "db1")
+		stdout, stderr, code := runMain(t, []string{"PW=secret", "OTHER=other"}, args...)
+		if code != 0 || stdout != tc.want {
+			t.Errorf("shallpass %q: exit %d, stdout %s, want %s; stderr: %s", tc.args, code, stdout, tc.want, stderr)
+		}
+	}
+	// A setting that is no flag is an error, not silently dropped.
+	if _, stderr, code := runMain(t, nil, "-profile", "typo", "-ssh-bin", fake, "--", "db1"); code != 2 {
+		t.Errorf("unknown setting: exit %d; stderr: %s", code, stderr)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// sessionRecorder is a shallpass.Recorder that writes a -record file.
+type sessionRecorder interface {
+	Record(stream string, p []byte)
+	Close() error
+}
+
+// openRecorder creates the -record file at path in format, "text" or
+// "asciicast". It is only readable by its owner: even with the secrets
+// redacted, a session's output is seldom for everyone.
+func openRecorder(path, format, title string) (sessionRecorder, error) {
+	if format != "text" && format != "asciicast" {
+		return nil, fmt.Errorf("unknown -record-format %q (want text or asciicast)", format)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	if format == "text" {
+		return &textRecorder{f: f, w: w}, nil
+	}
+	rec := &castRecorder{f: f, w: w, start: time.Now(), held: map[string][]byte{}}
+	header, err := json.Marshal(map[string]any{
+		"version":   2,
+		"width":     envSize("COLUMNS", 80),
+		"height":    envSize("LINES", 24),
+		"timestamp": rec.start.Unix(),
+		"title":     title,
+		"env":       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.Write(append(header, '\n'))
+	return rec, nil
+}
+
+// envSize is the terminal dimension in the environment variable name, or
+// def if it does not hold one.
+func envSize(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// textRecorder writes a line per line of the session, each with the time
+// and the stream it came from:
+//
+//	2026-10-14T09:30:01.204Z stderr | deploy@db01's password:
+//	2026-10-14T09:30:01.206Z stdin  | ***
+//
+// A line is written once it is complete, or as soon as another stream
+// has something to say, so the streams stay in the order they happened.
+type textRecorder struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+	// partial is the unfinished line of stream, which began at since.
+	stream  string
+	partial []byte
+	since   time.Time
+}
+
+func (tr *textRecorder) Record(stream string, p []byte) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	now := time.Now()
+	if len(tr.partial) > 0 && tr.stream != stream {
+		tr.line(tr.stream, tr.since, tr.partial)
+		tr.partial = nil
+	}
+	if len(tr.partial) == 0 {
+		tr.stream, tr.since = stream, now
+	}
+	buf := append(tr.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		tr.line(stream, tr.since, buf[:i])
+		buf, tr.since = buf[i+1:], now
+	}
+	tr.partial = append([]byte(nil), buf...)
+	tr.w.Flush()
+}
+
+// line writes one line of the record; the lock must be held.
+func (tr *textRecorder) line(stream string, at time.Time, text []byte) {
+	fmt.Fprintf(tr.w, "%s %-6s | %s\n", at.UTC().Format("2006-01-02T15:04:05.000Z07:00"), stream, bytes.TrimSuffix(text, []byte("\r")))
+}
+
+func (tr *textRecorder) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.partial) > 0 {
+		tr.line(tr.stream, tr.since, tr.partial)
+		tr.partial = nil
+	}
+	return closeRecord(tr.w, tr.f)
+}
+
+// castRecorder writes an asciicast v2 file, which asciinema can play back:
+// ssh's output as "o" events and the input as "i" events, timed from the
+// start of the session.
+type castRecorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+	// held is the start of a character each stream split across writes;
+	// events must be whole UTF-8.
+	held map[string][]byte
+}
+
+func (cr *castRecorder) Record(stream string, p []byte) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	buf := append(cr.held[stream], p...)
+	cut := len(buf)
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	cr.held[stream] = append([]byte(nil), buf[cut:]...)
+	cr.event(stream, buf[:cut])
+	cr.w.Flush()
+}
+
+// event writes one event; the lock must be held.
+func (cr *castRecorder) event(stream string, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	code := "o"
+	switch stream {
+	case "stdin":
+		code = "i"
+	case "terminal":
+	default:
+		// Off a terminal lines end in a bare newline, which a player
+		// would show as a staircase.
+		p = bytes.ReplaceAll(bytes.ReplaceAll(p, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	}
+	data, err := json.Marshal([]any{time.Since(cr.start).Seconds(), code, string(p)})
+	if err == nil {
+		cr.w.Write(append(data, '\n'))
+	}
+}
+
+func (cr *castRecorder) Close() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	for stream, rest := range cr.held {
+		cr.event(stream, rest)
+	}
+	return closeRecord(cr.w, cr.f)
+}
+
+// closeRecord flushes w into f and closes f.
+func closeRecord(w *bufio.Writer, f *os.File) error {
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// sessionRecord is the line -json writes for each session. Nothing in it
+// comes near a secret: matches name the rule and the pattern, not what was
+// typed.
+type sessionRecord struct {
+	Host         string        `json:"host"`
+	Command      string        `json:"command"`
+	ExitCode     int           `json:"exit_code"`
+	Reason       string        `json:"reason"`
+	Seconds      float64       `json:"duration_seconds"`
+	Connections  int           `json:"connections"`
+	AuthAttempts int           `json:"auth_attempts"`
+	Prompted     bool          `json:"prompted"`
+	Bytes        recordBytes   `json:"bytes"`
+	Matches      []recordMatch `json:"matches"`
+}
+
+// recordBytes is what passed through the session, as Result counts it.
+type recordBytes struct {
+	Stdin  int64 `json:"stdin"`
+	Stdout int64 `json:"stdout"`
+	Stderr int64 `json:"stderr"`
+}
+
+// recordMatch is one prompt a rule answered: the kind of rule, as in
+// -list-matchers, its name and the pattern that matched.
+type recordMatch struct {
+	Rule    string `json:"rule"`
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// resultWriter writes -json records, one per line, to a file or an
+// inherited file descriptor. Sessions running side by side take turns.
+type resultWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// openResults opens the -json destination: fd:N for a descriptor the
+// caller passed in, or a path, which is truncated.
+func openResults(dest string) (*resultWriter, error) {
+	if arg, ok := strings.CutPrefix(dest, "fd:"); ok {
+		fd, err := strconv.Atoi(arg)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %q", arg)
+		}
+		return &resultWriter{w: os.NewFile(uintptr(fd), dest)}, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &resultWriter{w: f}, nil
+}
+
+// write adds rec as one line.
+func (rw *resultWriter) write(rec sessionRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	_, err = rw.w.Write(append(data, '\n'))
+	return err
+}
+
+// newRecord makes the record of a session that took took, from its Result,
+// which is nil if the session could not be set up.
+func newRecord(host, command string, res *shallpass.Result, code int, reason string, matches []recordMatch, took time.Duration) sessionRecord {
+	rec := sessionRecord{Host: host, Command: command, ExitCode: code, Reason: reason, Seconds: took.Seconds(), Matches: matches}
+	if rec.Matches == nil {
+		rec.Matches = []recordMatch{}
+	}
+	if res != nil {
+		rec.Connections, rec.AuthAttempts, rec.Prompted = res.Attempts, res.SecretsSent, res.Prompted
+		rec.Bytes = recordBytes{res.BytesIn, res.BytesOut, res.BytesErr}
+	}
+	return rec
+}
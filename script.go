@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultStepTimeout is how long a -script step waits for its output when
+// the step does not say.
+const defaultStepTimeout = time.Minute
+
+// loadScript reads a -script file: a YAML list of expect/send steps,
+// held in the order they are written:
+//
+//	# steps.yaml
+//	- expect: 'Continue\? \[y/N\]'
+//	  send: "y"
+//
+//	- expect: 'Select a disk \(1-4\):'
+//	  send: "2"
+//	  ending: cr
+//	  timeout: 5m
+//
+//	- expect: Installation complete
+//
+// expect is a regular expression and must be given. send, sent with a
+// newline unless ending (lf, cr, crlf or none) says otherwise, may be left
+// out to only wait for the output. timeout defaults to defaultStepTimeout.
+func loadScript(path string) ([]*shallpass.Step, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s: want a list of steps", path)
+	}
+	var steps []*shallpass.Step
+	for i, node := range doc.Content[0].Content {
+		settings, err := yamlSettings(node)
+		if err == nil {
+			var step *shallpass.Step
+			if step, err = scriptStep(settings); err == nil {
+				steps = append(steps, step)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: step %d: %v", path, i+1, err)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps in it", path)
+	}
+	return steps, nil
+}
+
+// scriptStep makes a Step of the settings of one step.
+func scriptStep(settings []profileSetting) (*shallpass.Step, error) {
+	var expect, send string
+	sends := false
+	ending, timeout := "\n", defaultStepTimeout
+	for _, s := range settings {
+		if len(s.values) != 1 {
+			return nil, fmt.Errorf("%s takes a single value", s.key)
+		}
+		value := s.values[0]
+		switch s.key {
+		case "expect":
+			expect = value
+		case "send":
+			send, sends = value, true
+		case "ending":
+			e, ok := lineEndings[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown ending %q (want lf, cr, crlf or none)", value)
+			}
+			ending = e
+		case "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid timeout %q: want a positive duration such as 30s", value)
+			}
+			timeout = d
+		default:
+			return nil, fmt.Errorf("unknown key %q (want expect, send, ending or timeout)", s.key)
+		}
+	}
+	if expect == "" {
+		return nil, fmt.Errorf("no expect")
+	}
+	re, err := regexp.Compile(expect)
+	if err != nil {
+		return nil, err
+	}
+	step := &shallpass.Step{Name: expect, Match: re.MatchString, Timeout: timeout}
+	// A step that only waits sends nothing, not even a newline.
+	if sends {
+		step.Response = send + ending
+	}
+	return step, nil
+}
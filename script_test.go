@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "steps.yaml")
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScript(t *testing.T) {
+	steps, err := loadScript(writeScript(t, `- expect: 'Continue\? \[y/N\]'
+  send: y
+- expect: 'Select a disk \(1-4\):'
+  send: 2
+  ending: cr
+  timeout: 5m
+- expect: Installation complete
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 {
+		t.Fatalf("%d steps, want 3", len(steps))
+	}
+	for i, want := range []struct {
+		line, response string
+		timeout        time.Duration
+	}{
+		{"Continue? [y/N] ", "y\n", defaultStepTimeout},
+		{"Select a disk (1-4): ", "2\r", 5 * time.Minute},
+		{"Installation complete.", "", defaultStepTimeout},
+	} {
+		s := steps[i]
+		if !s.Match(want.line) || s.Response != want.response || s.Timeout != want.timeout {
+			t.Errorf("step %d: matches %q %v, response %q, timeout %v; want true, %q, %v", i+1, want.line, s.Match(want.line), s.Response, s.Timeout, want.response, want.timeout)
+		}
+	}
+}
+
+func TestLoadScriptErrors(t *testing.T) {
+	for _, tc := range []struct {
+		script, want string
+	}{
+		{"", "want a list of steps"},
+		{"expect: x\n", "want a list of steps"},
+		{"[]\n", "no steps"},
+		{"- send: y\n", "step 1: no expect"},
+		{"- expect: a\n- expect: b\n  sned: y\n", `step 2: unknown key "sned"`},
+		{"- expect: a\n  send: [y, n]\n", "send takes a single value"},
+		{"- expect: a\n  ending: crlf\n- expect: b\n  ending: lfcr\n", `step 2: unknown ending "lfcr"`},
+		{"- expect: a\n  timeout: 0s\n", "invalid timeout"},
+		{"- expect: '('\n", "step 1: error parsing regexp"},
+		{"- expect: [unterminated\n", "steps.yaml:"},
+	} {
+		_, err := loadScript(writeScript(t, tc.script))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: error %v, want one about %q", tc.script, err, tc.want)
+		}
+	}
+}
+
+func TestScriptAnswersTheSession(t *testing.T) {
+	fake := fakeSSH(t, `printf 'password: ' >&2
+read pw
+printf 'Continue? [y/N] '
+read answer
+echo "answered $answer"
+echo "Installation complete"`)
+	path := writeScript(t, `- expect: 'Continue\? \[y/N\]'
+  send: y
+- expect: Installation complete
+`)
+	stdout, stderr, code := runMain(t, []string{"PW=secret"}, "-password", "env:PW", "-script", path, "-ssh-bin", fake, "--", "host")
+	if code != 0 || !strings.Contains(stdout, "answered y\nInstallation complete\n") {
+		t.Errorf("exit %d, stdout %q; stderr: %s", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// readUntilDelim reads r up to a line that is exactly delim and returns
+// what came before it, without the final newline, as the secret. Like
+// ReadLine it reads a byte at a time and never past the delimiter, so
+// whatever follows is left in r for the remote command.
+func readUntilDelim(r io.Reader, delim string, max int) (string, error) {
+	var secret, line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 && b[0] != '\n' {
+			line = append(line, b[0])
+		}
+		done := n == 1 && b[0] == '\n' || err == io.EOF
+		if done && strings.TrimRight(string(line), "\r") == delim {
+			secret := strings.TrimRight(string(secret), "\r\n")
+			return secret, shallpass.CheckSecretSize(secret, max)
+		}
+		if err == io.EOF {
+			return "", fmt.Errorf("no %q line before the end of stdin", delim)
+		}
+		if err != nil {
+			return "", err
+		}
+		if done {
+			secret = append(append(secret, line...), '\n')
+			line = line[:0]
+		}
+		// The delimiter line itself is no part of the secret.
+		if max > 0 && len(secret)+len(line) > max+1 && !strings.HasPrefix(delim+"\r", string(line)) {
+			return "", fmt.Errorf("%w (%d bytes)", shallpass.ErrSecretTooLong, max)
+		}
+	}
+}
+
+// readFirstLine reads the first line of r as a secret, without its line
+// ending, and not a byte more: what follows is the remote command's. An
+// r that ends before its first newline holds the secret alone.
+func readFirstLine(r io.Reader, max int) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 && b[0] == '\n' || err == io.EOF {
+			secret := strings.TrimRight(string(line), "\r")
+			return secret, shallpass.CheckSecretSize(secret, max)
+		}
+		if err != nil {
+			return "", err
+		}
+		if n == 1 {
+			line = append(line, b[0])
+		}
+		if max > 0 && len(line) > max+1 {
+			return "", fmt.Errorf("%w (%d bytes)", shallpass.ErrSecretTooLong, max)
+		}
+	}
+}
+
+// secretSource is one place -source-order can take the password from.
+type secretSource struct {
+	name string
+	read func() (string, error)
+}
+
+// errNoPassword is returned when no source in a -source-order had a
+// password.
+var errNoPassword = errors.New("no source yielded a password")
+
+// firstSecret tries sources in order and returns the first non-empty
+// secret, with the name of the source it came from. A source that fails
+// is skipped; its error is reported only if no later source has a secret.
+func firstSecret(sources []secretSource) (secret, used string, err error) {
+	err = errNoPassword
+	for _, src := range sources {
+		s, readErr := src.read()
+		if readErr != nil {
+			err = fmt.Errorf("%s: %w", src.name, readErr)
+			continue
+		}
+		if strings.TrimSpace(s) != "" {
+			return s, src.name, nil
+		}
+	}
+	return "", "", err
+}
+
+// envSource is the source -e and -source-order's env name: $SHALLPASS,
+// or sshpass's $SSHPASS while that one is unset or empty.
+func envSource() string {
+	if os.Getenv("SHALLPASS") != "" {
+		return "env:SHALLPASS"
+	}
+	return "env:SSHPASS"
+}
+
+// argvSecret reports whether one of the command-line options in args names
+// a pass: source, whose secret anyone on the machine can then read in the
+// process list or /proc/PID/cmdline. It finds the source however it is
+// written: -password pass:X, -password=pass:X, -password-for 'P=pass:X',
+// totp:pass:KEY.
+func argvSecret(args []string) bool {
+	for _, arg := range args {
+		for rest, off := arg, 0; ; {
+			i := strings.Index(rest, "pass:")
+			if i < 0 {
+				break
+			}
+			if at := off + i; at == 0 || strings.ContainsRune("=:", rune(arg[at-1])) {
+				return true
+			}
+			rest, off = rest[i+len("pass:"):], off+i+len("pass:")
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFirstSecret(t *testing.T) {
+	var read []string
+	source := func(name, secret string, err error) secretSource {
+		return secretSource{name, func() (string, error) {
+			read = append(read, name)
+			return secret, err
+		}}
+	}
+	broken := errors.New("connection refused")
+	for _, tc := range []struct {
+		name     string
+		sources  []secretSource
+		secret   string
+		used     string
+		err      string
+		wantRead string
+	}{
+		{"first wins", []secretSource{source("stdin", "one\n", nil), source("env", "two", nil)}, "one\n", "stdin", "", "stdin"},
+		{"empty is skipped", []secretSource{source("stdin", "", nil), source("env", "two", nil)}, "two", "env", "", "stdin,env"},
+		{"blank is empty", []secretSource{source("stdin", " \n", nil), source("env", "two", nil)}, "two", "env", "", "stdin,env"},
+		{"failure is skipped", []secretSource{source("socket", "", broken), source("env", "two", nil)}, "two", "env", "", "socket,env"},
+		{"failure is reported", []secretSource{source("env", "", nil), source("socket", "", broken)}, "", "", "socket: connection refused", "env,socket"},
+		{"nothing anywhere", []secretSource{source("stdin", "", nil), source("env", "", nil)}, "", "", errNoPassword.Error(), "stdin,env"},
+	} {
+		read = nil
+		secret, used, err := firstSecret(tc.sources)
+		gotErr := ""
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if secret != tc.secret || used != tc.used || gotErr != tc.err {
+			t.Errorf("%s: got %q from %q, error %q; want %q from %q, error %q", tc.name, secret, used, gotErr, tc.secret, tc.used, tc.err)
+		}
+		if got := strings.Join(read, ","); got != tc.wantRead {
+			t.Errorf("%s: read %s, want %s", tc.name, got, tc.wantRead)
+		}
+	}
+}
+
+func TestReadUntilDelim(t *testing.T) {
+	const delim = "---END-PASSWORD---"
+	for _, tc := range []struct {
+		name, in     string
+		secret, rest string
+		fails        bool
+	}{
+		{"one line", "hunter2\n" + delim + "\necho hi\n", "hunter2", "echo hi\n", false},
+		{"several lines", "one\ntwo\n" + delim + "\n", "one\ntwo", "", false},
+		{"CRLF", "hunter2\r\n" + delim + "\r\nrest", "hunter2", "rest", false},
+		{"the delimiter at the end", "hunter2\n" + delim, "hunter2", "", false},
+		{"only a line like it", "hunter2\n" + delim + " \n", "", "", true},
+		{"no delimiter", "hunter2\n", "", "", true},
+		{"too long", strings.Repeat("x", 20) + "\n" + delim + "\n", "", "", true},
+	} {
+		r := strings.NewReader(tc.in)
+		secret, err := readUntilDelim(r, delim, 16)
+		if (err != nil) != tc.fails || secret != tc.secret {
+			t.Errorf("%s: got %q, %v; want %q, failing %v", tc.name, secret, err, tc.secret, tc.fails)
+			continue
+		}
+		// Nothing past the delimiter is taken from the remote command.
+		if rest, _ := io.ReadAll(r); !tc.fails && string(rest) != tc.rest {
+			t.Errorf("%s: left %q, want %q", tc.name, rest, tc.rest)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/plop-systems/shallpass/internal/sshargs"
+)
+
+// wrappedTools are the programs -cmd can run instead of ssh. Each of them
+// runs ssh itself to connect, and is told how with options of its own.
+var wrappedTools = []string{"ssh", "scp", "sftp", "rsync"}
+
+// isWrappedTool reports whether name is one of wrappedTools.
+func isWrappedTool(name string) bool {
+	for _, t := range wrappedTools {
+		if name == t {
+			return true
+		}
+	}
+	return false
+}
+
+// toolFromName is the tool a link to shallpass runs by its name: shallscp
+// runs scp, shallsftp sftp and shallrsync rsync. Anything else runs ssh.
+func toolFromName(argv0 string) string {
+	name := strings.TrimPrefix(filepath.Base(argv0), "shall")
+	if name != "ssh" && isWrappedTool(name) {
+		return name
+	}
+	return "ssh"
+}
+
+// toolArgs builds the argument list for tool. sshOpts are the options we
+// would have given ssh (the convenience options and the profile's ssh-args),
+// which are handed to the ssh the tool runs, sshBin, the way the tool takes
+// them. user are the tool's own arguments and follow unchanged; as with
+// sshArgs, whatever they set themselves wins.
+func toolArgs(tool, sshBin string, sshOpts, user []string) ([]string, error) {
+	switch tool {
+	case "scp", "sftp":
+		return scpArgs(tool, sshBin, sshOpts, user)
+	case "rsync":
+		return rsyncArgs(sshBin, sshOpts, user)
+	case "exec":
+		if len(sshOpts) > 0 {
+			return nil, errors.New("-exec runs its program as it is, so the ssh options shallpass adds (the profile's ssh-args too) can't be used with it")
+		}
+		return user, nil
+	}
+	return sshOpts, nil
+}
+
+// scpArgs is toolArgs for scp and sftp, which take some of ssh's options
+// as they are, the port as -P, and the rest as -o.
+func scpArgs(tool, sshBin string, sshOpts, user []string) ([]string, error) {
+	var args []string
+	if sshBin != "" && sshBin != "ssh" {
+		args = append(args, "-S", sshBin)
+	}
+	add := func(flag byte, keyword string, words ...string) {
+		if !sshargs.Sets(user, flag, keyword) {
+			args = append(args, words...)
+		}
+	}
+	for _, o := range sshargs.Options(sshOpts) {
+		switch o.Flag {
+		case 'p':
+			add('P', "Port", "-P", o.Value)
+		case 'i':
+			add('i', "IdentityFile", "-i", o.Value)
+		case 'F':
+			add('F', "", "-F", o.Value)
+		case 'J':
+			add('J', "ProxyJump", "-J", o.Value)
+		case 'o':
+			add(0, sshargs.ConfigKey(o.Value), "-o", o.Value)
+		case 'l':
+			// scp's -l is a bandwidth limit.
+			add(0, "User", "-o", "User="+o.Value)
+		case 'A', 'a':
+			add(0, "ForwardAgent", "-o", "ForwardAgent="+yesNo(o.Flag == 'A'))
+		case 'X', 'x':
+			add(0, "ForwardX11", "-o", "ForwardX11="+yesNo(o.Flag == 'X'))
+		case 'Y':
+			add(0, "ForwardX11", "-o", "ForwardX11=yes")
+			add(0, "ForwardX11Trusted", "-o", "ForwardX11Trusted=yes")
+		case '4', '6', 'C', 'q', 'v':
+			args = append(args, "-"+string(o.Flag))
+		default:
+			return nil, fmt.Errorf("ssh option -%c can't be passed on through %s", o.Flag, tool)
+		}
+	}
+	return append(args, user...), nil
+}
+
+// rsyncArgs is toolArgs for rsync, which takes the whole ssh command line
+// as -e. If the rsync arguments name their own, ours is left out.
+func rsyncArgs(sshBin string, sshOpts, user []string) ([]string, error) {
+	if sshBin == "" {
+		sshBin = "ssh"
+	}
+	if rsyncSetsShell(user) || (sshBin == "ssh" && len(sshOpts) == 0) {
+		return user, nil
+	}
+	words := make([]string, 0, 1+len(sshOpts))
+	for _, w := range append([]string{sshBin}, sshOpts...) {
+		words = append(words, sshargs.Quote(w))
+	}
+	return append([]string{"-e", strings.Join(words, " ")}, user...), nil
+}
+
+// rsyncSetsShell reports whether rsync arguments choose the remote shell
+// with -e or --rsh.
+func rsyncSetsShell(args []string) bool {
+	for _, a := range args {
+		if a == "--" {
+			break
+		}
+		if a == "--rsh" || strings.HasPrefix(a, "--rsh=") || strings.HasPrefix(a, "-e") {
+			return true
+		}
+	}
+	return false
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// toolDestination is sshDestination for the arguments of tool: for scp and
+// rsync the host of the first remote path (host:path, host::module or a
+// scp:// or rsync:// URI), for sftp the one destination.
+func toolDestination(tool string, args []string) string {
+	switch tool {
+	case "scp", "rsync":
+		for _, a := range args {
+			if strings.HasPrefix(a, "-") {
+				continue
+			}
+			if host := remoteHost(a); host != "" {
+				return host
+			}
+		}
+		return ""
+	case "sftp":
+		_, rest := sshargs.Split(args)
+		if len(rest) == 0 {
+			return ""
+		}
+		if host := remoteHost(rest[0]); host != "" {
+			return host
+		}
+		return sshargs.Destination(rest[:1])
+	case "exec":
+		return ""
+	}
+	return sshargs.Destination(args)
+}
+
+// remoteCommand is what a session of tool runs, for -json: ssh's remote
+// command as ssh hands it to the server's shell, and for the other tools
+// their own command line, quoted, as is the program -exec runs.
+func remoteCommand(tool string, args []string) string {
+	if tool == "ssh" {
+		return strings.Join(sshargs.Command(args), " ")
+	}
+	var words []string
+	if tool != "exec" {
+		words = append(words, tool)
+	}
+	for _, a := range args {
+		words = append(words, sshargs.Quote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+// remoteHost returns the host of a remote path, [user@]host:path or an
+// ssh-style URI, without the user or port, or "" for a local path. As in
+// scp, a colon after a slash does not make a path remote.
+func remoteHost(path string) string {
+	for _, scheme := range []string{"scp://", "sftp://", "rsync://"} {
+		if rest, ok := strings.CutPrefix(path, scheme); ok {
+			host, _, _ := strings.Cut(rest, "/")
+			if i := strings.LastIndexByte(host, '@'); i >= 0 {
+				host = host[i+1:]
+			}
+			if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+				host = host[:i]
+			}
+			return strings.Trim(host, "[]")
+		}
+	}
+	host := path
+	if user, rest, ok := strings.Cut(host, "@"); ok && !strings.ContainsAny(user, "/:") {
+		host = rest
+	}
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]:"); end > 0 {
+			return host[1:end]
+		}
+		return ""
+	}
+	i := strings.IndexByte(host, ':')
+	if i <= 0 || strings.Contains(host[:i], "/") {
+		return ""
+	}
+	return host[:i]
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/plop-systems/shallpass/pkg/shallpass"
+)
+
+// traceTimeout bounds sending one session's spans, so a collector that is
+// down costs a fleet run a warning per host, not its time.
+const traceTimeout = 10 * time.Second
+
+// tracer sends each session to -otlp-traces as an OpenTelemetry trace: a
+// span for the session with one each for connecting, logging in and
+// running the command inside it. It speaks OTLP's JSON encoding over HTTP
+// itself, so tracing brings in nothing an untraced run has to carry.
+type tracer struct {
+	url     string
+	headers map[string]string
+	service string
+	// traceID and parentID come from $TRACEPARENT when whoever started
+	// shallpass is tracing too: the sessions are then spans of its trace
+	// instead of traces of their own.
+	traceID  []byte
+	parentID []byte
+	client   http.Client
+}
+
+// newTracer sets up the tracer for the collector's traces endpoint, such as
+// http://localhost:4318/v1/traces. The headers to send, for a collector
+// that wants a key, and the service name are read from the standard
+// OTEL_EXPORTER_OTLP_HEADERS (or its _TRACES_ form) and OTEL_SERVICE_NAME.
+func newTracer(endpoint string) (*tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	t := &tracer{url: endpoint, service: "shallpass", client: http.Client{Timeout: traceTimeout}}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		t.service = name
+	}
+	spec := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")
+	if spec == "" {
+		spec = os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")
+	}
+	if t.headers, err = otlpHeaders(spec); err != nil {
+		return nil, err
+	}
+	// A traceparent that doesn't parse is ignored, as the W3C says to.
+	t.traceID, t.parentID = parseTraceparent(os.Getenv("TRACEPARENT"))
+	return t, nil
+}
+
+// otlpHeaders parses the NAME=VALUE,... list of the OTEL_EXPORTER_OTLP
+// headers variables, whose values are URL-encoded.
+func otlpHeaders(spec string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, field := range strings.Split(spec, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(field, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: want NAME=VALUE, got %q", field)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %s: %v", name, err)
+		}
+		headers[name] = v
+	}
+	return headers, nil
+}
+
+// parseTraceparent returns the trace and span IDs of a W3C traceparent,
+// 00-TRACEID-SPANID-FLAGS, or nil if tp is not one.
+func parseTraceparent(tp string) (traceID, spanID []byte) {
+	parts := strings.Split(strings.TrimSpace(tp), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, nil
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || isZero(traceID) || isZero(spanID) {
+		return nil, nil
+	}
+	return traceID, spanID
+}
+
+func isZero(id []byte) bool {
+	return bytes.Count(id, []byte{0}) == len(id)
+}
+
+// otlpSpan and the types below are the parts of OTLP's JSON encoding the
+// tracer uses. IDs are hex, times nanoseconds since the epoch in strings.
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Span kinds and status codes, as numbered in OTLP.
+const (
+	spanInternal = 1
+	spanClient   = 3
+	statusOK     = 1
+	statusError  = 2
+)
+
+// attr makes an attribute of a string, an int, an int64 or a bool.
+func attr(key string, v any) otlpAttribute {
+	switch v := v.(type) {
+	case int:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.FormatInt(v, 10)}}
+	case bool:
+		return otlpAttribute{key, map[string]any{"boolValue": v}}
+	default:
+		return otlpAttribute{key, map[string]any{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+// session sends the trace of a session that ran from start to end, with
+// its Result, which is nil if the session could not be set up. The phases
+// are those of the last connection, from its Timings: earlier ones, with
+// -max-tries or a reconnect, only show in the session's span.
+func (t *tracer) session(host, command string, start, end time.Time, res *shallpass.Result, code int, reason string) error {
+	traceID := t.traceID
+	if traceID == nil {
+		traceID = randomID(16)
+	}
+	span := func(name string, kind int, parent []byte, from, to time.Time, attrs ...otlpAttribute) otlpSpan {
+		s := otlpSpan{
+			TraceID:    hex.EncodeToString(traceID),
+			SpanID:     hex.EncodeToString(randomID(8)),
+			Name:       name,
+			Kind:       kind,
+			Start:      strconv.FormatInt(from.UnixNano(), 10),
+			End:        strconv.FormatInt(to.UnixNano(), 10),
+			Attributes: attrs,
+		}
+		if parent != nil {
+			s.ParentSpanID = hex.EncodeToString(parent)
+		}
+		return s
+	}
+
+	attrs := []otlpAttribute{
+		attr("server.address", host),
+		attr("shallpass.command", command),
+		attr("shallpass.exit_code", code),
+		attr("shallpass.reason", reason),
+	}
+	if res != nil {
+		attrs = append(attrs,
+			attr("shallpass.connections", res.Attempts),
+			attr("shallpass.auth_attempts", res.SecretsSent),
+			attr("shallpass.prompted", res.Prompted),
+			attr("shallpass.bytes.stdin", res.BytesIn),
+			attr("shallpass.bytes.stdout", res.BytesOut),
+			attr("shallpass.bytes.stderr", res.BytesErr),
+		)
+	}
+	root := span("ssh session", spanClient, t.parentID, start, end, attrs...)
+	root.Status = &otlpStatus{Code: statusOK}
+	if code != 0 {
+		root.Status = &otlpStatus{Code: statusError, Message: reason}
+	}
+	spans := []otlpSpan{root}
+
+	if res != nil {
+		parent, _ := hex.DecodeString(root.SpanID)
+		tm := res.Timings
+		began := end.Add(-tm.Total)
+		if began.Before(start) {
+			began = start
+		}
+		connected := connectTime(tm)
+		if connected == 0 {
+			// ssh never got as far as a prompt or any output.
+			spans = append(spans, span("connect", spanInternal, parent, began, end))
+		} else {
+			next := began.Add(connected)
+			spans = append(spans, span("connect", spanInternal, parent, began, next))
+			if res.Prompted && tm.Auth > 0 {
+				spans = append(spans, span("auth", spanInternal, parent, next, next.Add(tm.Auth)))
+				next = next.Add(tm.Auth)
+			}
+			if next.Before(end) {
+				spans = append(spans, span("exec", spanInternal, parent, next, end))
+			}
+		}
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttribute{attr("service.name", t.service)}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "shallpass"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, v := range t.headers {
+		req.Header.Set(name, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// randomID makes a trace or span ID of n random bytes.
+func randomID(n int) []byte {
+	id := make([]byte, n)
+	rand.Read(id)
+	return id
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"golang.org/x/term"
+)
+
+// stdinIsTerminal reports whether stdin is a terminal, so that reading the
+// password from it would wait for a ^D nobody is going to type.
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// askTerminal asks for the password on the terminal with echo off, for
+// when shallpass is run by hand with no password source. It asks on
+// /dev/tty, so a redirected stderr does not hide the question, or on
+// stdin and stderr where there is none. An interrupt while it waits puts
+// echo back on before shallpass exits.
+func askTerminal(prompt string) (string, error) {
+	in, out := os.Stdin, os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		in, out = tty, tty
+	}
+	fd := int(in.Fd())
+	state, err := term.GetState(fd)
+	if err != nil {
+		return "", err
+	}
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupted:
+			term.Restore(fd, state)
+			fmt.Fprintln(out)
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+	fmt.Fprint(out, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(out)
+	if err != nil {
+		return "", err
+	}
+	return string(password) + "\n", nil
+}